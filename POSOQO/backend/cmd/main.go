@@ -10,6 +10,7 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/swagger"
+	"github.com/gofiber/websocket/v2"
 	_ "github.com/posoqo/backend/docs"
 	"github.com/posoqo/backend/internal/db"
 	"github.com/posoqo/backend/internal/handlers"
@@ -51,6 +52,19 @@ func main() {
 	// Inicializar servicio de IA (Gemini)
 	handlers.InitAIService()
 
+	// Cada hora: limpiar claves de idempotencia y carritos anónimos vencidos, enviar
+	// recordatorios de carritos abandonados, procesar las suscripciones del club y vencer
+	// los puntos de fidelización
+	go func() {
+		for range time.Tick(time.Hour) {
+			middleware.PurgeExpiredIdempotencyKeys()
+			handlers.PurgeAnonymousCarts()
+			handlers.SendAbandonedCartReminders()
+			handlers.ProcessSubscriptions()
+			handlers.ExpireLoyaltyPoints()
+		}
+	}()
+
 	// Crear aplicación Fiber con configuración de seguridad
 	app := fiber.New(fiber.Config{
 		AppName:      "POSOQO API",
@@ -138,6 +152,16 @@ func main() {
 
 	// Ruta pública para consultar DNI
 	api.Get("/dni/:dni", handlers.ConsultarDNI)
+	api.Get("/ruc/:ruc", handlers.ConsultarRUC)
+
+	// Verificación pública del recibo de un pedido (código del QR)
+	api.Get("/orders/:id/verify", handlers.VerifyOrder)
+
+	// Checkout de invitados: pedido sin cuenta y seguimiento con enlace mágico
+	guest := api.Group("/guest")
+	guest.Post("/checkout", middleware.Idempotency(), handlers.GuestCheckout)
+	guest.Get("/orders/:id", handlers.GetGuestOrder)
+	guest.Post("/orders/link", middleware.AuthRateLimiter, handlers.ResendGuestOrderLinks)
 
 	// Ruta pública para suscripción al sorteo
 	api.Post("/raffle/subscribe", handlers.SubscribeToRaffle)
@@ -147,6 +171,8 @@ func main() {
 	api.Get("/products", handlers.GetProducts)
 	api.Get("/products/featured", handlers.GetFeaturedProducts)
 	api.Get("/products/:id", handlers.GetProduct)
+	api.Get("/products/:id/variants", handlers.ListProductVariants)
+	api.Get("/products/:id/pack-options", handlers.ListPackOptions)
 
 	// Rutas de reseñas (públicas para leer, protegidas para escribir)
 	api.Get("/products/:product_id/reviews", handlers.ListProductReviews)
@@ -187,14 +213,18 @@ func main() {
 	aiAdmin.Get("/analytics", handlers.PredictiveAnalyticsHandler)
 
 	// Endpoint de pago con Stripe
-	api.Post("/pay", handlers.CreateStripeCheckout)
-	api.Post("/create-payment-intent", middleware.AuthMiddleware(), handlers.CreateStripePaymentIntent)
-	api.Post("/create-reservation-payment-intent", middleware.AuthMiddleware(), handlers.CreateReservationPaymentIntent)
+	// Las rutas que mueven dinero aceptan Idempotency-Key para evitar cobros duplicados
+	api.Post("/pay", middleware.Idempotency(), handlers.CreateStripeCheckout)
+	api.Post("/create-payment-intent", middleware.AuthMiddleware(), middleware.Idempotency(), handlers.CreateStripePaymentIntent)
+	api.Post("/create-reservation-payment-intent", middleware.AuthMiddleware(), middleware.Idempotency(), handlers.CreateReservationPaymentIntent)
 	api.Post("/stripe/webhook", handlers.StripeWebhook)
 
+	// Validación pública de cupones
+	api.Post("/coupons/validate", handlers.ValidateCoupon)
+
 	// Historial de pagos y reembolsos
 	api.Get("/payments", handlers.GetPaymentHistory)
-	api.Post("/payments/refund", handlers.CreateRefund)
+	api.Post("/payments/refund", middleware.Idempotency(), handlers.CreateRefund)
 
 	// Ruta de prueba para verificar conexión a base de datos (mover fuera del grupo /api)
 
@@ -205,6 +235,7 @@ func main() {
 	api.Get("/verify-token", handlers.VerifyToken)
 	api.Put("/profile", middleware.AuthMiddleware(), handlers.UpdateProfile)
 	api.Get("/profile/public", handlers.ProfilePublic)
+	api.Get("/marketing/unsubscribe", handlers.UnsubscribeMarketing)
 	api.Post("/logout", middleware.AuthMiddleware(), handlers.Logout)
 
 	// Rutas protegidas (requieren autenticación)
@@ -212,8 +243,29 @@ func main() {
 	protected.Use(middleware.AuthMiddleware())
 
 	// Rutas de pedidos (protegidas)
-	protected.Post("/orders", handlers.CreateOrder)
+	protected.Post("/orders", middleware.Idempotency(), handlers.CreateOrder)
 	protected.Get("/orders", handlers.ListMyOrders)
+	protected.Get("/orders/:id", handlers.GetOrderDetail)
+	protected.Get("/orders/:id/timeline", handlers.GetOrderTimeline)
+	protected.Post("/orders/:id/cancel", middleware.Idempotency(), handlers.CancelMyOrder)
+	protected.Get("/orders/:id/tracking", handlers.GetOrderTracking)
+	protected.Get("/orders/:id/receipt.pdf", handlers.GetOrderReceiptPDF)
+	protected.Post("/orders/:id/reorder", handlers.ReorderOrder)
+	protected.Post("/orders/claim-guest", handlers.ClaimGuestOrders)
+
+	// Comprobantes electrónicos (boleta/factura)
+	protected.Post("/orders/:id/invoice", middleware.Idempotency(), handlers.IssueOrderInvoice)
+	protected.Get("/orders/:id/invoice", handlers.GetOrderInvoice)
+	protected.Get("/invoices/:id/xml", handlers.GetInvoiceXML)
+	protected.Get("/invoices/:id/pdf", handlers.GetInvoicePDF)
+
+	// Rutas de repartidores (protegidas)
+	driver := protected.Group("/driver")
+	driver.Use(middleware.RequireRole("repartidor"))
+	driver.Get("/orders", handlers.ListDriverOrders)
+	driver.Post("/location", handlers.PostDriverLocation)
+	driver.Post("/orders/:id/depart", handlers.DepartDriverOrder)
+	driver.Post("/orders/:id/deliver", handlers.DeliverDriverOrder)
 
 	// Rutas de reclamos (protegidas)
 	protected.Post("/complaints", handlers.CreateComplaint)
@@ -233,6 +285,37 @@ func main() {
 	protected.Post("/favorites/:product_id", handlers.AddFavorite)
 	protected.Delete("/favorites/:product_id", handlers.RemoveFavorite)
 
+	// Perfiles de facturación (DNI o RUC)
+	protected.Get("/billing-profiles", handlers.ListBillingProfiles)
+	protected.Post("/billing-profiles", handlers.CreateBillingProfile)
+	protected.Put("/billing-profiles/:id", handlers.UpdateBillingProfile)
+	protected.Delete("/billing-profiles/:id", handlers.DeleteBillingProfile)
+
+	// Verificación de edad para comprar bebidas alcohólicas
+	protected.Get("/age-verification", handlers.GetAgeVerification)
+	protected.Post("/age-verification", handlers.VerifyAge)
+
+	// Club POSOQO: suscripciones mensuales con tarjeta guardada
+	protected.Post("/subscriptions/setup-intent", handlers.CreateSubscriptionSetupIntent)
+	protected.Post("/subscriptions", middleware.Idempotency(), handlers.CreateSubscription)
+	protected.Get("/subscriptions", handlers.ListMySubscriptions)
+	protected.Put("/subscriptions/:id/payment-method", handlers.UpdateSubscriptionPaymentMethod)
+	protected.Post("/subscriptions/:id/pause", handlers.PauseSubscription)
+	protected.Post("/subscriptions/:id/resume", handlers.ResumeSubscription)
+	protected.Post("/subscriptions/:id/skip", handlers.SkipSubscriptionCycle)
+	protected.Post("/subscriptions/:id/cancel", handlers.CancelSubscription)
+
+	// Gift cards compradas o recibidas
+	protected.Post("/gift-cards", middleware.Idempotency(), handlers.PurchaseGiftCard)
+	protected.Get("/gift-cards", handlers.ListMyGiftCards)
+
+	// Puntos POSOQO: saldo, nivel y movimientos
+	protected.Get("/loyalty", handlers.GetMyLoyalty)
+	protected.Get("/loyalty/history", handlers.GetMyLoyaltyHistory)
+
+	// Consentimiento de emails de marketing
+	protected.Put("/marketing-consent", handlers.UpdateMarketingConsent)
+
 	// Rutas de reseñas (protegidas)
 	protected.Post("/products/:product_id/reviews", handlers.UpsertReview)
 	protected.Get("/reviews", handlers.ListMyReviews)
@@ -253,6 +336,25 @@ func main() {
 	// Ruta pública para carrito (devuelve datos vacíos si no hay usuario autenticado)
 	api.Get("/cart", handlers.GetCartPublic)
 	api.Post("/cart", handlers.SaveCartPublic)
+	api.Post("/cart/price", handlers.PriceCart)
+
+	// Promociones vigentes (público)
+	api.Get("/promotions", handlers.ListActivePromotions)
+
+	// Planes del Club POSOQO (público)
+	api.Get("/subscription-plans", handlers.ListSubscriptionPlans)
+
+	// Saldo de una gift card (público, también para invitados)
+	api.Post("/gift-cards/balance", middleware.AuthRateLimiter, handlers.CheckGiftCardBalance)
+
+	// Programa de puntos: niveles y recompensas (público)
+	api.Get("/loyalty/program", handlers.GetLoyaltyProgram)
+
+	// Cotización de envío por ubicación (público)
+	api.Post("/delivery/quote", handlers.QuoteDelivery)
+
+	// Franjas de reparto y recojo disponibles (público)
+	api.Get("/slots", handlers.ListSlots)
 
 	// Rutas de admin (protegidas)
 	admin := protected.Group("/admin")
@@ -262,11 +364,16 @@ func main() {
 	admin.Get("/users", handlers.ListUsers)
 	admin.Get("/users/:id", handlers.GetUser)
 	admin.Put("/users/:id", handlers.UpdateUser)
+	admin.Delete("/users/:id/age-verification", handlers.ResetAgeVerification)
 
 	// Gestión de productos (protegidas)
 	admin.Post("/products", handlers.CreateProduct)
 	admin.Put("/products/:id", handlers.UpdateProduct)
 	admin.Delete("/products/:id", handlers.DeleteProduct)
+	admin.Post("/products/:id/variants", handlers.CreateProductVariant)
+	admin.Put("/variants/:id", handlers.UpdateProductVariant)
+	admin.Delete("/variants/:id", handlers.DeleteProductVariant)
+	admin.Put("/products/:id/bundle", handlers.UpdateProductBundle)
 	admin.Get("/products/list", handlers.GetAllProductsAdmin)
 
 	// Gestión de servicios (protegidas)
@@ -294,12 +401,68 @@ func main() {
 	admin.Get("/reservations", handlers.ListAllReservations)
 	admin.Put("/reservations/:id/status", handlers.UpdateReservationStatus)
 
+	// Gestión de cupones (solo admin)
+	admin.Get("/coupons", handlers.ListCoupons)
+	admin.Post("/coupons", handlers.CreateCoupon)
+	admin.Put("/coupons/:id", handlers.UpdateCoupon)
+	admin.Get("/coupons/:id/redemptions", handlers.ListCouponRedemptions)
+
+	// Gestión de promociones (solo admin)
+	admin.Get("/promotions", handlers.ListPromotions)
+	admin.Post("/promotions", handlers.CreatePromotion)
+	admin.Put("/promotions/:id", handlers.UpdatePromotion)
+	admin.Delete("/promotions/:id", handlers.DeletePromotion)
+
+	// Asignación de repartidores (solo admin)
+	admin.Get("/drivers", handlers.ListDrivers)
+	admin.Put("/orders/:id/driver", handlers.AssignOrderDriver)
+
+	// Gestión de zonas de reparto (solo admin)
+	admin.Get("/delivery-zones", handlers.ListDeliveryZones)
+	admin.Post("/delivery-zones", handlers.CreateDeliveryZone)
+	admin.Put("/delivery-zones/:id", handlers.UpdateDeliveryZone)
+	admin.Delete("/delivery-zones/:id", handlers.DeleteDeliveryZone)
+
+	// Horario de atención y cupo por franja (solo admin)
+	admin.Get("/opening-hours", handlers.ListOpeningHours)
+	admin.Post("/opening-hours", handlers.CreateOpeningHours)
+	admin.Put("/opening-hours/:id", handlers.UpdateOpeningHours)
+	admin.Delete("/opening-hours/:id", handlers.DeleteOpeningHours)
+
 	// Reportes (solo admin)
 	admin.Get("/reports/sales/csv", handlers.ExportSalesCSV)
 	admin.Get("/reports/sales/pdf", handlers.ExportSalesPDF)
 	admin.Get("/reports/users/csv", handlers.ExportUsersCSV)
 	admin.Get("/reports/users/pdf", handlers.ExportUsersPDF)
 
+	// Comprobantes electrónicos
+	admin.Get("/invoices", handlers.ListInvoices)
+	admin.Post("/invoices/:id/resend", handlers.ResendInvoice)
+
+	// Recuperación de carritos abandonados
+	admin.Get("/abandoned-carts/stats", handlers.GetAbandonedCartStats)
+
+	// Club POSOQO: planes, socios y métricas (MRR)
+	admin.Post("/subscription-plans", handlers.CreateSubscriptionPlan)
+	admin.Put("/subscription-plans/:id", handlers.UpdateSubscriptionPlan)
+	admin.Get("/subscriptions", handlers.ListSubscriptionsAdmin)
+	admin.Get("/subscriptions/metrics", handlers.GetSubscriptionMetrics)
+
+	// Gift cards: emisión, anulación y ajustes de saldo (quedan en audit_logs)
+	admin.Get("/gift-cards", handlers.ListGiftCards)
+	admin.Get("/gift-cards/:id", handlers.GetGiftCard)
+	admin.Post("/gift-cards", middleware.Idempotency(), handlers.IssueGiftCard)
+	admin.Post("/gift-cards/:id/void", handlers.VoidGiftCard)
+	admin.Post("/gift-cards/:id/adjust", middleware.Idempotency(), handlers.AdjustGiftCardBalance)
+
+	// Puntos POSOQO: ajustes (quedan en audit_logs), niveles y recompensas
+	admin.Get("/loyalty/users/:id", handlers.GetUserLoyaltyAdmin)
+	admin.Post("/loyalty/users/:id/adjust", middleware.Idempotency(), handlers.AdjustLoyaltyPoints)
+	admin.Put("/loyalty/tiers/:id", handlers.UpdateLoyaltyTier)
+	admin.Get("/loyalty/rewards", handlers.ListLoyaltyRewards)
+	admin.Post("/loyalty/rewards", handlers.CreateLoyaltyReward)
+	admin.Put("/loyalty/rewards/:id", handlers.UpdateLoyaltyReward)
+
 	// Endpoints de dashboard para estadísticas (solo admin)
 	admin.Get("/test", handlers.TestDashboardEndpoint)
 	admin.Get("/products", handlers.GetAdminProducts)
@@ -340,6 +503,7 @@ func main() {
 	adminPublic.Get("/services/list", handlers.GetAdminServicesListPublic)
 	adminPublic.Get("/orders/list", handlers.GetAdminOrdersListPublic)
 	adminPublic.Put("/orders/:id/status", handlers.UpdateOrderStatus)
+	adminPublic.Get("/orders/:id/timeline", handlers.GetOrderTimeline)
 	adminPublic.Get("/users/list", handlers.GetAdminUsersPublic)
 	adminPublic.Put("/users/:id", handlers.UpdateUserAdmin)
 	adminPublic.Put("/users/:id/suspend", handlers.SuspendUserAdmin)
@@ -393,6 +557,10 @@ func main() {
 	// Health check endpoint mejorado para verificar que el servidor esté funcionando
 	app.Get("/health", handlers.HealthCheck)
 
+	// WebSocket de notificaciones en tiempo real (estados de pedido y ubicación del repartidor)
+	app.Use("/ws", middleware.WebSocketAuth(), handlers.WebSocketHandler)
+	app.Get("/ws", websocket.New(handlers.WebSocketConn))
+
 	// Rutas de prueba/debug - SOLO EN DESARROLLO
 	// Estas rutas solo están disponibles en modo desarrollo para evitar exposición de información sensible
 	if os.Getenv("NODE_ENV") != "production" {
@@ -0,0 +1,143 @@
+// Package einvoice genera comprobantes electrónicos SUNAT (boletas y facturas):
+// arma el XML UBL 2.1, lo firma con el certificado digital, genera la representación
+// impresa en PDF y lo envía a la OSE/SUNAT mediante un Submitter intercambiable.
+package einvoice
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// Tipos de comprobante (catálogo 01 de SUNAT)
+const (
+	TypeFactura = "01"
+	TypeBoleta  = "03"
+)
+
+// Tipos de documento de identidad (catálogo 06 de SUNAT)
+const (
+	DocSinDocumento = "0"
+	DocDNI          = "1"
+	DocCarnetExtr   = "4"
+	DocRUC          = "6"
+	DocPasaporte    = "7"
+)
+
+// BoletaIdentificationThreshold es el monto desde el cual la boleta debe identificar al cliente
+const BoletaIdentificationThreshold = 700.0
+
+// Issuer es la empresa emisora
+type Issuer struct {
+	RUC       string
+	Name      string // razón social
+	TradeName string // nombre comercial
+	Address   string
+	Ubigeo    string
+}
+
+// Customer es el adquiriente del comprobante
+type Customer struct {
+	DocType   string
+	DocNumber string
+	Name      string
+	Address   string
+}
+
+// Line es una línea del comprobante. Total incluye IGV y ya tiene descuentos aplicados.
+type Line struct {
+	Code        string
+	Description string
+	Quantity    float64
+	UnitCode    string // NIU = unidad, ZZ = servicio
+	TaxType     string // utils.TaxGravado, utils.TaxExonerado o utils.TaxInafecto
+	Base        float64
+	IGV         float64
+	Total       float64
+}
+
+// UnitValue devuelve el valor unitario sin IGV
+func (l Line) UnitValue() float64 {
+	if l.Quantity == 0 {
+		return 0
+	}
+	return l.Base / l.Quantity
+}
+
+// UnitPrice devuelve el precio unitario con IGV
+func (l Line) UnitPrice() float64 {
+	if l.Quantity == 0 {
+		return 0
+	}
+	return l.Total / l.Quantity
+}
+
+// Document es una boleta o factura lista para convertirse en XML
+type Document struct {
+	Type      string
+	Series    string
+	Number    int64
+	IssuedAt  time.Time
+	Currency  string
+	Issuer    Issuer
+	Customer  Customer
+	Lines     []Line
+	Totals    utils.TaxBreakdown
+	OrderRef  string // pedido de origen
+	PaymentID string // forma de pago (Contado)
+}
+
+// ID devuelve la serie y correlativo, p. ej. B001-123
+func (d *Document) ID() string {
+	return fmt.Sprintf("%s-%d", d.Series, d.Number)
+}
+
+// FileName devuelve el nombre que exige SUNAT: RUC-TIPO-SERIE-CORRELATIVO
+func (d *Document) FileName() string {
+	return fmt.Sprintf("%s-%s-%s", d.Issuer.RUC, d.Type, d.ID())
+}
+
+// Title devuelve el nombre del comprobante para la representación impresa
+func (d *Document) Title() string {
+	if d.Type == TypeFactura {
+		return "FACTURA ELECTRÓNICA"
+	}
+	return "BOLETA DE VENTA ELECTRÓNICA"
+}
+
+// Validate verifica las reglas de SUNAT que dependen del tipo de comprobante
+func (d *Document) Validate() error {
+	if !utils.IsValidRUC(d.Issuer.RUC) || d.Issuer.Name == "" {
+		return fmt.Errorf("emisor no configurado (RUC y razón social requeridos)")
+	}
+	if len(d.Lines) == 0 {
+		return fmt.Errorf("el comprobante no tiene líneas")
+	}
+	switch d.Type {
+	case TypeFactura:
+		if !strings.HasPrefix(d.Series, "F") {
+			return fmt.Errorf("la serie de una factura debe empezar con F")
+		}
+		if d.Customer.DocType != DocRUC || !utils.IsValidRUC(d.Customer.DocNumber) {
+			return fmt.Errorf("la factura requiere un RUC válido")
+		}
+		if strings.TrimSpace(d.Customer.Name) == "" {
+			return fmt.Errorf("la factura requiere la razón social del cliente")
+		}
+	case TypeBoleta:
+		if !strings.HasPrefix(d.Series, "B") {
+			return fmt.Errorf("la serie de una boleta debe empezar con B")
+		}
+		if d.Totals.Total >= BoletaIdentificationThreshold && d.Customer.DocType == DocSinDocumento {
+			return fmt.Errorf("boletas desde S/%.2f deben identificar al cliente", BoletaIdentificationThreshold)
+		}
+		if d.Customer.DocType == DocDNI && !utils.IsValidDNI(d.Customer.DocNumber) {
+			return fmt.Errorf("DNI inválido")
+		}
+	default:
+		return fmt.Errorf("tipo de comprobante inválido: %s", d.Type)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package einvoice
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/posoqo/backend/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAmountInWords(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		expected string
+	}{
+		{0, "CERO CON 00/100 SOLES"},
+		{21.5, "VEINTIUNO CON 50/100 SOLES"},
+		{100, "CIEN CON 00/100 SOLES"},
+		{120.5, "CIENTO VEINTE CON 50/100 SOLES"},
+		{1501.99, "MIL QUINIENTOS UNO CON 99/100 SOLES"},
+		{21000, "VEINTIUN MIL CON 00/100 SOLES"},
+		{2345678.1, "DOS MILLONES TRESCIENTOS CUARENTA Y CINCO MIL SEISCIENTOS SETENTA Y OCHO CON 10/100 SOLES"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			assert.Equal(t, tt.expected, AmountInWords(tt.amount))
+		})
+	}
+}
+
+func testDocument() *Document {
+	var totals utils.TaxBreakdown
+	base1, igv1 := totals.Add(50, utils.TaxGravado)
+	base2, igv2 := totals.Add(12, utils.TaxExonerado)
+	return &Document{
+		Type:     TypeBoleta,
+		Series:   "B001",
+		Number:   7,
+		IssuedAt: time.Date(2025, 6, 13, 19, 30, 0, 0, time.UTC),
+		Issuer:   Issuer{RUC: "20100070970", Name: "POSOQO S.A.C.", Address: "Av. Siempre Viva 123 & Co"},
+		Customer: Customer{DocType: DocDNI, DocNumber: "12345678", Name: "Juan Pérez"},
+		Lines: []Line{
+			{Description: "Cerveza Golden", Quantity: 2, TaxType: utils.TaxGravado, Base: base1, IGV: igv1, Total: 50},
+			{Description: "Libro", Quantity: 1, TaxType: utils.TaxExonerado, Base: base2, IGV: igv2, Total: 12},
+		},
+		Totals: totals,
+	}
+}
+
+func TestBuildXML(t *testing.T) {
+	out, err := BuildXML(testDocument())
+	require.NoError(t, err)
+	xml := string(out)
+
+	assert.Contains(t, xml, `<cbc:ID>B001-7</cbc:ID>`)
+	assert.Contains(t, xml, `<cbc:InvoiceTypeCode listID="0101">03</cbc:InvoiceTypeCode>`)
+	assert.Contains(t, xml, `<cbc:TaxAmount currencyID="PEN">7.63</cbc:TaxAmount>`)
+	assert.Contains(t, xml, `<cbc:PayableAmount currencyID="PEN">62.00</cbc:PayableAmount>`)
+	assert.Contains(t, xml, `<cbc:ID>9997</cbc:ID>`)
+	assert.Contains(t, xml, `SESENTA Y DOS CON 00/100 SOLES`)
+	assert.Contains(t, xml, `Av. Siempre Viva 123 &amp; Co`)
+	assert.Contains(t, xml, `<ext:ExtensionContent></ext:ExtensionContent>`)
+}
+
+func TestDocumentValidate(t *testing.T) {
+	d := testDocument()
+	d.Type = TypeFactura
+	assert.Error(t, d.Validate(), "una factura necesita serie F y RUC")
+
+	d.Series = "F001"
+	d.Customer = Customer{DocType: DocRUC, DocNumber: "20100070970", Name: "Cliente S.A."}
+	assert.NoError(t, d.Validate())
+
+	d = testDocument()
+	d.Totals.Total = 700
+	d.Customer = Customer{DocType: DocSinDocumento}
+	assert.Error(t, d.Validate(), "boletas desde 700 soles deben identificar al cliente")
+}
+
+func TestSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "POSOQO TEST"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	signer, err := NewSigner(key, cert)
+	require.NoError(t, err)
+	d := testDocument()
+	signed, err := signer.Sign(d)
+	require.NoError(t, err)
+
+	// Quitar la firma (transformación enveloped) debe dar el documento digerido
+	withoutSignature := regexp.MustCompile(`<ds:Signature .*</ds:Signature>`).ReplaceAll(signed.XML, nil)
+	unsigned, err := BuildXML(d)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(unsigned, withoutSignature))
+	digest := sha256.Sum256(bytes.TrimPrefix(unsigned, []byte(xmlDeclaration)))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(digest[:]), signed.DigestValue)
+
+	// SignatureValue se verifica sobre SignedInfo canonicalizado con los namespaces del documento
+	match := regexp.MustCompile(`<ds:SignatureValue>([^<]+)</ds:SignatureValue>`).FindSubmatch(signed.XML)
+	require.NotNil(t, match)
+	signature, err := base64.StdEncoding.DecodeString(string(match[1]))
+	require.NoError(t, err)
+	hashed := sha256.Sum256(signedInfoNode(signed.DigestValue).canonical(buildInvoice(d).nsDecls))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hashed[:], signature))
+}
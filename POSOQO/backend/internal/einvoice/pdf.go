@@ -0,0 +1,120 @@
+package einvoice
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+var customerDocLabels = map[string]string{
+	DocSinDocumento: "DOC.",
+	DocDNI:          "DNI",
+	DocCarnetExtr:   "C.E.",
+	DocRUC:          "RUC",
+	DocPasaporte:    "PASAPORTE",
+}
+
+// WritePDF genera la representación impresa del comprobante firmado
+func WritePDF(w io.Writer, d *Document, digestValue string) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	// Emisor
+	pdf.SetFont("Arial", "B", 14)
+	title := d.Issuer.TradeName
+	if title == "" {
+		title = d.Issuer.Name
+	}
+	pdf.SetXY(10, 12)
+	pdf.CellFormat(115, 8, tr(title), "", 2, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 9)
+	pdf.CellFormat(115, 5, tr(d.Issuer.Name), "", 2, "L", false, 0, "")
+	pdf.MultiCell(115, 5, tr(d.Issuer.Address), "", "L", false)
+
+	// Recuadro del comprobante
+	pdf.SetXY(130, 12)
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(70, 8, "RUC "+d.Issuer.RUC, "LTR", 2, "C", false, 0, "")
+	pdf.CellFormat(70, 8, tr(d.Title()), "LR", 2, "C", false, 0, "")
+	pdf.CellFormat(70, 8, d.ID(), "LBR", 2, "C", false, 0, "")
+
+	// Cliente
+	pdf.SetXY(10, 42)
+	pdf.SetFont("Arial", "", 9)
+	docLabel := customerDocLabels[d.Customer.DocType]
+	if docLabel == "" {
+		docLabel = "DOC."
+	}
+	customerName, customerDoc := d.Customer.Name, d.Customer.DocNumber
+	if customerName == "" {
+		customerName = "CLIENTES VARIOS"
+	}
+	if customerDoc == "" {
+		customerDoc = "-"
+	}
+	pdf.CellFormat(35, 5, tr("Fecha de emisión:"), "", 0, "L", false, 0, "")
+	pdf.CellFormat(155, 5, d.IssuedAt.Format("02/01/2006 15:04"), "", 1, "L", false, 0, "")
+	pdf.CellFormat(35, 5, tr("Señor(es):"), "", 0, "L", false, 0, "")
+	pdf.CellFormat(155, 5, tr(customerName), "", 1, "L", false, 0, "")
+	pdf.CellFormat(35, 5, docLabel+":", "", 0, "L", false, 0, "")
+	pdf.CellFormat(155, 5, customerDoc, "", 1, "L", false, 0, "")
+	if d.Customer.Address != "" {
+		pdf.CellFormat(35, 5, tr("Dirección:"), "", 0, "L", false, 0, "")
+		pdf.MultiCell(155, 5, tr(d.Customer.Address), "", "L", false)
+	}
+	if d.OrderRef != "" {
+		pdf.CellFormat(35, 5, "Pedido:", "", 0, "L", false, 0, "")
+		pdf.CellFormat(155, 5, d.OrderRef, "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	// Detalle
+	headers := []string{"Cant.", "Descripción", "P. Unit.", "Importe"}
+	widths := []float64{20, 110, 30, 30}
+	pdf.SetFont("Arial", "B", 9)
+	for i, h := range headers {
+		pdf.CellFormat(widths[i], 7, tr(h), "1", 0, "C", false, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Arial", "", 9)
+	for _, l := range d.Lines {
+		pdf.CellFormat(widths[0], 7, quantity(l.Quantity), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(widths[1], 7, tr(l.Description), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 7, fmt.Sprintf("%.2f", l.UnitPrice()), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, fmt.Sprintf("%.2f", l.Total), "1", 0, "R", false, 0, "")
+		pdf.Ln(-1)
+	}
+
+	// Totales
+	pdf.Ln(2)
+	totals := []struct {
+		label string
+		value float64
+	}{
+		{"Op. Gravadas", d.Totals.Gravado},
+		{"Op. Exoneradas", d.Totals.Exonerado},
+		{"Op. Inafectas", d.Totals.Inafecto},
+		{"IGV (18%)", d.Totals.IGV},
+		{"Importe Total", d.Totals.Total},
+	}
+	for i, t := range totals {
+		if i == len(totals)-1 {
+			pdf.SetFont("Arial", "B", 9)
+		}
+		pdf.CellFormat(130, 6, "", "", 0, "", false, 0, "")
+		pdf.CellFormat(30, 6, t.label, "", 0, "L", false, 0, "")
+		pdf.CellFormat(30, 6, fmt.Sprintf("S/ %.2f", t.value), "", 1, "R", false, 0, "")
+	}
+
+	pdf.Ln(4)
+	pdf.SetFont("Arial", "", 9)
+	pdf.MultiCell(190, 5, "SON: "+AmountInWords(d.Totals.Total), "", "L", false)
+	pdf.Ln(4)
+	pdf.SetFont("Arial", "", 8)
+	pdf.MultiCell(190, 4, tr(fmt.Sprintf("Representación impresa de la %s. Código hash: %s",
+		d.Title(), digestValue)), "", "L", false)
+
+	return pdf.Output(w)
+}
@@ -0,0 +1,186 @@
+package einvoice
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Algoritmos XMLDSig que acepta SUNAT
+const (
+	algC14N      = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	algRSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algEnveloped = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algSHA256    = "http://www.w3.org/2001/04/xmlenc#sha256"
+)
+
+// Signer firma comprobantes con el certificado digital del emisor
+type Signer struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// Signed es un comprobante firmado
+type Signed struct {
+	XML         []byte
+	DigestValue string // código hash que se imprime en la representación impresa
+}
+
+// NewSigner crea un firmador a partir de una llave y su certificado
+func NewSigner(key *rsa.PrivateKey, cert *x509.Certificate) (*Signer, error) {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || !pub.Equal(&key.PublicKey) {
+		return nil, errors.New("el certificado no corresponde a la llave privada")
+	}
+	return &Signer{key: key, cert: cert}, nil
+}
+
+// LoadSignerFromEnv carga el certificado configurado en EINVOICE_CERT_PATH.
+// Acepta un .pfx/.p12 con EINVOICE_CERT_PASSWORD, o un certificado PEM con su
+// llave en EINVOICE_KEY_PATH.
+func LoadSignerFromEnv() (*Signer, error) {
+	certPath := os.Getenv("EINVOICE_CERT_PATH")
+	if certPath == "" {
+		return nil, errors.New("EINVOICE_CERT_PATH no configurado")
+	}
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer el certificado: %w", err)
+	}
+
+	keyPath := os.Getenv("EINVOICE_KEY_PATH")
+	if keyPath == "" {
+		return signerFromPFX(certData, os.Getenv("EINVOICE_CERT_PASSWORD"))
+	}
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer la llave privada: %w", err)
+	}
+	return signerFromPEM(certData, keyData)
+}
+
+// signerFromPFX lee un PKCS#12. Si trae la cadena de certificación, busca el
+// certificado que corresponde a la llave.
+func signerFromPFX(data []byte, password string) (*Signer, error) {
+	if key, cert, err := pkcs12.Decode(data, password); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("el certificado debe tener llave RSA")
+		}
+		return NewSigner(rsaKey, cert)
+	}
+
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo abrir el certificado PFX: %w", err)
+	}
+	var pemData []byte
+	for _, b := range blocks {
+		pemData = append(pemData, pem.EncodeToMemory(b)...)
+	}
+	return signerFromPEM(pemData, pemData)
+}
+
+func signerFromPEM(certData, keyData []byte) (*Signer, error) {
+	var key *rsa.PrivateKey
+	for rest := keyData; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if !strings.Contains(block.Type, "PRIVATE KEY") {
+			continue
+		}
+		if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+			key = k
+			break
+		}
+		if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			if rsaKey, ok := k.(*rsa.PrivateKey); ok {
+				key = rsaKey
+				break
+			}
+		}
+	}
+	if key == nil {
+		return nil, errors.New("no se encontró una llave privada RSA")
+	}
+
+	for rest := certData; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if signer, err := NewSigner(key, cert); err == nil {
+			return signer, nil
+		}
+	}
+	return nil, errors.New("no se encontró el certificado de la llave privada")
+}
+
+// Sign genera el XML UBL firmado con XMLDSig enveloped (RSA-SHA256) dentro de
+// ext:UBLExtensions, como lo exige SUNAT.
+func (s *Signer) Sign(d *Document) (*Signed, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	root := buildInvoice(d)
+
+	// Con la transformación enveloped el digest se calcula sin el nodo Signature,
+	// es decir, sobre el documento tal como está antes de firmar.
+	digest := sha256.Sum256(root.canonical(nil))
+	digestValue := base64.StdEncoding.EncodeToString(digest[:])
+
+	signedInfo := signedInfoNode(digestValue)
+	signedInfoHash := sha256.Sum256(signedInfo.canonical(root.nsDecls))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, signedInfoHash[:])
+	if err != nil {
+		return nil, fmt.Errorf("error firmando comprobante: %w", err)
+	}
+
+	root.find("ext:ExtensionContent").add(
+		el("ds:Signature",
+			signedInfo,
+			leaf("ds:SignatureValue", base64.StdEncoding.EncodeToString(signature)),
+			el("ds:KeyInfo", el("ds:X509Data",
+				leaf("ds:X509Certificate", base64.StdEncoding.EncodeToString(s.cert.Raw)),
+			)),
+		).withAttr("Id", signatureID),
+	)
+
+	return &Signed{
+		XML:         withDeclaration(root.canonical(nil)),
+		DigestValue: digestValue,
+	}, nil
+}
+
+func signedInfoNode(digestValue string) *node {
+	return el("ds:SignedInfo",
+		el("ds:CanonicalizationMethod").withAttr("Algorithm", algC14N),
+		el("ds:SignatureMethod").withAttr("Algorithm", algRSASHA256),
+		el("ds:Reference",
+			el("ds:Transforms", el("ds:Transform").withAttr("Algorithm", algEnveloped)),
+			el("ds:DigestMethod").withAttr("Algorithm", algSHA256),
+			leaf("ds:DigestValue", digestValue),
+		).withAttr("URI", ""),
+	)
+}
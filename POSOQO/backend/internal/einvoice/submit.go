@@ -0,0 +1,193 @@
+package einvoice
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SubmissionResult es la respuesta de la OSE/SUNAT (constancia de recepción)
+type SubmissionResult struct {
+	Accepted    bool
+	Code        string
+	Description string
+	CDR         []byte // zip con el CDR, si lo hubo
+}
+
+// Submitter envía comprobantes firmados a la OSE o a SUNAT
+type Submitter interface {
+	Submit(ctx context.Context, d *Document, signedXML []byte) (*SubmissionResult, error)
+}
+
+// NewSubmitterFromEnv usa el servicio sendBill de EINVOICE_OSE_URL. Sin URL
+// configurada devuelve un stub local que acepta todo (desarrollo).
+func NewSubmitterFromEnv() Submitter {
+	url := os.Getenv("EINVOICE_OSE_URL")
+	if url == "" {
+		return StubSubmitter{}
+	}
+	return &SOAPSubmitter{
+		URL:      url,
+		Username: os.Getenv("EINVOICE_RUC") + os.Getenv("EINVOICE_SOL_USER"),
+		Password: os.Getenv("EINVOICE_SOL_PASSWORD"),
+		Client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// StubSubmitter simula la aceptación del comprobante sin enviarlo
+type StubSubmitter struct{}
+
+// Submit acepta el comprobante localmente
+func (StubSubmitter) Submit(ctx context.Context, d *Document, signedXML []byte) (*SubmissionResult, error) {
+	log.Printf("[EINVOICE] Stub: %s aceptado localmente (%d bytes)", d.FileName(), len(signedXML))
+	return &SubmissionResult{
+		Accepted:    true,
+		Code:        "0",
+		Description: fmt.Sprintf("El comprobante %s ha sido aceptado (stub local)", d.ID()),
+	}, nil
+}
+
+// SOAPSubmitter envía comprobantes con el servicio sendBill de SUNAT/OSE
+type SOAPSubmitter struct {
+	URL      string
+	Username string // RUC + usuario SOL
+	Password string
+	Client   *http.Client
+}
+
+const sendBillEnvelope = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ser="http://service.sunat.gob.pe" xmlns:wsse="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">` +
+	`<soapenv:Header><wsse:Security><wsse:UsernameToken><wsse:Username>%s</wsse:Username><wsse:Password>%s</wsse:Password></wsse:UsernameToken></wsse:Security></soapenv:Header>` +
+	`<soapenv:Body><ser:sendBill><fileName>%s</fileName><contentFile>%s</contentFile></ser:sendBill></soapenv:Body></soapenv:Envelope>`
+
+// sendBillResponse lee tanto la respuesta exitosa como un SOAP Fault
+type sendBillResponse struct {
+	ApplicationResponse string `xml:"Body>sendBillResponse>applicationResponse"`
+	FaultCode           string `xml:"Body>Fault>faultcode"`
+	FaultString         string `xml:"Body>Fault>faultstring"`
+}
+
+// cdrResponse son los campos que interesan del ApplicationResponse (CDR)
+type cdrResponse struct {
+	ResponseCode string   `xml:"DocumentResponse>Response>ResponseCode"`
+	Description  string   `xml:"DocumentResponse>Response>Description"`
+	Notes        []string `xml:"Note"`
+}
+
+// Submit comprime el XML, lo envía y lee el CDR
+func (s *SOAPSubmitter) Submit(ctx context.Context, d *Document, signedXML []byte) (*SubmissionResult, error) {
+	zipped, err := zipFile(d.FileName()+".xml", signedXML)
+	if err != nil {
+		return nil, err
+	}
+	envelope := fmt.Sprintf(sendBillEnvelope,
+		escapeText(s.Username), escapeText(s.Password),
+		d.FileName()+".zip", base64.StdEncoding.EncodeToString(zipped))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, strings.NewReader(envelope))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", "urn:sendBill")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error conectando con la OSE: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo respuesta de la OSE: %w", err)
+	}
+
+	var parsed sendBillResponse
+	if err := xml.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("respuesta inválida de la OSE (HTTP %d): %w", resp.StatusCode, err)
+	}
+
+	if parsed.FaultCode != "" {
+		// El código numérico va al final: soap-env:Client.2800
+		code := parsed.FaultCode
+		if i := strings.LastIndexAny(code, ".:"); i >= 0 {
+			code = code[i+1:]
+		}
+		result := &SubmissionResult{Code: code, Description: parsed.FaultString}
+		// 0100-1999 son excepciones del servicio: el comprobante no fue evaluado
+		if n, err := strconv.Atoi(code); err != nil || n < 2000 {
+			return nil, fmt.Errorf("OSE respondió %s: %s", code, parsed.FaultString)
+		}
+		return result, nil
+	}
+
+	cdr, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parsed.ApplicationResponse))
+	if err != nil || len(cdr) == 0 {
+		return nil, fmt.Errorf("la OSE no devolvió CDR (HTTP %d)", resp.StatusCode)
+	}
+	return parseCDR(cdr)
+}
+
+// parseCDR lee el código de respuesta del zip del CDR. Códigos 0 y desde 4000
+// (observaciones) significan aceptado; 2000-3999 es rechazo.
+func parseCDR(cdr []byte) (*SubmissionResult, error) {
+	zr, err := zip.NewReader(bytes.NewReader(cdr), int64(len(cdr)))
+	if err != nil {
+		return nil, fmt.Errorf("CDR inválido: %w", err)
+	}
+	for _, f := range zr.File {
+		if !strings.HasSuffix(strings.ToLower(f.Name), ".xml") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var r cdrResponse
+		if err := xml.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("CDR inválido: %w", err)
+		}
+		description := r.Description
+		if len(r.Notes) > 0 {
+			description += " | " + strings.Join(r.Notes, " | ")
+		}
+		code, _ := strconv.Atoi(r.ResponseCode)
+		return &SubmissionResult{
+			Accepted:    r.ResponseCode == "0" || code >= 4000,
+			Code:        r.ResponseCode,
+			Description: description,
+			CDR:         cdr,
+		}, nil
+	}
+	return nil, fmt.Errorf("el CDR no contiene XML")
+}
+
+func zipFile(name string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
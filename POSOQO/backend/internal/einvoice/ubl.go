@@ -0,0 +1,237 @@
+package einvoice
+
+import (
+	"strconv"
+
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// Espacios de nombres del Invoice UBL 2.1
+const (
+	nsInvoice = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	nsCac     = "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2"
+	nsCbc     = "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2"
+	nsExt     = "urn:oasis:names:specification:ubl:schema:xsd:CommonExtensionComponents-2"
+	nsDs      = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// signatureID enlaza cac:Signature con la firma XMLDSig
+const signatureID = "SignPOSOQO"
+
+// taxScheme describe un tributo del catálogo 05 y su afectación del catálogo 07
+type taxScheme struct {
+	id, name, typeCode, exemptionCode string
+}
+
+var taxSchemes = map[string]taxScheme{
+	utils.TaxGravado:   {"1000", "IGV", "VAT", "10"},
+	utils.TaxExonerado: {"9997", "EXO", "VAT", "20"},
+	utils.TaxInafecto:  {"9998", "INA", "FRE", "30"},
+}
+
+func amount(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// unitAmount usa más decimales: SUNAT valida cantidad x valor unitario contra la línea
+func unitAmount(v float64) string {
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
+
+func quantity(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// buildInvoice arma el árbol UBL 2.1 del comprobante. La firma se inserta después
+// dentro de ext:ExtensionContent.
+func buildInvoice(d *Document) *node {
+	currency := d.Currency
+	if currency == "" {
+		currency = "PEN"
+	}
+	money := func(name string, v float64) *node {
+		return leaf(name, amount(v)).withAttr("currencyID", currency)
+	}
+
+	root := el("Invoice")
+	root.nsDecls = []attr{
+		{"xmlns", nsInvoice},
+		{"xmlns:cac", nsCac},
+		{"xmlns:cbc", nsCbc},
+		{"xmlns:ds", nsDs},
+		{"xmlns:ext", nsExt},
+	}
+
+	root.add(
+		el("ext:UBLExtensions", el("ext:UBLExtension", el("ext:ExtensionContent"))),
+		leaf("cbc:UBLVersionID", "2.1"),
+		leaf("cbc:CustomizationID", "2.0"),
+		leaf("cbc:ID", d.ID()),
+		leaf("cbc:IssueDate", d.IssuedAt.Format("2006-01-02")),
+		leaf("cbc:IssueTime", d.IssuedAt.Format("15:04:05")),
+		leaf("cbc:InvoiceTypeCode", d.Type).withAttr("listID", "0101"),
+		leaf("cbc:Note", AmountInWords(d.Totals.Total)).withAttr("languageLocaleID", "1000"),
+		leaf("cbc:DocumentCurrencyCode", currency),
+		leaf("cbc:LineCountNumeric", strconv.Itoa(len(d.Lines))),
+	)
+	if d.OrderRef != "" {
+		root.add(el("cac:OrderReference", leaf("cbc:ID", d.OrderRef)))
+	}
+
+	// Referencia a la firma digital
+	root.add(el("cac:Signature",
+		leaf("cbc:ID", signatureID),
+		el("cac:SignatoryParty",
+			el("cac:PartyIdentification", leaf("cbc:ID", d.Issuer.RUC)),
+			el("cac:PartyName", leaf("cbc:Name", d.Issuer.Name)),
+		),
+		el("cac:DigitalSignatureAttachment",
+			el("cac:ExternalReference", leaf("cbc:URI", "#"+signatureID)),
+		),
+	))
+
+	// Emisor
+	supplier := el("cac:Party",
+		el("cac:PartyIdentification", leaf("cbc:ID", d.Issuer.RUC).withAttr("schemeID", DocRUC)),
+	)
+	if d.Issuer.TradeName != "" {
+		supplier.add(el("cac:PartyName", leaf("cbc:Name", d.Issuer.TradeName)))
+	}
+	address := el("cac:RegistrationAddress")
+	if d.Issuer.Ubigeo != "" {
+		address.add(leaf("cbc:ID", d.Issuer.Ubigeo))
+	}
+	address.add(leaf("cbc:AddressTypeCode", "0000"))
+	if d.Issuer.Address != "" {
+		address.add(el("cac:AddressLine", leaf("cbc:Line", d.Issuer.Address)))
+	}
+	supplier.add(el("cac:PartyLegalEntity",
+		leaf("cbc:RegistrationName", d.Issuer.Name),
+		address,
+	))
+	root.add(el("cac:AccountingSupplierParty", supplier))
+
+	// Cliente
+	docNumber, name := d.Customer.DocNumber, d.Customer.Name
+	if docNumber == "" {
+		docNumber = "-"
+	}
+	if name == "" {
+		name = "CLIENTES VARIOS"
+	}
+	legal := el("cac:PartyLegalEntity", leaf("cbc:RegistrationName", name))
+	if d.Customer.Address != "" {
+		legal.add(el("cac:RegistrationAddress", el("cac:AddressLine", leaf("cbc:Line", d.Customer.Address))))
+	}
+	root.add(el("cac:AccountingCustomerParty", el("cac:Party",
+		el("cac:PartyIdentification", leaf("cbc:ID", docNumber).withAttr("schemeID", d.Customer.DocType)),
+		legal,
+	)))
+
+	// Forma de pago (obligatoria en facturas)
+	if d.Type == TypeFactura {
+		root.add(el("cac:PaymentTerms",
+			leaf("cbc:ID", "FormaPago"),
+			leaf("cbc:PaymentMeansID", "Contado"),
+		))
+	}
+
+	// Totales de impuestos por tipo de afectación
+	taxTotal := el("cac:TaxTotal", money("cbc:TaxAmount", d.Totals.IGV))
+	subtotals := []struct {
+		taxType string
+		base    float64
+		igv     float64
+	}{
+		{utils.TaxGravado, d.Totals.Gravado, d.Totals.IGV},
+		{utils.TaxExonerado, d.Totals.Exonerado, 0},
+		{utils.TaxInafecto, d.Totals.Inafecto, 0},
+	}
+	for _, s := range subtotals {
+		if s.base == 0 && s.taxType != utils.TaxGravado {
+			continue
+		}
+		scheme := taxSchemes[s.taxType]
+		taxTotal.add(el("cac:TaxSubtotal",
+			money("cbc:TaxableAmount", s.base),
+			money("cbc:TaxAmount", s.igv),
+			el("cac:TaxCategory", schemeNode(scheme)),
+		))
+	}
+	root.add(taxTotal)
+
+	lineExtension := d.Totals.Gravado + d.Totals.Exonerado + d.Totals.Inafecto
+	root.add(el("cac:LegalMonetaryTotal",
+		money("cbc:LineExtensionAmount", lineExtension),
+		money("cbc:TaxInclusiveAmount", d.Totals.Total),
+		money("cbc:PayableAmount", d.Totals.Total),
+	))
+
+	// Líneas
+	for i, l := range d.Lines {
+		scheme, ok := taxSchemes[l.TaxType]
+		if !ok {
+			scheme = taxSchemes[utils.TaxGravado]
+		}
+		unitCode := l.UnitCode
+		if unitCode == "" {
+			unitCode = "NIU"
+		}
+		percent := "0"
+		if l.TaxType == utils.TaxGravado {
+			percent = quantity(utils.IGVRate * 100)
+		}
+		item := el("cac:Item", leaf("cbc:Description", l.Description))
+		if l.Code != "" {
+			item.add(el("cac:SellersItemIdentification", leaf("cbc:ID", l.Code)))
+		}
+
+		root.add(el("cac:InvoiceLine",
+			leaf("cbc:ID", strconv.Itoa(i+1)),
+			leaf("cbc:InvoicedQuantity", quantity(l.Quantity)).withAttr("unitCode", unitCode),
+			money("cbc:LineExtensionAmount", l.Base),
+			el("cac:PricingReference", el("cac:AlternativeConditionPrice",
+				leaf("cbc:PriceAmount", unitAmount(l.UnitPrice())).withAttr("currencyID", currency),
+				leaf("cbc:PriceTypeCode", "01"),
+			)),
+			el("cac:TaxTotal",
+				money("cbc:TaxAmount", l.IGV),
+				el("cac:TaxSubtotal",
+					money("cbc:TaxableAmount", l.Base),
+					money("cbc:TaxAmount", l.IGV),
+					el("cac:TaxCategory",
+						leaf("cbc:Percent", percent),
+						leaf("cbc:TaxExemptionReasonCode", scheme.exemptionCode),
+						schemeNode(scheme),
+					),
+				),
+			),
+			item,
+			el("cac:Price", leaf("cbc:PriceAmount", unitAmount(l.UnitValue())).withAttr("currencyID", currency)),
+		))
+	}
+
+	return root
+}
+
+func schemeNode(s taxScheme) *node {
+	return el("cac:TaxScheme",
+		leaf("cbc:ID", s.id),
+		leaf("cbc:Name", s.name),
+		leaf("cbc:TaxTypeCode", s.typeCode),
+	)
+}
+
+// BuildXML genera el XML UBL 2.1 sin firmar
+func BuildXML(d *Document) ([]byte, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return withDeclaration(buildInvoice(d).canonical(nil)), nil
+}
+
+const xmlDeclaration = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"
+
+func withDeclaration(body []byte) []byte {
+	return append([]byte(xmlDeclaration), body...)
+}
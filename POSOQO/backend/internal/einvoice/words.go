@@ -0,0 +1,81 @@
+package einvoice
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+var unidades = [...]string{
+	"", "UNO", "DOS", "TRES", "CUATRO", "CINCO", "SEIS", "SIETE", "OCHO", "NUEVE",
+	"DIEZ", "ONCE", "DOCE", "TRECE", "CATORCE", "QUINCE", "DIECISEIS", "DIECISIETE", "DIECIOCHO", "DIECINUEVE",
+	"VEINTE", "VEINTIUNO", "VEINTIDOS", "VEINTITRES", "VEINTICUATRO", "VEINTICINCO", "VEINTISEIS", "VEINTISIETE", "VEINTIOCHO", "VEINTINUEVE",
+}
+
+var decenas = [...]string{"", "", "", "TREINTA", "CUARENTA", "CINCUENTA", "SESENTA", "SETENTA", "OCHENTA", "NOVENTA"}
+
+var centenas = [...]string{"", "CIENTO", "DOSCIENTOS", "TRESCIENTOS", "CUATROCIENTOS", "QUINIENTOS",
+	"SEISCIENTOS", "SETECIENTOS", "OCHOCIENTOS", "NOVECIENTOS"}
+
+// hundredsInWords convierte de 1 a 999
+func hundredsInWords(n int64) string {
+	if n == 100 {
+		return "CIEN"
+	}
+	var parts []string
+	if c := n / 100; c > 0 {
+		parts = append(parts, centenas[c])
+	}
+	switch r := n % 100; {
+	case r == 0:
+	case r < 30:
+		parts = append(parts, unidades[r])
+	default:
+		d := decenas[r/10]
+		if r%10 > 0 {
+			d += " Y " + unidades[r%10]
+		}
+		parts = append(parts, d)
+	}
+	return strings.Join(parts, " ")
+}
+
+// apocope cambia UNO por UN delante de MIL y MILLONES (VEINTIUN MIL)
+func apocope(s string) string {
+	if strings.HasSuffix(s, "UNO") {
+		return strings.TrimSuffix(s, "O")
+	}
+	return s
+}
+
+func integerInWords(n int64) string {
+	if n == 0 {
+		return "CERO"
+	}
+	var parts []string
+	if m := n / 1_000_000; m > 0 {
+		if m == 1 {
+			parts = append(parts, "UN MILLON")
+		} else {
+			parts = append(parts, apocope(integerInWords(m))+" MILLONES")
+		}
+	}
+	if t := (n / 1000) % 1000; t > 0 {
+		if t == 1 {
+			parts = append(parts, "MIL")
+		} else {
+			parts = append(parts, apocope(hundredsInWords(t))+" MIL")
+		}
+	}
+	if r := n % 1000; r > 0 {
+		parts = append(parts, hundredsInWords(r))
+	}
+	return strings.Join(parts, " ")
+}
+
+// AmountInWords expresa un importe en soles como lo exige la leyenda 1000 de SUNAT,
+// p. ej. "CIENTO VEINTE CON 50/100 SOLES"
+func AmountInWords(amount float64) string {
+	cents := int64(math.Round(math.Abs(amount) * 100))
+	return fmt.Sprintf("%s CON %02d/100 SOLES", integerInWords(cents/100), cents%100)
+}
@@ -0,0 +1,128 @@
+package einvoice
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// node es un árbol XML mínimo que se serializa directamente en forma canónica
+// (C14N 1.0 inclusiva): sin espacios entre elementos, etiquetas de cierre explícitas
+// y atributos ordenados. Así el digest de la firma coincide con lo que verifica SUNAT
+// sin depender de una librería de canonicalización.
+type node struct {
+	name     string
+	nsDecls  []attr // declaraciones xmlns
+	attrs    []attr
+	text     string
+	children []*node
+}
+
+type attr struct {
+	name  string
+	value string
+}
+
+// el crea un elemento con hijos
+func el(name string, children ...*node) *node {
+	return &node{name: name, children: children}
+}
+
+// leaf crea un elemento con texto
+func leaf(name, text string) *node {
+	return &node{name: name, text: text}
+}
+
+// withAttr agrega un atributo y devuelve el mismo nodo
+func (n *node) withAttr(name, value string) *node {
+	n.attrs = append(n.attrs, attr{name, value})
+	return n
+}
+
+// add agrega hijos, ignorando los nil para armar bloques opcionales
+func (n *node) add(children ...*node) *node {
+	for _, c := range children {
+		if c != nil {
+			n.children = append(n.children, c)
+		}
+	}
+	return n
+}
+
+// find busca el primer descendiente con el nombre indicado
+func (n *node) find(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+		if found := c.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// canonical serializa el nodo en forma canónica. inherited son las declaraciones de
+// espacios de nombres de los ancestros, que C14N copia al serializar un subárbol.
+func (n *node) canonical(inherited []attr) []byte {
+	var b bytes.Buffer
+	n.write(&b, inherited)
+	return b.Bytes()
+}
+
+func (n *node) write(b *bytes.Buffer, inherited []attr) {
+	ns := mergeNamespaces(inherited, n.nsDecls)
+	sort.Slice(ns, func(i, j int) bool { return ns[i].name < ns[j].name })
+	attrs := append([]attr(nil), n.attrs...)
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].name < attrs[j].name })
+
+	b.WriteByte('<')
+	b.WriteString(n.name)
+	for _, a := range ns {
+		b.WriteByte(' ')
+		b.WriteString(a.name)
+		b.WriteString(`="`)
+		b.WriteString(escapeAttr(a.value))
+		b.WriteByte('"')
+	}
+	for _, a := range attrs {
+		b.WriteByte(' ')
+		b.WriteString(a.name)
+		b.WriteString(`="`)
+		b.WriteString(escapeAttr(a.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+	b.WriteString(escapeText(n.text))
+	for _, c := range n.children {
+		c.write(b, nil)
+	}
+	b.WriteString("</")
+	b.WriteString(n.name)
+	b.WriteByte('>')
+}
+
+// mergeNamespaces combina declaraciones heredadas y propias; las propias ganan
+func mergeNamespaces(inherited, own []attr) []attr {
+	out := make([]attr, 0, len(inherited)+len(own))
+	seen := make(map[string]bool)
+	for _, a := range own {
+		seen[a.name] = true
+		out = append(out, a)
+	}
+	for _, a := range inherited {
+		if !seen[a.name] {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;",
+	"\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func escapeText(s string) string { return textEscaper.Replace(s) }
+
+func escapeAttr(s string) string { return attrEscaper.Replace(s) }
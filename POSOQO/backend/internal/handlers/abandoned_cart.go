@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+const (
+	// abandonedCartCooldown es el tiempo mínimo entre dos recordatorios al mismo usuario
+	abandonedCartCooldown = 7 * 24 * time.Hour
+	// abandonedCartMaxAge evita recordar carritos demasiado antiguos
+	abandonedCartMaxAge = 7 * 24 * time.Hour
+	// abandonedCartAttribution es la ventana en que un pedido cuenta como recuperado
+	abandonedCartAttribution = 7 * 24 * time.Hour
+	// abandonedCartCouponTTL es la vigencia del cupón incluido en el recordatorio
+	abandonedCartCouponTTL = 7 * 24 * time.Hour
+	// abandonedCartBatch es el máximo de recordatorios por ejecución del job
+	abandonedCartBatch = 50
+)
+
+// abandonedCartConfig son los parámetros configurables del job de recordatorios
+type abandonedCartConfig struct {
+	After         time.Duration // horas sin cambios para considerar abandonado el carrito
+	CouponPercent float64       // descuento del cupón de un solo uso (0 = sin cupón)
+}
+
+// loadAbandonedCartConfig lee ABANDONED_CART_HOURS (24 por defecto) y ABANDONED_CART_COUPON_PERCENT
+func loadAbandonedCartConfig() abandonedCartConfig {
+	cfg := abandonedCartConfig{After: 24 * time.Hour}
+	if hours, err := strconv.Atoi(utils.GetEnvWithDefault("ABANDONED_CART_HOURS", "24")); err == nil && hours > 0 {
+		cfg.After = time.Duration(hours) * time.Hour
+	}
+	if percent, err := strconv.ParseFloat(utils.GetEnvWithDefault("ABANDONED_CART_COUPON_PERCENT", "0"), 64); err == nil && percent > 0 && percent <= 100 {
+		cfg.CouponPercent = percent
+	}
+	return cfg
+}
+
+// abandonedCart es un carrito candidato a recibir recordatorio
+type abandonedCart struct {
+	CartID    string
+	UpdatedAt time.Time
+	UserID    int64
+	Email     string
+	Name      string
+}
+
+// SendAbandonedCartReminders busca carritos sin cambios desde hace cfg.After horas, sin un
+// pedido posterior, de usuarios que aceptaron emails de marketing, y les envía un recordatorio.
+// Cada envío se registra para no repetirlo por el mismo carrito ni antes de abandonedCartCooldown.
+func SendAbandonedCartReminders() {
+	ctx := context.Background()
+	cfg := loadAbandonedCartConfig()
+	now := time.Now()
+
+	rows, err := db.DB.Query(ctx, `
+		SELECT c.id, c.updated_at, u.id, u.email, u.name
+		FROM carts c
+		JOIN users u ON u.id = c.user_id
+		WHERE c.updated_at < $1 AND c.updated_at > $2
+		  AND u.marketing_opt_in AND COALESCE(u.email_verified, false) AND COALESCE(u.is_active, true)
+		  AND EXISTS (SELECT 1 FROM cart_items ci WHERE ci.cart_id = c.id)
+		  AND NOT EXISTS (SELECT 1 FROM orders o WHERE o.user_id = u.id AND o.created_at >= c.updated_at)
+		  AND NOT EXISTS (
+		      SELECT 1 FROM abandoned_cart_emails e
+		      WHERE e.user_id = u.id AND (e.cart_updated_at = c.updated_at OR e.sent_at > $3)
+		  )
+		ORDER BY c.updated_at
+		LIMIT $4
+	`, now.Add(-cfg.After), now.Add(-abandonedCartMaxAge), now.Add(-abandonedCartCooldown), abandonedCartBatch)
+	if err != nil {
+		log.Printf("[ABANDONED_CART] Error buscando carritos abandonados: %v", err)
+		return
+	}
+	carts := []abandonedCart{}
+	for rows.Next() {
+		var cart abandonedCart
+		if err := rows.Scan(&cart.CartID, &cart.UpdatedAt, &cart.UserID, &cart.Email, &cart.Name); err != nil {
+			log.Printf("[ABANDONED_CART] Error leyendo carrito: %v", err)
+			continue
+		}
+		carts = append(carts, cart)
+	}
+	rows.Close()
+
+	sent := 0
+	for _, cart := range carts {
+		ok, err := sendAbandonedCartReminder(ctx, cart, cfg)
+		if err != nil {
+			log.Printf("[ABANDONED_CART] Error enviando recordatorio del carrito %s: %v", cart.CartID, err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Printf("[ABANDONED_CART] %d recordatorios enviados", sent)
+	}
+}
+
+// sendAbandonedCartReminder cotiza el carrito, crea el cupón opcional, registra el envío y
+// manda el email una vez confirmado el registro. Si el envío falla se borran el registro y el
+// cupón para reintentar en la próxima ejecución.
+// Devuelve false si el carrito ya no tiene productos disponibles.
+func sendAbandonedCartReminder(ctx context.Context, cart abandonedCart, cfg abandonedCartConfig) (bool, error) {
+	stored, err := loadStoredCartItems(ctx, db.DB, cart.CartID)
+	if err != nil {
+		return false, err
+	}
+	items, _ := reviewCartItems(stored)
+	if len(items) == 0 {
+		return false, nil
+	}
+	quote, _, err := quoteCart(ctx, db.DB, items)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var couponID *string
+	var couponCode string
+	if cfg.CouponPercent > 0 {
+		id, code, err := createRecoveryCoupon(ctx, tx, cart.UserID, cfg.CouponPercent)
+		if err != nil {
+			return false, err
+		}
+		couponID, couponCode = &id, code
+	}
+
+	var reminderID string
+	err = tx.QueryRow(ctx,
+		`INSERT INTO abandoned_cart_emails (cart_id, user_id, email, cart_updated_at, cart_total, coupon_id)
+		 VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		cart.CartID, cart.UserID, cart.Email, cart.UpdatedAt, quote.Totals.Total, couponID).Scan(&reminderID)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+
+	if err := sendAbandonedCartEmail(cart, quote, couponCode, cfg.CouponPercent); err != nil {
+		if discardErr := discardAbandonedCartReminder(ctx, db.DB, reminderID, couponID); discardErr != nil {
+			log.Printf("[ABANDONED_CART] Error descartando el recordatorio %s: %v", reminderID, discardErr)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// discardAbandonedCartReminder borra un recordatorio que no se llegó a enviar y su cupón,
+// que nadie recibió
+func discardAbandonedCartReminder(ctx context.Context, q dbQuerier, reminderID string, couponID *string) error {
+	if _, err := q.Exec(ctx, "DELETE FROM abandoned_cart_emails WHERE id=$1", reminderID); err != nil {
+		return err
+	}
+	if couponID == nil {
+		return nil
+	}
+	_, err := q.Exec(ctx, "DELETE FROM coupons WHERE id=$1", *couponID)
+	return err
+}
+
+// createRecoveryCoupon crea un cupón porcentual de un solo uso que solo puede canjear el
+// destinatario del recordatorio
+func createRecoveryCoupon(ctx context.Context, tx pgx.Tx, userID int64, percent float64) (string, string, error) {
+	token, err := generateVerificationToken()
+	if err != nil {
+		return "", "", err
+	}
+	code := "VUELVE-" + strings.ToUpper(token[:8])
+	var id string
+	err = tx.QueryRow(ctx,
+		`INSERT INTO coupons (code, value, type, expiration, max_redemptions, max_per_user, user_id)
+		 VALUES ($1, $2, 'percent', $3, 1, 1, $4) RETURNING id`,
+		code, percent, time.Now().In(businessLocation()).Add(abandonedCartCouponTTL).Format("2006-01-02"), userID).Scan(&id)
+	return id, code, err
+}
+
+// recordCartRecovery atribuye el pedido al último recordatorio no convertido del usuario
+// enviado dentro de abandonedCartAttribution
+func recordCartRecovery(ctx context.Context, tx pgx.Tx, userID int64, orderID string) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE abandoned_cart_emails SET recovered_order_id=$1, recovered_at=NOW()
+		WHERE id = (
+		    SELECT id FROM abandoned_cart_emails
+		    WHERE user_id=$2 AND recovered_order_id IS NULL AND sent_at > $3
+		    ORDER BY sent_at DESC LIMIT 1
+		)
+	`, orderID, userID, time.Now().Add(-abandonedCartAttribution))
+	return err
+}
+
+// marketingUnsubscribeURL es el enlace de baja de emails de marketing incluido en cada recordatorio
+func marketingUnsubscribeURL(userID int64) string {
+	id := strconv.FormatInt(userID, 10)
+	return fmt.Sprintf("%s/api/marketing/unsubscribe?u=%s&sig=%s", backendBaseURL(), id, signValue("unsubscribe", id))
+}
+
+// backendBaseURL es la URL pública de la API para enlaces que atiende el backend
+// (BACKEND_URL, o la URL que Render asigna al servicio)
+func backendBaseURL() string {
+	url := os.Getenv("BACKEND_URL")
+	if url == "" {
+		url = utils.GetEnvWithDefault("RENDER_EXTERNAL_URL", "http://localhost:4000")
+	}
+	return strings.TrimRight(url, "/")
+}
+
+const abandonedCartEmailTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Tu carrito te espera - POSOQO</title>
+</head>
+<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333; max-width: 600px; margin: 0 auto; padding: 20px; background-color: #f4f4f4;">
+    <div style="background-color: white; padding: 30px; border-radius: 10px; box-shadow: 0 2px 10px rgba(0,0,0,0.1);">
+        <div style="text-align: center; margin-bottom: 30px;">
+            <div style="font-size: 24px; font-weight: bold; color: #FFD700; margin-bottom: 10px;">POSOQO</div>
+            <div style="color: #333; font-size: 20px; margin-bottom: 20px;">Tu carrito te espera</div>
+        </div>
+
+        <p>Hola {{.Name}},</p>
+        <p>Dejaste estos productos en tu carrito:</p>
+
+        <table style="width: 100%; border-collapse: collapse; margin: 15px 0;">
+            {{range .Lines}}
+            <tr style="border-bottom: 1px solid #eee;">
+                <td style="padding: 8px 0;">{{.Quantity}} x {{.Name}}</td>
+                <td style="padding: 8px 0; text-align: right;">S/ {{printf "%.2f" .Total}}</td>
+            </tr>
+            {{end}}
+            <tr>
+                <td style="padding: 8px 0;"><strong>Total</strong></td>
+                <td style="padding: 8px 0; text-align: right;"><strong>S/ {{printf "%.2f" .Total}}</strong></td>
+            </tr>
+        </table>
+
+        {{if .CouponCode}}
+        <div style="background-color: #fff8dc; border: 1px dashed #D4AF37; border-radius: 8px; padding: 15px; text-align: center; margin: 20px 0;">
+            <p style="margin: 0;">Usa el cupón <strong>{{.CouponCode}}</strong> y obtén {{printf "%.0f" .CouponPercent}}% de descuento.<br>Válido por un solo uso hasta el {{.CouponExpiration}}.</p>
+        </div>
+        {{end}}
+
+        <div style="text-align: center; margin: 30px 0;">
+            <a href="{{.CartURL}}" style="display: inline-block; background: linear-gradient(135deg, #FFD700, #D4AF37); color: #000; padding: 12px 30px; text-decoration: none; border-radius: 25px; font-weight: bold;">Completar mi pedido</a>
+        </div>
+
+        <div style="text-align: center; margin-top: 30px; padding-top: 20px; border-top: 1px solid #eee; color: #666; font-size: 12px;">
+            <p>Recibes este email porque aceptaste recibir novedades de POSOQO. <a href="{{.UnsubscribeURL}}" style="color: #666;">Dejar de recibirlas</a>.</p>
+        </div>
+    </div>
+</body>
+</html>
+`
+
+// sendAbandonedCartEmail envía el recordatorio con el carrito cotizado y el cupón opcional
+func sendAbandonedCartEmail(cart abandonedCart, quote *CartQuote, couponCode string, couponPercent float64) error {
+	tmpl, err := template.New("abandonedCart").Parse(abandonedCartEmailTemplate)
+	if err != nil {
+		return err
+	}
+	var body strings.Builder
+	err = tmpl.Execute(&body, struct {
+		Name             string
+		Lines            []CartQuoteLine
+		Total            float64
+		CouponCode       string
+		CouponPercent    float64
+		CouponExpiration string
+		CartURL          string
+		UnsubscribeURL   string
+	}{
+		Name:             cart.Name,
+		Lines:            quote.Lines,
+		Total:            quote.Totals.Total,
+		CouponCode:       couponCode,
+		CouponPercent:    couponPercent,
+		CouponExpiration: time.Now().In(businessLocation()).Add(abandonedCartCouponTTL).Format("02/01/2006"),
+		CartURL:          frontendBaseURL() + "/carrito",
+		UnsubscribeURL:   marketingUnsubscribeURL(cart.UserID),
+	})
+	if err != nil {
+		return err
+	}
+	return sendHTMLEmail(cart.Email, "Tu carrito te espera - POSOQO", body.String())
+}
+
+// MarketingConsentRequest cambia el consentimiento de emails de marketing
+type MarketingConsentRequest struct {
+	OptIn bool `json:"opt_in"`
+}
+
+// PUT /api/protected/marketing-consent
+// Activa o desactiva los emails de marketing (recordatorios de carrito, ofertas)
+func UpdateMarketingConsent(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req MarketingConsentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	_, err := db.DB.Exec(context.Background(),
+		`UPDATE users SET marketing_opt_in=$1,
+		        marketing_opt_in_at = CASE WHEN $1 THEN COALESCE(marketing_opt_in_at, NOW()) END
+		 WHERE id=$2`, req.OptIn, userID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al guardar preferencia"})
+	}
+	return c.JSON(fiber.Map{"success": true, "marketing_opt_in": req.OptIn})
+}
+
+// GET /api/marketing/unsubscribe?u=<user_id>&sig=<firma>
+// Baja de un clic desde el enlace del email; la firma evita dar de baja a otros usuarios
+func UnsubscribeMarketing(c *fiber.Ctx) error {
+	userID := c.Query("u")
+	if _, err := strconv.ParseInt(userID, 10, 64); err != nil ||
+		!hmac.Equal([]byte(c.Query("sig")), []byte(signValue("unsubscribe", userID))) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Enlace inválido"})
+	}
+	_, err := db.DB.Exec(context.Background(),
+		"UPDATE users SET marketing_opt_in=false, marketing_opt_in_at=NULL WHERE id=$1", userID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al procesar la baja"})
+	}
+	c.Type("html", "utf-8")
+	return c.SendString(`<!DOCTYPE html><html><head><meta charset="UTF-8"><title>POSOQO</title></head>` +
+		`<body style="font-family: Arial, sans-serif; text-align: center; padding: 40px;">` +
+		`<h2>Listo</h2><p>Ya no recibirás emails de marketing de POSOQO.</p></body></html>`)
+}
+
+// GET /api/admin/abandoned-carts/stats?days=30
+// Recordatorios enviados, pedidos recuperados, tasa de conversión e ingresos recuperados
+func GetAbandonedCartStats(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 30)
+	if days < 1 || days > 365 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Rango de días inválido (1-365)"})
+	}
+	since := time.Now().AddDate(0, 0, -days)
+	ctx := context.Background()
+
+	var sent, recovered, couponsRedeemed int
+	var cartValue, recoveredRevenue float64
+	err := db.DB.QueryRow(ctx, `
+		SELECT COUNT(*),
+		       COUNT(o.id),
+		       COUNT(r.id),
+		       COALESCE(SUM(e.cart_total), 0),
+		       COALESCE(SUM(o.total), 0)
+		FROM abandoned_cart_emails e
+		LEFT JOIN orders o ON o.id = e.recovered_order_id AND o.status <> 'cancelado'
+		LEFT JOIN coupon_redemptions r ON r.coupon_id = e.coupon_id AND r.reversed_at IS NULL
+		WHERE e.sent_at >= $1
+	`, since).Scan(&sent, &recovered, &couponsRedeemed, &cartValue, &recoveredRevenue)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener estadísticas"})
+	}
+
+	rows, err := db.DB.Query(ctx, `
+		SELECT e.sent_at::date, COUNT(*), COUNT(o.id), COALESCE(SUM(o.total), 0)
+		FROM abandoned_cart_emails e
+		LEFT JOIN orders o ON o.id = e.recovered_order_id AND o.status <> 'cancelado'
+		WHERE e.sent_at >= $1
+		GROUP BY e.sent_at::date
+		ORDER BY e.sent_at::date
+	`, since)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener estadísticas"})
+	}
+	defer rows.Close()
+
+	daily := []fiber.Map{}
+	for rows.Next() {
+		var date time.Time
+		var daySent, dayRecovered int
+		var dayRevenue float64
+		if err := rows.Scan(&date, &daySent, &dayRecovered, &dayRevenue); err != nil {
+			continue
+		}
+		daily = append(daily, fiber.Map{
+			"date": date.Format("2006-01-02"), "sent": daySent, "recovered": dayRecovered, "revenue": roundMoney(dayRevenue),
+		})
+	}
+
+	conversionRate := 0.0
+	if sent > 0 {
+		conversionRate = roundMoney(float64(recovered) / float64(sent) * 100)
+	}
+	return c.JSON(fiber.Map{
+		"days":              days,
+		"sent":              sent,
+		"recovered":         recovered,
+		"conversion_rate":   conversionRate,
+		"coupons_redeemed":  couponsRedeemed,
+		"cart_value":        roundMoney(cartValue),
+		"recovered_revenue": roundMoney(recoveredRevenue),
+		"daily":             daily,
+	})
+}
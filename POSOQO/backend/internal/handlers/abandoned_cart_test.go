@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadAbandonedCartConfig valida los valores por defecto y los rangos de la configuración del job
+func TestLoadAbandonedCartConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		hours         string
+		percent       string
+		after         time.Duration
+		couponPercent float64
+	}{
+		{"Por defecto", "", "", 24 * time.Hour, 0},
+		{"Configurado", "6", "10", 6 * time.Hour, 10},
+		{"Horas inválidas", "0", "", 24 * time.Hour, 0},
+		{"Porcentaje fuera de rango", "", "150", 24 * time.Hour, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ABANDONED_CART_HOURS", tt.hours)
+			t.Setenv("ABANDONED_CART_COUPON_PERCENT", tt.percent)
+			cfg := loadAbandonedCartConfig()
+			assert.Equal(t, tt.after, cfg.After)
+			assert.Equal(t, tt.couponPercent, cfg.CouponPercent)
+		})
+	}
+}
+
+// TestDiscardAbandonedCartReminder valida que un email no enviado libere el carrito para el
+// próximo intento y no deje un cupón vigente sin destinatario
+func TestDiscardAbandonedCartReminder(t *testing.T) {
+	coupon := "c1"
+	tx := newScriptedTx()
+	assert.NoError(t, discardAbandonedCartReminder(context.Background(), tx, "r1", &coupon))
+	if reminders := tx.executed("DELETE FROM abandoned_cart_emails"); assert.Len(t, reminders, 1) {
+		assert.Equal(t, []interface{}{"r1"}, reminders[0].args)
+	}
+	if coupons := tx.executed("DELETE FROM coupons"); assert.Len(t, coupons, 1) {
+		assert.Equal(t, []interface{}{"c1"}, coupons[0].args)
+	}
+
+	// Sin cupón solo se borra el registro del envío
+	tx = newScriptedTx()
+	assert.NoError(t, discardAbandonedCartReminder(context.Background(), tx, "r2", nil))
+	assert.Len(t, tx.execs, 1)
+}
@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// minimumPurchaseAge es la edad mínima para comprar bebidas alcohólicas
+const minimumPurchaseAge = 18
+
+// Métodos de verificación de edad de una cuenta
+const (
+	ageMethodBirthDate = "birth_date" // fecha de nacimiento declarada
+	ageMethodDNI       = "dni"        // fecha declarada y DNI cruzado con el padrón
+)
+
+// birthDateLayout es el formato de la fecha de nacimiento (AAAA-MM-DD)
+const birthDateLayout = "2006-01-02"
+
+// AgeVerificationRequest datos para verificar la mayoría de edad de la cuenta
+type AgeVerificationRequest struct {
+	BirthDate string `json:"birth_date"`
+	// DNI es opcional salvo que AGE_VERIFICATION_REQUIRE_DNI esté activo; se cruza con el padrón
+	DNI string `json:"dni,omitempty"`
+}
+
+// AgeVerificationError indica que el pedido contiene alcohol y el comprador no verificó su edad
+type AgeVerificationError struct {
+	Code    string // AGE_VERIFICATION_REQUIRED o UNDERAGE
+	Message string
+}
+
+func (e *AgeVerificationError) Error() string {
+	return e.Message
+}
+
+// ErrDNIMismatch indica que el DNI existe pero no corresponde al nombre del comprador
+var ErrDNIMismatch = errors.New("el DNI no corresponde al nombre registrado")
+
+// ageRestrictedSQL indica si alguno de los productos pertenece a una categoría (o
+// subcategoría de una categoría) que requiere mayoría de edad
+const ageRestrictedSQL = `SELECT EXISTS (
+	SELECT 1
+	  FROM products p
+	  JOIN categories cat ON cat.id = p.category_id
+	  LEFT JOIN categories parent ON parent.id = cat.parent_id
+	 WHERE p.id = ANY($1::uuid[])
+	   AND (cat.requires_age_verification OR COALESCE(parent.requires_age_verification, FALSE)))`
+
+// requireDNICrossCheck indica si la verificación de edad exige cruzar el DNI con el padrón
+func requireDNICrossCheck() bool {
+	return utils.GetEnvWithDefault("AGE_VERIFICATION_REQUIRE_DNI", "false") == "true"
+}
+
+// ageOn devuelve los años cumplidos a la fecha now
+func ageOn(birth, now time.Time) int {
+	years := now.Year() - birth.Year()
+	if now.Month() < birth.Month() || (now.Month() == birth.Month() && now.Day() < birth.Day()) {
+		years--
+	}
+	return years
+}
+
+// parseBirthDate interpreta la fecha de nacimiento y devuelve el mensaje de error si no es válida
+func parseBirthDate(value string, now time.Time) (time.Time, string) {
+	birth, err := time.Parse(birthDateLayout, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, "Fecha de nacimiento inválida (AAAA-MM-DD)"
+	}
+	if birth.Year() < 1900 || ageOn(birth, now) < 0 {
+		return time.Time{}, "Fecha de nacimiento inválida"
+	}
+	return birth, ""
+}
+
+// ageVerificationError decide si el comprador puede llevar alcohol. method es el método
+// con que se verificó la edad (vacío si no se verificó).
+func ageVerificationError(birth *time.Time, method string, requireDNI bool, now time.Time) error {
+	if birth == nil || method == "" {
+		return &AgeVerificationError{
+			Code:    "AGE_VERIFICATION_REQUIRED",
+			Message: "Verifica tu edad para comprar bebidas alcohólicas",
+		}
+	}
+	if ageOn(*birth, now) < minimumPurchaseAge {
+		return &AgeVerificationError{
+			Code:    "UNDERAGE",
+			Message: "Debes ser mayor de 18 años para comprar bebidas alcohólicas",
+		}
+	}
+	if requireDNI && method != ageMethodDNI {
+		return &AgeVerificationError{
+			Code:    "AGE_VERIFICATION_REQUIRED",
+			Message: "Verifica tu DNI para comprar bebidas alcohólicas",
+		}
+	}
+	return nil
+}
+
+// birthDateChangeError decide si el usuario puede declarar birth cuando ya tiene stored
+// registrada y devuelve el mensaje de error si no. Una fecha ya guardada solo se cambia
+// cruzando el DNI (o la borra un admin): así un menor rechazado no puede reintentar con
+// otra fecha.
+func birthDateChangeError(stored *time.Time, birth time.Time, withDNI bool) string {
+	if stored == nil || withDNI || stored.Equal(birth) {
+		return ""
+	}
+	return "Tu fecha de nacimiento ya está registrada; para corregirla verifica tu DNI"
+}
+
+// normalizeNameWords pasa un nombre a mayúsculas sin tildes y lo separa en palabras
+func normalizeNameWords(name string) []string {
+	replacer := strings.NewReplacer("Á", "A", "É", "E", "Í", "I", "Ó", "O", "Ú", "U", "Ü", "U", "Ñ", "N")
+	return strings.Fields(replacer.Replace(strings.ToUpper(name)))
+}
+
+// dniNameMatches indica si el nombre del comprador corresponde a los datos del DNI:
+// deben coincidir el apellido paterno completo y al menos uno de los nombres
+func dniNameMatches(data *DNIDataResponse, fullName string) bool {
+	words := map[string]bool{}
+	for _, w := range normalizeNameWords(fullName) {
+		words[w] = true
+	}
+	paterno := normalizeNameWords(data.ApellidoPaterno)
+	if len(paterno) == 0 {
+		return false
+	}
+	for _, w := range paterno {
+		if !words[w] {
+			return false
+		}
+	}
+	for _, w := range normalizeNameWords(data.Nombres) {
+		if words[w] {
+			return true
+		}
+	}
+	return false
+}
+
+// crossCheckDNI consulta el DNI en el padrón y verifica que corresponda al comprador
+func crossCheckDNI(ctx context.Context, dni, fullName string) error {
+	data, err := dniProvider.LookupDNI(ctx, dni)
+	if err != nil {
+		return err
+	}
+	if !dniNameMatches(data, fullName) {
+		return ErrDNIMismatch
+	}
+	return nil
+}
+
+// respondDNICheckError traduce los errores del cruce de DNI a la respuesta HTTP
+func respondDNICheckError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrDNIMismatch):
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "El DNI no corresponde a tu nombre",
+			"code":  "DNI_MISMATCH",
+		})
+	case errors.Is(err, ErrDNINotFound):
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "DNI no encontrado en los registros",
+			"code":  "DNI_NOT_FOUND",
+		})
+	case errors.Is(err, ErrLookupRateLimited):
+		return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Límite de consultas excedido. Por favor intenta más tarde.",
+		})
+	}
+	log.Printf("[AGE] Error consultando DNI: %v", err)
+	return c.Status(http.StatusBadGateway).JSON(fiber.Map{
+		"error": "No se pudo verificar el DNI. Por favor intenta más tarde.",
+		"code":  "DNI_CHECK_FAILED",
+	})
+}
+
+// linesRequireAgeVerification indica si alguna línea (o componente de un pack) es alcohol
+func linesRequireAgeVerification(ctx context.Context, q dbQuerier, lines []pricedLine) (bool, error) {
+	var ids []string
+	for _, line := range lines {
+		ids = append(ids, line.ProductID)
+		for _, s := range line.Components {
+			ids = append(ids, s.ProductID)
+		}
+	}
+	if len(ids) == 0 {
+		return false, nil
+	}
+	var restricted bool
+	err := q.QueryRow(ctx, ageRestrictedSQL, ids).Scan(&restricted)
+	return restricted, err
+}
+
+// checkAgeVerification bloquea el pedido si contiene alcohol y el comprador no verificó
+// su edad. Devuelve true si el documento se debe verificar en la entrega.
+func checkAgeVerification(ctx context.Context, q dbQuerier, in checkoutInput, lines []pricedLine) (bool, error) {
+	restricted, err := linesRequireAgeVerification(ctx, q, lines)
+	if err != nil || !restricted {
+		return false, err
+	}
+
+	now := time.Now().In(businessLocation())
+	if in.Guest != nil {
+		method := ""
+		if in.Guest.BirthDate != nil {
+			method = ageMethodBirthDate
+		}
+		if in.Guest.DNIVerified {
+			method = ageMethodDNI
+		}
+		return true, ageVerificationError(in.Guest.BirthDate, method, requireDNICrossCheck(), now)
+	}
+
+	var birth *time.Time
+	var method string
+	err = q.QueryRow(ctx,
+		"SELECT birth_date, COALESCE(age_verification_method, '') FROM users WHERE id=$1 AND age_verified_at IS NOT NULL",
+		in.UserID).Scan(&birth, &method)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return true, err
+	}
+	return true, ageVerificationError(birth, method, requireDNICrossCheck(), now)
+}
+
+// markOrderIDVerified registra que se verificó el documento de quien recibe el pedido
+func markOrderIDVerified(ctx context.Context, tx pgx.Tx, orderID string, actor orderActor) error {
+	_, err := tx.Exec(ctx,
+		"UPDATE orders SET id_verified_at=NOW(), id_verified_by=$1 WHERE id=$2 AND verify_id_on_delivery AND id_verified_at IS NULL",
+		actor.UserID, orderID)
+	return err
+}
+
+// GET /api/protected/age-verification
+// Estado de la verificación de edad del usuario autenticado
+func GetAgeVerification(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var birth, verifiedAt *time.Time
+	var method string
+	err := db.DB.QueryRow(context.Background(),
+		"SELECT birth_date, age_verified_at, COALESCE(age_verification_method, '') FROM users WHERE id=$1",
+		userID).Scan(&birth, &verifiedAt, &method)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	if verifiedAt == nil {
+		method = ""
+	}
+
+	var birthDate string
+	if birth != nil {
+		birthDate = birth.Format(birthDateLayout)
+	}
+	check := ageVerificationError(birth, method, requireDNICrossCheck(), time.Now().In(businessLocation()))
+	return c.JSON(fiber.Map{
+		"birth_date":   birthDate,
+		"verified":     check == nil,
+		"method":       method,
+		"verified_at":  verifiedAt,
+		"dni_required": requireDNICrossCheck(),
+	})
+}
+
+// POST /api/protected/age-verification
+// Guarda la fecha de nacimiento del usuario y, si envía su DNI (o es obligatorio), lo
+// cruza con el padrón antes de marcar la cuenta como verificada
+func VerifyAge(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req AgeVerificationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	now := time.Now().In(businessLocation())
+	birth, msg := parseBirthDate(req.BirthDate, now)
+	if msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	req.DNI = strings.TrimSpace(req.DNI)
+	if req.DNI != "" && !utils.IsValidDNI(req.DNI) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "El DNI debe contener exactamente 8 dígitos numéricos"})
+	}
+
+	ctx := context.Background()
+	var name, lastName, storedDNI string
+	var storedBirth *time.Time
+	err := db.DB.QueryRow(ctx,
+		"SELECT name, COALESCE(last_name, ''), COALESCE(dni, ''), birth_date FROM users WHERE id=$1", userID).
+		Scan(&name, &lastName, &storedDNI, &storedBirth)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	if msg := birthDateChangeError(storedBirth, birth, req.DNI != ""); msg != "" {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": msg, "code": "BIRTH_DATE_LOCKED"})
+	}
+
+	// Menor de edad: se guarda la fecha pero la cuenta queda sin verificar
+	if ageOn(birth, now) < minimumPurchaseAge {
+		_, err = db.DB.Exec(ctx,
+			"UPDATE users SET birth_date=$1, age_verified_at=NULL, age_verification_method=NULL WHERE id=$2",
+			birth, userID)
+		if err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar la verificación"})
+		}
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{
+			"error": "Debes ser mayor de 18 años para comprar bebidas alcohólicas",
+			"code":  "UNDERAGE",
+		})
+	}
+
+	if req.DNI == "" && requireDNICrossCheck() {
+		if !utils.IsValidDNI(storedDNI) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Ingresa tu DNI para verificar tu edad",
+				"code":  "DNI_REQUIRED",
+			})
+		}
+		req.DNI = storedDNI
+	}
+
+	method := ageMethodBirthDate
+	if req.DNI != "" {
+		if err := crossCheckDNI(ctx, req.DNI, name+" "+lastName); err != nil {
+			return respondDNICheckError(c, err)
+		}
+		method = ageMethodDNI
+	}
+
+	_, err = db.DB.Exec(ctx,
+		`UPDATE users SET birth_date=$1, age_verified_at=NOW(), age_verification_method=$2,
+		        dni=CASE WHEN $3 <> '' THEN $3 ELSE dni END
+		 WHERE id=$4`,
+		birth, method, req.DNI, userID)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.Status(http.StatusConflict).JSON(fiber.Map{
+				"error": "El DNI ya está registrado en otra cuenta",
+				"code":  "DNI_IN_USE",
+			})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar la verificación"})
+	}
+
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"message":    "Edad verificada",
+		"birth_date": birth.Format(birthDateLayout),
+		"method":     method,
+	})
+}
+
+// DELETE /api/admin/users/:id/age-verification
+// Borra la fecha de nacimiento y la verificación de edad de un usuario (p. ej. si la
+// declaró mal) para que vuelva a verificarse; queda en audit_logs
+func ResetAgeVerification(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	adminID := int64(claims["id"].(float64))
+
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	var previous *time.Time
+	err = tx.QueryRow(ctx,
+		`UPDATE users u SET birth_date=NULL, age_verified_at=NULL, age_verification_method=NULL
+		 FROM (SELECT id, birth_date FROM users WHERE id=$1 FOR UPDATE) old
+		 WHERE u.id = old.id RETURNING old.birth_date`, userID).Scan(&previous)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	if err == nil {
+		var previousDate string
+		if previous != nil {
+			previousDate = previous.Format(birthDateLayout)
+		}
+		err = recordAdminAudit(ctx, tx, c, adminID, "AGE_VERIFICATION_RESET", "user", userID, fiber.Map{
+			"previous_birth_date": previousDate,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo reiniciar la verificación"})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
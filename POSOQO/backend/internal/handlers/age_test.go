@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAgeVerification valida la edad mínima para comprar alcohol
+func TestAgeVerification(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	adult := time.Date(2008, 10, 17, 0, 0, 0, 0, time.UTC)
+	minor := time.Date(2008, 10, 18, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 18, ageOn(adult, now))
+	assert.Equal(t, 17, ageOn(minor, now))
+
+	assert.NoError(t, ageVerificationError(&adult, ageMethodBirthDate, false, now))
+	assert.NoError(t, ageVerificationError(&adult, ageMethodDNI, true, now))
+
+	code := func(err error) string {
+		var ageErr *AgeVerificationError
+		if errors.As(err, &ageErr) {
+			return ageErr.Code
+		}
+		return ""
+	}
+	assert.Equal(t, "UNDERAGE", code(ageVerificationError(&minor, ageMethodDNI, false, now)))
+	assert.Equal(t, "AGE_VERIFICATION_REQUIRED", code(ageVerificationError(nil, "", false, now)))
+	assert.Equal(t, "AGE_VERIFICATION_REQUIRED", code(ageVerificationError(&adult, "", false, now)))
+	assert.Equal(t, "AGE_VERIFICATION_REQUIRED", code(ageVerificationError(&adult, ageMethodBirthDate, true, now)))
+
+	_, msg := parseBirthDate("2027-01-01", now)
+	assert.Equal(t, "Fecha de nacimiento inválida", msg)
+	_, msg = parseBirthDate("17/10/2008", now)
+	assert.Equal(t, "Fecha de nacimiento inválida (AAAA-MM-DD)", msg)
+	birth, msg := parseBirthDate(" 2008-10-17 ", now)
+	assert.Empty(t, msg)
+	assert.Equal(t, adult, birth)
+}
+
+// TestDNINameMatches valida el cruce del nombre del comprador con los datos del DNI
+func TestDNINameMatches(t *testing.T) {
+	data := &DNIDataResponse{Nombres: "MARÍA JOSÉ", ApellidoPaterno: "DE LA CRUZ", ApellidoMaterno: "QUISPE"}
+
+	assert.True(t, dniNameMatches(data, "María de la Cruz Quispe"))
+	assert.True(t, dniNameMatches(data, "Jose De La Cruz"))
+	assert.False(t, dniNameMatches(data, "María Cruz"))
+	assert.False(t, dniNameMatches(data, "Rosa de la Cruz"))
+	assert.False(t, dniNameMatches(&DNIDataResponse{Nombres: "MARIA"}, "Maria"))
+}
+
+// TestBirthDateChange valida que un menor rechazado no pueda reintentar con otra fecha
+func TestBirthDateChange(t *testing.T) {
+	minor := time.Date(2010, 5, 1, 0, 0, 0, 0, time.UTC)
+	adult := time.Date(1990, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	// Primera declaración: se acepta cualquier fecha
+	assert.Empty(t, birthDateChangeError(nil, minor, false))
+	// Menor que reintenta con una fecha de adulto sin DNI
+	assert.NotEmpty(t, birthDateChangeError(&minor, adult, false))
+	// Con el cruce de DNI sí se puede corregir
+	assert.Empty(t, birthDateChangeError(&minor, adult, true))
+	// Repetir la misma fecha no es un cambio
+	assert.Empty(t, birthDateChangeError(&adult, adult, false))
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// cartCookieName guarda el token firmado del carrito anónimo
+const cartCookieName = "posoqo_cart"
+
+// anonymousCartTTL es cuánto se conserva un carrito anónimo sin cambios
+const anonymousCartTTL = 30 * 24 * time.Hour
+
+// Reglas para combinar la cantidad de un producto que está en ambos carritos al iniciar sesión
+const (
+	cartMergeSum = "sum" // se suman las cantidades (por defecto)
+	cartMergeMax = "max" // se queda la cantidad mayor
+)
+
+// cartMergeStrategy lee la regla de combinación de CART_MERGE_STRATEGY
+func cartMergeStrategy() string {
+	if os.Getenv("CART_MERGE_STRATEGY") == cartMergeMax {
+		return cartMergeMax
+	}
+	return cartMergeSum
+}
+
+// mergeQuantity combina la cantidad del carrito del usuario con la del carrito anónimo
+func mergeQuantity(strategy string, current, incoming int) int {
+	quantity := current + incoming
+	if strategy == cartMergeMax {
+		quantity = max(current, incoming)
+	}
+	return min(quantity, 100)
+}
+
+// signValue firma un valor con el secreto del servidor; purpose separa los usos
+// para que una firma de un tipo de enlace no sirva para otro
+func signValue(purpose, value string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_ACCESS_SECRET")))
+	mac.Write([]byte(purpose + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// cartTokenSignature firma el ID del carrito para que el token no se pueda falsificar
+func cartTokenSignature(cartID string) string {
+	return signValue("cart", cartID)
+}
+
+// signCartToken arma el token "<cart_id>.<firma>" del carrito anónimo
+func signCartToken(cartID string) string {
+	return cartID + "." + cartTokenSignature(cartID)
+}
+
+// parseCartToken valida la firma del token y devuelve el ID del carrito
+func parseCartToken(token string) (string, bool) {
+	cartID, signature, ok := strings.Cut(token, ".")
+	if !ok || !utils.IsValidUUID(cartID) {
+		return "", false
+	}
+	return cartID, hmac.Equal([]byte(signature), []byte(cartTokenSignature(cartID)))
+}
+
+// setCartCookie guarda el token del carrito anónimo. En producción el frontend está en
+// otro dominio, por eso la cookie es SameSite=None y Secure.
+func setCartCookie(c *fiber.Ctx, token string, expires time.Time) {
+	cookie := &fiber.Cookie{
+		Name:     cartCookieName,
+		Value:    token,
+		Path:     "/api",
+		Expires:  expires,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	}
+	if utils.IsProduction() {
+		cookie.SameSite = fiber.CookieSameSiteNoneMode
+		cookie.Secure = true
+	}
+	c.Cookie(cookie)
+}
+
+// loadAnonymousCart devuelve el carrito anónimo del token (cookie o cabecera X-Cart-Token)
+// si la firma es válida y el carrito todavía existe
+func loadAnonymousCart(ctx context.Context, q dbQuerier, c *fiber.Ctx) (string, bool) {
+	token := c.Cookies(cartCookieName)
+	if token == "" {
+		token = c.Get("X-Cart-Token")
+	}
+	cartID, ok := parseCartToken(token)
+	if !ok {
+		return "", false
+	}
+	err := q.QueryRow(ctx, "SELECT id FROM carts WHERE id=$1 AND user_id IS NULL", cartID).Scan(&cartID)
+	return cartID, err == nil
+}
+
+// userCartID obtiene o crea el carrito del usuario
+func userCartID(ctx context.Context, q dbQuerier, userID int64) (string, error) {
+	var cartID string
+	err := q.QueryRow(ctx, `
+		INSERT INTO carts (user_id) VALUES ($1)
+		ON CONFLICT (user_id) DO UPDATE SET updated_at=NOW()
+		RETURNING id
+	`, userID).Scan(&cartID)
+	return cartID, err
+}
+
+// mergeAnonymousCart pasa los items del carrito anónimo al carrito del usuario que acaba
+// de iniciar sesión o registrarse. Un error no impide el login: solo se registra.
+func mergeAnonymousCart(c *fiber.Ctx, userID int64) {
+	ctx := context.Background()
+	anonCartID, ok := loadAnonymousCart(ctx, db.DB, c)
+	if !ok {
+		return
+	}
+	if err := mergeCarts(ctx, anonCartID, userID, cartMergeStrategy()); err != nil {
+		log.Printf("[CART] No se pudo combinar el carrito anónimo %s con el usuario %d: %v", anonCartID, userID, err)
+		return
+	}
+	setCartCookie(c, "", time.Unix(0, 0))
+}
+
+// mergeCarts combina el carrito anónimo con el del usuario y elimina el anónimo
+func mergeCarts(ctx context.Context, anonCartID string, userID int64, strategy string) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Bloquear el carrito anónimo para que dos logins simultáneos no lo combinen dos veces
+	var locked string
+	err = tx.QueryRow(ctx, "SELECT id FROM carts WHERE id=$1 AND user_id IS NULL FOR UPDATE", anonCartID).Scan(&locked)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cartID, err := userCartID(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	current := map[string]int{}
+	rows, err := tx.Query(ctx,
+		"SELECT product_id::text, COALESCE(variant_id::text, ''), components, quantity FROM cart_items WHERE cart_id=$1", cartID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var productID, variantID string
+		var components []BundleSelection
+		var quantity int
+		if err := rows.Scan(&productID, &variantID, &components, &quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		current[cartItemKey(productID, variantID, components)] = quantity
+	}
+	rows.Close()
+
+	type anonItem struct {
+		productID  string
+		variantID  string
+		components []BundleSelection
+		quantity   int
+		unitPrice  *float64
+	}
+	items := []anonItem{}
+	rows, err = tx.Query(ctx,
+		"SELECT product_id::text, COALESCE(variant_id::text, ''), components, quantity, unit_price FROM cart_items WHERE cart_id=$1", anonCartID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var item anonItem
+		if err := rows.Scan(&item.productID, &item.variantID, &item.components, &item.quantity, &item.unitPrice); err != nil {
+			rows.Close()
+			return err
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+
+	for _, item := range items {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO cart_items (cart_id, product_id, quantity, unit_price, variant_id, components)
+			VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid, $6::jsonb)
+			ON CONFLICT `+cartItemConflict+` DO UPDATE SET quantity = EXCLUDED.quantity
+		`, cartID, item.productID, mergeQuantity(strategy, current[cartItemKey(item.productID, item.variantID, item.components)], item.quantity),
+			item.unitPrice, item.variantID, selectionsJSON(item.components))
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM carts WHERE id=$1", anonCartID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// PurgeAnonymousCarts elimina los carritos anónimos sin cambios desde hace más de anonymousCartTTL
+func PurgeAnonymousCarts() {
+	_, err := db.DB.Exec(context.Background(),
+		"DELETE FROM carts WHERE user_id IS NULL AND updated_at < $1", time.Now().Add(-anonymousCartTTL))
+	if err != nil {
+		log.Printf("[CART] Error eliminando carritos anónimos vencidos: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMergeQuantity valida las reglas de combinación del carrito anónimo con el del usuario
+func TestMergeQuantity(t *testing.T) {
+	assert.Equal(t, 5, mergeQuantity(cartMergeSum, 2, 3))
+	assert.Equal(t, 3, mergeQuantity(cartMergeMax, 2, 3))
+	assert.Equal(t, 4, mergeQuantity(cartMergeSum, 0, 4), "producto que solo está en el carrito anónimo")
+	assert.Equal(t, 100, mergeQuantity(cartMergeSum, 80, 40), "no supera el máximo por producto")
+}
+
+// TestCartToken valida que solo se acepten tokens de carrito firmados por el servidor
+func TestCartToken(t *testing.T) {
+	t.Setenv("JWT_ACCESS_SECRET", "test-secret")
+	cartID := "0b6f1c52-3a8e-4c7e-9d1a-2f4b5c6d7e8f"
+
+	parsed, ok := parseCartToken(signCartToken(cartID))
+	assert.True(t, ok)
+	assert.Equal(t, cartID, parsed)
+
+	_, ok = parseCartToken(cartID + ".firma-falsa")
+	assert.False(t, ok)
+	_, ok = parseCartToken("no-es-uuid." + cartTokenSignature("no-es-uuid"))
+	assert.False(t, ok)
+	_, ok = parseCartToken("")
+	assert.False(t, ok)
+}
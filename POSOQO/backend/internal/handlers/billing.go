@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/einvoice"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// maxBillingProfiles limita los perfiles de facturación por usuario
+const maxBillingProfiles = 10
+
+// billingDocTypes traduce el tipo de documento de la API al catálogo 06 de SUNAT
+var billingDocTypes = map[string]string{
+	"dni": einvoice.DocDNI,
+	"ruc": einvoice.DocRUC,
+}
+
+// BillingProfileRequest crea o actualiza un perfil de facturación.
+// Para un RUC, la razón social y dirección fiscal se completan desde SUNAT si faltan.
+type BillingProfileRequest struct {
+	DocType   string `json:"doc_type"` // dni o ruc
+	DocNumber string `json:"doc_number"`
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	IsDefault bool   `json:"is_default"`
+}
+
+// billingProfile es un perfil de facturación guardado
+type billingProfile struct {
+	ID        int64     `json:"id"`
+	DocType   string    `json:"doc_type"`
+	DocNumber string    `json:"doc_number"`
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	IsDefault bool      `json:"is_default"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// sunatDocType devuelve el código del catálogo 06 del perfil
+func (p *billingProfile) sunatDocType() string {
+	return billingDocTypes[p.DocType]
+}
+
+// ErrBillingProfileNotFound indica un perfil inexistente o de otro usuario
+var ErrBillingProfileNotFound = errors.New("perfil de facturación no encontrado")
+
+const billingProfileColumns = `id, CASE doc_type WHEN '6' THEN 'ruc' ELSE 'dni' END, doc_number, name, address, is_default, created_at`
+
+func scanBillingProfile(row pgx.Row, p *billingProfile) error {
+	return row.Scan(&p.ID, &p.DocType, &p.DocNumber, &p.Name, &p.Address, &p.IsDefault, &p.CreatedAt)
+}
+
+// loadBillingProfile obtiene un perfil del usuario
+func loadBillingProfile(ctx context.Context, q dbQuerier, userID, profileID int64) (*billingProfile, error) {
+	var p billingProfile
+	err := scanBillingProfile(q.QueryRow(ctx,
+		`SELECT `+billingProfileColumns+` FROM billing_profiles WHERE id=$1 AND user_id=$2`,
+		profileID, userID), &p)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrBillingProfileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// normalizeBillingProfile valida el perfil y completa los datos del RUC desde SUNAT.
+// Devuelve el mensaje de error para el cliente, o el error del proveedor.
+func normalizeBillingProfile(req *BillingProfileRequest) (string, error) {
+	req.DocType = strings.ToLower(strings.TrimSpace(req.DocType))
+	req.DocNumber = strings.TrimSpace(req.DocNumber)
+	req.Name = strings.TrimSpace(req.Name)
+	req.Address = strings.TrimSpace(req.Address)
+
+	switch req.DocType {
+	case "dni":
+		if !utils.IsValidDNI(req.DocNumber) {
+			return "El DNI debe contener exactamente 8 dígitos numéricos", nil
+		}
+		if !utils.IsValidString(req.Name, 2, 255) {
+			return "Nombre inválido (2-255 caracteres)", nil
+		}
+	case "ruc":
+		if !utils.IsValidRUC(req.DocNumber) {
+			return "El RUC debe tener 11 dígitos y un dígito verificador válido", nil
+		}
+		if req.Name == "" || req.Address == "" {
+			data, err := rucProvider.LookupRUC(context.Background(), req.DocNumber)
+			if err != nil {
+				return "", err
+			}
+			if data.Estado != "" && data.Estado != "ACTIVO" {
+				return "El RUC no está activo en SUNAT (" + data.Estado + ")", nil
+			}
+			if req.Name == "" {
+				req.Name = data.RazonSocial
+			}
+			if req.Address == "" {
+				req.Address = data.Direccion
+			}
+		}
+		if !utils.IsValidString(req.Name, 2, 255) {
+			return "Razón social inválida (2-255 caracteres)", nil
+		}
+		if req.Address == "" {
+			return "La factura requiere la dirección fiscal", nil
+		}
+	default:
+		return "Tipo de documento inválido (dni o ruc)", nil
+	}
+	if !utils.IsValidString(req.Address, 0, 500) {
+		return "Dirección inválida (máximo 500 caracteres)", nil
+	}
+	return "", nil
+}
+
+// Listar los perfiles de facturación del usuario
+func ListBillingProfiles(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT `+billingProfileColumns+` FROM billing_profiles WHERE user_id=$1
+		 ORDER BY is_default DESC, created_at`, userID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener perfiles de facturación"})
+	}
+	defer rows.Close()
+
+	profiles := []billingProfile{}
+	for rows.Next() {
+		var p billingProfile
+		if err := scanBillingProfile(rows, &p); err != nil {
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	return c.JSON(fiber.Map{"profiles": profiles})
+}
+
+// Crear un perfil de facturación
+func CreateBillingProfile(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req BillingProfileRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	msg, err := normalizeBillingProfile(&req)
+	if err != nil {
+		return respondLookupError(c, err)
+	}
+	if msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	// Bloquear al usuario serializa la creación de perfiles y el perfil por defecto
+	var count int
+	err = tx.QueryRow(ctx,
+		`SELECT (SELECT COUNT(*) FROM billing_profiles WHERE user_id=$1) FROM users WHERE id=$1 FOR UPDATE`,
+		userID).Scan(&count)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	if count >= maxBillingProfiles {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Máximo 10 perfiles de facturación"})
+	}
+	isDefault := req.IsDefault || count == 0
+	if isDefault {
+		if _, err := tx.Exec(ctx, "UPDATE billing_profiles SET is_default=FALSE WHERE user_id=$1 AND is_default", userID); err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+		}
+	}
+
+	var p billingProfile
+	err = scanBillingProfile(tx.QueryRow(ctx,
+		`INSERT INTO billing_profiles (user_id, doc_type, doc_number, name, address, is_default)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING `+billingProfileColumns,
+		userID, billingDocTypes[req.DocType], req.DocNumber, req.Name, req.Address, isDefault), &p)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo crear el perfil (¿ya existe?)"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear el perfil"})
+	}
+	return c.Status(http.StatusCreated).JSON(p)
+}
+
+// Actualizar un perfil de facturación
+func UpdateBillingProfile(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	profileID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "ID inválido"})
+	}
+
+	var req BillingProfileRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	msg, err := normalizeBillingProfile(&req)
+	if err != nil {
+		return respondLookupError(c, err)
+	}
+	if msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := loadBillingProfile(ctx, tx, userID, int64(profileID)); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Perfil de facturación no encontrado"})
+	}
+	if req.IsDefault {
+		if _, err := tx.Exec(ctx,
+			"UPDATE billing_profiles SET is_default=FALSE WHERE user_id=$1 AND is_default AND id<>$2",
+			userID, profileID); err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+		}
+	}
+
+	// Quitar la marca por defecto se hace eligiendo otro perfil, no desmarcando este
+	var p billingProfile
+	err = scanBillingProfile(tx.QueryRow(ctx,
+		`UPDATE billing_profiles SET doc_type=$1, doc_number=$2, name=$3, address=$4, is_default=(is_default OR $5)
+		 WHERE id=$6 AND user_id=$7
+		 RETURNING `+billingProfileColumns,
+		billingDocTypes[req.DocType], req.DocNumber, req.Name, req.Address, req.IsDefault, profileID, userID), &p)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo actualizar el perfil (¿ya existe?)"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el perfil"})
+	}
+	return c.JSON(p)
+}
+
+// Eliminar un perfil de facturación. Si era el perfil por defecto, el más antiguo pasa a serlo.
+func DeleteBillingProfile(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	profileID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "ID inválido"})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	var wasDefault bool
+	err = tx.QueryRow(ctx,
+		"DELETE FROM billing_profiles WHERE id=$1 AND user_id=$2 RETURNING is_default",
+		profileID, userID).Scan(&wasDefault)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Perfil de facturación no encontrado"})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo eliminar el perfil"})
+	}
+	if wasDefault {
+		_, err = tx.Exec(ctx,
+			`UPDATE billing_profiles SET is_default=TRUE
+			 WHERE id = (SELECT id FROM billing_profiles WHERE user_id=$1 ORDER BY created_at LIMIT 1)`, userID)
+		if err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo eliminar el perfil"})
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo eliminar el perfil"})
+	}
+	return c.JSON(fiber.Map{"message": "Perfil de facturación eliminado"})
+}
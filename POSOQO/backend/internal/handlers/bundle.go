@@ -0,0 +1,598 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// Tipos de pack (columna products.bundle_type)
+const (
+	bundleFixed = "fixed" // componentes definidos por el admin
+	bundleMixed = "mixed" // "arma tu six-pack": el cliente elige según una regla
+)
+
+// maxPackUnits es el máximo de unidades de un pack y de componentes elegidos
+const maxPackUnits = 48
+
+// BundleSelection es un componente de un pack: producto, formato y unidades por pack
+type BundleSelection struct {
+	ProductID string `json:"product_id"`
+	VariantID string `json:"variant_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Quantity  int    `json:"quantity"`
+}
+
+// PackRule es la regla para armar un pack mixto, p. ej. "6 cualquiera de la categoría Lager"
+type PackRule struct {
+	PackSize      int     `json:"pack_size"`
+	CategoryID    *string `json:"category_id"`
+	ContainerType string  `json:"container_type,omitempty"`
+	SizeML        int     `json:"size_ml,omitempty"`
+	MaxPerProduct int     `json:"max_per_product,omitempty"`
+}
+
+// BundleError indica un pack mal armado por el cliente
+type BundleError struct {
+	ProductID string
+	Message   string
+}
+
+func (e *BundleError) Error() string {
+	return fmt.Sprintf("pack %s: %s", e.ProductID, e.Message)
+}
+
+// normalizeSelections agrupa los componentes repetidos y los ordena, de modo que la misma
+// selección siempre se guarde igual en el carrito
+func normalizeSelections(selections []BundleSelection) []BundleSelection {
+	index := map[string]int{}
+	result := []BundleSelection{}
+	for _, s := range selections {
+		key := s.ProductID + "/" + s.VariantID
+		if i, ok := index[key]; ok {
+			result[i].Quantity += s.Quantity
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, BundleSelection{ProductID: s.ProductID, VariantID: s.VariantID, Quantity: s.Quantity})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ProductID != result[j].ProductID {
+			return result[i].ProductID < result[j].ProductID
+		}
+		return result[i].VariantID < result[j].VariantID
+	})
+	return result
+}
+
+// selectionsJSON es la selección normalizada tal como se guarda en cart_items.components
+func selectionsJSON(selections []BundleSelection) string {
+	data, err := json.Marshal(normalizeSelections(selections))
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+// selectionKey identifica una selección para comparar items del carrito
+func selectionKey(selections []BundleSelection) string {
+	parts := make([]string, 0, len(selections))
+	for _, s := range normalizeSelections(selections) {
+		parts = append(parts, s.ProductID+":"+s.VariantID+":"+strconv.Itoa(s.Quantity))
+	}
+	return strings.Join(parts, ",")
+}
+
+// packPick es un componente elegido para un pack mixto con los datos para validarlo
+type packPick struct {
+	BundleSelection
+	Found         bool // el producto (y el formato elegido) existen
+	IsActive      bool
+	IsBundle      bool
+	CategoryIDs   []string // categoría del producto y su categoría padre
+	HasVariants   bool
+	ContainerType string // envase del formato elegido
+	SizeML        int
+}
+
+// checkPackSelection valida la selección de un pack mixto contra su regla y devuelve el
+// mensaje de error si no la cumple
+func checkPackSelection(rule PackRule, picks []packPick) string {
+	units := 0
+	perProduct := map[string]int{}
+	for _, pick := range picks {
+		switch {
+		case !pick.Found || !pick.IsActive || pick.IsBundle:
+			return "Uno de los productos elegidos no está disponible para el pack"
+		case pick.HasVariants && pick.VariantID == "":
+			return "Elige un formato para cada producto del pack"
+		case rule.CategoryID != nil && !containsString(pick.CategoryIDs, *rule.CategoryID):
+			return "Uno de los productos elegidos no es de la categoría del pack"
+		case rule.ContainerType != "" && pick.ContainerType != rule.ContainerType:
+			return "Uno de los productos elegidos no tiene el envase del pack"
+		case rule.SizeML > 0 && pick.SizeML != rule.SizeML:
+			return "Uno de los productos elegidos no tiene el tamaño del pack"
+		}
+		units += pick.Quantity
+		perProduct[pick.ProductID] += pick.Quantity
+		if rule.MaxPerProduct > 0 && perProduct[pick.ProductID] > rule.MaxPerProduct {
+			return fmt.Sprintf("Máximo %d unidades de un mismo producto en el pack", rule.MaxPerProduct)
+		}
+	}
+	if units != rule.PackSize {
+		return fmt.Sprintf("El pack debe tener exactamente %d unidades", rule.PackSize)
+	}
+	return ""
+}
+
+func containsString(list []string, value string) bool {
+	for _, s := range list {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBundle devuelve los componentes que consume una unidad del producto: los del
+// pack fijo, la selección validada de un pack mixto o ninguno para un producto simple
+func resolveBundle(ctx context.Context, q dbQuerier, bundleType, productID string, selections []BundleSelection) ([]BundleSelection, error) {
+	switch bundleType {
+	case bundleFixed:
+		return loadBundleComponents(ctx, q, productID)
+	case bundleMixed:
+		return resolvePackSelection(ctx, q, productID, selections)
+	}
+	if len(selections) > 0 {
+		return nil, &BundleError{ProductID: productID, Message: "El producto no es un pack"}
+	}
+	return nil, nil
+}
+
+// loadBundleComponents obtiene los componentes de un pack fijo; si alguno ya no está a la
+// venta el pack tampoco
+func loadBundleComponents(ctx context.Context, q dbQuerier, bundleID string) ([]BundleSelection, error) {
+	rows, err := q.Query(ctx,
+		`SELECT p.id::text, COALESCE(v.id::text, ''), `+itemNameSQL+`, bc.quantity,
+		        p.is_active AND (bc.variant_id IS NULL OR v.is_active)
+		 FROM bundle_components bc
+		 JOIN products p ON p.id = bc.product_id
+		 LEFT JOIN product_variants v ON v.id = bc.variant_id
+		 WHERE bc.bundle_id = $1
+		 ORDER BY p.name, v.size_ml`, bundleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	components := []BundleSelection{}
+	for rows.Next() {
+		var s BundleSelection
+		var available bool
+		if err := rows.Scan(&s.ProductID, &s.VariantID, &s.Name, &s.Quantity, &available); err != nil {
+			return nil, err
+		}
+		if !available {
+			return nil, &ProductUnavailableError{ProductID: bundleID}
+		}
+		components = append(components, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(components) == 0 {
+		return nil, &ProductUnavailableError{ProductID: bundleID}
+	}
+	return components, nil
+}
+
+// loadPackRule obtiene la regla de un pack mixto
+func loadPackRule(ctx context.Context, q dbQuerier, bundleID string) (PackRule, error) {
+	var rule PackRule
+	var containerType *string
+	var sizeML, maxPerProduct *int
+	err := q.QueryRow(ctx,
+		`SELECT pack_size, category_id::text, container_type, size_ml, max_per_product
+		 FROM bundle_pack_rules WHERE bundle_id = $1`, bundleID).
+		Scan(&rule.PackSize, &rule.CategoryID, &containerType, &sizeML, &maxPerProduct)
+	if containerType != nil {
+		rule.ContainerType = *containerType
+	}
+	if sizeML != nil {
+		rule.SizeML = *sizeML
+	}
+	if maxPerProduct != nil {
+		rule.MaxPerProduct = *maxPerProduct
+	}
+	return rule, err
+}
+
+// resolvePackSelection valida la selección del cliente para un pack mixto y la devuelve
+// normalizada con el nombre de cada componente
+func resolvePackSelection(ctx context.Context, q dbQuerier, bundleID string, selections []BundleSelection) ([]BundleSelection, error) {
+	rule, err := loadPackRule(ctx, q, bundleID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &ProductUnavailableError{ProductID: bundleID}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	selections = normalizeSelections(selections)
+	picks := make([]packPick, 0, len(selections))
+	for _, s := range selections {
+		pick := packPick{BundleSelection: s}
+		var variantID string
+		err := q.QueryRow(ctx,
+			`SELECT COALESCE(v.id::text, ''), `+itemNameSQL+`, p.is_active AND COALESCE(v.is_active, true),
+			        p.bundle_type IS NOT NULL, ARRAY_REMOVE(ARRAY[p.category_id::text, cat.parent_id::text], NULL),
+			        EXISTS(SELECT 1 FROM product_variants pv WHERE pv.product_id = p.id AND pv.is_active),
+			        COALESCE(v.container_type, ''), COALESCE(v.size_ml, 0)
+			 FROM products p
+			 LEFT JOIN categories cat ON cat.id = p.category_id
+			 LEFT JOIN product_variants v ON v.id = NULLIF($2, '')::uuid AND v.product_id = p.id
+			 WHERE p.id::text = $1`, s.ProductID, s.VariantID).
+			Scan(&variantID, &pick.Name, &pick.IsActive, &pick.IsBundle, &pick.CategoryIDs,
+				&pick.HasVariants, &pick.ContainerType, &pick.SizeML)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		pick.Found = err == nil && variantID == s.VariantID
+		picks = append(picks, pick)
+	}
+	if msg := checkPackSelection(rule, picks); msg != "" {
+		return nil, &BundleError{ProductID: bundleID, Message: msg}
+	}
+
+	resolved := make([]BundleSelection, len(picks))
+	for i, pick := range picks {
+		resolved[i] = pick.BundleSelection
+	}
+	return resolved, nil
+}
+
+// checkCartBundles valida la selección de los packs mixtos antes de guardar el carrito,
+// para que el carrito guardado siempre se pueda cotizar
+func checkCartBundles(ctx context.Context, q dbQuerier, items []OrderItemRequest) error {
+	for _, item := range items {
+		var bundleType string
+		err := q.QueryRow(ctx, "SELECT COALESCE(bundle_type, '') FROM products WHERE id::text = $1", item.ProductID).
+			Scan(&bundleType)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if bundleType == bundleFixed {
+			continue
+		}
+		if _, err := resolveBundle(ctx, q, bundleType, item.ProductID, item.Components); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemStockSQL es el stock vigente de un item: el del formato o producto, o el calculado
+// con bundle_stock para un pack (p es products, v el formato y selection la selección jsonb)
+func itemStockSQL(selection string) string {
+	return `CASE WHEN p.bundle_type IS NULL THEN COALESCE(v.stock, p.stock, 0) ELSE bundle_stock(p.id, ` + selection + `) END`
+}
+
+// saveOrderItemComponents guarda los componentes que consume cada unidad de una línea de pedido
+func saveOrderItemComponents(ctx context.Context, tx pgx.Tx, orderItemID string, components []BundleSelection) error {
+	for _, s := range components {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO order_item_components (order_item_id, product_id, variant_id, quantity)
+			 VALUES ($1, $2, NULLIF($3, '')::uuid, $4)`,
+			orderItemID, s.ProductID, s.VariantID, s.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadOrderItemComponents obtiene los componentes de los packs de un pedido por order_items.id
+func loadOrderItemComponents(ctx context.Context, q dbQuerier, orderID string) (map[string][]BundleSelection, error) {
+	rows, err := q.Query(ctx,
+		`SELECT c.order_item_id::text, p.id::text, COALESCE(v.id::text, ''), `+itemNameSQL+`, c.quantity
+		 FROM order_item_components c
+		 JOIN order_items oi ON oi.id = c.order_item_id
+		 JOIN products p ON p.id = c.product_id
+		 LEFT JOIN product_variants v ON v.id = c.variant_id
+		 WHERE oi.order_id = $1
+		 ORDER BY p.name, v.size_ml`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	components := map[string][]BundleSelection{}
+	for rows.Next() {
+		var itemID string
+		var s BundleSelection
+		if err := rows.Scan(&itemID, &s.ProductID, &s.VariantID, &s.Name, &s.Quantity); err != nil {
+			return nil, err
+		}
+		components[itemID] = append(components[itemID], s)
+	}
+	return components, rows.Err()
+}
+
+// attachBundles completa el tipo de pack, sus componentes o regla y el stock calculado
+// desde los componentes de los productos que son packs
+func attachBundles(ctx context.Context, products []ProductResponse) error {
+	index := map[string]int{}
+	ids := make([]string, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+		index[p.ID] = i
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	rows, err := db.DB.Query(ctx,
+		`SELECT id::text, bundle_type, bundle_stock(id) FROM products
+		 WHERE id = ANY($1::uuid[]) AND bundle_type IS NOT NULL`, ids)
+	if err != nil {
+		return err
+	}
+	bundles := []string{}
+	for rows.Next() {
+		var id, bundleType string
+		var stock int
+		if err := rows.Scan(&id, &bundleType, &stock); err != nil {
+			rows.Close()
+			return err
+		}
+		p := &products[index[id]]
+		p.BundleType, p.Stock = bundleType, stock
+		bundles = append(bundles, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range bundles {
+		p := &products[index[id]]
+		switch p.BundleType {
+		case bundleFixed:
+			rows, err := db.DB.Query(ctx,
+				`SELECT p.id::text, COALESCE(v.id::text, ''), `+itemNameSQL+`, bc.quantity
+				 FROM bundle_components bc
+				 JOIN products p ON p.id = bc.product_id
+				 LEFT JOIN product_variants v ON v.id = bc.variant_id
+				 WHERE bc.bundle_id = $1
+				 ORDER BY p.name, v.size_ml`, id)
+			if err != nil {
+				return err
+			}
+			p.BundleComponents = []BundleSelection{}
+			for rows.Next() {
+				var s BundleSelection
+				if err := rows.Scan(&s.ProductID, &s.VariantID, &s.Name, &s.Quantity); err != nil {
+					rows.Close()
+					return err
+				}
+				p.BundleComponents = append(p.BundleComponents, s)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		case bundleMixed:
+			rule, err := loadPackRule(ctx, db.DB, id)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+			if err == nil {
+				p.PackRule = &rule
+			}
+		}
+	}
+	return nil
+}
+
+// BundleRequest configura un producto como pack fijo, pack mixto o producto simple
+type BundleRequest struct {
+	BundleType string            `json:"bundle_type"` // fixed, mixed o vacío para dejar de ser pack
+	Components []BundleSelection `json:"components"`
+	PackRule   *PackRule         `json:"pack_rule"`
+}
+
+// validateBundleRequest normaliza la configuración del pack y devuelve el mensaje de error si no es válida
+func validateBundleRequest(productID string, req *BundleRequest) string {
+	req.BundleType = strings.ToLower(strings.TrimSpace(req.BundleType))
+	switch req.BundleType {
+	case "":
+		return ""
+	case bundleFixed:
+		if len(req.Components) == 0 || len(req.Components) > maxPackUnits {
+			return "El pack debe tener entre 1 y 48 componentes"
+		}
+		for _, s := range req.Components {
+			switch {
+			case !utils.IsValidUUID(s.ProductID) || (s.VariantID != "" && !utils.IsValidUUID(s.VariantID)):
+				return "ID de componente inválido"
+			case s.ProductID == productID:
+				return "El pack no puede contenerse a sí mismo"
+			case !utils.IsValidNumber(s.Quantity, 1, maxPackUnits):
+				return "Cantidad de componente inválida (1-48)"
+			}
+		}
+		req.Components = normalizeSelections(req.Components)
+		return ""
+	case bundleMixed:
+		rule := req.PackRule
+		if rule == nil {
+			return "El pack mixto requiere una regla (pack_rule)"
+		}
+		rule.ContainerType = strings.ToLower(strings.TrimSpace(rule.ContainerType))
+		switch {
+		case !utils.IsValidNumber(rule.PackSize, 2, maxPackUnits):
+			return "Tamaño de pack inválido (2-48 unidades)"
+		case rule.CategoryID != nil && !utils.IsValidUUID(*rule.CategoryID):
+			return "Categoría inválida"
+		case rule.ContainerType != "" && containerLabels[rule.ContainerType] == "":
+			return "Envase inválido (bottle, can, growler o keg)"
+		case rule.SizeML < 0 || rule.MaxPerProduct < 0:
+			return "Tamaño o máximo por producto inválido"
+		}
+		return ""
+	}
+	return "Tipo de pack inválido (fixed o mixed)"
+}
+
+// PUT /api/admin/products/:id/bundle
+// Convierte el producto en un pack (fijo o mixto) o lo vuelve un producto simple
+func UpdateProductBundle(c *fiber.Ctx) error {
+	productID := c.Params("id")
+	var req BundleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateBundleRequest(productID, &req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := tx.Exec(ctx, "UPDATE products SET bundle_type=NULLIF($1, '') WHERE id=$2", req.BundleType, productID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar el pack"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Producto no encontrado"})
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM bundle_components WHERE bundle_id=$1", productID); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar el pack"})
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM bundle_pack_rules WHERE bundle_id=$1", productID); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar el pack"})
+	}
+
+	switch req.BundleType {
+	case bundleFixed:
+		for _, s := range req.Components {
+			// Los componentes deben ser productos simples y el formato debe ser del producto
+			res, err := tx.Exec(ctx,
+				`INSERT INTO bundle_components (bundle_id, product_id, variant_id, quantity)
+				 SELECT $1, p.id, v.id, $4 FROM products p
+				 LEFT JOIN product_variants v ON v.id = NULLIF($3, '')::uuid AND v.product_id = p.id
+				 WHERE p.id = $2 AND p.bundle_type IS NULL AND (NULLIF($3, '') IS NULL OR v.id IS NOT NULL)`,
+				productID, s.ProductID, s.VariantID, s.Quantity)
+			if err != nil {
+				return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar el pack"})
+			}
+			if res.RowsAffected() == 0 {
+				return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+					"error":      "Componente inexistente o que también es un pack",
+					"product_id": s.ProductID,
+				})
+			}
+		}
+	case bundleMixed:
+		rule := req.PackRule
+		_, err := tx.Exec(ctx,
+			`INSERT INTO bundle_pack_rules (bundle_id, pack_size, category_id, container_type, size_ml, max_per_product)
+			 VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, 0), NULLIF($6, 0))`,
+			productID, rule.PackSize, rule.CategoryID, rule.ContainerType, rule.SizeML, rule.MaxPerProduct)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo guardar la regla (¿categoría inexistente?)"})
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar el pack"})
+	}
+	return c.JSON(fiber.Map{"message": "Pack actualizado"})
+}
+
+// GET /api/products/:id/pack-options
+// Productos y formatos que se pueden elegir para armar un pack mixto, con su stock
+func ListPackOptions(c *fiber.Ctx) error {
+	bundleID := c.Params("id")
+	if !utils.IsValidUUID(bundleID) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "ID de producto inválido"})
+	}
+	ctx := context.Background()
+	rule, err := loadPackRule(ctx, db.DB, bundleID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "El producto no es un pack mixto"})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener el pack"})
+	}
+
+	// Misma elegibilidad que checkPackSelection y bundle_stock
+	rows, err := db.DB.Query(ctx,
+		`SELECT p.id::text, COALESCE(v.id::text, ''), `+itemNameSQL+`, COALESCE(p.image_url, ''),
+		        COALESCE(v.stock, p.stock, 0)
+		 FROM bundle_pack_rules r
+		 JOIN products p ON p.is_active AND p.bundle_type IS NULL
+		 LEFT JOIN categories cat ON cat.id = p.category_id
+		 LEFT JOIN product_variants v ON v.product_id = p.id AND v.is_active
+		 WHERE r.bundle_id = $1
+		   AND (r.category_id IS NULL OR r.category_id IN (p.category_id, cat.parent_id))
+		   AND (r.container_type IS NULL OR v.container_type = r.container_type)
+		   AND (r.size_ml IS NULL OR v.size_ml = r.size_ml)
+		   AND (v.id IS NOT NULL OR NOT EXISTS (
+		        SELECT 1 FROM product_variants pv WHERE pv.product_id = p.id AND pv.is_active))
+		 ORDER BY p.name, v.sort_order, v.size_ml`, bundleID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener opciones del pack"})
+	}
+	defer rows.Close()
+
+	options := []fiber.Map{}
+	for rows.Next() {
+		var productID, variantID, name, imageURL string
+		var stock int
+		if err := rows.Scan(&productID, &variantID, &name, &imageURL, &stock); err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener opciones del pack"})
+		}
+		options = append(options, fiber.Map{
+			"product_id": productID,
+			"variant_id": variantID,
+			"name":       name,
+			"image_url":  imageURL,
+			"stock":      stock,
+		})
+	}
+	return c.JSON(fiber.Map{"rule": rule, "options": options})
+}
+
+// respondCartBundlesError traduce un error de checkCartBundles a la respuesta HTTP
+func respondCartBundlesError(c *fiber.Ctx, err error) error {
+	var bundleErr *BundleError
+	var unavailable *ProductUnavailableError
+	if errors.As(err, &bundleErr) || errors.As(err, &unavailable) {
+		return respondCheckoutError(c, err)
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar el carrito"})
+}
+
+// respondBundleError traduce un pack mal armado a la respuesta HTTP
+func respondBundleError(c *fiber.Ctx, err *BundleError) error {
+	return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+		"error":      err.Message,
+		"code":       "INVALID_BUNDLE",
+		"product_id": err.ProductID,
+	})
+}
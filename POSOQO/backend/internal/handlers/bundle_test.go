@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNormalizeSelections valida que la misma selección siempre se guarde igual
+func TestNormalizeSelections(t *testing.T) {
+	a := []BundleSelection{
+		{ProductID: "stout", Quantity: 2, Name: "Stout"},
+		{ProductID: "ipa", VariantID: "can", Quantity: 3},
+		{ProductID: "stout", Quantity: 1},
+	}
+	b := []BundleSelection{
+		{ProductID: "ipa", VariantID: "can", Quantity: 3},
+		{ProductID: "stout", Quantity: 3},
+	}
+
+	assert.Equal(t, []BundleSelection{
+		{ProductID: "ipa", VariantID: "can", Quantity: 3},
+		{ProductID: "stout", Quantity: 3},
+	}, normalizeSelections(a))
+	assert.Equal(t, selectionKey(a), selectionKey(b))
+	assert.Equal(t, selectionsJSON(a), selectionsJSON(b))
+	assert.Equal(t, "[]", selectionsJSON(nil))
+	assert.NotEqual(t, cartItemKey("pack", "", a), cartItemKey("pack", "", nil))
+}
+
+// TestCheckPackSelection valida las reglas de un pack mixto ("6 cualquiera de Lager")
+func TestCheckPackSelection(t *testing.T) {
+	lager := "lager"
+	rule := PackRule{PackSize: 6, CategoryID: &lager, MaxPerProduct: 4}
+	pick := func(productID string, quantity int) packPick {
+		return packPick{
+			BundleSelection: BundleSelection{ProductID: productID, Quantity: quantity},
+			Found:           true, IsActive: true, CategoryIDs: []string{"pilsen", lager},
+		}
+	}
+
+	assert.Empty(t, checkPackSelection(rule, []packPick{pick("a", 4), pick("b", 2)}))
+	assert.Equal(t, "El pack debe tener exactamente 6 unidades", checkPackSelection(rule, []packPick{pick("a", 4), pick("b", 1)}))
+	assert.Equal(t, "Máximo 4 unidades de un mismo producto en el pack", checkPackSelection(rule, []packPick{pick("a", 5), pick("b", 1)}))
+
+	other := pick("c", 2)
+	other.CategoryIDs = []string{"stout"}
+	assert.Equal(t, "Uno de los productos elegidos no es de la categoría del pack",
+		checkPackSelection(rule, []packPick{pick("a", 4), other}))
+
+	inactive := pick("c", 2)
+	inactive.IsActive = false
+	assert.Equal(t, "Uno de los productos elegidos no está disponible para el pack",
+		checkPackSelection(rule, []packPick{pick("a", 4), inactive}))
+
+	nested := pick("c", 2)
+	nested.IsBundle = true
+	assert.Equal(t, "Uno de los productos elegidos no está disponible para el pack",
+		checkPackSelection(rule, []packPick{pick("a", 4), nested}))
+
+	noFormat := pick("c", 2)
+	noFormat.HasVariants = true
+	assert.Equal(t, "Elige un formato para cada producto del pack",
+		checkPackSelection(rule, []packPick{pick("a", 4), noFormat}))
+
+	cans := PackRule{PackSize: 2, ContainerType: containerCan, SizeML: 473}
+	can := pick("a", 2)
+	can.VariantID, can.ContainerType, can.SizeML = "a-can", containerCan, 473
+	bottle := pick("b", 2)
+	bottle.VariantID, bottle.ContainerType, bottle.SizeML = "b-bottle", containerBottle, 330
+	assert.Empty(t, checkPackSelection(cans, []packPick{can}))
+	assert.Equal(t, "Uno de los productos elegidos no tiene el envase del pack", checkPackSelection(cans, []packPick{bottle}))
+}
+
+// TestValidateBundleRequest valida la configuración de un pack desde el admin
+func TestValidateBundleRequest(t *testing.T) {
+	const packID = "8f14e45f-ceea-467f-a0e6-1b2c3d4e5f60"
+	const ipaID = "c9f0f895-fb98-4b91-9f5e-2a1b3c4d5e6f"
+
+	fixed := BundleRequest{BundleType: " Fixed ", Components: []BundleSelection{{ProductID: ipaID, Quantity: 6}}}
+	assert.Empty(t, validateBundleRequest(packID, &fixed))
+	assert.Equal(t, bundleFixed, fixed.BundleType)
+
+	self := BundleRequest{BundleType: bundleFixed, Components: []BundleSelection{{ProductID: packID, Quantity: 1}}}
+	assert.Equal(t, "El pack no puede contenerse a sí mismo", validateBundleRequest(packID, &self))
+
+	empty := BundleRequest{BundleType: bundleFixed}
+	assert.Equal(t, "El pack debe tener entre 1 y 48 componentes", validateBundleRequest(packID, &empty))
+
+	mixed := BundleRequest{BundleType: bundleMixed, PackRule: &PackRule{PackSize: 6, ContainerType: " CAN "}}
+	assert.Empty(t, validateBundleRequest(packID, &mixed))
+	assert.Equal(t, containerCan, mixed.PackRule.ContainerType)
+
+	noRule := BundleRequest{BundleType: bundleMixed}
+	assert.Equal(t, "El pack mixto requiere una regla (pack_rule)", validateBundleRequest(packID, &noRule))
+
+	tooSmall := BundleRequest{BundleType: bundleMixed, PackRule: &PackRule{PackSize: 1}}
+	assert.Equal(t, "Tamaño de pack inválido (2-48 unidades)", validateBundleRequest(packID, &tooSmall))
+
+	assert.Equal(t, "Tipo de pack inválido (fixed o mixed)", validateBundleRequest(packID, &BundleRequest{BundleType: "combo"}))
+	assert.Empty(t, validateBundleRequest(packID, &BundleRequest{}))
+}
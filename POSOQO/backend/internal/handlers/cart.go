@@ -2,54 +2,324 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/posoqo/backend/internal/db"
 )
 
 type CartItemRequest struct {
 	ProductID string `json:"product_id"`
-	Quantity  int    `json:"quantity"`
+	VariantID string `json:"variant_id,omitempty"`
+	// Components es la selección del cliente si el producto es un pack mixto
+	Components []BundleSelection `json:"components,omitempty"`
+	Quantity   int               `json:"quantity"`
 }
 
 type SaveCartRequest struct {
 	Items []CartItemRequest `json:"items"`
 }
 
+// orderItems devuelve los items a guardar, omitiendo los de cantidad menor a 1
+func (r SaveCartRequest) orderItems() []OrderItemRequest {
+	items := make([]OrderItemRequest, 0, len(r.Items))
+	for _, item := range r.Items {
+		if item.Quantity < 1 {
+			continue
+		}
+		items = append(items, OrderItemRequest{
+			ProductID: item.ProductID, VariantID: item.VariantID, Components: item.Components, Quantity: item.Quantity,
+		})
+	}
+	return items
+}
+
+// cartItemKey identifica un item del carrito: un mismo producto puede estar en varios
+// formatos y un mismo pack mixto con distintas selecciones
+func cartItemKey(productID, variantID string, components []BundleSelection) string {
+	return productID + "/" + variantID + "/" + selectionKey(components)
+}
+
+// cartItemMatch filtra cart_items por carrito ($1), producto ($2), formato ($3, vacío para
+// productos sin formatos) y selección del pack ($4)
+const cartItemMatch = "cart_id=$1 AND product_id=$2 AND variant_id IS NOT DISTINCT FROM NULLIF($3, '')::uuid AND components = $4::jsonb"
+
+// cartItemConflict es la unicidad de cart_items (carrito, producto, formato, selección del pack)
+const cartItemConflict = "(cart_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'::uuid), md5(components::text))"
+
+// cartItemPriceSQL es el precio vigente del producto $2 o de su formato $4
+const cartItemPriceSQL = "COALESCE((SELECT price FROM product_variants WHERE id = NULLIF($4, '')::uuid), (SELECT price FROM products WHERE id = $2))"
+
+// storedCartItem es un item guardado en el carrito junto con el estado actual del producto
+type storedCartItem struct {
+	ProductID    string
+	VariantID    string // vacío si el producto no tiene formatos
+	Components   []BundleSelection
+	Name         string
+	ImageURL     string
+	Quantity     int
+	SavedPrice   *float64 // precio mostrado la última vez; nil en carritos anteriores al aviso
+	Price        float64
+	Stock        int
+	IsActive     bool
+	NeedsVariant bool // el producto pasó a venderse por formatos y el item no tiene uno
+}
+
+// CartWarning avisa de un cambio en el carrito desde la última vez que el cliente lo vio
+type CartWarning struct {
+	ProductID string   `json:"product_id"`
+	VariantID string   `json:"variant_id,omitempty"`
+	Name      string   `json:"name"`
+	Code      string   `json:"code"` // PRODUCT_UNAVAILABLE, VARIANT_REQUIRED, OUT_OF_STOCK, QUANTITY_ADJUSTED, PRICE_CHANGED o INVALID_BUNDLE
+	Message   string   `json:"message"`
+	OldPrice  *float64 `json:"old_price,omitempty"`
+	NewPrice  *float64 `json:"new_price,omitempty"`
+	Available *int     `json:"available,omitempty"`
+}
+
+// CartLine es una línea del carrito con los datos que el frontend necesita para mostrarla
+type CartLine struct {
+	CartQuoteLine
+	ImageURL  string `json:"image_url"`
+	Stock     int    `json:"stock"`
+	Available bool   `json:"available"`
+}
+
+// reviewCartItems decide qué items del carrito se pueden comprar y arma los avisos.
+// Los productos desactivados (o sin el formato elegido) se quitan, las cantidades se
+// ajustan al stock y los productos agotados se quedan en el carrito pero no se cotizan.
+func reviewCartItems(stored []storedCartItem) ([]OrderItemRequest, []CartWarning) {
+	items := []OrderItemRequest{}
+	warnings := []CartWarning{}
+	for i := range stored {
+		item := &stored[i]
+		if !item.IsActive {
+			warnings = append(warnings, CartWarning{
+				ProductID: item.ProductID, VariantID: item.VariantID, Name: item.Name, Code: "PRODUCT_UNAVAILABLE",
+				Message: "El producto ya no está disponible y se quitó del carrito",
+			})
+			continue
+		}
+		if item.NeedsVariant {
+			warnings = append(warnings, CartWarning{
+				ProductID: item.ProductID, Name: item.Name, Code: "VARIANT_REQUIRED",
+				Message: "El producto ahora se vende por formatos; vuelve a agregarlo eligiendo uno",
+			})
+			continue
+		}
+		if item.Stock <= 0 {
+			warnings = append(warnings, CartWarning{
+				ProductID: item.ProductID, VariantID: item.VariantID, Name: item.Name, Code: "OUT_OF_STOCK",
+				Message: "El producto está agotado", Available: &item.Stock,
+			})
+			continue
+		}
+		if item.Quantity > item.Stock || item.Quantity > 100 {
+			item.Quantity = min(item.Stock, 100)
+			warnings = append(warnings, CartWarning{
+				ProductID: item.ProductID, VariantID: item.VariantID, Name: item.Name, Code: "QUANTITY_ADJUSTED",
+				Message: "La cantidad se ajustó al stock disponible", Available: &item.Stock,
+			})
+		}
+		if item.SavedPrice != nil && toCents(*item.SavedPrice) != toCents(item.Price) {
+			warnings = append(warnings, CartWarning{
+				ProductID: item.ProductID, VariantID: item.VariantID, Name: item.Name, Code: "PRICE_CHANGED",
+				Message: "El precio del producto cambió", OldPrice: item.SavedPrice, NewPrice: &item.Price,
+			})
+		}
+		items = append(items, OrderItemRequest{
+			ProductID: item.ProductID, VariantID: item.VariantID, Components: item.Components, Quantity: item.Quantity,
+		})
+	}
+	return items, warnings
+}
+
 // GET /api/cart
+// Devuelve el carrito cotizado por el servidor: precios vigentes, stock, promociones,
+// totales y avisos de productos quitados o modificados
 func GetCart(c *fiber.Ctx) error {
 	claims := c.Locals("user").(jwt.MapClaims)
 	userID := int64(claims["id"].(float64))
+	ctx := context.Background()
 
 	var cartID string
-	err := db.DB.QueryRow(context.Background(), "SELECT id FROM carts WHERE user_id=$1", userID).Scan(&cartID)
+	err := db.DB.QueryRow(ctx, "SELECT id FROM carts WHERE user_id=$1", userID).Scan(&cartID)
 	if err != nil {
 		// Si no existe carrito, devolver vacío
-		return c.JSON(fiber.Map{"items": []interface{}{}})
+		return respondEmptyCart(c)
 	}
+	return respondPricedCart(c, cartID)
+}
+
+// respondEmptyCart devuelve un carrito vacío con la misma forma que el cotizado
+func respondEmptyCart(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"items":      []CartLine{},
+		"promotions": []AppliedPromotion{},
+		"totals":     OrderTotals{},
+		"warnings":   []CartWarning{},
+	})
+}
 
-	rows, err := db.DB.Query(context.Background(), `
-		SELECT product_id, quantity FROM cart_items WHERE cart_id=$1
+// loadStoredCartItems obtiene los items guardados de un carrito con el estado actual de
+// cada producto (o del formato elegido, que tiene su propio precio y stock)
+func loadStoredCartItems(ctx context.Context, q dbQuerier, cartID string) ([]storedCartItem, error) {
+	rows, err := q.Query(ctx, `
+		SELECT p.id::text, COALESCE(ci.variant_id::text, ''), ci.components, `+itemNameSQL+`, COALESCE(p.image_url, ''),
+		       ci.quantity, ci.unit_price, COALESCE(v.price, p.price), `+itemStockSQL("ci.components")+`,
+		       COALESCE(p.is_active, false) AND (ci.variant_id IS NULL OR COALESCE(v.is_active, false)),
+		       ci.variant_id IS NULL AND EXISTS(SELECT 1 FROM product_variants pv WHERE pv.product_id = p.id AND pv.is_active)
+		FROM cart_items ci
+		JOIN products p ON p.id = ci.product_id
+		LEFT JOIN product_variants v ON v.id = ci.variant_id
+		WHERE ci.cart_id=$1
+		ORDER BY p.name, v.sort_order, v.size_ml
 	`, cartID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener carrito"})
+		return nil, err
 	}
 	defer rows.Close()
 
-	items := []fiber.Map{}
+	stored := []storedCartItem{}
 	for rows.Next() {
-		var productID string
-		var quantity int
-		if err := rows.Scan(&productID, &quantity); err != nil {
+		var item storedCartItem
+		if err := rows.Scan(&item.ProductID, &item.VariantID, &item.Components, &item.Name, &item.ImageURL, &item.Quantity, &item.SavedPrice,
+			&item.Price, &item.Stock, &item.IsActive, &item.NeedsVariant); err != nil {
+			return nil, err
+		}
+		stored = append(stored, item)
+	}
+	return stored, rows.Err()
+}
+
+// isCartLineError indica si un error de cotización se debe a una sola línea del carrito (un
+// producto, formato o pack que dejó de estar disponible) y no a un fallo interno
+func isCartLineError(err error) bool {
+	var unavailable *ProductUnavailableError
+	var variantErr *VariantRequiredError
+	var bundleErr *BundleError
+	var stockErr *InsufficientStockError
+	return errors.As(err, &unavailable) || errors.As(err, &variantErr) || errors.As(err, &bundleErr) || errors.As(err, &stockErr)
+}
+
+// quoteAvailableItems cotiza los items del carrito. Si una línea ya no se puede cotizar (p. ej.
+// un pack mixto cuyo componente se desactivó o agotó) se excluye del total y se devuelve en
+// failed, por clave de item, para que el cliente pueda ver y corregir el resto del carrito.
+func quoteAvailableItems(items []OrderItemRequest, quote func([]OrderItemRequest) (*CartQuote, error)) (*CartQuote, []OrderItemRequest, map[string]error, error) {
+	failed := map[string]error{}
+	empty := &CartQuote{Lines: []CartQuoteLine{}, Promotions: []AppliedPromotion{}}
+	if len(items) == 0 {
+		return empty, items, failed, nil
+	}
+	result, err := quote(items)
+	if err == nil || !isCartLineError(err) {
+		return result, items, failed, err
+	}
+
+	valid := []OrderItemRequest{}
+	for _, item := range items {
+		if _, err := quote([]OrderItemRequest{item}); err != nil {
+			if !isCartLineError(err) {
+				return nil, nil, nil, err
+			}
+			failed[cartItemKey(item.ProductID, item.VariantID, item.Components)] = err
 			continue
 		}
-		items = append(items, fiber.Map{
-			"product_id": productID,
-			"quantity":   quantity,
-		})
+		valid = append(valid, item)
 	}
-	return c.JSON(fiber.Map{"items": items})
+	if len(valid) == 0 {
+		return empty, valid, failed, nil
+	}
+	result, err = quote(valid)
+	return result, valid, failed, err
+}
+
+// cartLineWarning avisa de una línea del carrito que no se pudo cotizar
+func cartLineWarning(item storedCartItem, err error) CartWarning {
+	warning := CartWarning{
+		ProductID: item.ProductID, VariantID: item.VariantID, Name: item.Name,
+		Code: "PRODUCT_UNAVAILABLE", Message: "El producto no está disponible por ahora",
+	}
+	var bundleErr *BundleError
+	if errors.As(err, &bundleErr) {
+		warning.Code, warning.Message = "INVALID_BUNDLE", bundleErr.Message
+	}
+	return warning
+}
+
+// respondPricedCart revisa el carrito contra el catálogo, guarda los ajustes y lo devuelve cotizado
+func respondPricedCart(c *fiber.Ctx, cartID string) error {
+	ctx := context.Background()
+	stored, err := loadStoredCartItems(ctx, db.DB, cartID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener carrito"})
+	}
+
+	items, warnings := reviewCartItems(stored)
+
+	// Guardar los ajustes para que los avisos se muestren una sola vez
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+	for _, item := range stored {
+		if !item.IsActive || item.NeedsVariant {
+			_, err = tx.Exec(ctx, "DELETE FROM cart_items WHERE "+cartItemMatch,
+				cartID, item.ProductID, item.VariantID, selectionsJSON(item.Components))
+		} else {
+			_, err = tx.Exec(ctx, "UPDATE cart_items SET quantity=$5, unit_price=$6 WHERE "+cartItemMatch,
+				cartID, item.ProductID, item.VariantID, selectionsJSON(item.Components), item.Quantity, item.Price)
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Error al actualizar carrito"})
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al actualizar carrito"})
+	}
+
+	quote, items, failed, err := quoteAvailableItems(items, func(items []OrderItemRequest) (*CartQuote, error) {
+		quote, _, err := quoteCart(ctx, db.DB, items)
+		return quote, err
+	})
+	if err != nil {
+		return respondCheckoutError(c, err)
+	}
+	// Las líneas cotizadas siguen el orden de los items
+	quoted := make(map[string]CartQuoteLine, len(quote.Lines))
+	for i, line := range quote.Lines {
+		quoted[cartItemKey(items[i].ProductID, items[i].VariantID, items[i].Components)] = line
+	}
+
+	lines := []CartLine{}
+	for _, item := range stored {
+		if !item.IsActive || item.NeedsVariant {
+			continue
+		}
+		key := cartItemKey(item.ProductID, item.VariantID, item.Components)
+		if lineErr, ok := failed[key]; ok {
+			warnings = append(warnings, cartLineWarning(item, lineErr))
+		}
+		line, ok := quoted[key]
+		if !ok {
+			// Agotado o sin cotizar: se muestra con el precio vigente pero no suma al total
+			line = CartQuoteLine{ProductID: item.ProductID, VariantID: item.VariantID, Name: item.Name,
+				Quantity: item.Quantity, UnitPrice: item.Price, Components: item.Components}
+		}
+		lines = append(lines, CartLine{CartQuoteLine: line, ImageURL: item.ImageURL, Stock: item.Stock, Available: ok})
+	}
+
+	return c.JSON(fiber.Map{
+		"items":      lines,
+		"promotions": quote.Promotions,
+		"totals":     quote.Totals,
+		"warnings":   warnings,
+	})
 }
 
 // POST /api/cart
@@ -78,23 +348,12 @@ func SaveCart(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "No se pudo crear/obtener carrito"})
 	}
 
-	_, err = tx.Exec(context.Background(), "DELETE FROM cart_items WHERE cart_id=$1", cartID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "No se pudo limpiar carrito"})
+	items := req.orderItems()
+	if err := checkCartBundles(context.Background(), tx, items); err != nil {
+		return respondCartBundlesError(c, err)
 	}
-
-	for _, item := range req.Items {
-		if item.Quantity < 1 {
-			continue
-		}
-		_, err = tx.Exec(context.Background(), `
-			INSERT INTO cart_items (cart_id, product_id, quantity)
-			VALUES ($1, $2, $3)
-			ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity = EXCLUDED.quantity
-		`, cartID, item.ProductID, item.Quantity)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "No se pudo guardar producto en carrito"})
-		}
+	if err := writeCartItems(context.Background(), tx, cartID, items); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "No se pudo guardar producto en carrito"})
 	}
 
 	if err := tx.Commit(context.Background()); err != nil {
@@ -103,17 +362,20 @@ func SaveCart(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"success": true})
 }
 
-// GetCartPublic versión pública que devuelve carrito vacío si no hay usuario autenticado
+// GetCartPublic versión pública: sin usuario autenticado devuelve el carrito anónimo
+// identificado por la cookie firmada (o vacío si no hay uno válido)
 func GetCartPublic(c *fiber.Ctx) error {
 	// Verificar si hay usuario autenticado
 	user := c.Locals("user")
-	if user == nil {
-		// Si no hay usuario autenticado, devolver carrito vacío
-		return c.JSON(fiber.Map{"items": []interface{}{}})
+	if user != nil {
+		return GetCart(c)
 	}
 
-	// Si hay usuario autenticado, usar la función original
-	return GetCart(c)
+	cartID, ok := loadAnonymousCart(context.Background(), db.DB, c)
+	if !ok {
+		return respondEmptyCart(c)
+	}
+	return respondPricedCart(c, cartID)
 }
 
 // POST /api/cart/add - Agregar producto individual al carrito
@@ -130,14 +392,23 @@ func AddToCart(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Cantidad debe ser mayor a 0"})
 	}
 
-	// Verificar que el producto existe y está activo
-	var productExists bool
+	// Verificar que el producto existe y está activo, y el formato elegido si lo tiene
+	var productExists, hasVariants bool
 	err := db.DB.QueryRow(context.Background(), `
-		SELECT EXISTS(SELECT 1 FROM products WHERE id = $1 AND is_active = true)
-	`, req.ProductID).Scan(&productExists)
+		SELECT EXISTS(SELECT 1 FROM products WHERE id = $1 AND is_active = true) AND
+		       ($2 = '' OR EXISTS(SELECT 1 FROM product_variants WHERE id::text = $2 AND product_id = $1 AND is_active)),
+		       EXISTS(SELECT 1 FROM product_variants WHERE product_id = $1 AND is_active)
+	`, req.ProductID, req.VariantID).Scan(&productExists, &hasVariants)
 	if err != nil || !productExists {
 		return c.Status(404).JSON(fiber.Map{"error": "Producto no encontrado o no disponible"})
 	}
+	if hasVariants && req.VariantID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Elige un formato del producto", "code": "VARIANT_REQUIRED"})
+	}
+	item := OrderItemRequest{ProductID: req.ProductID, VariantID: req.VariantID, Components: req.Components, Quantity: req.Quantity}
+	if err := checkCartBundles(context.Background(), db.DB, []OrderItemRequest{item}); err != nil {
+		return respondCartBundlesError(c, err)
+	}
 
 	tx, err := db.DB.Begin(context.Background())
 	if err != nil {
@@ -158,11 +429,12 @@ func AddToCart(c *fiber.Ctx) error {
 
 	// Agregar o actualizar item en el carrito
 	_, err = tx.Exec(context.Background(), `
-		INSERT INTO cart_items (cart_id, product_id, quantity)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (cart_id, product_id) DO UPDATE SET 
-			quantity = cart_items.quantity + EXCLUDED.quantity
-	`, cartID, req.ProductID, req.Quantity)
+		INSERT INTO cart_items (cart_id, product_id, quantity, unit_price, variant_id, components)
+		VALUES ($1, $2, $3, `+cartItemPriceSQL+`, NULLIF($4, '')::uuid, $5::jsonb)
+		ON CONFLICT `+cartItemConflict+` DO UPDATE SET
+			quantity = cart_items.quantity + EXCLUDED.quantity,
+			unit_price = EXCLUDED.unit_price
+	`, cartID, req.ProductID, req.Quantity, req.VariantID, selectionsJSON(req.Components))
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "No se pudo agregar producto al carrito"})
 	}
@@ -174,18 +446,284 @@ func AddToCart(c *fiber.Ctx) error {
 	return c.Status(201).JSON(fiber.Map{"success": true, "message": "Producto agregado al carrito"})
 }
 
-// SaveCartPublic versión pública que maneja el guardado del carrito
+// SaveCartPublic versión pública que maneja el guardado del carrito. Sin usuario
+// autenticado guarda un carrito anónimo y devuelve su token firmado en la cookie
+// posoqo_cart (y en "cart_token" para clientes que no usan cookies).
 func SaveCartPublic(c *fiber.Ctx) error {
 	// Verificar si hay usuario autenticado
 	user := c.Locals("user")
-	if user == nil {
-		// Si no hay usuario autenticado, devolver error 401
-		return c.Status(401).JSON(fiber.Map{
-			"error":   "Usuario no autenticado",
-			"message": "Se requiere autenticación para guardar el carrito",
+	if user != nil {
+		return SaveCart(c)
+	}
+
+	var req SaveCartRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	items := req.orderItems()
+	if len(items) > 0 {
+		if msg := validateOrderItems(items); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkCartBundles(ctx, tx, items); err != nil {
+		return respondCartBundlesError(c, err)
+	}
+	cartID, ok := loadAnonymousCart(ctx, tx, c)
+	if ok {
+		_, err = tx.Exec(ctx, "UPDATE carts SET updated_at=NOW() WHERE id=$1", cartID)
+	} else {
+		err = tx.QueryRow(ctx, "INSERT INTO carts (user_id) VALUES (NULL) RETURNING id").Scan(&cartID)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "No se pudo crear/obtener carrito"})
+	}
+	if err := writeCartItems(ctx, tx, cartID, items); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "No se pudo guardar producto en carrito"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al guardar carrito"})
+	}
+
+	token := signCartToken(cartID)
+	setCartCookie(c, token, time.Now().Add(anonymousCartTTL))
+	return c.JSON(fiber.Map{"success": true, "cart_token": token})
+}
+
+// PriceCartRequest carrito a cotizar con un cupón opcional
+type PriceCartRequest struct {
+	Items      []OrderItemRequest `json:"items"`
+	CouponCode string             `json:"coupon_code"`
+}
+
+// POST /api/cart/price
+// Cotiza un carrito con precios vigentes, promociones y cupón usando las mismas reglas del checkout
+func PriceCart(c *fiber.Ctx) error {
+	var req PriceCartRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateOrderItems(req.Items); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+
+	quote, lines, err := quoteCart(context.Background(), db.DB, req.Items)
+	if err != nil {
+		return respondCheckoutError(c, err)
+	}
+
+	resp := fiber.Map{
+		"lines":      quote.Lines,
+		"promotions": quote.Promotions,
+		"totals":     quote.Totals,
+	}
+
+	// El cupón se evalúa sin registrar canje; los límites de uso se validan al pagar
+	if req.CouponCode != "" {
+		rule, err := loadCoupon(context.Background(), db.DB, req.CouponCode, false)
+		if err == nil {
+			var discount float64
+			discount, err = rule.evaluate(lines, time.Now())
+			if err == nil {
+				quote.Totals.Discount = roundMoney(quote.Totals.Discount + discount)
+				quote.Totals.Total = roundMoney(quote.Totals.Subtotal - quote.Totals.Discount + quote.Totals.Shipping + quote.Totals.Deposit)
+				resp["totals"] = quote.Totals
+				resp["coupon"] = fiber.Map{"code": rule.Code, "discount": discount}
+			}
+		}
+		if err != nil {
+			var couponErr *CouponError
+			if !errors.As(err, &couponErr) {
+				return c.Status(500).JSON(fiber.Map{"error": "Error al validar cupón"})
+			}
+			resp["coupon_error"] = fiber.Map{"code": couponErr.Code, "error": couponErr.Message}
+		}
+	}
+
+	return c.JSON(resp)
+}
+
+// ReorderSkippedItem es un producto del pedido original que no se pudo volver a agregar
+type ReorderSkippedItem struct {
+	ProductID string `json:"product_id"`
+	VariantID string `json:"variant_id,omitempty"`
+	Name      string `json:"name"`
+	Requested int    `json:"requested"`
+	Added     int    `json:"added"`
+	Reason    string `json:"reason"` // inactive, variant_required, out_of_stock, limited_stock, quantity_limit o invalid_bundle
+}
+
+// reorderQuantity decide cuántas unidades de una línea del pedido vuelven al carrito y por qué se omiten o reducen
+func reorderQuantity(quantity, stock int, isActive, needsVariant bool) (int, string) {
+	switch {
+	case !isActive:
+		return 0, "inactive"
+	case needsVariant:
+		return 0, "variant_required"
+	case stock <= 0:
+		return 0, "out_of_stock"
+	case stock < quantity:
+		return min(stock, 100), "limited_stock"
+	case quantity > 100:
+		return 100, "quantity_limit"
+	}
+	return quantity, ""
+}
+
+// isReorderBundleSkip indica si el error de validación de un pack solo omite la línea al repetir el pedido
+func isReorderBundleSkip(err error) bool {
+	var bundleErr *BundleError
+	var unavailable *ProductUnavailableError
+	return errors.As(err, &bundleErr) || errors.As(err, &unavailable)
+}
+
+// replaceCartItems reemplaza el contenido del carrito del usuario dentro de la transacción
+func replaceCartItems(ctx context.Context, tx pgx.Tx, userID int64, items []OrderItemRequest) error {
+	cartID, err := userCartID(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	return writeCartItems(ctx, tx, cartID, items)
+}
+
+// writeCartItems reemplaza los items de un carrito guardando el precio vigente de cada producto o formato
+func writeCartItems(ctx context.Context, tx pgx.Tx, cartID string, items []OrderItemRequest) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM cart_items WHERE cart_id=$1", cartID); err != nil {
+		return err
+	}
+	for _, item := range items {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO cart_items (cart_id, product_id, quantity, unit_price, variant_id, components)
+			VALUES ($1, $2, $3, `+cartItemPriceSQL+`, NULLIF($4, '')::uuid, $5::jsonb)
+			ON CONFLICT `+cartItemConflict+` DO UPDATE SET quantity = EXCLUDED.quantity
+		`, cartID, item.ProductID, item.Quantity, item.VariantID, selectionsJSON(item.Components))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// POST /api/protected/orders/:id/reorder
+// Rearma el carrito con los productos de un pedido anterior a precios vigentes.
+// Los productos inactivos o sin stock se omiten y se informan en "skipped".
+func ReorderOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	ctx := context.Background()
+
+	if _, err := loadOwnOrderStatus(ctx, db.DB, orderID, userID, false); err != nil {
+		if errors.Is(err, errOrderNotOwned) {
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
+		}
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+
+	// La selección de un pack mixto se vuelve a pedir igual; los packs fijos usan sus componentes vigentes
+	rows, err := db.DB.Query(ctx,
+		`SELECT p.id::text, COALESCE(v.id::text, ''), sel.components, `+itemNameSQL+`, SUM(oi.quantity)::int,
+		        p.is_active AND (v.id IS NULL OR v.is_active), `+itemStockSQL("sel.components")+`,
+		        v.id IS NULL AND EXISTS(SELECT 1 FROM product_variants pv WHERE pv.product_id = p.id AND pv.is_active)
+		 FROM order_items oi
+		 JOIN products p ON p.id = oi.product_id
+		 LEFT JOIN product_variants v ON v.id = oi.variant_id
+		 CROSS JOIN LATERAL (
+		     SELECT COALESCE(jsonb_agg(jsonb_build_object('product_id', c.product_id, 'variant_id', COALESCE(c.variant_id::text, ''),
+		                                                  'quantity', c.quantity)), '[]'::jsonb) AS components
+		     FROM order_item_components c
+		     WHERE c.order_item_id = oi.id AND p.bundle_type = 'mixed') sel
+		 WHERE oi.order_id = $1
+		 GROUP BY p.id, p.name, p.is_active, p.stock, v.id, sel.components
+		 ORDER BY p.name, v.sort_order, v.size_ml`, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+	defer rows.Close()
+
+	items := []OrderItemRequest{}
+	names := []string{}
+	skipped := []ReorderSkippedItem{}
+	for rows.Next() {
+		var productID, variantID, name string
+		var components []BundleSelection
+		var quantity, stock int
+		var isActive, needsVariant bool
+		if err := rows.Scan(&productID, &variantID, &components, &name, &quantity, &isActive, &stock, &needsVariant); err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+		}
+		added, reason := reorderQuantity(quantity, stock, isActive, needsVariant)
+		if reason != "" {
+			skipped = append(skipped, ReorderSkippedItem{
+				ProductID: productID, VariantID: variantID, Name: name, Requested: quantity, Added: added, Reason: reason,
+			})
+		}
+		if added > 0 {
+			items = append(items, OrderItemRequest{
+				ProductID: productID, VariantID: variantID, Components: normalizeSelections(components), Quantity: added,
+			})
+			names = append(names, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+	rows.Close()
+
+	// Un pack mixto cuya regla cambió desde el pedido ya no se puede armar igual
+	valid := items[:0]
+	for i, item := range items {
+		err := checkCartBundles(ctx, db.DB, []OrderItemRequest{item})
+		if err == nil {
+			valid = append(valid, item)
+			continue
+		}
+		if !isReorderBundleSkip(err) {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+		}
+		skipped = append(skipped, ReorderSkippedItem{
+			ProductID: item.ProductID, VariantID: item.VariantID, Name: names[i], Requested: item.Quantity, Reason: "invalid_bundle",
+		})
+	}
+	items = valid
+	if len(items) == 0 {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error":   "Ningún producto del pedido está disponible",
+			"code":    "NOTHING_TO_REORDER",
+			"skipped": skipped,
 		})
 	}
 
-	// Si hay usuario autenticado, usar la función original
-	return SaveCart(c)
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+	if err := replaceCartItems(ctx, tx, userID, items); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar el carrito"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al guardar carrito"})
+	}
+
+	// El carrito se cotiza con precios y promociones vigentes, no con los del pedido original
+	quote, _, err := quoteCart(ctx, db.DB, items)
+	if err != nil {
+		return respondCheckoutError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"items":      items,
+		"lines":      quote.Lines,
+		"promotions": quote.Promotions,
+		"totals":     quote.Totals,
+		"skipped":    skipped,
+	})
 }
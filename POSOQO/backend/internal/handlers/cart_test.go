@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReviewCartItems valida qué items del carrito se cotizan y qué avisos recibe el cliente
+func TestReviewCartItems(t *testing.T) {
+	oldPrice := 12.0
+	samePrice := 15.0
+	stored := []storedCartItem{
+		{ProductID: "ipa", Name: "IPA", Quantity: 2, SavedPrice: &samePrice, Price: 15, Stock: 10, IsActive: true},
+		{ProductID: "stout", Name: "Stout", Quantity: 1, SavedPrice: &oldPrice, Price: 14, Stock: 5, IsActive: true},
+		{ProductID: "lager", Name: "Lager", Quantity: 6, Price: 10, Stock: 4, IsActive: true},
+		{ProductID: "porter", Name: "Porter", Quantity: 1, Price: 16, Stock: 0, IsActive: true},
+		{ProductID: "merch", Name: "Polo", Quantity: 1, Price: 40, Stock: 3, IsActive: false},
+	}
+
+	items, warnings := reviewCartItems(stored)
+
+	assert.Equal(t, []OrderItemRequest{
+		{ProductID: "ipa", Quantity: 2},
+		{ProductID: "stout", Quantity: 1},
+		{ProductID: "lager", Quantity: 4},
+	}, items)
+	assert.Equal(t, 4, stored[2].Quantity, "la cantidad ajustada se guarda en el carrito")
+
+	codes := map[string]string{}
+	for _, w := range warnings {
+		codes[w.ProductID] = w.Code
+	}
+	assert.Equal(t, map[string]string{
+		"stout":  "PRICE_CHANGED",
+		"lager":  "QUANTITY_ADJUSTED",
+		"porter": "OUT_OF_STOCK",
+		"merch":  "PRODUCT_UNAVAILABLE",
+	}, codes)
+
+	for _, w := range warnings {
+		if w.Code == "PRICE_CHANGED" {
+			assert.Equal(t, 12.0, *w.OldPrice)
+			assert.Equal(t, 14.0, *w.NewPrice)
+		}
+	}
+}
+
+// TestReorderQuantity valida por qué se omite o reduce cada línea al repetir un pedido
+func TestReorderQuantity(t *testing.T) {
+	tests := []struct {
+		name         string
+		quantity     int
+		stock        int
+		isActive     bool
+		needsVariant bool
+		added        int
+		reason       string
+	}{
+		{"Disponible", 3, 10, true, false, 3, ""},
+		{"Producto inactivo", 3, 10, false, false, 0, "inactive"},
+		{"Ahora requiere formato", 3, 10, true, true, 0, "variant_required"},
+		{"Agotado", 3, 0, true, false, 0, "out_of_stock"},
+		{"Stock parcial", 6, 4, true, false, 4, "limited_stock"},
+		{"Stock parcial sobre el límite", 300, 150, true, false, 100, "limited_stock"},
+		{"Sobre el límite por línea", 120, 500, true, false, 100, "quantity_limit"},
+		{"Justo en el límite", 100, 500, true, false, 100, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, reason := reorderQuantity(tt.quantity, tt.stock, tt.isActive, tt.needsVariant)
+			assert.Equal(t, tt.added, added)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+}
+
+// TestIsReorderBundleSkip valida qué errores de packs omiten la línea (invalid_bundle) y cuáles cortan la operación
+func TestIsReorderBundleSkip(t *testing.T) {
+	assert.True(t, isReorderBundleSkip(&BundleError{ProductID: "pack", Message: "regla cambiada"}))
+	assert.True(t, isReorderBundleSkip(fmt.Errorf("pack: %w", &ProductUnavailableError{ProductID: "ipa"})))
+	assert.False(t, isReorderBundleSkip(errors.New("conexión perdida")))
+}
+
+// TestQuoteAvailableItems valida que una línea que ya no se puede cotizar no impida ver el carrito
+func TestQuoteAvailableItems(t *testing.T) {
+	pack := OrderItemRequest{ProductID: "pack", Components: []BundleSelection{{ProductID: "stout", Quantity: 6}}, Quantity: 1}
+	ipa := OrderItemRequest{ProductID: "ipa", Quantity: 2}
+	// El componente del pack se desactivó después de guardarlo en el carrito
+	quote := func(items []OrderItemRequest) (*CartQuote, error) {
+		result := &CartQuote{}
+		for _, item := range items {
+			if item.ProductID == "pack" {
+				return nil, fmt.Errorf("cotizar: %w", &BundleError{ProductID: "pack", Message: "Un producto del pack ya no está disponible"})
+			}
+			result.Lines = append(result.Lines, CartQuoteLine{ProductID: item.ProductID, Quantity: item.Quantity})
+		}
+		return result, nil
+	}
+
+	result, items, failed, err := quoteAvailableItems([]OrderItemRequest{pack, ipa}, quote)
+	assert.NoError(t, err)
+	assert.Equal(t, []OrderItemRequest{ipa}, items)
+	assert.Len(t, result.Lines, 1)
+	packErr, ok := failed[cartItemKey("pack", "", pack.Components)]
+	if assert.True(t, ok) {
+		warning := cartLineWarning(storedCartItem{ProductID: "pack", Name: "Six pack"}, packErr)
+		assert.Equal(t, "INVALID_BUNDLE", warning.Code)
+		assert.Equal(t, "Un producto del pack ya no está disponible", warning.Message)
+	}
+
+	// Solo el pack: el carrito se muestra vacío de líneas cotizadas
+	result, items, failed, err = quoteAvailableItems([]OrderItemRequest{pack}, quote)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+	assert.Empty(t, result.Lines)
+	assert.Len(t, failed, 1)
+
+	// Un fallo interno sí corta la respuesta
+	_, _, _, err = quoteAvailableItems([]OrderItemRequest{ipa}, func([]OrderItemRequest) (*CartQuote, error) {
+		return nil, errors.New("conexión perdida")
+	})
+	assert.Error(t, err)
+}
+
+// TestReorderOwnership valida que repetir un pedido de invitado (user_id NULL) se rechace
+// como ajeno en lugar de fallar al leerlo
+func TestReorderOwnership(t *testing.T) {
+	ctx := context.Background()
+	guest := newScriptedTx().on("SELECT user_id, status FROM orders", []interface{}{nil, "entregado"})
+	_, err := loadOwnOrderStatus(ctx, guest, "o1", 7, false)
+	assert.ErrorIs(t, err, errOrderNotOwned)
+
+	other := newScriptedTx().on("SELECT user_id, status FROM orders", []interface{}{int64(8), "entregado"})
+	_, err = loadOwnOrderStatus(ctx, other, "o1", 7, false)
+	assert.ErrorIs(t, err, errOrderNotOwned)
+
+	_, err = loadOwnOrderStatus(ctx, newScriptedTx(), "o1", 7, false)
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+
+	own := newScriptedTx().on("SELECT user_id, status FROM orders", []interface{}{int64(7), "entregado"})
+	status, err := loadOwnOrderStatus(ctx, own, "o1", 7, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "entregado", status)
+}
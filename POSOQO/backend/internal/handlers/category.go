@@ -8,25 +8,32 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
 )
 
 type CategoryRequest struct {
 	Name     string `json:"name"`
 	ParentID string `json:"parent_id,omitempty"`
+	TaxType  string `json:"tax_type,omitempty"` // afectación al IGV (por defecto gravado)
+	// RequiresAgeVerification marca la categoría como alcohol (nil = no cambia)
+	RequiresAgeVerification *bool `json:"requires_age_verification,omitempty"`
 }
 
 type CategoryResponse struct {
 	ID        string  `json:"id"`
 	Name      string  `json:"name"`
 	ParentID  *string `json:"parent_id,omitempty"`
+	TaxType   string  `json:"tax_type"`
 	CreatedAt string  `json:"created_at"`
 	UpdatedAt string  `json:"updated_at"`
+	// RequiresAgeVerification indica que sus productos solo se venden a mayores de edad
+	RequiresAgeVerification bool `json:"requires_age_verification"`
 }
 
 // ListCategories devuelve todas las categorías
 func ListCategories(c *fiber.Ctx) error {
 	rows, err := db.DB.Query(context.Background(), 
-		"SELECT id, name, parent_id, created_at, updated_at FROM categories ORDER BY parent_id NULLS FIRST, name")
+		"SELECT id, name, parent_id, tax_type, requires_age_verification, created_at, updated_at FROM categories ORDER BY parent_id NULLS FIRST, name")
 	if err != nil {
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener categorías"})
 	}
@@ -37,7 +44,7 @@ func ListCategories(c *fiber.Ctx) error {
 		var cat CategoryResponse
 		var parentID *string
 		var createdAt, updatedAt time.Time
-		if err := rows.Scan(&cat.ID, &cat.Name, &parentID, &createdAt, &updatedAt); err != nil {
+		if err := rows.Scan(&cat.ID, &cat.Name, &parentID, &cat.TaxType, &cat.RequiresAgeVerification, &createdAt, &updatedAt); err != nil {
 			continue
 		}
 		cat.ParentID = parentID
@@ -119,6 +126,9 @@ func CreateCategory(c *fiber.Ctx) error {
 	if req.Name == "" {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "El nombre es obligatorio"})
 	}
+	if req.TaxType != "" && !utils.IsValidTaxType(req.TaxType) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Afectación al IGV inválida (gravado, exonerado o inafecto)"})
+	}
 
 	var err error
 	var categoryID string
@@ -134,12 +144,12 @@ func CreateCategory(c *fiber.Ctx) error {
 		}
 
 		err = db.DB.QueryRow(context.Background(), 
-			"INSERT INTO categories (name, parent_id) VALUES ($1, $2) RETURNING id", 
-			req.Name, req.ParentID).Scan(&categoryID)
+			"INSERT INTO categories (name, parent_id, tax_type, requires_age_verification) VALUES ($1, $2, COALESCE(NULLIF($3, ''), 'gravado'), COALESCE($4, FALSE)) RETURNING id", 
+			req.Name, req.ParentID, req.TaxType, req.RequiresAgeVerification).Scan(&categoryID)
 	} else {
 		// Crear categoría padre
 		err = db.DB.QueryRow(context.Background(), 
-			"INSERT INTO categories (name) VALUES ($1) RETURNING id", req.Name).Scan(&categoryID)
+			"INSERT INTO categories (name, tax_type, requires_age_verification) VALUES ($1, COALESCE(NULLIF($2, ''), 'gravado'), COALESCE($3, FALSE)) RETURNING id", req.Name, req.TaxType, req.RequiresAgeVerification).Scan(&categoryID)
 	}
 
 	if err != nil {
@@ -168,6 +178,9 @@ func UpdateCategory(c *fiber.Ctx) error {
 	if req.Name == "" {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "El nombre es obligatorio"})
 	}
+	if req.TaxType != "" && !utils.IsValidTaxType(req.TaxType) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Afectación al IGV inválida (gravado, exonerado o inafecto)"})
+	}
 
 	// Verificar que la categoría existe
 	var exists bool
@@ -192,10 +205,10 @@ func UpdateCategory(c *fiber.Ctx) error {
 		}
 
 		_, err = db.DB.Exec(context.Background(), 
-			"UPDATE categories SET name=$1, parent_id=$2 WHERE id=$3", req.Name, req.ParentID, id)
+			"UPDATE categories SET name=$1, parent_id=$2, tax_type=COALESCE(NULLIF($4, ''), tax_type), requires_age_verification=COALESCE($5, requires_age_verification) WHERE id=$3", req.Name, req.ParentID, id, req.TaxType, req.RequiresAgeVerification)
 	} else {
 		_, err = db.DB.Exec(context.Background(), 
-			"UPDATE categories SET name=$1, parent_id=NULL WHERE id=$2", req.Name, id)
+			"UPDATE categories SET name=$1, parent_id=NULL, tax_type=COALESCE(NULLIF($3, ''), tax_type), requires_age_verification=COALESCE($4, requires_age_verification) WHERE id=$2", req.Name, id, req.TaxType, req.RequiresAgeVerification)
 	}
 
 	if err != nil {
@@ -0,0 +1,631 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// OrderTotals es el desglose del cobro calculado por el servidor
+type OrderTotals struct {
+	Subtotal float64 `json:"subtotal"`
+	Discount float64 `json:"discount"`
+	Shipping float64 `json:"shipping"`
+	// Deposit es la garantía por envases retornables (growler, barril), sin IGV
+	Deposit float64 `json:"deposit"`
+	Total   float64 `json:"total"`
+	// GiftCard es la parte del total pagada con gift card
+	GiftCard float64 `json:"gift_card,omitempty"`
+	// Loyalty es la parte del descuento pagada con puntos
+	Loyalty float64 `json:"loyalty_discount,omitempty"`
+}
+
+// AmountDue es lo que queda por cobrar después de la gift card
+func (t OrderTotals) AmountDue() float64 {
+	return roundMoney(t.Total - t.GiftCard)
+}
+
+// checkoutInput reúne los datos necesarios para crear un pedido desde cualquier flujo
+// de checkout (pago contra entrega o PaymentIntent de Stripe)
+type checkoutInput struct {
+	UserID        int64
+	Actor         orderActor
+	Status        string
+	PaymentMethod string
+	Items         []OrderItemRequest
+	Location      string
+	Lat           interface{}
+	Lng           interface{}
+	CouponCode    string
+	// FulfillmentType es delivery o pickup; ScheduledFor nil significa lo antes posible
+	FulfillmentType string
+	ScheduledFor    *time.Time
+	// BillingProfileID es el perfil (DNI o RUC) elegido para el comprobante
+	BillingProfileID *int64
+	// Guest son los datos de contacto de un pedido sin cuenta; en ese caso UserID no se usa
+	Guest *GuestContact
+	// Subscription es la suscripción del club que genera el pedido (con su descuento)
+	Subscription *subscriptionOrder
+	// GiftCardCode paga parte o todo el total con el saldo de una gift card
+	GiftCardCode string
+	// LoyaltyPoints son los puntos a canjear como descuento y LoyaltyRewardID la
+	// recompensa elegida (solo clientes con cuenta)
+	LoyaltyPoints   int
+	LoyaltyRewardID string
+}
+
+// GuestContact son los datos de contacto de quien compra sin cuenta
+type GuestContact struct {
+	Name  string
+	Email string
+	Phone string
+	// BirthDate y DNIVerified solo se exigen si el pedido contiene alcohol
+	BirthDate   *time.Time
+	DNIVerified bool
+}
+
+// customerID devuelve el usuario dueño del pedido, o nil si es un pedido de invitado
+func (in checkoutInput) customerID() *int64 {
+	if in.Guest != nil {
+		return nil
+	}
+	return &in.UserID
+}
+
+// coordinates devuelve las coordenadas de entrega si el pedido las tiene
+func (in checkoutInput) coordinates() (float64, float64, bool) {
+	lat, okLat := in.Lat.(float64)
+	lng, okLng := in.Lng.(float64)
+	return lat, lng, okLat && okLng
+}
+
+// dbQuerier permite usar las mismas consultas con el pool o dentro de una transacción
+type dbQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+// pricedLine es una línea del carrito o pedido con su precio vigente y categorías
+type pricedLine struct {
+	ItemID      string // order_items.id (vacío para carritos)
+	ProductID   string
+	VariantID   string // formato elegido (vacío si el producto no tiene variantes)
+	Name        string
+	CategoryIDs []string // categoría del producto y su categoría padre
+	Quantity    int
+	UnitPrice   float64
+	Discount    float64 // descuento por promociones
+	// CouponDiscount es la parte del cupón asignada a la línea
+	CouponDiscount float64
+	TaxType        string  // afectación al IGV (utils.TaxGravado, ...)
+	Deposit        float64 // garantía por unidad del envase retornable
+	// Components son los productos que consume cada unidad si la línea es un pack
+	Components []BundleSelection
+}
+
+// Subtotal devuelve cantidad x precio unitario de la línea
+func (l pricedLine) Subtotal() float64 {
+	return l.UnitPrice * float64(l.Quantity)
+}
+
+// Net devuelve el subtotal de la línea menos sus descuentos por promociones
+func (l pricedLine) Net() float64 {
+	return l.Subtotal() - l.Discount
+}
+
+// Charged devuelve lo que se cobra por la línea (con IGV) después de promociones y cupón
+func (l pricedLine) Charged() float64 {
+	return roundMoney(l.Net() - l.CouponDiscount)
+}
+
+// CartQuoteLine es una línea del carrito con su precio calculado por el servidor
+type CartQuoteLine struct {
+	ProductID string  `json:"product_id"`
+	VariantID string  `json:"variant_id,omitempty"`
+	Name      string  `json:"name"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+	Subtotal  float64 `json:"subtotal"`
+	Discount  float64 `json:"discount"`
+	Total     float64 `json:"total"`
+	Deposit   float64 `json:"deposit,omitempty"` // garantía por unidad
+	// Components son los productos que contiene cada unidad si la línea es un pack
+	Components []BundleSelection `json:"components,omitempty"`
+}
+
+// CartQuote es la cotización de un carrito: líneas, promociones y totales
+type CartQuote struct {
+	Lines      []CartQuoteLine    `json:"lines"`
+	Promotions []AppliedPromotion `json:"promotions"`
+	Totals     OrderTotals        `json:"totals"`
+	// RequiresAgeVerification indica que el carrito tiene alcohol y se pedirá verificar la edad
+	RequiresAgeVerification bool `json:"requires_age_verification"`
+}
+
+// quoteCart calcula precios, promociones y totales de un carrito con las mismas reglas
+// que placeOrder, sin reservar stock ni registrar canjes
+func quoteCart(ctx context.Context, q dbQuerier, items []OrderItemRequest) (*CartQuote, []pricedLine, error) {
+	lines, err := priceItems(ctx, q, items)
+	if err != nil {
+		return nil, nil, err
+	}
+	promos, err := loadActivePromotions(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := evaluatePromotions(promos, lines, time.Now())
+	applyLinePromotions(lines, result)
+	restricted, err := linesRequireAgeVerification(ctx, q, lines)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	quote := &CartQuote{Lines: make([]CartQuoteLine, 0, len(lines)), Promotions: result.Applied, RequiresAgeVerification: restricted}
+	for _, line := range lines {
+		quote.Lines = append(quote.Lines, CartQuoteLine{
+			ProductID:  line.ProductID,
+			VariantID:  line.VariantID,
+			Name:       line.Name,
+			Quantity:   line.Quantity,
+			UnitPrice:  line.UnitPrice,
+			Subtotal:   roundMoney(line.Subtotal()),
+			Discount:   line.Discount,
+			Total:      roundMoney(line.Net()),
+			Deposit:    line.Deposit,
+			Components: line.Components,
+		})
+		quote.Totals.Subtotal += line.Subtotal()
+	}
+	quote.Totals.Subtotal = roundMoney(quote.Totals.Subtotal)
+	quote.Totals.Discount = result.Total
+	quote.Totals.Deposit = depositTotal(lines)
+	quote.Totals.Total = roundMoney(quote.Totals.Subtotal - quote.Totals.Discount + quote.Totals.Shipping + quote.Totals.Deposit)
+	return quote, lines, nil
+}
+
+// depositTotal suma las garantías por envases retornables de las líneas
+func depositTotal(lines []pricedLine) float64 {
+	var total float64
+	for _, line := range lines {
+		total += line.Deposit * float64(line.Quantity)
+	}
+	return roundMoney(total)
+}
+
+// pricedLineColumns son las columnas que lee scanPricedLines (en ese orden);
+// v es el LEFT JOIN a la variante del item
+const pricedLineColumns = `p.id::text, COALESCE(v.id::text, ''), ` + itemNameSQL + `,
+	ARRAY_REMOVE(ARRAY[p.category_id::text, cat.parent_id::text], NULL),
+	COALESCE(p.tax_type, cat.tax_type, 'gravado')`
+
+// priceItems obtiene los precios vigentes de los items enviados por el cliente. Si el
+// producto tiene formatos, el precio y la garantía son los de la variante elegida; si
+// es un pack, se resuelven los componentes que consume.
+func priceItems(ctx context.Context, q dbQuerier, items []OrderItemRequest) ([]pricedLine, error) {
+	lines := make([]pricedLine, 0, len(items))
+	for _, item := range items {
+		line := pricedLine{Quantity: item.Quantity}
+		var hasVariants bool
+		var bundleType string
+		err := q.QueryRow(ctx,
+			`SELECT `+pricedLineColumns+`, COALESCE(v.price, p.price), COALESCE(v.deposit_amount, 0),
+			        EXISTS(SELECT 1 FROM product_variants pv WHERE pv.product_id = p.id AND pv.is_active),
+			        COALESCE(p.bundle_type, '')
+			 FROM products p
+			 LEFT JOIN categories cat ON cat.id = p.category_id
+			 LEFT JOIN product_variants v ON v.id = NULLIF($2, '')::uuid AND v.product_id = p.id AND v.is_active
+			 WHERE p.id=$1 AND p.is_active=TRUE`, item.ProductID, item.VariantID).
+			Scan(&line.ProductID, &line.VariantID, &line.Name, &line.CategoryIDs, &line.TaxType, &line.UnitPrice, &line.Deposit, &hasVariants, &bundleType)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && item.VariantID != "" && line.VariantID == "") {
+			return nil, &ProductUnavailableError{ProductID: item.ProductID}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hasVariants && line.VariantID == "" {
+			return nil, &VariantRequiredError{ProductID: item.ProductID}
+		}
+		line.Components, err = resolveBundle(ctx, q, bundleType, line.ProductID, item.Components)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// loadOrderLines obtiene las líneas guardadas de un pedido
+func loadOrderLines(ctx context.Context, q dbQuerier, orderID string) ([]pricedLine, error) {
+	rows, err := q.Query(ctx,
+		`SELECT oi.id::text, `+pricedLineColumns+`, oi.quantity, oi.unit_price, oi.deposit_amount
+		 FROM order_items oi
+		 JOIN products p ON p.id = oi.product_id
+		 LEFT JOIN categories cat ON cat.id = p.category_id
+		 LEFT JOIN product_variants v ON v.id = oi.variant_id
+		 WHERE oi.order_id = $1`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []pricedLine{}
+	for rows.Next() {
+		var line pricedLine
+		if err := rows.Scan(&line.ItemID, &line.ProductID, &line.VariantID, &line.Name, &line.CategoryIDs, &line.TaxType,
+			&line.Quantity, &line.UnitPrice, &line.Deposit); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// ProductUnavailableError indica un producto inexistente o inactivo en el carrito
+type ProductUnavailableError struct {
+	ProductID string
+}
+
+func (e *ProductUnavailableError) Error() string {
+	return fmt.Sprintf("producto %s no encontrado o inactivo", e.ProductID)
+}
+
+// validateOrderItems valida los items recibidos del cliente y devuelve el mensaje de error
+func validateOrderItems(items []OrderItemRequest) string {
+	if len(items) == 0 {
+		return "Carrito vacío"
+	}
+	for _, item := range items {
+		if !utils.IsValidString(item.ProductID, 1, 50) {
+			return "ID de producto inválido"
+		}
+		if !utils.IsValidNumber(item.Quantity, 1, 100) {
+			return "Cantidad inválida (1-100)"
+		}
+		if item.VariantID != "" && !utils.IsValidUUID(item.VariantID) {
+			return "ID de formato inválido"
+		}
+		if len(item.Components) > maxPackUnits {
+			return "Demasiados productos en el pack"
+		}
+		for _, s := range item.Components {
+			if !utils.IsValidUUID(s.ProductID) || (s.VariantID != "" && !utils.IsValidUUID(s.VariantID)) {
+				return "ID de producto del pack inválido"
+			}
+			if !utils.IsValidNumber(s.Quantity, 1, maxPackUnits) {
+				return "Cantidad inválida en el pack"
+			}
+		}
+	}
+	return ""
+}
+
+// placeOrder crea el pedido y sus items con los precios vigentes, reserva el stock y
+// guarda el desglose de totales. Es el único punto donde se calcula lo que se cobra.
+func placeOrder(ctx context.Context, tx pgx.Tx, in checkoutInput) (string, OrderTotals, error) {
+	if in.FulfillmentType == "" {
+		in.FulfillmentType = fulfillmentDelivery
+	}
+	// La franja se valida antes de insertar para no contarse a sí mismo en el cupo
+	if in.ScheduledFor != nil {
+		if err := reserveSlot(ctx, tx, in.FulfillmentType, *in.ScheduledFor); err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+
+	var guestName, guestEmail, guestPhone *string
+	if in.Guest != nil {
+		guestName, guestEmail, guestPhone = &in.Guest.Name, &in.Guest.Email, &in.Guest.Phone
+	}
+
+	var subscriptionID *string
+	if in.Subscription != nil {
+		subscriptionID = &in.Subscription.ID
+	}
+
+	var orderID string
+	err := tx.QueryRow(ctx,
+		`INSERT INTO orders (user_id, status, payment_method, total, location, lat, lng, fulfillment_type, scheduled_for,
+		                     guest_name, guest_email, guest_phone, subscription_id)
+		 VALUES ($1, $2, $3, 0, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		in.customerID(), in.Status, in.PaymentMethod, in.Location, in.Lat, in.Lng, in.FulfillmentType, in.ScheduledFor,
+		guestName, guestEmail, guestPhone, subscriptionID).Scan(&orderID)
+	if err != nil {
+		return "", OrderTotals{}, err
+	}
+	if err := recordOrderStatus(ctx, tx, orderID, nil, in.Status, in.Actor, "Pedido creado"); err != nil {
+		return "", OrderTotals{}, err
+	}
+
+	// Los datos de facturación se copian para que editar el perfil no cambie el pedido
+	if in.BillingProfileID != nil && in.Guest == nil {
+		profile, err := loadBillingProfile(ctx, tx, in.UserID, *in.BillingProfileID)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+		_, err = tx.Exec(ctx,
+			`UPDATE orders SET billing_doc_type=$1, billing_doc_number=$2, billing_name=$3, billing_address=$4
+			 WHERE id=$5`,
+			profile.sunatDocType(), profile.DocNumber, profile.Name, profile.Address, orderID)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+
+	// Precios vigentes con la misma consulta que cotiza el carrito (quoteCart)
+	priced, err := priceItems(ctx, tx, in.Items)
+	if err != nil {
+		return "", OrderTotals{}, err
+	}
+
+	// Bebidas alcohólicas: solo con la edad verificada y revisando el documento en la entrega
+	verifyID, err := checkAgeVerification(ctx, tx, in, priced)
+	if err != nil {
+		return "", OrderTotals{}, err
+	}
+	if verifyID {
+		var guestBirthDate *time.Time
+		if in.Guest != nil {
+			guestBirthDate = in.Guest.BirthDate
+		}
+		_, err = tx.Exec(ctx, "UPDATE orders SET verify_id_on_delivery=TRUE, guest_birth_date=$1 WHERE id=$2",
+			guestBirthDate, orderID)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+	for _, line := range priced {
+		var itemID string
+		err = tx.QueryRow(ctx,
+			`INSERT INTO order_items (order_id, product_id, variant_id, quantity, unit_price, deposit_amount)
+			 VALUES ($1, $2, NULLIF($3, '')::uuid, $4, $5, $6) RETURNING id`,
+			orderID, line.ProductID, line.VariantID, line.Quantity, line.UnitPrice, line.Deposit).Scan(&itemID)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+		// Los packs descuentan el stock de sus componentes
+		if err := saveOrderItemComponents(ctx, tx, itemID, line.Components); err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+
+	// Reservar stock con bloqueo de filas dentro de la misma transacción
+	if err := reserveStock(ctx, tx, orderID); err != nil {
+		return "", OrderTotals{}, err
+	}
+
+	lines, err := loadOrderLines(ctx, tx, orderID)
+	if err != nil {
+		return "", OrderTotals{}, err
+	}
+
+	var totals OrderTotals
+	for _, line := range lines {
+		totals.Subtotal += line.Subtotal()
+	}
+	totals.Subtotal = roundMoney(totals.Subtotal)
+
+	// Promociones automáticas (multibuy, bundles, happy hour)
+	promos, err := loadActivePromotions(ctx, tx)
+	if err != nil {
+		return "", OrderTotals{}, err
+	}
+	promoResult := evaluatePromotions(promos, lines, time.Now())
+	applyLinePromotions(lines, promoResult)
+	if err := savePromotionsForOrder(ctx, tx, orderID, lines, promoResult); err != nil {
+		return "", OrderTotals{}, err
+	}
+	totals.Discount = promoResult.Total
+
+	// Cupón de descuento sobre el monto ya promocionado (valida límites y registra el canje)
+	if in.CouponCode != "" {
+		var couponEmail string
+		if in.Guest != nil {
+			couponEmail = in.Guest.Email
+		}
+		discount, err := applyCoupon(ctx, tx, in.customerID(), couponEmail, orderID, in.CouponCode, lines)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+		totals.Discount = roundMoney(totals.Discount + discount)
+	}
+
+	// Descuento del Club POSOQO (los pedidos de suscripción no llevan cupón)
+	if in.Subscription != nil {
+		totals.Discount = roundMoney(totals.Discount + applyClubDiscount(lines, in.Subscription.DiscountPercent))
+	}
+
+	// Canje de puntos: va después del cupón porque se suma a lo ya asignado por línea
+	totals.Loyalty, err = redeemLoyalty(ctx, tx, in, orderID, lines)
+	if err != nil {
+		return "", OrderTotals{}, err
+	}
+	totals.Discount = roundMoney(totals.Discount + totals.Loyalty)
+
+	// Zona de reparto: costo de envío, pedido mínimo y tiempo estimado (no aplica al recojo)
+	var zone *deliveryZone
+	if in.FulfillmentType == fulfillmentDelivery {
+		lat, lng, hasLocation := in.coordinates()
+		zone, err = resolveDelivery(ctx, tx, lat, lng, hasLocation, totals.Subtotal-totals.Discount)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+	if zone != nil {
+		totals.Shipping = zone.Fee
+		_, err = tx.Exec(ctx,
+			"UPDATE orders SET delivery_zone_id=$1, delivery_eta_minutes=$2 WHERE id=$3",
+			zone.ID, zone.EtaMinutes, orderID)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+
+	totals.Deposit = depositTotal(lines)
+	totals.Total = roundMoney(totals.Subtotal - totals.Discount + totals.Shipping + totals.Deposit)
+
+	// Desglose de IGV por línea; el envío es un servicio gravado y la garantía de envases
+	// no es una venta, por eso va como inafecta
+	var tax utils.TaxBreakdown
+	for _, line := range lines {
+		base, igv := tax.Add(line.Charged(), line.TaxType)
+		_, err = tx.Exec(ctx,
+			"UPDATE order_items SET tax_type=$1, net_amount=$2, taxable_base=$3, igv_amount=$4 WHERE id=$5",
+			line.TaxType, line.Charged(), base, igv, line.ItemID)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+	tax.Add(totals.Shipping, utils.TaxGravado)
+	tax.Add(totals.Deposit, utils.TaxInafecto)
+
+	// La gift card es un medio de pago: no cambia el total ni el IGV, solo lo que se cobra
+	if in.GiftCardCode != "" {
+		minCharge := 0.0
+		if in.PaymentMethod == paymentMethodStripe {
+			minCharge = stripeMinimumCharge
+		}
+		totals.GiftCard, err = redeemGiftCard(ctx, tx, orderID, in.GiftCardCode, totals.Total, minCharge, in.Actor.UserID)
+		if err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE orders SET subtotal=$1, discount_total=$2, shipping_fee=$3, deposit_total=$4, total=$5,
+		        taxable_amount=$6, exempt_amount=$7, unaffected_amount=$8, igv_amount=$9, gift_card_amount=$10
+		 WHERE id=$11`,
+		totals.Subtotal, totals.Discount, totals.Shipping, totals.Deposit, totals.Total,
+		tax.Gravado, tax.Exonerado, tax.Inafecto, tax.IGV, totals.GiftCard, orderID)
+	if err != nil {
+		return "", OrderTotals{}, err
+	}
+
+	// Conversión del último recordatorio de carrito abandonado del usuario
+	if userID := in.customerID(); userID != nil {
+		if err := recordCartRecovery(ctx, tx, *userID, orderID); err != nil {
+			return "", OrderTotals{}, err
+		}
+	}
+
+	return orderID, totals, nil
+}
+
+// respondCheckoutError traduce los errores de placeOrder a la respuesta HTTP
+func respondCheckoutError(c *fiber.Ctx, err error) error {
+	var unavailable *ProductUnavailableError
+	if errors.As(err, &unavailable) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error":      "Producto no encontrado o inactivo",
+			"product_id": unavailable.ProductID,
+		})
+	}
+	var variantErr *VariantRequiredError
+	if errors.As(err, &variantErr) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error":      "Elige un formato para el producto",
+			"code":       "VARIANT_REQUIRED",
+			"product_id": variantErr.ProductID,
+		})
+	}
+	var bundleErr *BundleError
+	if errors.As(err, &bundleErr) {
+		return respondBundleError(c, bundleErr)
+	}
+	var ageErr *AgeVerificationError
+	if errors.As(err, &ageErr) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": ageErr.Message, "code": ageErr.Code})
+	}
+	var stockErr *InsufficientStockError
+	if errors.As(err, &stockErr) {
+		return respondStockError(c, err)
+	}
+	var couponErr *CouponError
+	if errors.As(err, &couponErr) {
+		return respondCouponError(c, err)
+	}
+	var giftErr *GiftCardError
+	if errors.As(err, &giftErr) {
+		return respondGiftCardError(c, err)
+	}
+	var loyaltyErr *LoyaltyError
+	if errors.As(err, &loyaltyErr) {
+		return c.Status(loyaltyErr.Status).JSON(fiber.Map{"error": loyaltyErr.Message, "code": loyaltyErr.Code})
+	}
+	var deliveryErr *DeliveryError
+	if errors.As(err, &deliveryErr) {
+		return respondDeliveryError(c, deliveryErr)
+	}
+	var slotErr *SlotError
+	if errors.As(err, &slotErr) {
+		return respondSlotError(c, slotErr)
+	}
+	if errors.Is(err, ErrBillingProfileNotFound) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Perfil de facturación no encontrado",
+			"code":  "BILLING_PROFILE_NOT_FOUND",
+		})
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear el pedido"})
+}
+
+// respondAmountMismatch rechaza un monto del cliente que no coincide con el calculado
+func respondAmountMismatch(c *fiber.Ctx, expected float64, totals *OrderTotals) error {
+	resp := fiber.Map{
+		"error":           "El monto no coincide con el total del pedido",
+		"code":            "AMOUNT_MISMATCH",
+		"expected_amount": expected,
+	}
+	if totals != nil {
+		resp["totals"] = totals
+	}
+	return c.Status(http.StatusConflict).JSON(resp)
+}
+
+// toCents convierte soles a céntimos para Stripe evitando errores de redondeo
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// roundMoney redondea un monto a dos decimales
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// reconcileOrderPayment guarda el monto capturado por Stripe y lo compara con el total
+// esperado del pedido. Si no coinciden se marca el pedido y se avisa a los admins.
+func reconcileOrderPayment(orderID string, capturedCents int64) {
+	// Lo pagado con gift card no pasa por Stripe
+	var total float64
+	err := db.DB.QueryRow(context.Background(), "SELECT total - gift_card_amount FROM orders WHERE id=$1", orderID).Scan(&total)
+	if err != nil {
+		fmt.Printf("Error obteniendo total del pedido %s: %v\n", orderID, err)
+		return
+	}
+
+	mismatch := capturedCents != toCents(total)
+	captured := float64(capturedCents) / 100.0
+	_, err = db.DB.Exec(context.Background(),
+		"UPDATE orders SET amount_paid=$1, payment_mismatch=$2 WHERE id=$3",
+		captured, mismatch, orderID)
+	if err != nil {
+		fmt.Printf("Error guardando monto pagado del pedido %s: %v\n", orderID, err)
+		return
+	}
+
+	if mismatch {
+		fmt.Printf("[PAGO] Monto capturado S/%.2f no coincide con total S/%.2f del pedido %s\n", captured, total, orderID)
+		CreateAutomaticNotificationWithPriority("warning", "Pago no conciliado",
+			fmt.Sprintf("El pedido %s esperaba S/%.2f pero Stripe capturó S/%.2f", orderID, total, captured),
+			nil, &orderID, 3)
+	}
+}
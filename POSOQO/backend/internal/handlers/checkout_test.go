@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestToCents valida que la conversión a céntimos no pierda centavos por redondeo
+func TestToCents(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		expected int64
+	}{
+		{"Entero", 25, 2500},
+		{"Decimal exacto", 12.5, 1250},
+		{"Decimal con error de coma flotante", 19.99, 1999},
+		{"Suma acumulada", 0.1 + 0.2, 30},
+		{"Cero", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, toCents(tt.amount))
+		})
+	}
+}
@@ -2,24 +2,255 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
 	"github.com/posoqo/backend/internal/db"
 	"github.com/posoqo/backend/internal/utils"
 )
 
 type CouponRequest struct {
-	Code       string  `json:"code"`
-	Value      float64 `json:"value"`
-	Type       string  `json:"type"`
-	Expiration string  `json:"expiration"`
+	Code           string   `json:"code"`
+	Value          float64  `json:"value"`
+	Type           string   `json:"type"`
+	Expiration     string   `json:"expiration"`
+	MaxRedemptions *int     `json:"max_redemptions"`
+	MaxPerUser     *int     `json:"max_per_user"`
+	MinOrderAmount float64  `json:"min_order_amount"`
+	ProductIDs     []string `json:"product_ids"`
+	CategoryIDs    []string `json:"category_ids"`
+}
+
+type UpdateCouponRequest struct {
+	IsActive   *bool   `json:"is_active"`
+	Expiration *string `json:"expiration"`
+	// Los límites omitidos se conservan; 0 quita el límite
+	MaxRedemptions *int     `json:"max_redemptions"`
+	MaxPerUser     *int     `json:"max_per_user"`
+	MinOrderAmount *float64 `json:"min_order_amount"`
 }
 
 type ValidateCouponRequest struct {
-	Code string `json:"code"`
+	Code  string             `json:"code"`
+	Items []OrderItemRequest `json:"items"`
+}
+
+// couponRule es un cupón con sus reglas de uso cargado desde la base de datos
+type couponRule struct {
+	ID               string
+	Code             string
+	Type             string
+	Value            float64
+	Expiration       time.Time
+	IsActive         bool
+	MaxRedemptions   *int
+	MaxPerUser       *int
+	MinOrderAmount   float64
+	ProductIDs       []string
+	CategoryIDs      []string
+	RedemptionsCount int
+	UserID           *int64 // Cupón personal: solo lo canjea este usuario
+}
+
+// CouponError indica por qué un cupón no puede aplicarse
+type CouponError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *CouponError) Error() string {
+	return e.Message
+}
+
+var errCouponNotFound = &CouponError{Status: http.StatusNotFound, Code: "COUPON_INVALID", Message: "Cupón no válido"}
+
+var errCouponNotOwner = &CouponError{Status: http.StatusForbidden, Code: "COUPON_NOT_OWNER", Message: "Este cupón es personal y no pertenece a tu cuenta"}
+
+// normalizeCouponCode aplica el mismo formato con el que se guardan los códigos
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// loadCoupon obtiene un cupón por código; con forUpdate bloquea la fila para canjearlo
+func loadCoupon(ctx context.Context, q dbQuerier, code string, forUpdate bool) (*couponRule, error) {
+	query := `SELECT id, code, type, value, expiration, is_active, max_redemptions, max_per_user,
+	                 min_order_amount, product_ids::text[], category_ids::text[], redemptions_count, user_id
+	          FROM coupons WHERE code=$1`
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var r couponRule
+	err := q.QueryRow(ctx, query, normalizeCouponCode(code)).Scan(&r.ID, &r.Code, &r.Type, &r.Value, &r.Expiration,
+		&r.IsActive, &r.MaxRedemptions, &r.MaxPerUser, &r.MinOrderAmount, &r.ProductIDs, &r.CategoryIDs, &r.RedemptionsCount, &r.UserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errCouponNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// appliesTo indica si la línea está dentro del alcance del cupón
+func (r *couponRule) appliesTo(line pricedLine) bool {
+	if len(r.ProductIDs) == 0 && len(r.CategoryIDs) == 0 {
+		return true
+	}
+	for _, id := range r.ProductIDs {
+		if id == line.ProductID {
+			return true
+		}
+	}
+	for _, id := range r.CategoryIDs {
+		for _, categoryID := range line.CategoryIDs {
+			if id == categoryID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allows indica si el cliente puede canjear el cupón; los invitados no canjean cupones personales
+func (r *couponRule) allows(userID *int64) error {
+	if r.UserID != nil && (userID == nil || *userID != *r.UserID) {
+		return errCouponNotOwner
+	}
+	return nil
+}
+
+// evaluate calcula el descuento del cupón sobre las líneas del pedido. No valida los
+// límites de canje, que dependen de la base de datos (ver applyCoupon).
+func (r *couponRule) evaluate(lines []pricedLine, now time.Time) (float64, error) {
+	if !r.IsActive {
+		return 0, errCouponNotFound
+	}
+	// La fecha de expiración es inclusiva: el cupón vale todo ese día
+	if now.After(r.Expiration.AddDate(0, 0, 1)) {
+		return 0, &CouponError{Status: http.StatusBadRequest, Code: "COUPON_EXPIRED", Message: "Cupón expirado"}
+	}
+
+	subtotal, eligible := 0.0, 0.0
+	for _, line := range lines {
+		amount := line.Net()
+		subtotal += amount
+		if r.appliesTo(line) {
+			eligible += amount
+		}
+	}
+	if subtotal < r.MinOrderAmount {
+		return 0, &CouponError{
+			Status:  http.StatusBadRequest,
+			Code:    "COUPON_MIN_ORDER",
+			Message: fmt.Sprintf("El pedido mínimo para este cupón es S/%.2f", r.MinOrderAmount),
+		}
+	}
+	if eligible <= 0 {
+		return 0, &CouponError{Status: http.StatusBadRequest, Code: "COUPON_NOT_APPLICABLE", Message: "El cupón no aplica a los productos del carrito"}
+	}
+
+	discount := r.Value
+	if r.Type == "percent" {
+		discount = eligible * math.Min(r.Value, 100) / 100
+	}
+	return roundMoney(math.Min(discount, eligible)), nil
+}
+
+// allocate reparte el descuento del cupón entre las líneas a las que aplica en
+// proporción a su importe; la última absorbe el redondeo para que la suma cuadre
+func (r *couponRule) allocate(lines []pricedLine, discount float64) {
+	eligible, last := 0.0, -1
+	for i, line := range lines {
+		if r.appliesTo(line) && line.Net() > 0 {
+			eligible += line.Net()
+			last = i
+		}
+	}
+	if last < 0 || eligible <= 0 {
+		return
+	}
+	remaining := discount
+	for i := range lines {
+		if !r.appliesTo(lines[i]) || lines[i].Net() <= 0 {
+			continue
+		}
+		share := roundMoney(discount * lines[i].Net() / eligible)
+		if i == last {
+			share = roundMoney(remaining)
+		}
+		lines[i].CouponDiscount = share
+		remaining -= share
+	}
+}
+
+// applyCoupon valida los límites de canje con el cupón bloqueado, calcula el descuento,
+// lo reparte entre las líneas y registra el canje del pedido en coupon_redemptions.
+// Para invitados userID es nil y el límite por cliente se cuenta por guestEmail.
+func applyCoupon(ctx context.Context, tx pgx.Tx, userID *int64, guestEmail, orderID, code string, lines []pricedLine) (float64, error) {
+	rule, err := loadCoupon(ctx, tx, code, true)
+	if err != nil {
+		return 0, err
+	}
+	if err := rule.allows(userID); err != nil {
+		return 0, err
+	}
+	discount, err := rule.evaluate(lines, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if rule.MaxRedemptions != nil && rule.RedemptionsCount >= *rule.MaxRedemptions {
+		return 0, &CouponError{Status: http.StatusConflict, Code: "COUPON_EXHAUSTED", Message: "El cupón alcanzó su límite de usos"}
+	}
+	if rule.MaxPerUser != nil {
+		var used int
+		err := tx.QueryRow(ctx,
+			`SELECT COUNT(*) FROM coupon_redemptions r
+			 JOIN orders o ON o.id = r.order_id
+			 WHERE r.coupon_id=$1 AND r.reversed_at IS NULL
+			   AND (r.user_id=$2 OR LOWER(o.guest_email) = LOWER(NULLIF($3, '')))`,
+			rule.ID, userID, guestEmail).Scan(&used)
+		if err != nil {
+			return 0, err
+		}
+		if used >= *rule.MaxPerUser {
+			return 0, &CouponError{Status: http.StatusConflict, Code: "COUPON_USER_LIMIT", Message: "Ya usaste este cupón el máximo de veces permitido"}
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO coupon_redemptions (coupon_id, user_id, order_id, discount_amount) VALUES ($1, $2, $3, $4)",
+		rule.ID, userID, orderID, discount)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, "UPDATE coupons SET redemptions_count = redemptions_count + 1 WHERE id=$1", rule.ID)
+	if err != nil {
+		return 0, err
+	}
+	rule.allocate(lines, discount)
+	return discount, nil
+}
+
+// reverseCouponRedemptions revierte los canjes de un pedido cancelado para liberar sus usos
+func reverseCouponRedemptions(ctx context.Context, tx pgx.Tx, orderID string) error {
+	_, err := tx.Exec(ctx,
+		`WITH reversed AS (
+		     UPDATE coupon_redemptions SET reversed_at = NOW()
+		     WHERE order_id = $1 AND reversed_at IS NULL
+		     RETURNING coupon_id
+		 )
+		 UPDATE coupons c SET redemptions_count = GREATEST(c.redemptions_count - r.n, 0)
+		 FROM (SELECT coupon_id, COUNT(*) AS n FROM reversed GROUP BY coupon_id) r
+		 WHERE c.id = r.coupon_id`, orderID)
+	return err
 }
 
 // Crear cupón (solo admin)
@@ -37,12 +268,29 @@ func CreateCoupon(c *fiber.Ctx) error {
 	if req.Type != "fixed" && req.Type != "percent" {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tipo de cupón inválido"})
 	}
+	if req.Type == "percent" && req.Value > 100 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "El porcentaje no puede ser mayor a 100"})
+	}
 	if !utils.IsValidString(req.Expiration, 8, 10) {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Fecha de expiración inválida"})
 	}
+	if (req.MaxRedemptions != nil && *req.MaxRedemptions < 1) || (req.MaxPerUser != nil && *req.MaxPerUser < 1) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Los límites de uso deben ser mayores a 0"})
+	}
+	if req.MinOrderAmount < 0 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Monto mínimo inválido"})
+	}
+	if req.ProductIDs == nil {
+		req.ProductIDs = []string{}
+	}
+	if req.CategoryIDs == nil {
+		req.CategoryIDs = []string{}
+	}
 	_, err := db.DB.Exec(context.Background(),
-		`INSERT INTO coupons (code, value, type, expiration) VALUES ($1, $2, $3, $4)`,
-		strings.ToUpper(strings.TrimSpace(req.Code)), req.Value, req.Type, req.Expiration)
+		`INSERT INTO coupons (code, value, type, expiration, max_redemptions, max_per_user, min_order_amount, product_ids, category_ids)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8::uuid[], $9::uuid[])`,
+		normalizeCouponCode(req.Code), req.Value, req.Type, req.Expiration,
+		req.MaxRedemptions, req.MaxPerUser, req.MinOrderAmount, req.ProductIDs, req.CategoryIDs)
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo crear el cupón (¿ya existe?)"})
 	}
@@ -66,7 +314,9 @@ func ListCoupons(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Error al contar cupones"})
 	}
 	offset := (page - 1) * limit
-	listQuery := `SELECT id, code, value, type, expiration, is_active, created_at, updated_at FROM coupons ORDER BY created_at DESC LIMIT $1 OFFSET $2`
+	listQuery := `SELECT id, code, value, type, expiration::text, is_active, max_redemptions, max_per_user, min_order_amount,
+	                     product_ids::text[], category_ids::text[], redemptions_count, created_at, updated_at
+	              FROM coupons ORDER BY created_at DESC LIMIT $1 OFFSET $2`
 	rows, err := db.DB.Query(context.Background(), listQuery, limit, offset)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener cupones"})
@@ -76,21 +326,31 @@ func ListCoupons(c *fiber.Ctx) error {
 	coupons := []fiber.Map{}
 	for rows.Next() {
 		var id, code, ctype, expiration string
-		var value float64
+		var value, minOrderAmount float64
 		var isActive bool
+		var maxRedemptions, maxPerUser *int
+		var productIDs, categoryIDs []string
+		var redemptionsCount int
 		var createdAt, updatedAt time.Time
-		if err := rows.Scan(&id, &code, &value, &ctype, &expiration, &isActive, &createdAt, &updatedAt); err != nil {
+		if err := rows.Scan(&id, &code, &value, &ctype, &expiration, &isActive, &maxRedemptions, &maxPerUser, &minOrderAmount,
+			&productIDs, &categoryIDs, &redemptionsCount, &createdAt, &updatedAt); err != nil {
 			continue
 		}
 		coupons = append(coupons, fiber.Map{
-			"id":         id,
-			"code":       code,
-			"value":      value,
-			"type":       ctype,
-			"expiration": expiration,
-			"is_active":  isActive,
-			"created_at": createdAt,
-			"updated_at": updatedAt,
+			"id":                id,
+			"code":              code,
+			"value":             value,
+			"type":              ctype,
+			"expiration":        expiration,
+			"is_active":         isActive,
+			"max_redemptions":   maxRedemptions,
+			"max_per_user":      maxPerUser,
+			"min_order_amount":  minOrderAmount,
+			"product_ids":       productIDs,
+			"category_ids":      categoryIDs,
+			"redemptions_count": redemptionsCount,
+			"created_at":        createdAt,
+			"updated_at":        updatedAt,
 		})
 	}
 	return c.JSON(fiber.Map{
@@ -104,7 +364,102 @@ func ListCoupons(c *fiber.Ctx) error {
 	})
 }
 
-// Validar cupón (usuario)
+// Actualizar cupón (solo admin): activar/desactivar, expiración y límites
+func UpdateCoupon(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var req UpdateCouponRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if req.Expiration != nil && !utils.IsValidString(*req.Expiration, 8, 10) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Fecha de expiración inválida"})
+	}
+	if (req.MaxRedemptions != nil && *req.MaxRedemptions < 0) || (req.MaxPerUser != nil && *req.MaxPerUser < 0) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Los límites de uso no pueden ser negativos (0 quita el límite)"})
+	}
+	if req.MinOrderAmount != nil && *req.MinOrderAmount < 0 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Monto mínimo inválido"})
+	}
+	setMaxRedemptions, maxRedemptions := couponLimitUpdate(req.MaxRedemptions)
+	setMaxPerUser, maxPerUser := couponLimitUpdate(req.MaxPerUser)
+	res, err := db.DB.Exec(context.Background(),
+		`UPDATE coupons SET
+		     is_active = COALESCE($1, is_active),
+		     expiration = COALESCE($2::date, expiration),
+		     max_redemptions = CASE WHEN $3 THEN $4::int ELSE max_redemptions END,
+		     max_per_user = CASE WHEN $5 THEN $6::int ELSE max_per_user END,
+		     min_order_amount = COALESCE($7, min_order_amount),
+		     updated_at = NOW()
+		 WHERE id = $8`,
+		req.IsActive, req.Expiration, setMaxRedemptions, maxRedemptions, setMaxPerUser, maxPerUser, req.MinOrderAmount, id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo actualizar el cupón"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Cupón no encontrado"})
+	}
+	return c.JSON(fiber.Map{"message": "Cupón actualizado"})
+}
+
+// couponLimitUpdate traduce un límite de la edición: nil lo conserva y 0 lo quita (NULL)
+func couponLimitUpdate(limit *int) (bool, *int) {
+	if limit == nil {
+		return false, nil
+	}
+	if *limit == 0 {
+		return true, nil
+	}
+	return true, limit
+}
+
+// Listar canjes de un cupón (solo admin) para atribuir descuentos en reportes
+func ListCouponRedemptions(c *fiber.Ctx) error {
+	id := c.Params("id")
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT r.order_id, r.user_id, u.name, r.discount_amount, r.reversed_at, r.created_at, o.total, o.status
+		 FROM coupon_redemptions r
+		 JOIN orders o ON o.id = r.order_id
+		 LEFT JOIN users u ON u.id = r.user_id
+		 WHERE r.coupon_id = $1
+		 ORDER BY r.created_at DESC`, id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener canjes"})
+	}
+	defer rows.Close()
+
+	redemptions := []fiber.Map{}
+	totalDiscount := 0.0
+	for rows.Next() {
+		var orderID, status string
+		var userID *int64
+		var userName *string
+		var discount, orderTotal float64
+		var reversedAt *time.Time
+		var createdAt time.Time
+		if err := rows.Scan(&orderID, &userID, &userName, &discount, &reversedAt, &createdAt, &orderTotal, &status); err != nil {
+			continue
+		}
+		if reversedAt == nil {
+			totalDiscount += discount
+		}
+		redemptions = append(redemptions, fiber.Map{
+			"order_id":        orderID,
+			"user_id":         userID,
+			"user_name":       userName,
+			"discount_amount": discount,
+			"order_total":     orderTotal,
+			"order_status":    status,
+			"reversed_at":     reversedAt,
+			"created_at":      createdAt,
+		})
+	}
+	return c.JSON(fiber.Map{
+		"redemptions":    redemptions,
+		"total_discount": roundMoney(totalDiscount),
+	})
+}
+
+// Validar cupón (público). Si se envían items se calcula el descuento que tendría el carrito.
 func ValidateCoupon(c *fiber.Ctx) error {
 	var req ValidateCouponRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -113,28 +468,56 @@ func ValidateCoupon(c *fiber.Ctx) error {
 	if !utils.IsValidString(req.Code, 3, 20) {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Código inválido"})
 	}
-	var id, code, ctype, expiration string
-	var value float64
-	var isActive bool
-	var createdAt, updatedAt time.Time
-	err := db.DB.QueryRow(context.Background(),
-		`SELECT id, code, value, type, expiration, is_active, created_at, updated_at FROM coupons WHERE code=$1`,
-		strings.ToUpper(strings.TrimSpace(req.Code))).Scan(&id, &code, &value, &ctype, &expiration, &isActive, &createdAt, &updatedAt)
-	if err != nil || !isActive {
-		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Cupón no válido"})
+	rule, err := loadCoupon(context.Background(), db.DB, req.Code, false)
+	if err != nil {
+		return respondCouponError(c, err)
 	}
-	exp, _ := time.Parse("2006-01-02", expiration)
-	if exp.Before(time.Now()) {
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Cupón expirado"})
+
+	resp := fiber.Map{
+		"id":               rule.ID,
+		"code":             rule.Code,
+		"value":            rule.Value,
+		"type":             rule.Type,
+		"expiration":       rule.Expiration.Format("2006-01-02"),
+		"is_active":        rule.IsActive,
+		"min_order_amount": rule.MinOrderAmount,
+		"product_ids":      rule.ProductIDs,
+		"category_ids":     rule.CategoryIDs,
 	}
-	return c.JSON(fiber.Map{
-		"id":         id,
-		"code":       code,
-		"value":      value,
-		"type":       ctype,
-		"expiration": expiration,
-		"is_active":  isActive,
-		"created_at": createdAt,
-		"updated_at": updatedAt,
-	})
+
+	if len(req.Items) > 0 {
+		if msg := validateOrderItems(req.Items); msg != "" {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+		}
+		lines, err := priceItems(context.Background(), db.DB, req.Items)
+		if err != nil {
+			return respondCheckoutError(c, err)
+		}
+		discount, err := rule.evaluate(lines, time.Now())
+		if err != nil {
+			return respondCouponError(c, err)
+		}
+		resp["discount"] = discount
+	} else if _, err := rule.evaluate(nil, time.Now()); err != nil {
+		// Sin items solo se validan vigencia y estado del cupón
+		var couponErr *CouponError
+		if errors.As(err, &couponErr) && (couponErr.Code == "COUPON_INVALID" || couponErr.Code == "COUPON_EXPIRED") {
+			return respondCouponError(c, err)
+		}
+	}
+
+	if rule.MaxRedemptions != nil && rule.RedemptionsCount >= *rule.MaxRedemptions {
+		return respondCouponError(c, &CouponError{Status: http.StatusConflict, Code: "COUPON_EXHAUSTED", Message: "El cupón alcanzó su límite de usos"})
+	}
+
+	return c.JSON(resp)
+}
+
+// respondCouponError traduce un error de cupón a la respuesta HTTP
+func respondCouponError(c *fiber.Ctx, err error) error {
+	var couponErr *CouponError
+	if errors.As(err, &couponErr) {
+		return c.Status(couponErr.Status).JSON(fiber.Map{"error": couponErr.Message, "code": couponErr.Code})
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al validar cupón"})
 }
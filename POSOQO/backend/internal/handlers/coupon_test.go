@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCouponEvaluate valida el cálculo de descuento, el alcance y el pedido mínimo de los cupones
+func TestCouponEvaluate(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	lines := []pricedLine{
+		{ProductID: "ipa", CategoryIDs: []string{"craft", "beers"}, Quantity: 2, UnitPrice: 15},
+		{ProductID: "merch", CategoryIDs: []string{"merch"}, Quantity: 1, UnitPrice: 40},
+	}
+
+	tests := []struct {
+		name      string
+		rule      couponRule
+		expected  float64
+		errorCode string
+	}{
+		{"Porcentaje global", couponRule{IsActive: true, Type: "percent", Value: 10}, 7, ""},
+		{"Monto fijo", couponRule{IsActive: true, Type: "fixed", Value: 12.5}, 12.5, ""},
+		{"Fijo limitado a lo elegible", couponRule{IsActive: true, Type: "fixed", Value: 50, ProductIDs: []string{"ipa"}}, 30, ""},
+		{"Porcentaje por categoría padre", couponRule{IsActive: true, Type: "percent", Value: 50, CategoryIDs: []string{"beers"}}, 15, ""},
+		{"No aplica al carrito", couponRule{IsActive: true, Type: "percent", Value: 10, ProductIDs: []string{"otro"}}, 0, "COUPON_NOT_APPLICABLE"},
+		{"Pedido mínimo", couponRule{IsActive: true, Type: "fixed", Value: 5, MinOrderAmount: 100}, 0, "COUPON_MIN_ORDER"},
+		{"Expirado", couponRule{IsActive: true, Type: "fixed", Value: 5, Expiration: now.AddDate(0, 0, -2)}, 0, "COUPON_EXPIRED"},
+		{"Vence hoy", couponRule{IsActive: true, Type: "fixed", Value: 5, Expiration: time.Date(2025, 6, 15, 0, 0, 0, 0, time.UTC)}, 5, ""},
+		{"Inactivo", couponRule{Type: "fixed", Value: 5}, 0, "COUPON_INVALID"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			if rule.Expiration.IsZero() {
+				rule.Expiration = now.AddDate(0, 1, 0)
+			}
+			discount, err := rule.evaluate(lines, now)
+			if tt.errorCode != "" {
+				if assert.Error(t, err) {
+					assert.Equal(t, tt.errorCode, err.(*CouponError).Code)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, discount)
+		})
+	}
+}
+
+// TestApplyCouponPersonal valida que un cupón de recuperación solo lo canjee su destinatario
+func TestApplyCouponPersonal(t *testing.T) {
+	owner, other := int64(5), int64(6)
+	personalCouponTx := func() *scriptedTx {
+		return newScriptedTx().on("FROM coupons WHERE code", []interface{}{
+			"c1", "VUELVE-ABCD1234", "percent", 10.0, time.Now().AddDate(0, 0, 7), true, 1, 1,
+			0.0, []string{}, []string{}, 0, owner,
+		})
+	}
+	lines := []pricedLine{{ProductID: "ipa", Quantity: 2, UnitPrice: 15}}
+
+	for _, userID := range []*int64{&other, nil} {
+		tx := personalCouponTx()
+		_, err := applyCoupon(context.Background(), tx, userID, "invitado@correo.com", "o1", "vuelve-abcd1234", lines)
+		assert.Equal(t, errCouponNotOwner, err)
+		assert.Empty(t, tx.execs)
+	}
+
+	tx := personalCouponTx().on("SELECT COUNT(*) FROM coupon_redemptions", []interface{}{0})
+	discount, err := applyCoupon(context.Background(), tx, &owner, "", "o1", "vuelve-abcd1234", lines)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, discount)
+	assert.Len(t, tx.executed("INSERT INTO coupon_redemptions"), 1)
+}
+
+// TestUpdateCouponLimits valida que la edición conserve, cambie o quite los límites de uso
+func TestUpdateCouponLimits(t *testing.T) {
+	unlimited, fifty := 0, 50
+	set, value := couponLimitUpdate(nil)
+	assert.False(t, set)
+	assert.Nil(t, value)
+
+	// 0 deja el cupón sin límite
+	set, value = couponLimitUpdate(&unlimited)
+	assert.True(t, set)
+	assert.Nil(t, value)
+
+	set, value = couponLimitUpdate(&fifty)
+	assert.True(t, set)
+	assert.Equal(t, &fifty, value)
+
+	app := fiber.New()
+	app.Put("/coupons/:id", UpdateCoupon)
+	req := httptest.NewRequest(http.MethodPut, "/coupons/c1", bytes.NewBufferString(`{"max_per_user": -1}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
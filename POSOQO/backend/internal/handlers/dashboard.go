@@ -750,51 +750,90 @@ func GetAdminOrdersListPublic(c *fiber.Ctx) error {
 		log.Printf("[DEBUG] Columnas de coordenadas existen: %v", hasCoordinates)
 	}
 
+	// Filtros por franja para planificar la preparación:
+	// ?slot=<inicio RFC3339> o ?date=YYYY-MM-DD, opcionalmente con ?fulfillment_type=
+	conditions := []string{}
+	args := []interface{}{}
+	if slot := c.Query("slot"); slot != "" {
+		at, err := time.Parse(time.RFC3339, slot)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Franja inválida (formato RFC3339)"})
+		}
+		args = append(args, at)
+		conditions = append(conditions, fmt.Sprintf("o.scheduled_for = $%d", len(args)))
+	} else if date := c.Query("date"); date != "" {
+		day, err := time.ParseInLocation("2006-01-02", date, businessLocation())
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Fecha inválida (formato YYYY-MM-DD)"})
+		}
+		args = append(args, day, day.AddDate(0, 0, 1))
+		conditions = append(conditions, fmt.Sprintf("o.scheduled_for >= $%d AND o.scheduled_for < $%d", len(args)-1, len(args)))
+	}
+	if fulfillmentType := c.Query("fulfillment_type"); fulfillmentType != "" {
+		if !isValidFulfillmentType(fulfillmentType) {
+			return c.Status(400).JSON(fiber.Map{"error": "Tipo de entrega inválido (delivery o pickup)"})
+		}
+		args = append(args, fulfillmentType)
+		conditions = append(conditions, fmt.Sprintf("o.fulfillment_type = $%d", len(args)))
+	}
+
 	// Query dinámico según si existen las columnas
 	var query string
 	if hasCoordinates {
 		query = `
 			SELECT 
 				o.id,
-				o.user_id,
-				COALESCE(u.name, '') as user_name,
+				COALESCE(o.user_id, 0) as user_id,
+				COALESCE(u.name, o.guest_name, '') as user_name,
 				COALESCE(u.last_name, '') as user_last_name,
-				COALESCE(u.email, '') as user_email,
+				COALESCE(u.email, o.guest_email, '') as user_email,
 				COALESCE(u.dni, '') as dni,
-				COALESCE(u.phone, '') as phone,
+				COALESCE(u.phone, o.guest_phone, '') as phone,
 				o.total,
 				o.status,
 				COALESCE(o.location, '') as location,
 				COALESCE(o.lat, 0) as lat,
 				COALESCE(o.lng, 0) as lng,
+				o.fulfillment_type,
+				o.scheduled_for,
 				o.created_at,
 				o.updated_at
 			FROM orders o
 			LEFT JOIN users u ON o.user_id = u.id
-			ORDER BY o.created_at DESC
 		`
 	} else {
 		query = `
 			SELECT 
 				o.id,
-				o.user_id,
-				COALESCE(u.name, '') as user_name,
+				COALESCE(o.user_id, 0) as user_id,
+				COALESCE(u.name, o.guest_name, '') as user_name,
 				COALESCE(u.last_name, '') as user_last_name,
-				COALESCE(u.email, '') as user_email,
+				COALESCE(u.email, o.guest_email, '') as user_email,
 				COALESCE(u.dni, '') as dni,
-				COALESCE(u.phone, '') as phone,
+				COALESCE(u.phone, o.guest_phone, '') as phone,
 				o.total,
 				o.status,
 				COALESCE(o.location, '') as location,
+				o.fulfillment_type,
+				o.scheduled_for,
 				o.created_at,
 				o.updated_at
 			FROM orders o
 			LEFT JOIN users u ON o.user_id = u.id
-			ORDER BY o.created_at DESC
 		`
 	}
 
-	rows, err := db.DB.Query(context.Background(), query)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// Al filtrar por franja se ordena por hora programada
+	if c.Query("slot") != "" || c.Query("date") != "" {
+		query += " ORDER BY o.scheduled_for, o.created_at"
+	} else {
+		query += " ORDER BY o.created_at DESC"
+	}
+
+	rows, err := db.DB.Query(context.Background(), query, args...)
 	if err != nil {
 		fmt.Printf("[ERROR] Error en query GetAdminOrdersListPublic: %v\n", err)
 		return c.Status(500).JSON(fiber.Map{
@@ -815,15 +854,17 @@ func GetAdminOrdersListPublic(c *fiber.Ctx) error {
 		var location string
 		var createdAt, updatedAt time.Time
 		var lat, lng float64
+		var fulfillmentType string
+		var scheduledFor *time.Time
 
 		if hasCoordinates {
-			err := rows.Scan(&id, &userID, &userName, &userLastName, &userEmail, &dni, &phone, &total, &status, &location, &lat, &lng, &createdAt, &updatedAt)
+			err := rows.Scan(&id, &userID, &userName, &userLastName, &userEmail, &dni, &phone, &total, &status, &location, &lat, &lng, &fulfillmentType, &scheduledFor, &createdAt, &updatedAt)
 			if err != nil {
 				fmt.Printf("[ERROR] Error escaneando orden con coordenadas: %v\n", err)
 				continue
 			}
 		} else {
-			err := rows.Scan(&id, &userID, &userName, &userLastName, &userEmail, &dni, &phone, &total, &status, &location, &createdAt, &updatedAt)
+			err := rows.Scan(&id, &userID, &userName, &userLastName, &userEmail, &dni, &phone, &total, &status, &location, &fulfillmentType, &scheduledFor, &createdAt, &updatedAt)
 			if err != nil {
 				fmt.Printf("[ERROR] Error escaneando orden sin coordenadas: %v\n", err)
 				continue
@@ -839,19 +880,22 @@ func GetAdminOrdersListPublic(c *fiber.Ctx) error {
 		}
 
 		order := fiber.Map{
-			"id":         id,
-			"user_id":    userID,
-			"user_name":  fullName,
-			"user_email": userEmail,
-			"dni":        dni,
-			"phone":      phone,
-			"total":      total,
-			"status":     status,
-			"location":   location,
-			"lat":        lat,
-			"lng":        lng,
-			"created_at": createdAt.Format("2006-01-02T15:04:05Z"),
-			"updated_at": updatedAt.Format("2006-01-02T15:04:05Z"),
+			"id":               id,
+			"user_id":          userID,
+			"user_name":        fullName,
+			"user_email":       userEmail,
+			"is_guest":         userID == 0,
+			"dni":              dni,
+			"phone":            phone,
+			"total":            total,
+			"status":           status,
+			"location":         location,
+			"lat":              lat,
+			"lng":              lng,
+			"fulfillment_type": fulfillmentType,
+			"scheduled_for":    scheduledFor,
+			"created_at":       createdAt.Format("2006-01-02T15:04:05Z"),
+			"updated_at":       updatedAt.Format("2006-01-02T15:04:05Z"),
 		}
 		orders = append(orders, order)
 	}
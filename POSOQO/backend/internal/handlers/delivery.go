@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// Tipos de zona de reparto
+const (
+	zoneTypeRadius  = "radius"
+	zoneTypePolygon = "polygon"
+)
+
+// DeliveryZoneRequest datos para crear o actualizar una zona de reparto (solo admin)
+type DeliveryZoneRequest struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	RadiusKm   *float64         `json:"radius_km"`
+	Polygon    []utils.GeoPoint `json:"polygon"`
+	Fee        float64          `json:"fee"`
+	MinOrder   float64          `json:"min_order"`
+	EtaMinutes int              `json:"eta_minutes"`
+	Priority   int              `json:"priority"`
+	IsActive   *bool            `json:"is_active"`
+}
+
+// DeliveryQuoteRequest ubicación (y opcionalmente carrito) a cotizar
+type DeliveryQuoteRequest struct {
+	Lat   *float64           `json:"lat"`
+	Lng   *float64           `json:"lng"`
+	Items []OrderItemRequest `json:"items"`
+}
+
+// deliveryZone es una zona de reparto cargada desde la base de datos
+type deliveryZone struct {
+	ID         string           `json:"id"`
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	RadiusKm   float64          `json:"radius_km,omitempty"`
+	Polygon    []utils.GeoPoint `json:"polygon,omitempty"`
+	Fee        float64          `json:"fee"`
+	MinOrder   float64          `json:"min_order"`
+	EtaMinutes int              `json:"eta_minutes"`
+	Priority   int              `json:"priority"`
+	IsActive   bool             `json:"is_active"`
+}
+
+// DeliveryError indica por qué no se puede entregar un pedido en la ubicación dada
+type DeliveryError struct {
+	Code     string
+	Message  string
+	MinOrder float64
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Message
+}
+
+// breweryLocation devuelve la ubicación de la cervecería (origen de las zonas por radio)
+func breweryLocation() *utils.GeoPoint {
+	lat, errLat := strconv.ParseFloat(os.Getenv("BREWERY_LAT"), 64)
+	lng, errLng := strconv.ParseFloat(os.Getenv("BREWERY_LNG"), 64)
+	if errLat != nil || errLng != nil || !utils.IsValidCoordinate(lat, lng) {
+		return nil
+	}
+	return &utils.GeoPoint{Lat: lat, Lng: lng}
+}
+
+// contains indica si el punto cae dentro de la zona
+func (z *deliveryZone) contains(origin *utils.GeoPoint, point utils.GeoPoint) bool {
+	switch z.Type {
+	case zoneTypeRadius:
+		return origin != nil && utils.HaversineKm(*origin, point) <= z.RadiusKm
+	case zoneTypePolygon:
+		return utils.PointInPolygon(point, z.Polygon)
+	}
+	return false
+}
+
+// matchDeliveryZone busca la zona que cubre el punto. Si varias lo cubren gana la de
+// mayor prioridad y, a igual prioridad, la de menor costo de envío.
+func matchDeliveryZone(zones []deliveryZone, origin *utils.GeoPoint, point utils.GeoPoint) *deliveryZone {
+	var best *deliveryZone
+	for i := range zones {
+		zone := &zones[i]
+		if !zone.contains(origin, point) {
+			continue
+		}
+		if best == nil || zone.Priority > best.Priority || (zone.Priority == best.Priority && zone.Fee < best.Fee) {
+			best = zone
+		}
+	}
+	return best
+}
+
+// loadDeliveryZones obtiene las zonas de reparto (solo activas si onlyActive)
+func loadDeliveryZones(ctx context.Context, q dbQuerier, onlyActive bool) ([]deliveryZone, error) {
+	query := `SELECT id, name, type, COALESCE(radius_km, 0), polygon, fee, min_order, eta_minutes, priority, is_active
+	          FROM delivery_zones`
+	if onlyActive {
+		query += " WHERE is_active = TRUE"
+	}
+	query += " ORDER BY priority DESC, name"
+
+	rows, err := q.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := []deliveryZone{}
+	for rows.Next() {
+		var z deliveryZone
+		var polygon []byte
+		if err := rows.Scan(&z.ID, &z.Name, &z.Type, &z.RadiusKm, &polygon, &z.Fee, &z.MinOrder, &z.EtaMinutes, &z.Priority, &z.IsActive); err != nil {
+			return nil, err
+		}
+		if len(polygon) > 0 {
+			if err := json.Unmarshal(polygon, &z.Polygon); err != nil {
+				return nil, fmt.Errorf("polígono inválido en zona %s: %w", z.ID, err)
+			}
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+// resolveDelivery determina la zona de reparto para la ubicación y valida el pedido
+// mínimo. Si no hay zonas configuradas el reparto no tiene costo ni restricciones.
+func resolveDelivery(ctx context.Context, q dbQuerier, lat, lng float64, hasLocation bool, goodsTotal float64) (*deliveryZone, error) {
+	zones, err := loadDeliveryZones(ctx, q, true)
+	if err != nil || len(zones) == 0 {
+		return nil, err
+	}
+	if !hasLocation || !utils.IsValidCoordinate(lat, lng) {
+		return nil, &DeliveryError{Code: "DELIVERY_LOCATION_REQUIRED", Message: "Indica la ubicación de entrega en el mapa"}
+	}
+
+	zone := matchDeliveryZone(zones, breweryLocation(), utils.GeoPoint{Lat: lat, Lng: lng})
+	if zone == nil {
+		return nil, &DeliveryError{Code: "OUT_OF_DELIVERY_AREA", Message: "Tu dirección está fuera de nuestra zona de reparto"}
+	}
+	if goodsTotal < zone.MinOrder {
+		return zone, &DeliveryError{
+			Code:     "BELOW_MINIMUM_ORDER",
+			Message:  fmt.Sprintf("El pedido mínimo para %s es S/%.2f", zone.Name, zone.MinOrder),
+			MinOrder: zone.MinOrder,
+		}
+	}
+	return zone, nil
+}
+
+// respondDeliveryError traduce un error de reparto a la respuesta HTTP
+func respondDeliveryError(c *fiber.Ctx, err *DeliveryError) error {
+	resp := fiber.Map{"error": err.Message, "code": err.Code}
+	if err.MinOrder > 0 {
+		resp["min_order"] = err.MinOrder
+	}
+	return c.Status(http.StatusBadRequest).JSON(resp)
+}
+
+// POST /api/delivery/quote
+// Cotiza el envío para una ubicación; con items también valida el pedido mínimo
+func QuoteDelivery(c *fiber.Ctx) error {
+	var req DeliveryQuoteRequest
+	if err := c.BodyParser(&req); err != nil || req.Lat == nil || req.Lng == nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Coordenadas requeridas"})
+	}
+	if !utils.IsValidCoordinate(*req.Lat, *req.Lng) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Coordenadas inválidas"})
+	}
+
+	goodsTotal := 0.0
+	var quote *CartQuote
+	if len(req.Items) > 0 {
+		if msg := validateOrderItems(req.Items); msg != "" {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+		}
+		var err error
+		quote, _, err = quoteCart(context.Background(), db.DB, req.Items)
+		if err != nil {
+			return respondCheckoutError(c, err)
+		}
+		goodsTotal = quote.Totals.Subtotal - quote.Totals.Discount
+	}
+
+	zone, err := resolveDelivery(context.Background(), db.DB, *req.Lat, *req.Lng, true, goodsTotal)
+	resp := fiber.Map{"deliverable": true, "fee": 0.0}
+	if deliveryErr, ok := err.(*DeliveryError); ok {
+		// Sin items no se valida el pedido mínimo: solo se informa
+		if deliveryErr.Code != "BELOW_MINIMUM_ORDER" || len(req.Items) > 0 {
+			resp["deliverable"] = false
+			resp["code"] = deliveryErr.Code
+			resp["error"] = deliveryErr.Message
+		}
+	} else if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al cotizar envío"})
+	}
+
+	if zone != nil {
+		resp["zone"] = fiber.Map{"id": zone.ID, "name": zone.Name}
+		resp["fee"] = zone.Fee
+		resp["min_order"] = zone.MinOrder
+		resp["eta_minutes"] = zone.EtaMinutes
+	}
+	if quote != nil {
+		quote.Totals.Shipping = resp["fee"].(float64)
+		quote.Totals.Total = roundMoney(quote.Totals.Subtotal - quote.Totals.Discount + quote.Totals.Shipping + quote.Totals.Deposit)
+		resp["totals"] = quote.Totals
+	}
+	return c.JSON(resp)
+}
+
+// validateDeliveryZoneRequest valida los campos de la zona según su tipo
+func validateDeliveryZoneRequest(req *DeliveryZoneRequest) string {
+	if !utils.IsValidString(req.Name, 2, 100) {
+		return "Nombre inválido (2-100 caracteres)"
+	}
+	switch req.Type {
+	case zoneTypeRadius:
+		if req.RadiusKm == nil || *req.RadiusKm <= 0 || *req.RadiusKm > 100 {
+			return "Radio inválido (0-100 km)"
+		}
+		req.Polygon = nil
+	case zoneTypePolygon:
+		if len(req.Polygon) < 3 {
+			return "El polígono necesita al menos 3 vértices"
+		}
+		for _, p := range req.Polygon {
+			if !utils.IsValidCoordinate(p.Lat, p.Lng) {
+				return "Vértice del polígono inválido"
+			}
+		}
+		req.RadiusKm = nil
+	default:
+		return "Tipo de zona inválido (radius o polygon)"
+	}
+	if req.Fee < 0 || req.MinOrder < 0 {
+		return "Costo y pedido mínimo no pueden ser negativos"
+	}
+	if req.EtaMinutes <= 0 {
+		req.EtaMinutes = 45
+	}
+	return ""
+}
+
+// polygonJSON serializa el polígono para la columna JSONB (nil si no aplica)
+func polygonJSON(polygon []utils.GeoPoint) interface{} {
+	if len(polygon) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(polygon)
+	return string(data)
+}
+
+// Listar zonas de reparto (solo admin)
+func ListDeliveryZones(c *fiber.Ctx) error {
+	zones, err := loadDeliveryZones(context.Background(), db.DB, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener zonas de reparto"})
+	}
+	return c.JSON(fiber.Map{"zones": zones, "origin": breweryLocation()})
+}
+
+// Crear zona de reparto (solo admin)
+func CreateDeliveryZone(c *fiber.Ctx) error {
+	var req DeliveryZoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateDeliveryZoneRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+	var id string
+	err := db.DB.QueryRow(context.Background(),
+		`INSERT INTO delivery_zones (name, type, radius_km, polygon, fee, min_order, eta_minutes, priority, is_active)
+		 VALUES ($1, $2, $3, $4::jsonb, $5, $6, $7, $8, $9) RETURNING id`,
+		req.Name, req.Type, req.RadiusKm, polygonJSON(req.Polygon), req.Fee, req.MinOrder, req.EtaMinutes, req.Priority, isActive).Scan(&id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo crear la zona de reparto"})
+	}
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"message": "Zona de reparto creada", "id": id})
+}
+
+// Actualizar zona de reparto (solo admin)
+func UpdateDeliveryZone(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var req DeliveryZoneRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateDeliveryZoneRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	res, err := db.DB.Exec(context.Background(),
+		`UPDATE delivery_zones SET name=$1, type=$2, radius_km=$3, polygon=$4::jsonb, fee=$5, min_order=$6,
+		        eta_minutes=$7, priority=$8, is_active=COALESCE($9, is_active)
+		 WHERE id=$10`,
+		req.Name, req.Type, req.RadiusKm, polygonJSON(req.Polygon), req.Fee, req.MinOrder, req.EtaMinutes, req.Priority, req.IsActive, id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo actualizar la zona de reparto"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Zona de reparto no encontrada"})
+	}
+	return c.JSON(fiber.Map{"message": "Zona de reparto actualizada"})
+}
+
+// Eliminar zona de reparto (solo admin)
+func DeleteDeliveryZone(c *fiber.Ctx) error {
+	id := c.Params("id")
+	res, err := db.DB.Exec(context.Background(), "DELETE FROM delivery_zones WHERE id=$1", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "No se pudo eliminar la zona de reparto"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Zona de reparto no encontrada"})
+	}
+	return c.JSON(fiber.Map{"message": "Zona de reparto eliminada"})
+}
@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -265,3 +268,84 @@ func ConsultarDNI(c *fiber.Ctx) error {
 		"data":    response,
 	})
 }
+
+// DNIProvider consulta personas en el padrón del RENIEC
+type DNIProvider interface {
+	LookupDNI(ctx context.Context, dni string) (*DNIDataResponse, error)
+}
+
+// ErrDNINotFound indica un DNI que no figura en el padrón
+var ErrDNINotFound = errors.New("DNI no encontrado")
+
+// dniProvider es el proveedor en uso; las pruebas lo reemplazan por uno falso
+var dniProvider DNIProvider = &apiPeruDNIProvider{
+	baseURL: "https://apiperu.dev/api",
+	client:  &http.Client{Timeout: 10 * time.Second},
+}
+
+// apiPeruDNIProvider consulta DNIs en APIperu.dev, el mismo servicio que ConsultarDNI
+type apiPeruDNIProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+// apiPeruDNIResponse es la respuesta de APIperu.dev para /dni/{dni}; numero y
+// codigo_verificacion se ignoran porque pueden venir como número o como texto
+type apiPeruDNIResponse struct {
+	Success bool `json:"success"`
+	Data    struct {
+		Nombres          string `json:"nombres"`
+		ApellidoPaterno  string `json:"apellido_paterno"`
+		ApellidoMaterno  string `json:"apellido_materno"`
+		NombresCompletos string `json:"nombres_completos"`
+	} `json:"data"`
+}
+
+// LookupDNI consulta un DNI en APIperu.dev
+func (p *apiPeruDNIProvider) LookupDNI(ctx context.Context, dni string) (*DNIDataResponse, error) {
+	apiToken := os.Getenv("APIPERU_TOKEN")
+	if apiToken == "" {
+		// Si no hay token, usar token de prueba (limitado)
+		apiToken = "demo"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/dni/%s", p.baseURL, dni), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrDNINotFound
+	case http.StatusTooManyRequests:
+		return nil, ErrLookupRateLimited
+	case http.StatusUnauthorized:
+		return nil, ErrLookupUnauthorized
+	default:
+		return nil, fmt.Errorf("APIperu respondió HTTP %d", resp.StatusCode)
+	}
+
+	var body apiPeruDNIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("respuesta inválida de APIperu: %w", err)
+	}
+	if !body.Success || (body.Data.Nombres == "" && body.Data.NombresCompletos == "") {
+		return nil, ErrDNINotFound
+	}
+	return &DNIDataResponse{
+		DNI:             dni,
+		Nombres:         strings.TrimSpace(body.Data.Nombres),
+		ApellidoPaterno: strings.TrimSpace(body.Data.ApellidoPaterno),
+		ApellidoMaterno: strings.TrimSpace(body.Data.ApellidoMaterno),
+		NombreCompleto:  strings.TrimSpace(body.Data.NombresCompletos),
+	}, nil
+}
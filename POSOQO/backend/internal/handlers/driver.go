@@ -0,0 +1,453 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// roleDriver es el rol de los repartidores
+const roleDriver = "repartidor"
+
+// AssignDriverRequest asigna (o quita, con driver_id null) el repartidor de un pedido
+type AssignDriverRequest struct {
+	DriverID *int64 `json:"driver_id"`
+}
+
+// DriverLocationRequest posición GPS enviada por el repartidor
+type DriverLocationRequest struct {
+	Lat       *float64 `json:"lat"`
+	Lng       *float64 `json:"lng"`
+	AccuracyM *float64 `json:"accuracy_m"`
+}
+
+// DeliveryProofRequest prueba de entrega: foto y/o firma subidas a Cloudinary desde la app
+type DeliveryProofRequest struct {
+	PhotoURL      string `json:"photo_url"`
+	SignatureURL  string `json:"signature_url"`
+	RecipientName string `json:"recipient_name"`
+	Notes         string `json:"notes"`
+	// IDVerified confirma que se revisó el documento de quien recibe (pedidos con alcohol)
+	IDVerified bool `json:"id_verified"`
+}
+
+// isValidProofURL acepta solo URLs https (las imágenes se suben desde el frontend)
+func isValidProofURL(url string) bool {
+	return strings.HasPrefix(url, "https://") && len(url) <= 500
+}
+
+// isAssignableDriver indica si un usuario puede recibir pedidos para repartir
+func isAssignableDriver(role string, active bool) bool {
+	return role == roleDriver && active
+}
+
+// driverAssignmentGuard indica por qué no se puede asignar repartidor a un pedido: solo
+// los pedidos de reparto que no estén cerrados
+func driverAssignmentGuard(status, fulfillmentType string) *OrderGuardError {
+	if fulfillmentType != fulfillmentDelivery {
+		return &OrderGuardError{Code: "NOT_A_DELIVERY", Message: "El pedido es para recojo en tienda"}
+	}
+	if status == "entregado" || status == "cancelado" {
+		return &OrderGuardError{Code: "ORDER_CLOSED", Message: "El pedido ya está cerrado"}
+	}
+	return nil
+}
+
+// driverOrderGuard rechaza que un repartidor actúe sobre un pedido que no tiene asignado
+func driverOrderGuard(assigned *int64, driverID int64) error {
+	if assigned == nil || *assigned != driverID {
+		return &OrderGuardError{Code: "NOT_ASSIGNED", Message: "El pedido no está asignado a ti"}
+	}
+	return nil
+}
+
+// validateDeliveryProof valida la prueba de entrega y devuelve el mensaje de error
+func validateDeliveryProof(req DeliveryProofRequest) string {
+	switch {
+	case req.PhotoURL == "" && req.SignatureURL == "":
+		return "Se requiere foto o firma como prueba de entrega"
+	case (req.PhotoURL != "" && !isValidProofURL(req.PhotoURL)) || (req.SignatureURL != "" && !isValidProofURL(req.SignatureURL)):
+		return "URL de prueba inválida"
+	case req.RecipientName != "" && !utils.IsValidString(req.RecipientName, 2, 100):
+		return "Nombre de quien recibe inválido (2-100 caracteres)"
+	case req.Notes != "" && !utils.IsValidString(req.Notes, 1, 500):
+		return "Notas inválidas (máximo 500 caracteres)"
+	}
+	return ""
+}
+
+// notifyOrderStatus avisa al cliente y a los admins de un cambio de estado
+func notifyOrderStatus(orderID string, userID int64, status string) {
+	go func() {
+		// Los pedidos de invitados (userID 0) solo notifican a los admins
+		userRef := ""
+		if userID > 0 {
+			userRef = fmt.Sprintf("%d", userID)
+		}
+		CreateOrderNotification(orderID, userRef, status)
+	}()
+	go func() {
+		msg := "El estado de tu pedido " + orderID + " cambió a: " + status
+		NotifyUserAndAdmins(userID, msg)
+	}()
+}
+
+// PUT /api/protected/admin/orders/:id/driver
+// Asigna un repartidor a un pedido de reparto (solo admin)
+func AssignOrderDriver(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	var req AssignDriverRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+
+	if req.DriverID != nil {
+		var role string
+		var active bool
+		err := db.DB.QueryRow(context.Background(),
+			"SELECT role, COALESCE(is_active, TRUE) FROM users WHERE id=$1", *req.DriverID).Scan(&role, &active)
+		if err != nil || !isAssignableDriver(role, active) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "El usuario no es un repartidor activo"})
+		}
+	}
+
+	var status, fulfillmentType string
+	err := db.DB.QueryRow(context.Background(),
+		"SELECT status, fulfillment_type FROM orders WHERE id=$1", orderID).Scan(&status, &fulfillmentType)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+	if guardErr := driverAssignmentGuard(status, fulfillmentType); guardErr != nil {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{"error": guardErr.Message, "code": guardErr.Code})
+	}
+
+	_, err = db.DB.Exec(context.Background(),
+		`UPDATE orders SET driver_id=$1, driver_assigned_at=CASE WHEN $1::bigint IS NULL THEN NULL ELSE NOW() END, updated_at=NOW()
+		 WHERE id=$2`, req.DriverID, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo asignar el repartidor"})
+	}
+
+	if req.DriverID != nil {
+		driverID := *req.DriverID
+		go NotifyUser(driverID, "Se te asignó el pedido "+orderID)
+		return c.JSON(fiber.Map{"message": "Repartidor asignado", "driver_id": driverID})
+	}
+	return c.JSON(fiber.Map{"message": "Repartidor removido"})
+}
+
+// GET /api/protected/admin/drivers
+// Lista los repartidores para asignar pedidos (solo admin)
+func ListDrivers(c *fiber.Ctx) error {
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT u.id, u.name, COALESCE(u.last_name, ''), COALESCE(u.phone, ''),
+		        (SELECT COUNT(*) FROM orders o WHERE o.driver_id = u.id AND o.status NOT IN ('entregado', 'cancelado')) AS active_orders,
+		        l.lat, l.lng, l.recorded_at
+		 FROM users u
+		 LEFT JOIN LATERAL (
+		     SELECT lat, lng, recorded_at FROM driver_locations
+		     WHERE driver_id = u.id ORDER BY recorded_at DESC LIMIT 1
+		 ) l ON TRUE
+		 WHERE u.role = $1 AND COALESCE(u.is_active, TRUE)
+		 ORDER BY u.name`, roleDriver)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener repartidores"})
+	}
+	defer rows.Close()
+
+	drivers := []fiber.Map{}
+	for rows.Next() {
+		var id int64
+		var name, lastName, phone string
+		var activeOrders int
+		var lat, lng *float64
+		var recordedAt *time.Time
+		if err := rows.Scan(&id, &name, &lastName, &phone, &activeOrders, &lat, &lng, &recordedAt); err != nil {
+			continue
+		}
+		driver := fiber.Map{
+			"id":            id,
+			"name":          strings.TrimSpace(name + " " + lastName),
+			"phone":         phone,
+			"active_orders": activeOrders,
+		}
+		if lat != nil && lng != nil {
+			driver["last_location"] = fiber.Map{"lat": *lat, "lng": *lng, "recorded_at": recordedAt}
+		}
+		drivers = append(drivers, driver)
+	}
+	return c.JSON(fiber.Map{"data": drivers})
+}
+
+// GET /api/protected/driver/orders?status=active|all
+// Lista los pedidos asignados al repartidor autenticado
+func ListDriverOrders(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	driverID := int64(claims["id"].(float64))
+
+	query := `SELECT o.id, o.status, COALESCE(o.location, ''), o.lat, o.lng, o.total, o.payment_method,
+	                 o.paid_at IS NOT NULL, o.scheduled_for, o.delivery_eta_minutes, o.created_at,
+	                 COALESCE(u.name, ''), COALESCE(u.last_name, ''), COALESCE(u.phone, ''),
+	                 o.verify_id_on_delivery, o.id_verified_at IS NOT NULL
+	          FROM orders o
+	          LEFT JOIN users u ON u.id = o.user_id
+	          WHERE o.driver_id = $1`
+	if c.Query("status", "active") != "all" {
+		query += " AND o.status NOT IN ('entregado', 'cancelado')"
+	}
+	query += " ORDER BY o.scheduled_for NULLS FIRST, o.created_at"
+
+	rows, err := db.DB.Query(context.Background(), query, driverID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener pedidos"})
+	}
+	defer rows.Close()
+
+	orders := []fiber.Map{}
+	for rows.Next() {
+		var id, status, location, paymentMethod, name, lastName, phone string
+		var lat, lng *float64
+		var total float64
+		var paid, verifyID, idVerified bool
+		var scheduledFor *time.Time
+		var etaMinutes *int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &status, &location, &lat, &lng, &total, &paymentMethod, &paid,
+			&scheduledFor, &etaMinutes, &createdAt, &name, &lastName, &phone, &verifyID, &idVerified); err != nil {
+			continue
+		}
+		// Monto a cobrar en la puerta para pedidos contra entrega
+		amountToCollect := 0.0
+		if !paid && paymentMethod == paymentMethodContraEntrega {
+			amountToCollect = total
+		}
+		orders = append(orders, fiber.Map{
+			"id":                id,
+			"status":            status,
+			"location":          location,
+			"lat":               lat,
+			"lng":               lng,
+			"total":             total,
+			"amount_to_collect": amountToCollect,
+			"scheduled_for":     scheduledFor,
+			"eta_minutes":       etaMinutes,
+			"created_at":        createdAt,
+			"customer_name":     strings.TrimSpace(name + " " + lastName),
+			"customer_phone":    phone,
+			// Pedidos con alcohol: el repartidor revisa el DNI de quien recibe
+			"verify_id_on_delivery": verifyID,
+			"id_verified":           idVerified,
+		})
+	}
+	return c.JSON(fiber.Map{"data": orders})
+}
+
+// POST /api/protected/driver/location
+// Registra la posición del repartidor y la envía por WebSocket a los clientes
+// cuyos pedidos lleva en camino
+func PostDriverLocation(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	driverID := int64(claims["id"].(float64))
+
+	var req DriverLocationRequest
+	if err := c.BodyParser(&req); err != nil || req.Lat == nil || req.Lng == nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Coordenadas requeridas"})
+	}
+	if !utils.IsValidCoordinate(*req.Lat, *req.Lng) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Coordenadas inválidas"})
+	}
+
+	var recordedAt time.Time
+	err := db.DB.QueryRow(context.Background(),
+		`INSERT INTO driver_locations (driver_id, lat, lng, accuracy_m) VALUES ($1, $2, $3, $4) RETURNING recorded_at`,
+		driverID, *req.Lat, *req.Lng, req.AccuracyM).Scan(&recordedAt)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo registrar la ubicación"})
+	}
+
+	rows, err := db.DB.Query(context.Background(),
+		"SELECT id, user_id FROM orders WHERE driver_id=$1 AND status='camino' AND user_id IS NOT NULL", driverID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener pedidos"})
+	}
+	type follower struct {
+		orderID string
+		userID  int64
+	}
+	followers := []follower{}
+	for rows.Next() {
+		var f follower
+		if err := rows.Scan(&f.orderID, &f.userID); err == nil {
+			followers = append(followers, f)
+		}
+	}
+	rows.Close()
+
+	for _, f := range followers {
+		msg, _ := json.Marshal(fiber.Map{
+			"type":        "driver_location",
+			"order_id":    f.orderID,
+			"lat":         *req.Lat,
+			"lng":         *req.Lng,
+			"recorded_at": recordedAt,
+		})
+		go NotifyUser(f.userID, string(msg))
+	}
+
+	return c.JSON(fiber.Map{"message": "Ubicación registrada", "tracking_orders": len(followers)})
+}
+
+// loadDriverOrder obtiene el cliente de un pedido asignado al repartidor
+func loadDriverOrder(ctx context.Context, tx pgx.Tx, orderID string, driverID int64) (int64, error) {
+	var userID int64
+	var assigned *int64
+	err := tx.QueryRow(ctx, "SELECT COALESCE(user_id, 0), driver_id FROM orders WHERE id=$1", orderID).Scan(&userID, &assigned)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrOrderNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := driverOrderGuard(assigned, driverID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// POST /api/protected/driver/orders/:id/depart
+// El repartidor recoge el pedido y sale a entregarlo (preparando -> camino)
+func DepartDriverOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	actor := actorFromClaims(claims)
+
+	tx, err := db.DB.Begin(context.Background())
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(context.Background())
+
+	userID, err := loadDriverOrder(context.Background(), tx, orderID, *actor.UserID)
+	if err != nil {
+		return respondTransitionError(c, err)
+	}
+	if _, err := transitionOrderStatus(context.Background(), tx, orderID, "camino", actor, "Repartidor en camino"); err != nil {
+		return respondTransitionError(c, err)
+	}
+	if err := tx.Commit(context.Background()); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el estado"})
+	}
+
+	notifyOrderStatus(orderID, userID, "camino")
+	return c.JSON(fiber.Map{"success": true, "message": "Pedido en camino"})
+}
+
+// POST /api/protected/driver/orders/:id/deliver
+// Marca el pedido como entregado con foto y/o firma como prueba de entrega
+func DeliverDriverOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	actor := actorFromClaims(claims)
+
+	var req DeliveryProofRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateDeliveryProof(req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	tx, err := db.DB.Begin(context.Background())
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(context.Background())
+
+	userID, err := loadDriverOrder(context.Background(), tx, orderID, *actor.UserID)
+	if err != nil {
+		return respondTransitionError(c, err)
+	}
+	if req.IDVerified {
+		if err := markOrderIDVerified(context.Background(), tx, orderID, actor); err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar la prueba de entrega"})
+		}
+	}
+	if _, err := transitionOrderStatus(context.Background(), tx, orderID, "entregado", actor, "Entregado por el repartidor"); err != nil {
+		return respondTransitionError(c, err)
+	}
+
+	nullIfEmpty := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	_, err = tx.Exec(context.Background(),
+		`UPDATE orders SET delivered_at=NOW(), delivery_proof_photo_url=$1, delivery_proof_signature_url=$2,
+		        delivery_recipient_name=$3, delivery_notes=$4
+		 WHERE id=$5`,
+		nullIfEmpty(req.PhotoURL), nullIfEmpty(req.SignatureURL), nullIfEmpty(req.RecipientName), nullIfEmpty(req.Notes), orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo guardar la prueba de entrega"})
+	}
+	if err := tx.Commit(context.Background()); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el estado"})
+	}
+
+	notifyOrderStatus(orderID, userID, "entregado")
+	return c.JSON(fiber.Map{"success": true, "message": "Pedido entregado"})
+}
+
+// GET /api/protected/orders/:id/tracking
+// Devuelve el repartidor y su última posición mientras el pedido está en camino (dueño o admin)
+func GetOrderTracking(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	role := claims["role"].(string)
+
+	var ownerID int64
+	var status string
+	var driverID *int64
+	var etaMinutes *int
+	var driverName *string
+	err := db.DB.QueryRow(context.Background(),
+		`SELECT COALESCE(o.user_id, 0), o.status, o.driver_id, o.delivery_eta_minutes, d.name
+		 FROM orders o LEFT JOIN users d ON d.id = o.driver_id
+		 WHERE o.id=$1`, orderID).Scan(&ownerID, &status, &driverID, &etaMinutes, &driverName)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+	if role != "admin" && ownerID != userID {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
+	}
+
+	resp := fiber.Map{"order_id": orderID, "status": status, "eta_minutes": etaMinutes}
+	if driverID == nil {
+		return c.JSON(resp)
+	}
+	resp["driver"] = fiber.Map{"name": driverName}
+
+	// La posición solo se comparte mientras el pedido está en camino
+	if status == "camino" {
+		var lat, lng float64
+		var recordedAt time.Time
+		err := db.DB.QueryRow(context.Background(),
+			`SELECT lat, lng, recorded_at FROM driver_locations
+			 WHERE driver_id=$1 ORDER BY recorded_at DESC LIMIT 1`, *driverID).Scan(&lat, &lng, &recordedAt)
+		if err == nil {
+			resp["location"] = fiber.Map{"lat": lat, "lng": lng, "recorded_at": recordedAt}
+		}
+	}
+	return c.JSON(resp)
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/posoqo/backend/internal/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+// guardCode devuelve el código de un OrderGuardError (vacío si no lo es)
+func guardCode(err error) string {
+	var guardErr *OrderGuardError
+	if errors.As(err, &guardErr) {
+		return guardErr.Code
+	}
+	return ""
+}
+
+// TestDriverAssignment valida a quién y en qué pedidos se puede asignar un repartidor
+func TestDriverAssignment(t *testing.T) {
+	assert.True(t, isAssignableDriver(roleDriver, true))
+	assert.False(t, isAssignableDriver(roleDriver, false))
+	assert.False(t, isAssignableDriver("admin", true))
+	assert.False(t, isAssignableDriver("user", true))
+
+	tests := []struct {
+		name            string
+		status          string
+		fulfillmentType string
+		code            string
+	}{
+		{"Reparto en preparación", "preparando", fulfillmentDelivery, ""},
+		{"Reparto recibido", "recibido", fulfillmentDelivery, ""},
+		{"Recojo en tienda", "preparando", fulfillmentPickup, "NOT_A_DELIVERY"},
+		{"Pedido entregado", "entregado", fulfillmentDelivery, "ORDER_CLOSED"},
+		{"Pedido cancelado", "cancelado", fulfillmentDelivery, "ORDER_CLOSED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guardErr := driverAssignmentGuard(tt.status, tt.fulfillmentType)
+			if tt.code == "" {
+				assert.Nil(t, guardErr)
+			} else {
+				assert.Equal(t, tt.code, guardErr.Code)
+			}
+		})
+	}
+}
+
+// TestDriverOrderGuard valida que el repartidor solo actúe sobre sus pedidos
+func TestDriverOrderGuard(t *testing.T) {
+	assigned := int64(5)
+	assert.NoError(t, driverOrderGuard(&assigned, 5))
+	assert.Equal(t, "NOT_ASSIGNED", guardCode(driverOrderGuard(&assigned, 6)))
+	assert.Equal(t, "NOT_ASSIGNED", guardCode(driverOrderGuard(nil, 5)))
+}
+
+// TestDepartDeliverGuards valida las reglas para salir a entregar y para entregar
+func TestDepartDeliverGuards(t *testing.T) {
+	tests := []struct {
+		name          string
+		to            string
+		paymentMethod string
+		paid          bool
+		idPending     bool
+		code          string
+	}{
+		{"Salir con pedido pagado", "camino", paymentMethodStripe, true, false, ""},
+		{"Salir contra entrega sin pagar", "camino", paymentMethodContraEntrega, false, false, ""},
+		{"Salir sin pagar", "camino", paymentMethodStripe, false, false, "ORDER_NOT_PAID"},
+		{"Entregar sin alcohol", "entregado", paymentMethodStripe, true, false, ""},
+		{"Entregar alcohol sin revisar documento", "entregado", paymentMethodStripe, true, true, "ID_CHECK_REQUIRED"},
+		{"Cancelar con documento pendiente", "cancelado", paymentMethodStripe, true, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guardErr := orderTransitionGuard(tt.to, tt.paymentMethod, tt.paid, tt.idPending)
+			if tt.code == "" {
+				assert.Nil(t, guardErr)
+			} else {
+				assert.Equal(t, tt.code, guardErr.Code)
+			}
+		})
+	}
+}
+
+// TestValidateDeliveryProof valida la prueba de entrega
+func TestValidateDeliveryProof(t *testing.T) {
+	assert.Empty(t, validateDeliveryProof(DeliveryProofRequest{PhotoURL: "https://res.cloudinary.com/p.jpg"}))
+	assert.Empty(t, validateDeliveryProof(DeliveryProofRequest{SignatureURL: "https://res.cloudinary.com/s.png", RecipientName: "Ana"}))
+	assert.Equal(t, "Se requiere foto o firma como prueba de entrega", validateDeliveryProof(DeliveryProofRequest{}))
+	assert.Equal(t, "URL de prueba inválida", validateDeliveryProof(DeliveryProofRequest{PhotoURL: "http://example.com/p.jpg"}))
+	assert.Equal(t, "Nombre de quien recibe inválido (2-100 caracteres)",
+		validateDeliveryProof(DeliveryProofRequest{PhotoURL: "https://res.cloudinary.com/p.jpg", RecipientName: "A"}))
+}
+
+// TestDriverLocationRole valida que solo los repartidores envíen su ubicación
+func TestDriverLocationRole(t *testing.T) {
+	app := fiber.New()
+	app.Post("/driver/location", func(c *fiber.Ctx) error {
+		c.Locals("user", jwt.MapClaims{"id": float64(9), "role": c.Get("X-Role")})
+		return c.Next()
+	}, middleware.RequireRole(roleDriver), PostDriverLocation)
+
+	post := func(role, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/driver/location", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Role", role)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// Clientes y admins no publican ubicaciones
+	assert.Equal(t, http.StatusForbidden, post("user", `{"lat": -13.16, "lng": -74.22}`))
+	assert.Equal(t, http.StatusForbidden, post("admin", `{"lat": -13.16, "lng": -74.22}`))
+	// El repartidor pasa el control de rol; las coordenadas se validan antes de guardar
+	assert.Equal(t, http.StatusBadRequest, post(roleDriver, `{"lat": -13.16}`))
+	assert.Equal(t, http.StatusBadRequest, post(roleDriver, `{"lat": 120, "lng": -74.22}`))
+}
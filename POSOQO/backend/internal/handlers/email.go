@@ -586,9 +586,16 @@ func VerifyEmail(c *fiber.Ctx) error {
 		fmt.Printf("Error marcando token como usado: %v\n", err)
 	}
 
+	// Con el email ya verificado, los pedidos hechos como invitado pasan a la cuenta
+	claimed, err := claimGuestOrders(context.Background(), db.DB, userID, email)
+	if err != nil {
+		fmt.Printf("Error asociando pedidos de invitado: %v\n", err)
+	}
+
 	return c.JSON(fiber.Map{
-		"message": "Email verificado exitosamente",
-		"email":   email,
+		"message":        "Email verificado exitosamente",
+		"email":          email,
+		"claimed_orders": claimed,
 	})
 }
 
@@ -1109,3 +1116,74 @@ func sendPasswordResetCodeViaResendAPI(apiKey, fromEmail, toEmail, name, code st
 	fmt.Printf("[RESEND API] ✅ Respuesta exitosa: %s\n", string(body))
 	return nil
 }
+
+// sendHTMLEmail envía un email HTML ya renderizado. Igual que los emails de verificación,
+// usa la API REST de Resend si está configurada y si no SMTP.
+func sendHTMLEmail(toEmail, subject, htmlBody string) error {
+	config := getEmailConfig()
+	if config.SMTPHost == "" || config.SMTPUser == "" || config.SMTPPassword == "" {
+		return fmt.Errorf("configuración SMTP incompleta")
+	}
+
+	if config.SMTPHost == "smtp.resend.com" {
+		apiErr := sendHTMLViaResendAPI(config.SMTPPassword, config.FromEmail, toEmail, subject, htmlBody)
+		if apiErr == nil {
+			return nil
+		}
+		fmt.Printf("[EMAIL] ⚠️ Error con API REST de Resend: %v - intentando SMTP...\n", apiErr)
+	}
+
+	var message strings.Builder
+	message.WriteString(fmt.Sprintf("From: %s <%s>\r\n", config.FromName, config.FromEmail))
+	message.WriteString(fmt.Sprintf("To: %s\r\n", toEmail))
+	message.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	message.WriteString(htmlBody)
+
+	auth := smtp.PlainAuth("", config.SMTPUser, config.SMTPPassword, config.SMTPHost)
+	addr := fmt.Sprintf("%s:%s", config.SMTPHost, config.SMTPPort)
+	return smtp.SendMail(addr, auth, config.FromEmail, []string{toEmail}, []byte(message.String()))
+}
+
+// sendHTMLViaResendAPI envía un email HTML usando la API REST de Resend
+func sendHTMLViaResendAPI(apiKey, fromEmail, toEmail, subject, htmlBody string) error {
+	// En modo prueba Resend solo permite enviar desde el email registrado
+	effectiveFromEmail := fromEmail
+	if fromEmail == "onboarding@resend.dev" {
+		effectiveFromEmail = os.Getenv("RESEND_REGISTERED_EMAIL")
+		if effectiveFromEmail == "" {
+			effectiveFromEmail = toEmail
+		}
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"from":    fmt.Sprintf("%s <%s>", "POSOQO", effectiveFromEmail),
+		"to":      []string{toEmail},
+		"subject": subject,
+		"html":    htmlBody,
+	})
+	if err != nil {
+		return fmt.Errorf("error creando JSON: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", "https://api.resend.com/emails", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("error creando petición: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error en petición HTTP: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error de API: status %d, respuesta: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -18,6 +18,7 @@ func AddFavorite(c *fiber.Ctx) error {
 	// Obtener product_id del body o de los parámetros
 	var requestBody struct {
 		ProductID string `json:"product_id"`
+		VariantID string `json:"variant_id"` // formato preferido, opcional
 	}
 	
 	// Intentar obtener del body primero
@@ -31,8 +32,10 @@ func AddFavorite(c *fiber.Ctx) error {
 	}
 	
 	_, err := db.DB.Exec(context.Background(),
-		"INSERT INTO favorites (user_id, product_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
-		userID, requestBody.ProductID)
+		`INSERT INTO favorites (user_id, product_id, variant_id)
+		 VALUES ($1, $2, (SELECT id FROM product_variants WHERE id::text = $3 AND product_id = $2))
+		 ON CONFLICT (user_id, product_id) DO UPDATE SET variant_id = COALESCE(EXCLUDED.variant_id, favorites.variant_id)`,
+		userID, requestBody.ProductID, requestBody.VariantID)
 	if err != nil {
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo agregar a favoritos"})
 	}
@@ -64,7 +67,8 @@ func ListFavorites(c *fiber.Ctx) error {
 	userID := int64(claims["id"].(float64))
 	
 	rows, err := db.DB.Query(context.Background(),
-		`SELECT p.id, p.name, p.description, p.price, p.image_url, p.category_id, p.is_active, p.created_at, p.updated_at
+		`SELECT p.id, p.name, p.description, p.price, p.image_url, p.category_id, p.is_active, p.created_at, p.updated_at,
+		        COALESCE(f.variant_id::text, '')
 		 FROM favorites f
 		 JOIN products p ON f.product_id = p.id
 		 WHERE f.user_id = $1
@@ -76,11 +80,11 @@ func ListFavorites(c *fiber.Ctx) error {
 
 	products := []fiber.Map{}
 	for rows.Next() {
-		var id, name, description, imageURL, categoryID string
+		var id, name, description, imageURL, categoryID, variantID string
 		var price float64
 		var isActive bool
 		var createdAt, updatedAt time.Time
-		if err := rows.Scan(&id, &name, &description, &price, &imageURL, &categoryID, &isActive, &createdAt, &updatedAt); err != nil {
+		if err := rows.Scan(&id, &name, &description, &price, &imageURL, &categoryID, &isActive, &createdAt, &updatedAt, &variantID); err != nil {
 			continue
 		}
 		products = append(products, fiber.Map{
@@ -91,6 +95,7 @@ func ListFavorites(c *fiber.Ctx) error {
 			"image_url":   imageURL,
 			"category_id": categoryID,
 			"is_active":   isActive,
+			"variant_id":  variantID,
 			"created_at":  createdAt.Format("2006-01-02T15:04:05Z07:00"),
 			"updated_at":  updatedAt.Format("2006-01-02T15:04:05Z07:00"),
 		})
@@ -0,0 +1,921 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/paymentintent"
+)
+
+// Estados y origen de una gift card
+const (
+	giftCardPending = "pending" // comprada, esperando el pago
+	giftCardActive  = "active"
+	giftCardVoided  = "voided"
+
+	giftCardSourcePurchase = "purchase"
+	giftCardSourceAdmin    = "admin"
+)
+
+// Movimientos del libro de saldo
+const (
+	giftCardTxIssue  = "issue"
+	giftCardTxRedeem = "redeem"
+	giftCardTxRefund = "refund"
+	giftCardTxAdjust = "adjust"
+	giftCardTxVoid   = "void"
+)
+
+const (
+	// paymentMethodGiftCard es el método de pago de un pedido cubierto por completo con gift card
+	paymentMethodGiftCard = "gift_card"
+
+	minGiftCardAmount = 20.0
+	maxGiftCardAmount = 1000.0
+	// stripeMinimumCharge es el mínimo que Stripe cobra en soles; si una gift card dejara un
+	// saldo por cobrar menor, se usa un poco menos de la gift card
+	stripeMinimumCharge = 2.0
+
+	giftCardCodePrefix = "POSO"
+	// giftCardCodeAlphabet no incluye caracteres ambiguos (0/O, 1/I); 32 símbolos para que
+	// cada byte aleatorio se reparta sin sesgo
+	giftCardCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	giftCardCodeRandom   = 12
+)
+
+// GiftCardError indica por qué una gift card no puede usarse o modificarse
+type GiftCardError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *GiftCardError) Error() string {
+	return e.Message
+}
+
+var errGiftCardNotFound = &GiftCardError{Status: http.StatusNotFound, Code: "GIFT_CARD_INVALID", Message: "Gift card no válida"}
+
+// GiftCardRequest es la compra de una gift card por un cliente o su emisión por un admin
+type GiftCardRequest struct {
+	Amount         float64 `json:"amount"`
+	Currency       string  `json:"currency,omitempty"`
+	SenderName     string  `json:"sender_name"`
+	RecipientName  string  `json:"recipient_name"`
+	RecipientEmail string  `json:"recipient_email"`
+	Message        string  `json:"message"`
+	// Note es el motivo de una emisión manual (solo admin)
+	Note string `json:"note,omitempty"`
+}
+
+// GiftCardAdjustRequest suma (positivo) o descuenta (negativo) saldo de una gift card
+type GiftCardAdjustRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// GiftCardVoidRequest anula una gift card
+type GiftCardVoidRequest struct {
+	Reason string `json:"reason"`
+}
+
+// GiftCardBalanceRequest consulta el saldo de una gift card por su código
+type GiftCardBalanceRequest struct {
+	Code string `json:"code"`
+}
+
+// giftCardRecord es una gift card cargada desde la base de datos
+type giftCardRecord struct {
+	ID              int64
+	Code            string
+	InitialAmount   float64
+	Balance         float64
+	Status          string
+	Source          string
+	PurchaserUserID *int64
+	IssuedBy        *int64
+	SenderName      string
+	RecipientName   string
+	RecipientEmail  string
+	Message         string
+	ActivatedAt     *time.Time
+	DeliveredAt     *time.Time
+	VoidedAt        *time.Time
+	VoidReason      string
+	CreatedAt       time.Time
+}
+
+// giftCardColumns son las columnas que lee scanGiftCard
+const giftCardColumns = `id, code, initial_amount, balance, status, source, purchaser_user_id, issued_by,
+	COALESCE(sender_name, ''), COALESCE(recipient_name, ''), COALESCE(recipient_email, ''), COALESCE(message, ''),
+	activated_at, delivered_at, voided_at, COALESCE(void_reason, ''), created_at`
+
+func scanGiftCard(row pgx.Row, g *giftCardRecord) error {
+	return row.Scan(&g.ID, &g.Code, &g.InitialAmount, &g.Balance, &g.Status, &g.Source, &g.PurchaserUserID, &g.IssuedBy,
+		&g.SenderName, &g.RecipientName, &g.RecipientEmail, &g.Message,
+		&g.ActivatedAt, &g.DeliveredAt, &g.VoidedAt, &g.VoidReason, &g.CreatedAt)
+}
+
+// toMap es la representación JSON de la gift card para su comprador y el admin
+func (g *giftCardRecord) toMap() fiber.Map {
+	return fiber.Map{
+		"id":              g.ID,
+		"code":            formatGiftCardCode(g.Code),
+		"initial_amount":  g.InitialAmount,
+		"balance":         g.Balance,
+		"status":          g.Status,
+		"source":          g.Source,
+		"sender_name":     g.SenderName,
+		"recipient_name":  g.RecipientName,
+		"recipient_email": g.RecipientEmail,
+		"message":         g.Message,
+		"activated_at":    g.ActivatedAt,
+		"delivered_at":    g.DeliveredAt,
+		"voided_at":       g.VoidedAt,
+		"void_reason":     g.VoidReason,
+		"created_at":      g.CreatedAt,
+	}
+}
+
+// generateGiftCardCode genera un código aleatorio como POSO + 12 símbolos
+func generateGiftCardCode() (string, error) {
+	bytes := make([]byte, giftCardCodeRandom)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	code := []byte(giftCardCodePrefix)
+	for _, b := range bytes {
+		code = append(code, giftCardCodeAlphabet[int(b)%len(giftCardCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeGiftCardCode aplica el formato con el que se guardan los códigos (sin guiones ni espacios)
+func normalizeGiftCardCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// formatGiftCardCode muestra el código en grupos de 4 (POSO-ABCD-EFGH-JKLM)
+func formatGiftCardCode(code string) string {
+	groups := make([]string, 0, len(code)/4+1)
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+// maskGiftCardCode oculta el código salvo sus últimos 4 caracteres
+func maskGiftCardCode(code string) string {
+	if len(code) <= 4 {
+		return code
+	}
+	return formatGiftCardCode(strings.Repeat("*", len(code)-4) + code[len(code)-4:])
+}
+
+// giftCardRedemption calcula cuánto de la gift card se usa en un pedido: todo el saldo
+// hasta cubrir el total, dejando por cobrar 0 o al menos minCharge
+func giftCardRedemption(balance, total, minCharge float64) float64 {
+	if balance <= 0 || total <= 0 {
+		return 0
+	}
+	amount := roundMoney(min(balance, total))
+	if rest := roundMoney(total - amount); rest > 0 && rest < minCharge {
+		amount = roundMoney(max(total-minCharge, 0))
+	}
+	return amount
+}
+
+// validateGiftCardRequest normaliza una gift card y devuelve el mensaje de error si no es
+// válida; el email del destinatario es obligatorio salvo en una emisión del admin
+func validateGiftCardRequest(req *GiftCardRequest, requireRecipient bool) string {
+	req.SenderName = strings.TrimSpace(req.SenderName)
+	req.RecipientName = strings.TrimSpace(req.RecipientName)
+	req.RecipientEmail = strings.ToLower(strings.TrimSpace(req.RecipientEmail))
+	req.Message = strings.TrimSpace(req.Message)
+	req.Note = strings.TrimSpace(req.Note)
+	req.Amount = roundMoney(req.Amount)
+	switch {
+	case req.Amount < minGiftCardAmount || req.Amount > maxGiftCardAmount:
+		return fmt.Sprintf("Monto inválido (S/%.0f - S/%.0f)", minGiftCardAmount, maxGiftCardAmount)
+	case requireRecipient && req.RecipientEmail == "":
+		return "El email del destinatario es obligatorio"
+	case req.RecipientEmail != "" && !utils.IsValidEmail(req.RecipientEmail):
+		return "Email del destinatario inválido"
+	case len(req.SenderName) > 100 || len(req.RecipientName) > 100:
+		return "Nombre inválido (máximo 100 caracteres)"
+	case len(req.Message) > 500:
+		return "Mensaje inválido (máximo 500 caracteres)"
+	case len(req.Note) > 500:
+		return "Nota inválida (máximo 500 caracteres)"
+	}
+	return ""
+}
+
+// insertGiftCard crea la gift card con un código único y devuelve su ID y código
+func insertGiftCard(ctx context.Context, q dbQuerier, req *GiftCardRequest, status, source string, purchaser, issuedBy *int64) (int64, string, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := generateGiftCardCode()
+		if err != nil {
+			return 0, "", err
+		}
+		var id int64
+		err = q.QueryRow(ctx,
+			`INSERT INTO gift_cards (code, initial_amount, status, source, purchaser_user_id, issued_by,
+			                         sender_name, recipient_name, recipient_email, message)
+			 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''))
+			 ON CONFLICT (code) DO NOTHING RETURNING id`,
+			code, req.Amount, status, source, purchaser, issuedBy,
+			req.SenderName, req.RecipientName, req.RecipientEmail, req.Message).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		return id, code, err
+	}
+	return 0, "", errors.New("no se pudo generar un código único")
+}
+
+// lockGiftCard obtiene una gift card por código bloqueando su fila
+func lockGiftCard(ctx context.Context, tx pgx.Tx, code string) (*giftCardRecord, error) {
+	var card giftCardRecord
+	err := scanGiftCard(tx.QueryRow(ctx,
+		`SELECT `+giftCardColumns+` FROM gift_cards WHERE code=$1 FOR UPDATE`, normalizeGiftCardCode(code)), &card)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errGiftCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+// recordGiftCardMovement registra un movimiento en el libro de saldo
+func recordGiftCardMovement(ctx context.Context, tx pgx.Tx, cardID int64, txType string, amount, balanceAfter float64, orderID *string, actorID *int64, note string) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO gift_card_transactions (gift_card_id, type, amount, balance_after, order_id, actor_user_id, note)
+		 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))`,
+		cardID, txType, roundMoney(amount), roundMoney(balanceAfter), orderID, actorID, note)
+	return err
+}
+
+// recordAdminAudit deja constancia en audit_logs de una acción de un admin (sobre una gift
+// card, los puntos de un usuario, ...) en la misma transacción que el cambio
+func recordAdminAudit(ctx context.Context, tx pgx.Tx, c *fiber.Ctx, adminID int64, action, resourceType string, resourceID int64, metadata fiber.Map) error {
+	payload, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO audit_logs (user_id, action, resource_type, resource_id, ip_address, user_agent,
+		                         request_method, request_path, response_status, metadata)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::jsonb)`,
+		adminID, action, resourceType, resourceID, c.IP(), c.Get("User-Agent"), c.Method(), c.Path(), http.StatusOK, string(payload))
+	return err
+}
+
+// redeemGiftCard descuenta del saldo de la gift card la parte del total que cubre y la
+// registra en el libro con el pedido. minCharge es el mínimo que debe quedar por cobrar
+// con tarjeta (0 si el resto se paga contra entrega).
+func redeemGiftCard(ctx context.Context, tx pgx.Tx, orderID, code string, total, minCharge float64, actorID *int64) (float64, error) {
+	card, err := lockGiftCard(ctx, tx, code)
+	if err != nil {
+		return 0, err
+	}
+	switch card.Status {
+	case giftCardPending:
+		return 0, errGiftCardNotFound
+	case giftCardVoided:
+		return 0, &GiftCardError{Status: http.StatusConflict, Code: "GIFT_CARD_VOIDED", Message: "La gift card fue anulada"}
+	}
+	if card.Balance <= 0 {
+		return 0, &GiftCardError{Status: http.StatusConflict, Code: "GIFT_CARD_EMPTY", Message: "La gift card no tiene saldo"}
+	}
+	amount := giftCardRedemption(card.Balance, total, minCharge)
+	if amount <= 0 {
+		return 0, &GiftCardError{
+			Status:  http.StatusBadRequest,
+			Code:    "GIFT_CARD_MIN_CHARGE",
+			Message: fmt.Sprintf("El monto por cobrar con tarjeta no puede ser menor a S/%.2f", minCharge),
+		}
+	}
+
+	balance := roundMoney(card.Balance - amount)
+	if _, err := tx.Exec(ctx, "UPDATE gift_cards SET balance=$1 WHERE id=$2", balance, card.ID); err != nil {
+		return 0, err
+	}
+	if err := recordGiftCardMovement(ctx, tx, card.ID, giftCardTxRedeem, -amount, balance, &orderID, actorID, ""); err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// reverseGiftCardRedemptions devuelve a sus gift cards lo usado en un pedido cancelado.
+// Es idempotente: solo devuelve lo que no se devolvió antes. Las gift cards anuladas no
+// recuperan saldo.
+func reverseGiftCardRedemptions(ctx context.Context, tx pgx.Tx, orderID string) error {
+	rows, err := tx.Query(ctx,
+		`SELECT gift_card_id, -SUM(amount) FROM gift_card_transactions
+		 WHERE order_id = $1 AND type IN ('redeem', 'refund')
+		 GROUP BY gift_card_id HAVING SUM(amount) < 0`, orderID)
+	if err != nil {
+		return err
+	}
+	pending := map[int64]float64{}
+	for rows.Next() {
+		var cardID int64
+		var amount float64
+		if err := rows.Scan(&cardID, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		pending[cardID] = amount
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for cardID, amount := range pending {
+		var balance float64
+		err := tx.QueryRow(ctx,
+			"UPDATE gift_cards SET balance = balance + $1 WHERE id=$2 AND status <> 'voided' RETURNING balance",
+			amount, cardID).Scan(&balance)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := recordGiftCardMovement(ctx, tx, cardID, giftCardTxRefund, amount, balance, &orderID, nil, "Pedido cancelado"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleGiftCardOrder da por pagado un pedido cubierto por completo con gift card: no hay
+// nada que cobrar con Stripe. No acredita puntos a propósito: lo pagado con gift card no
+// suma puntos (awardLoyaltyPoints lo excluye de la base), así que la base sería cero.
+func settleGiftCardOrder(ctx context.Context, tx pgx.Tx, orderID string) error {
+	var current string
+	err := tx.QueryRow(ctx,
+		`UPDATE orders SET payment_method=$1, paid_at=COALESCE(paid_at, NOW()), amount_paid=0
+		 WHERE id=$2 RETURNING status`, paymentMethodGiftCard, orderID).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current == "pendiente" {
+		if _, err := transitionOrderStatus(ctx, tx, orderID, "recibido", systemActor, "Pagado con gift card"); err != nil {
+			return err
+		}
+	}
+	return commitOrderStock(ctx, tx, orderID)
+}
+
+// respondGiftCardError traduce los errores de gift cards a la respuesta HTTP
+func respondGiftCardError(c *fiber.Ctx, err error) error {
+	var giftErr *GiftCardError
+	if errors.As(err, &giftErr) {
+		return c.Status(giftErr.Status).JSON(fiber.Map{"error": giftErr.Message, "code": giftErr.Code})
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+}
+
+// POST /api/protected/gift-cards
+// Compra una gift card: se crea pendiente y se activa (y envía al destinatario) cuando
+// Stripe confirma el pago
+func PurchaseGiftCard(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req GiftCardRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	req.Note = ""
+	if msg := validateGiftCardRequest(&req, true); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	if req.Currency == "" {
+		req.Currency = "pen"
+	}
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Stripe no configurado"})
+	}
+
+	ctx := context.Background()
+	id, code, err := insertGiftCard(ctx, db.DB, &req, giftCardPending, giftCardSourcePurchase, &userID, nil)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear la gift card"})
+	}
+
+	pi, err := paymentintent.New(&stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(toCents(req.Amount)),
+		Currency: stripe.String(req.Currency),
+		Metadata: map[string]string{
+			"type":    "gift_card",
+			"id":      strconv.FormatInt(id, 10),
+			"user_id": fmt.Sprintf("%d", userID),
+		},
+	})
+	if err != nil {
+		_, _ = db.DB.Exec(ctx, "DELETE FROM gift_cards WHERE id=$1 AND status='pending'", id)
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error creando PaymentIntent"})
+	}
+	_, _ = db.DB.Exec(ctx, "UPDATE gift_cards SET stripe_payment_intent_id=$1 WHERE id=$2", pi.ID, id)
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"clientSecret": pi.ClientSecret,
+		"gift_card": fiber.Map{
+			"id":     id,
+			"code":   maskGiftCardCode(code),
+			"amount": req.Amount,
+			"status": giftCardPending,
+		},
+	})
+}
+
+// GET /api/protected/gift-cards
+// Gift cards compradas por el usuario o recibidas en su email
+func ListMyGiftCards(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT `+giftCardColumns+` FROM gift_cards
+		 WHERE purchaser_user_id = $1
+		    OR (status = 'active' AND LOWER(recipient_email) = (SELECT LOWER(email) FROM users WHERE id = $1))
+		 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener gift cards"})
+	}
+	defer rows.Close()
+
+	cards := []fiber.Map{}
+	for rows.Next() {
+		var card giftCardRecord
+		if err := scanGiftCard(rows, &card); err != nil {
+			continue
+		}
+		item := card.toMap()
+		item["purchased"] = card.PurchaserUserID != nil && *card.PurchaserUserID == userID
+		delete(item, "void_reason")
+		cards = append(cards, item)
+	}
+	return c.JSON(fiber.Map{"data": cards})
+}
+
+// POST /api/gift-cards/balance
+// Consulta el saldo de una gift card por su código (también para invitados)
+func CheckGiftCardBalance(c *fiber.Ctx) error {
+	var req GiftCardBalanceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	code := normalizeGiftCardCode(req.Code)
+	if !utils.IsValidString(code, 8, 20) {
+		return respondGiftCardError(c, errGiftCardNotFound)
+	}
+
+	var balance float64
+	var status string
+	err := db.DB.QueryRow(context.Background(),
+		"SELECT balance, status FROM gift_cards WHERE code=$1 AND status <> 'pending'", code).Scan(&balance, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return respondGiftCardError(c, errGiftCardNotFound)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al consultar la gift card"})
+	}
+	return c.JSON(fiber.Map{
+		"code":    maskGiftCardCode(code),
+		"balance": balance,
+		"status":  status,
+	})
+}
+
+// activateGiftCard activa una gift card comprada cuando Stripe confirma el pago, carga su
+// saldo y la envía al destinatario. Es idempotente.
+func activateGiftCard(cardID string, capturedCents int64) {
+	id, err := strconv.ParseInt(cardID, 10, 64)
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("[GIFT_CARD] Error iniciando transacción para la gift card %d: %v", id, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var card giftCardRecord
+	err = scanGiftCard(tx.QueryRow(ctx, `SELECT `+giftCardColumns+` FROM gift_cards WHERE id=$1 FOR UPDATE`, id), &card)
+	if err != nil || card.Status != giftCardPending {
+		return
+	}
+	if capturedCents < toCents(card.InitialAmount) {
+		log.Printf("[GIFT_CARD] Pago de S/%.2f menor al monto de la gift card %d", float64(capturedCents)/100, id)
+		CreateAutomaticNotificationWithPriority("warning", "Pago no conciliado",
+			fmt.Sprintf("La gift card %d esperaba S/%.2f pero Stripe capturó S/%.2f", id, card.InitialAmount, float64(capturedCents)/100),
+			nil, nil, 3)
+		return
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE gift_cards SET status='active', balance=initial_amount, activated_at=NOW() WHERE id=$1", id)
+	if err == nil {
+		err = recordGiftCardMovement(ctx, tx, id, giftCardTxIssue, card.InitialAmount, card.InitialAmount, nil, card.PurchaserUserID, "Compra")
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		log.Printf("[GIFT_CARD] Error activando la gift card %d: %v", id, err)
+		return
+	}
+
+	card.Status, card.Balance = giftCardActive, card.InitialAmount
+	if card.PurchaserUserID != nil {
+		userIDStr := fmt.Sprintf("%d", *card.PurchaserUserID)
+		CreateAutomaticNotification("success", "Gift card enviada",
+			fmt.Sprintf("Tu gift card de S/%.2f fue enviada a %s", card.InitialAmount, card.RecipientEmail), &userIDStr, nil)
+	}
+	go deliverGiftCard(&card)
+}
+
+// deliverGiftCard envía la gift card por email al destinatario y registra el envío
+func deliverGiftCard(card *giftCardRecord) {
+	if card.RecipientEmail == "" {
+		return
+	}
+	if err := sendGiftCardEmail(card); err != nil {
+		log.Printf("[GIFT_CARD] No se pudo enviar la gift card %d a %s: %v", card.ID, utils.SanitizeForLog(card.RecipientEmail), err)
+		return
+	}
+	_, _ = db.DB.Exec(context.Background(), "UPDATE gift_cards SET delivered_at=NOW() WHERE id=$1", card.ID)
+}
+
+// GET /api/admin/gift-cards?status=active&q=...&page=1&limit=20
+// Gift cards emitidas; q busca por código o email del destinatario
+func ListGiftCards(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	status := c.Query("status")
+	if status != "" && status != giftCardPending && status != giftCardActive && status != giftCardVoided {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Estado inválido"})
+	}
+	search := strings.TrimSpace(c.Query("q"))
+	code := normalizeGiftCardCode(search)
+
+	ctx := context.Background()
+	where := ` WHERE ($1 = '' OR status = $1)
+	   AND ($2 = '' OR code = $3 OR LOWER(recipient_email) LIKE '%' || LOWER($2) || '%')`
+	var total int
+	if err := db.DB.QueryRow(ctx, "SELECT COUNT(*) FROM gift_cards"+where, status, search, code).Scan(&total); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al contar gift cards"})
+	}
+	rows, err := db.DB.Query(ctx,
+		`SELECT `+giftCardColumns+` FROM gift_cards`+where+`
+		 ORDER BY created_at DESC LIMIT $4 OFFSET $5`, status, search, code, limit, (page-1)*limit)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener gift cards"})
+	}
+	defer rows.Close()
+
+	cards := []fiber.Map{}
+	for rows.Next() {
+		var card giftCardRecord
+		if err := scanGiftCard(rows, &card); err != nil {
+			continue
+		}
+		cards = append(cards, card.toMap())
+	}
+	return c.JSON(fiber.Map{
+		"data": cards,
+		"pagination": fiber.Map{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+			"pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// GET /api/admin/gift-cards/:id
+// Detalle de una gift card con su libro de saldo
+func GetGiftCard(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Gift card no encontrada"})
+	}
+	ctx := context.Background()
+
+	var card giftCardRecord
+	err = scanGiftCard(db.DB.QueryRow(ctx, `SELECT `+giftCardColumns+` FROM gift_cards WHERE id=$1`, id), &card)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Gift card no encontrada"})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener la gift card"})
+	}
+
+	rows, err := db.DB.Query(ctx,
+		`SELECT id, type, amount, balance_after, order_id::text, actor_user_id, COALESCE(note, ''), created_at
+		 FROM gift_card_transactions WHERE gift_card_id=$1 ORDER BY created_at, id`, id)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener movimientos"})
+	}
+	defer rows.Close()
+
+	ledger := []fiber.Map{}
+	for rows.Next() {
+		var txID int64
+		var txType, note string
+		var amount, balanceAfter float64
+		var orderID *string
+		var actorID *int64
+		var createdAt time.Time
+		if err := rows.Scan(&txID, &txType, &amount, &balanceAfter, &orderID, &actorID, &note, &createdAt); err != nil {
+			continue
+		}
+		ledger = append(ledger, fiber.Map{
+			"id":            txID,
+			"type":          txType,
+			"amount":        amount,
+			"balance_after": balanceAfter,
+			"order_id":      orderID,
+			"actor_user_id": actorID,
+			"note":          note,
+			"created_at":    createdAt,
+		})
+	}
+
+	result := card.toMap()
+	result["transactions"] = ledger
+	return c.JSON(result)
+}
+
+// POST /api/admin/gift-cards
+// Emite una gift card activa (cortesías, compensaciones, ventas en tienda)
+func IssueGiftCard(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	adminID := int64(claims["id"].(float64))
+
+	var req GiftCardRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateGiftCardRequest(&req, false); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	id, _, err := insertGiftCard(ctx, tx, &req, giftCardActive, giftCardSourceAdmin, nil, &adminID)
+	if err == nil {
+		_, err = tx.Exec(ctx, "UPDATE gift_cards SET balance=initial_amount, activated_at=NOW() WHERE id=$1", id)
+	}
+	if err == nil {
+		err = recordGiftCardMovement(ctx, tx, id, giftCardTxIssue, req.Amount, req.Amount, nil, &adminID, req.Note)
+	}
+	if err == nil {
+		err = recordAdminAudit(ctx, tx, c, adminID, "GIFT_CARD_ISSUED", "gift_card", id, fiber.Map{
+			"amount":          req.Amount,
+			"recipient_email": req.RecipientEmail,
+			"note":            req.Note,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo emitir la gift card"})
+	}
+
+	var card giftCardRecord
+	if err := scanGiftCard(db.DB.QueryRow(ctx, `SELECT `+giftCardColumns+` FROM gift_cards WHERE id=$1`, id), &card); err != nil {
+		return c.Status(http.StatusCreated).JSON(fiber.Map{"success": true, "id": id})
+	}
+	go deliverGiftCard(&card)
+	return c.Status(http.StatusCreated).JSON(card.toMap())
+}
+
+// lockGiftCardByID obtiene una gift card por ID bloqueando su fila
+func lockGiftCardByID(ctx context.Context, tx pgx.Tx, rawID string) (*giftCardRecord, error) {
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		return nil, errGiftCardNotFound
+	}
+	var card giftCardRecord
+	err = scanGiftCard(tx.QueryRow(ctx, `SELECT `+giftCardColumns+` FROM gift_cards WHERE id=$1 FOR UPDATE`, id), &card)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errGiftCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &card, nil
+}
+
+// POST /api/admin/gift-cards/:id/void
+// Anula una gift card: su saldo queda en cero y ya no se puede usar
+func VoidGiftCard(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	adminID := int64(claims["id"].(float64))
+
+	var req GiftCardVoidRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if !utils.IsValidString(req.Reason, 3, 500) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Motivo inválido (3-500 caracteres)"})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	card, err := lockGiftCardByID(ctx, tx, c.Params("id"))
+	if err != nil {
+		return respondGiftCardError(c, err)
+	}
+	if card.Status == giftCardVoided {
+		return respondGiftCardError(c, &GiftCardError{Status: http.StatusConflict, Code: "GIFT_CARD_VOIDED", Message: "La gift card ya está anulada"})
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE gift_cards SET status='voided', balance=0, voided_at=NOW(), void_reason=$1 WHERE id=$2", req.Reason, card.ID)
+	if err == nil && card.Balance > 0 {
+		err = recordGiftCardMovement(ctx, tx, card.ID, giftCardTxVoid, -card.Balance, 0, nil, &adminID, req.Reason)
+	}
+	if err == nil {
+		err = recordAdminAudit(ctx, tx, c, adminID, "GIFT_CARD_VOIDED", "gift_card", card.ID, fiber.Map{
+			"previous_status":  card.Status,
+			"previous_balance": card.Balance,
+			"reason":           req.Reason,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo anular la gift card"})
+	}
+	return c.JSON(fiber.Map{"success": true, "status": giftCardVoided, "voided_balance": card.Balance})
+}
+
+// POST /api/admin/gift-cards/:id/adjust
+// Ajusta el saldo de una gift card activa (positivo suma, negativo descuenta)
+func AdjustGiftCardBalance(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	adminID := int64(claims["id"].(float64))
+
+	var req GiftCardAdjustRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	req.Amount = roundMoney(req.Amount)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Amount == 0 || req.Amount > maxGiftCardAmount || req.Amount < -maxGiftCardAmount {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Monto de ajuste inválido"})
+	}
+	if !utils.IsValidString(req.Reason, 3, 500) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Motivo inválido (3-500 caracteres)"})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	card, err := lockGiftCardByID(ctx, tx, c.Params("id"))
+	if err != nil {
+		return respondGiftCardError(c, err)
+	}
+	if card.Status != giftCardActive {
+		return respondGiftCardError(c, &GiftCardError{Status: http.StatusConflict, Code: "GIFT_CARD_NOT_ACTIVE", Message: "Solo se puede ajustar una gift card activa"})
+	}
+	balance := roundMoney(card.Balance + req.Amount)
+	if balance < 0 {
+		return respondGiftCardError(c, &GiftCardError{Status: http.StatusBadRequest, Code: "GIFT_CARD_NEGATIVE_BALANCE", Message: "El saldo no puede quedar negativo"})
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE gift_cards SET balance=$1 WHERE id=$2", balance, card.ID)
+	if err == nil {
+		err = recordGiftCardMovement(ctx, tx, card.ID, giftCardTxAdjust, req.Amount, balance, nil, &adminID, req.Reason)
+	}
+	if err == nil {
+		err = recordAdminAudit(ctx, tx, c, adminID, "GIFT_CARD_ADJUSTED", "gift_card", card.ID, fiber.Map{
+			"amount":           req.Amount,
+			"previous_balance": card.Balance,
+			"balance":          balance,
+			"reason":           req.Reason,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo ajustar el saldo"})
+	}
+	return c.JSON(fiber.Map{"success": true, "balance": balance})
+}
+
+const giftCardEmailTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Tu gift card POSOQO</title>
+</head>
+<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333; max-width: 600px; margin: 0 auto; padding: 20px; background-color: #f4f4f4;">
+    <div style="background-color: white; padding: 30px; border-radius: 10px; box-shadow: 0 2px 10px rgba(0,0,0,0.1);">
+        <div style="text-align: center; margin-bottom: 30px;">
+            <div style="font-size: 24px; font-weight: bold; color: #FFD700; margin-bottom: 10px;">POSOQO</div>
+            <div style="color: #333; font-size: 20px; margin-bottom: 20px;">¡Tienes una gift card!</div>
+        </div>
+
+        <p>Hola{{if .RecipientName}} {{.RecipientName}}{{end}},</p>
+        <p>{{if .SenderName}}{{.SenderName}} te regaló{{else}}Recibiste{{end}} una gift card de <strong>S/ {{printf "%.2f" .Amount}}</strong> para usar en POSOQO.</p>
+
+        {{if .Message}}
+        <blockquote style="border-left: 4px solid #FFD700; margin: 20px 0; padding: 10px 20px; background: #fafafa; font-style: italic;">{{.Message}}</blockquote>
+        {{end}}
+
+        <div style="text-align: center; margin: 30px 0;">
+            <div style="font-size: 14px; color: #666;">Tu código</div>
+            <div style="font-size: 26px; font-weight: bold; letter-spacing: 3px; font-family: monospace; margin: 10px 0;">{{.Code}}</div>
+            <div style="font-size: 13px; color: #666;">Ingrésalo al pagar; puedes usar el saldo en varias compras.</div>
+        </div>
+
+        <div style="text-align: center; margin: 30px 0;">
+            <a href="{{.ShopURL}}" style="display: inline-block; background: linear-gradient(135deg, #FFD700, #D4AF37); color: #000; padding: 12px 30px; text-decoration: none; border-radius: 25px; font-weight: bold;">Ir a la tienda</a>
+        </div>
+    </div>
+</body>
+</html>
+`
+
+// sendGiftCardEmail envía el código de la gift card a su destinatario
+func sendGiftCardEmail(card *giftCardRecord) error {
+	tmpl, err := template.New("giftCard").Parse(giftCardEmailTemplate)
+	if err != nil {
+		return err
+	}
+	var body strings.Builder
+	err = tmpl.Execute(&body, struct {
+		RecipientName string
+		SenderName    string
+		Message       string
+		Amount        float64
+		Code          string
+		ShopURL       string
+	}{
+		RecipientName: card.RecipientName,
+		SenderName:    card.SenderName,
+		Message:       card.Message,
+		Amount:        card.InitialAmount,
+		Code:          formatGiftCardCode(card.Code),
+		ShopURL:       frontendBaseURL() + "/products",
+	})
+	if err != nil {
+		return err
+	}
+	return sendHTMLEmail(card.RecipientEmail, "Tu gift card POSOQO", body.String())
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGiftCardCode valida el formato de los códigos de gift card
+func TestGiftCardCode(t *testing.T) {
+	code, err := generateGiftCardCode()
+	assert.NoError(t, err)
+	assert.Len(t, code, len(giftCardCodePrefix)+giftCardCodeRandom)
+	assert.True(t, strings.HasPrefix(code, giftCardCodePrefix))
+	for _, r := range code[len(giftCardCodePrefix):] {
+		assert.Contains(t, giftCardCodeAlphabet, string(r))
+	}
+
+	assert.Equal(t, "POSOABCDEFGH2345", normalizeGiftCardCode(" poso-abcd efgh-2345 "))
+	assert.Equal(t, "POSO-ABCD-EFGH-2345", formatGiftCardCode("POSOABCDEFGH2345"))
+	assert.Equal(t, "****-****-****-2345", maskGiftCardCode("POSOABCDEFGH2345"))
+}
+
+// TestGiftCardRedemption valida cuánto saldo se usa en un pedido
+func TestGiftCardRedemption(t *testing.T) {
+	// Cubre todo el pedido
+	assert.Equal(t, 80.0, giftCardRedemption(100, 80, stripeMinimumCharge))
+	// Pago parcial: el resto se cobra con tarjeta
+	assert.Equal(t, 50.0, giftCardRedemption(50, 80, stripeMinimumCharge))
+	// El resto no puede quedar debajo del mínimo de Stripe
+	assert.Equal(t, 78.0, giftCardRedemption(79.5, 80, stripeMinimumCharge))
+	assert.Equal(t, 79.5, giftCardRedemption(79.5, 80, 0))
+	assert.Equal(t, 0.0, giftCardRedemption(1, 1.5, stripeMinimumCharge))
+	assert.Equal(t, 0.0, giftCardRedemption(0, 80, stripeMinimumCharge))
+}
+
+// TestValidateGiftCardRequest valida la compra y emisión de gift cards
+func TestValidateGiftCardRequest(t *testing.T) {
+	req := GiftCardRequest{Amount: 50, RecipientEmail: " Ana@Example.com ", Message: " ¡Salud! "}
+	assert.Empty(t, validateGiftCardRequest(&req, true))
+	assert.Equal(t, "ana@example.com", req.RecipientEmail)
+	assert.Equal(t, "¡Salud!", req.Message)
+
+	req = GiftCardRequest{Amount: 10, RecipientEmail: "ana@example.com"}
+	assert.Equal(t, "Monto inválido (S/20 - S/1000)", validateGiftCardRequest(&req, true))
+
+	req = GiftCardRequest{Amount: 50}
+	assert.Equal(t, "El email del destinatario es obligatorio", validateGiftCardRequest(&req, true))
+	assert.Empty(t, validateGiftCardRequest(&req, false))
+
+	req = GiftCardRequest{Amount: 50, RecipientEmail: "no-es-email"}
+	assert.Equal(t, "Email del destinatario inválido", validateGiftCardRequest(&req, false))
+}
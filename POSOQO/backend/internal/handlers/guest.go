@@ -0,0 +1,497 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+	"github.com/stripe/stripe-go/v78"
+)
+
+// guestLinkTTL es la vigencia del enlace mágico de seguimiento de un pedido de invitado
+const guestLinkTTL = 30 * 24 * time.Hour
+
+// GuestCheckoutRequest son los datos de un pedido hecho sin cuenta
+type GuestCheckoutRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+	// contra_entrega (por defecto) o stripe; con stripe amount es el total que ve el cliente
+	PaymentMethod   string             `json:"payment_method,omitempty"`
+	Amount          float64            `json:"amount,omitempty"`
+	Currency        string             `json:"currency,omitempty"`
+	Items           []OrderItemRequest `json:"items"`
+	Location        string             `json:"location"`
+	Lat             *float64           `json:"lat,omitempty"`
+	Lng             *float64           `json:"lng,omitempty"`
+	CouponCode      string             `json:"coupon_code,omitempty"`
+	GiftCardCode    string             `json:"gift_card_code,omitempty"`
+	FulfillmentType string             `json:"fulfillment_type,omitempty"`
+	ScheduledFor    *time.Time         `json:"scheduled_for,omitempty"`
+	// BirthDate (AAAA-MM-DD) es obligatoria si el pedido contiene alcohol; DNI es opcional
+	// salvo que AGE_VERIFICATION_REQUIRE_DNI esté activo y se cruza con el nombre
+	BirthDate string `json:"birth_date,omitempty"`
+	DNI       string `json:"dni,omitempty"`
+}
+
+// validateGuestCheckout normaliza la solicitud y devuelve el mensaje de error si no es válida
+func validateGuestCheckout(req *GuestCheckoutRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	req.Phone = strings.TrimSpace(req.Phone)
+	req.DNI = strings.TrimSpace(req.DNI)
+	if req.PaymentMethod == "" {
+		req.PaymentMethod = paymentMethodContraEntrega
+	}
+	if req.FulfillmentType == "" {
+		req.FulfillmentType = fulfillmentDelivery
+	}
+	if req.FulfillmentType == fulfillmentPickup && req.Location == "" {
+		req.Location = "Recojo en tienda"
+	}
+
+	switch {
+	case !utils.IsValidName(req.Name, 2, 100):
+		return "Nombre inválido (2-100 letras)"
+	case !utils.IsValidEmail(req.Email):
+		return "Email inválido"
+	case !utils.IsValidPeruvianPhone(req.Phone):
+		return "Celular inválido"
+	case req.PaymentMethod != paymentMethodContraEntrega && req.PaymentMethod != paymentMethodStripe:
+		return "Método de pago inválido (contra_entrega o stripe)"
+	case req.PaymentMethod == paymentMethodStripe && req.Amount <= 0:
+		return "Monto inválido"
+	case !isValidFulfillmentType(req.FulfillmentType):
+		return "Tipo de entrega inválido (delivery o pickup)"
+	case !utils.IsValidString(req.Location, 2, 200):
+		return "Ubicación inválida (2-200 caracteres)"
+	case req.DNI != "" && !utils.IsValidDNI(req.DNI):
+		return "El DNI debe contener exactamente 8 dígitos numéricos"
+	}
+	if req.BirthDate != "" {
+		if _, msg := parseBirthDate(req.BirthDate, time.Now().In(businessLocation())); msg != "" {
+			return msg
+		}
+	}
+	return validateOrderItems(req.Items)
+}
+
+// hashGuestToken es el valor que se guarda del token; el token en claro solo viaja por email
+func hashGuestToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createGuestOrderLink genera un enlace mágico para seguir el pedido y devuelve el token
+func createGuestOrderLink(ctx context.Context, q dbQuerier, orderID, email string) (string, error) {
+	token, err := generateVerificationToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = q.Exec(ctx,
+		"INSERT INTO guest_order_links (order_id, email, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		orderID, email, hashGuestToken(token), time.Now().Add(guestLinkTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// guestTrackingURL es la página del frontend que muestra un pedido de invitado
+func guestTrackingURL(orderID, token string) string {
+	return fmt.Sprintf("%s/pedidos/invitado/%s?token=%s", frontendBaseURL(), url.PathEscape(orderID), token)
+}
+
+// guestRegisterURL invita a crear una cuenta con el mismo email para conservar los pedidos
+func guestRegisterURL(email string) string {
+	return fmt.Sprintf("%s/registro?email=%s", frontendBaseURL(), url.QueryEscape(email))
+}
+
+// guestOrderEmail es un pedido listado en el email de seguimiento
+type guestOrderEmail struct {
+	ID          string
+	Total       float64
+	CreatedAt   string
+	TrackingURL string
+}
+
+const guestOrdersEmailTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Tus pedidos - POSOQO</title>
+</head>
+<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333; max-width: 600px; margin: 0 auto; padding: 20px; background-color: #f4f4f4;">
+    <div style="background-color: white; padding: 30px; border-radius: 10px; box-shadow: 0 2px 10px rgba(0,0,0,0.1);">
+        <div style="text-align: center; margin-bottom: 30px;">
+            <div style="font-size: 24px; font-weight: bold; color: #FFD700; margin-bottom: 10px;">POSOQO</div>
+            <div style="color: #333; font-size: 20px; margin-bottom: 20px;">Sigue tu pedido</div>
+        </div>
+
+        <p>Hola {{.Name}},</p>
+        <p>Usa estos enlaces para ver el estado de tus pedidos. No los compartas: cualquiera con el enlace puede ver el pedido.</p>
+
+        {{range .Orders}}
+        <div style="border: 1px solid #eee; border-radius: 8px; padding: 15px; margin: 15px 0;">
+            <p style="margin: 0;"><strong>Pedido {{.ID}}</strong><br>{{.CreatedAt}} - S/ {{printf "%.2f" .Total}}</p>
+            <div style="text-align: center; margin-top: 10px;">
+                <a href="{{.TrackingURL}}" style="display: inline-block; background: linear-gradient(135deg, #FFD700, #D4AF37); color: #000; padding: 10px 25px; text-decoration: none; border-radius: 25px; font-weight: bold;">Ver pedido</a>
+            </div>
+        </div>
+        {{end}}
+
+        <p>¿Quieres guardar tu historial y comprar más rápido? <a href="{{.RegisterURL}}">Crea tu cuenta</a> con este mismo email y, al verificarlo, tus pedidos aparecerán en ella.</p>
+
+        <div style="text-align: center; margin-top: 30px; padding-top: 20px; border-top: 1px solid #eee; color: #666; font-size: 12px;">
+            <p>Este es un email automático, no respondas a este mensaje.</p>
+        </div>
+    </div>
+</body>
+</html>
+`
+
+// sendGuestOrdersEmail envía los enlaces mágicos de seguimiento de uno o más pedidos
+func sendGuestOrdersEmail(email, name string, orders []guestOrderEmail) error {
+	tmpl, err := template.New("guestOrders").Parse(guestOrdersEmailTemplate)
+	if err != nil {
+		return err
+	}
+	var body strings.Builder
+	err = tmpl.Execute(&body, struct {
+		Name        string
+		Orders      []guestOrderEmail
+		RegisterURL string
+	}{name, orders, guestRegisterURL(email)})
+	if err != nil {
+		return err
+	}
+	return sendHTMLEmail(email, "Sigue tu pedido - POSOQO", body.String())
+}
+
+// claimGuestOrders pasa a la cuenta los pedidos de invitado hechos con su email verificado,
+// junto con sus pagos y canjes de cupón. Devuelve cuántos pedidos se asociaron.
+func claimGuestOrders(ctx context.Context, q dbQuerier, userID int64, email string) (int64, error) {
+	var claimed int64
+	err := q.QueryRow(ctx,
+		`WITH claimed AS (
+		     UPDATE orders SET user_id=$1
+		     WHERE user_id IS NULL AND LOWER(guest_email) = LOWER($2)
+		     RETURNING id
+		 ), payments_claimed AS (
+		     UPDATE payments SET user_id=$1
+		     WHERE user_id IS NULL AND order_id IN (SELECT id FROM claimed)
+		 ), redemptions_claimed AS (
+		     UPDATE coupon_redemptions SET user_id=$1
+		     WHERE user_id IS NULL AND order_id IN (SELECT id FROM claimed)
+		 )
+		 SELECT COUNT(*) FROM claimed`,
+		userID, email).Scan(&claimed)
+	return claimed, err
+}
+
+// POST /api/guest/checkout
+// Crea un pedido sin cuenta, identificado por email y celular, y envía el enlace de seguimiento
+func GuestCheckout(c *fiber.Ctx) error {
+	var req GuestCheckoutRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateGuestCheckout(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	status := "recibido"
+	if req.PaymentMethod == paymentMethodStripe {
+		stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+		if stripe.Key == "" {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Stripe no configurado"})
+		}
+		if req.Currency == "" {
+			req.Currency = "pen"
+		}
+		status = "pendiente"
+	}
+
+	var orderLat, orderLng interface{}
+	if req.Lat != nil && req.Lng != nil && utils.IsValidCoordinate(*req.Lat, *req.Lng) {
+		orderLat, orderLng = *req.Lat, *req.Lng
+	}
+
+	ctx := context.Background()
+	contact := GuestContact{Name: req.Name, Email: req.Email, Phone: req.Phone}
+	if req.BirthDate != "" {
+		birth, _ := parseBirthDate(req.BirthDate, time.Now().In(businessLocation()))
+		contact.BirthDate = &birth
+	}
+	// El DNI se cruza antes de abrir la transacción para no retenerla durante la consulta
+	if req.DNI != "" {
+		if err := crossCheckDNI(ctx, req.DNI, req.Name); err != nil {
+			return respondDNICheckError(c, err)
+		}
+		contact.DNIVerified = true
+	}
+
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	orderID, totals, err := placeOrder(ctx, tx, checkoutInput{
+		Actor:           orderActor{Role: "guest"},
+		Status:          status,
+		PaymentMethod:   req.PaymentMethod,
+		Items:           req.Items,
+		Location:        req.Location,
+		Lat:             orderLat,
+		Lng:             orderLng,
+		CouponCode:      req.CouponCode,
+		FulfillmentType: req.FulfillmentType,
+		ScheduledFor:    req.ScheduledFor,
+		Guest:           &contact,
+		GiftCardCode:    req.GiftCardCode,
+	})
+	if err != nil {
+		return respondCheckoutError(c, err)
+	}
+	if req.PaymentMethod == paymentMethodStripe && toCents(req.Amount) != toCents(totals.Total) {
+		return respondAmountMismatch(c, totals.Total, &totals)
+	}
+
+	// Pedido cubierto por completo con gift card: no hay nada que cobrar
+	paidWithGiftCard := totals.GiftCard > 0 && totals.AmountDue() == 0
+	if paidWithGiftCard {
+		if err := settleGiftCardOrder(ctx, tx, orderID); err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al guardar pedido"})
+		}
+	}
+
+	token, err := createGuestOrderLink(ctx, tx, orderID, req.Email)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al guardar pedido"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al guardar pedido"})
+	}
+
+	trackingURL := guestTrackingURL(orderID, token)
+	response := fiber.Map{
+		"message":      "Pedido creado",
+		"order_id":     orderID,
+		"totals":       totals,
+		"amount_due":   totals.AmountDue(),
+		"token":        token,
+		"tracking_url": trackingURL,
+		"register_url": guestRegisterURL(req.Email),
+	}
+
+	if req.PaymentMethod == paymentMethodStripe && !paidWithGiftCard {
+		pi, err := newOrderPaymentIntent(orderID, totals.AmountDue(), req.Currency, map[string]string{
+			"guest_email": req.Email,
+		})
+		if err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error creando PaymentIntent"})
+		}
+		response["clientSecret"] = pi.ClientSecret
+	} else {
+		// Solo se avisa a los admins: el invitado no tiene notificaciones en la app
+		CreateOrderNotification(orderID, "", "creado")
+	}
+
+	go func() {
+		order := guestOrderEmail{
+			ID:          orderID,
+			Total:       totals.Total,
+			CreatedAt:   time.Now().In(businessLocation()).Format("02/01/2006 15:04"),
+			TrackingURL: trackingURL,
+		}
+		if err := sendGuestOrdersEmail(req.Email, req.Name, []guestOrderEmail{order}); err != nil {
+			log.Printf("[GUEST] No se pudo enviar el enlace del pedido %s: %v", orderID, err)
+		}
+	}()
+
+	return c.Status(http.StatusCreated).JSON(response)
+}
+
+// GET /api/guest/orders/:id?token=...
+// Seguimiento de un pedido de invitado con el enlace mágico
+func GetGuestOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	token := c.Query("token")
+	if token == "" {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Enlace inválido o expirado"})
+	}
+	ctx := context.Background()
+
+	var linkID int64
+	err := db.DB.QueryRow(ctx,
+		`UPDATE guest_order_links SET last_used_at=NOW()
+		 WHERE order_id=$1 AND token_hash=$2 AND expires_at > NOW()
+		 RETURNING id`,
+		orderID, hashGuestToken(token)).Scan(&linkID)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Enlace inválido o expirado"})
+	}
+
+	var status, paymentMethod, fulfillmentType, location string
+	var totals OrderTotals
+	var paid, claimed bool
+	var scheduledFor *time.Time
+	var etaMinutes *int
+	var createdAt time.Time
+	err = db.DB.QueryRow(ctx,
+		`SELECT status, payment_method, fulfillment_type, COALESCE(location, ''), scheduled_for,
+		        delivery_eta_minutes, paid_at IS NOT NULL, user_id IS NOT NULL, created_at,
+		        subtotal, discount_total, shipping_fee, deposit_total, total, gift_card_amount
+		 FROM orders WHERE id=$1`, orderID).
+		Scan(&status, &paymentMethod, &fulfillmentType, &location, &scheduledFor,
+			&etaMinutes, &paid, &claimed, &createdAt,
+			&totals.Subtotal, &totals.Discount, &totals.Shipping, &totals.Deposit, &totals.Total, &totals.GiftCard)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+
+	lines, err := loadOrderLines(ctx, db.DB, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+	items := make([]fiber.Map, 0, len(lines))
+	for _, line := range lines {
+		items = append(items, fiber.Map{
+			"product_id": line.ProductID,
+			"variant_id": line.VariantID,
+			"name":       line.Name,
+			"quantity":   line.Quantity,
+			"unit_price": line.UnitPrice,
+			"subtotal":   roundMoney(line.Subtotal()),
+		})
+	}
+
+	// El invitado ve el historial de estados sin la identidad del personal
+	rows, err := db.DB.Query(ctx,
+		`SELECT to_status, created_at FROM order_status_history
+		 WHERE order_id=$1 ORDER BY created_at, id`, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener historial"})
+	}
+	defer rows.Close()
+	timeline := []fiber.Map{}
+	for rows.Next() {
+		var toStatus string
+		var at time.Time
+		if err := rows.Scan(&toStatus, &at); err != nil {
+			continue
+		}
+		timeline = append(timeline, fiber.Map{"status": toStatus, "created_at": at})
+	}
+
+	return c.JSON(fiber.Map{
+		"id":                   orderID,
+		"status":               status,
+		"payment_method":       paymentMethod,
+		"paid":                 paid,
+		"fulfillment_type":     fulfillmentType,
+		"location":             location,
+		"scheduled_for":        scheduledFor,
+		"delivery_eta_minutes": etaMinutes,
+		"created_at":           createdAt,
+		"totals":               totals,
+		"items":                items,
+		"timeline":             timeline,
+		"claimed":              claimed,
+	})
+}
+
+// POST /api/guest/orders/link
+// Reenvía los enlaces de seguimiento de los pedidos de invitado de un email.
+// Siempre responde lo mismo para no revelar qué emails tienen pedidos.
+func ResendGuestOrderLinks(c *fiber.Ctx) error {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := c.BodyParser(&req); err != nil || !utils.IsValidEmail(req.Email) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Email inválido"})
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	response := fiber.Map{"message": "Si hay pedidos con ese email, te enviamos los enlaces de seguimiento"}
+	ctx := context.Background()
+
+	rows, err := db.DB.Query(ctx,
+		`SELECT id, COALESCE(guest_name, ''), total, created_at FROM orders
+		 WHERE user_id IS NULL AND LOWER(guest_email) = $1 AND created_at > NOW() - INTERVAL '90 days'
+		 ORDER BY created_at DESC LIMIT 5`, email)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al buscar pedidos"})
+	}
+	var name string
+	orders := []guestOrderEmail{}
+	for rows.Next() {
+		var order guestOrderEmail
+		var createdAt time.Time
+		if err := rows.Scan(&order.ID, &name, &order.Total, &createdAt); err != nil {
+			continue
+		}
+		order.CreatedAt = createdAt.In(businessLocation()).Format("02/01/2006 15:04")
+		orders = append(orders, order)
+	}
+	rows.Close()
+	if len(orders) == 0 {
+		return c.JSON(response)
+	}
+
+	for i := range orders {
+		token, err := createGuestOrderLink(ctx, db.DB, orders[i].ID, email)
+		if err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al generar enlaces"})
+		}
+		orders[i].TrackingURL = guestTrackingURL(orders[i].ID, token)
+	}
+	go func() {
+		if err := sendGuestOrdersEmail(email, name, orders); err != nil {
+			log.Printf("[GUEST] No se pudieron reenviar los enlaces a %s: %v", email, err)
+		}
+	}()
+	return c.JSON(response)
+}
+
+// POST /api/protected/orders/claim-guest
+// Asocia a la cuenta los pedidos hechos como invitado con su email (debe estar verificado)
+func ClaimGuestOrders(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	ctx := context.Background()
+
+	var email string
+	var verified bool
+	err := db.DB.QueryRow(ctx,
+		"SELECT email, COALESCE(email_verified, false) FROM users WHERE id=$1", userID).Scan(&email, &verified)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	if !verified {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{
+			"error": "Verifica tu email para recuperar tus pedidos",
+			"code":  "EMAIL_NOT_VERIFIED",
+		})
+	}
+
+	claimed, err := claimGuestOrders(ctx, db.DB, userID, email)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudieron asociar los pedidos"})
+	}
+	return c.JSON(fiber.Map{"claimed": claimed})
+}
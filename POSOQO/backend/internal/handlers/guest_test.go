@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestValidateGuestCheckout valida los datos de contacto y los valores por defecto del checkout de invitados
+func TestValidateGuestCheckout(t *testing.T) {
+	valid := func() GuestCheckoutRequest {
+		return GuestCheckoutRequest{
+			Name:     "Ana Quispe",
+			Email:    " Ana@Example.com ",
+			Phone:    "987654321",
+			Location: "Jr. Lima 123, Ayacucho",
+			Items:    []OrderItemRequest{{ProductID: "ipa", Quantity: 2}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		mutate   func(*GuestCheckoutRequest)
+		expected string
+	}{
+		{"Válido", func(r *GuestCheckoutRequest) {}, ""},
+		{"Nombre vacío", func(r *GuestCheckoutRequest) { r.Name = " " }, "Nombre inválido (2-100 letras)"},
+		{"Email inválido", func(r *GuestCheckoutRequest) { r.Email = "ana@" }, "Email inválido"},
+		{"Celular inválido", func(r *GuestCheckoutRequest) { r.Phone = "123" }, "Celular inválido"},
+		{"Método de pago desconocido", func(r *GuestCheckoutRequest) { r.PaymentMethod = "yape" }, "Método de pago inválido (contra_entrega o stripe)"},
+		{"Stripe sin monto", func(r *GuestCheckoutRequest) { r.PaymentMethod = paymentMethodStripe }, "Monto inválido"},
+		{"Recojo sin dirección", func(r *GuestCheckoutRequest) { r.FulfillmentType = fulfillmentPickup; r.Location = "" }, ""},
+		{"Carrito vacío", func(r *GuestCheckoutRequest) { r.Items = nil }, "Carrito vacío"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid()
+			tt.mutate(&req)
+			assert.Equal(t, tt.expected, validateGuestCheckout(&req))
+		})
+	}
+
+	req := valid()
+	assert.Equal(t, "", validateGuestCheckout(&req))
+	assert.Equal(t, "ana@example.com", req.Email)
+	assert.Equal(t, paymentMethodContraEntrega, req.PaymentMethod)
+	assert.Equal(t, fulfillmentDelivery, req.FulfillmentType)
+}
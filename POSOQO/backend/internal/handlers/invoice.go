@@ -0,0 +1,514 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/einvoice"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// InvoiceRequest pide la boleta o factura de un pedido pagado. Sin datos del cliente
+// se usan los del perfil de facturación elegido en el checkout.
+type InvoiceRequest struct {
+	Type            string `json:"type"` // boleta o factura
+	CustomerDocType string `json:"customer_doc_type"`
+	CustomerDoc     string `json:"customer_doc_number"`
+	CustomerName    string `json:"customer_name"`
+	CustomerAddress string `json:"customer_address"`
+}
+
+var invoiceTypes = map[string]string{
+	"boleta":  einvoice.TypeBoleta,
+	"factura": einvoice.TypeFactura,
+}
+
+var invoiceCustomerDocTypes = map[string]bool{
+	einvoice.DocSinDocumento: true,
+	einvoice.DocDNI:          true,
+	einvoice.DocCarnetExtr:   true,
+	einvoice.DocRUC:          true,
+	einvoice.DocPasaporte:    true,
+}
+
+// invoiceIssuer devuelve los datos del emisor configurados en el entorno
+func invoiceIssuer() einvoice.Issuer {
+	return einvoice.Issuer{
+		RUC:       os.Getenv("EINVOICE_RUC"),
+		Name:      os.Getenv("EINVOICE_BUSINESS_NAME"),
+		TradeName: os.Getenv("EINVOICE_TRADE_NAME"),
+		Address:   os.Getenv("EINVOICE_ADDRESS"),
+		Ubigeo:    os.Getenv("EINVOICE_UBIGEO"),
+	}
+}
+
+// invoiceLines arma las líneas del comprobante a partir de los items del pedido y el
+// delivery. Los importes ya incluyen descuentos, así que el total cuadra con el pedido.
+func invoiceLines(ctx context.Context, q dbQuerier, orderID string) ([]einvoice.Line, utils.TaxBreakdown, error) {
+	var totals utils.TaxBreakdown
+	rows, err := q.Query(ctx,
+		`SELECT COALESCE(v.sku, oi.product_id::text), `+itemNameSQL+`, oi.quantity, oi.tax_type,
+		        COALESCE(oi.net_amount, oi.quantity * oi.unit_price - oi.discount_amount)
+		 FROM order_items oi
+		 JOIN products p ON oi.product_id = p.id
+		 LEFT JOIN product_variants v ON v.id = oi.variant_id
+		 WHERE oi.order_id = $1
+		 ORDER BY p.name, v.size_ml`, orderID)
+	if err != nil {
+		return nil, totals, err
+	}
+	defer rows.Close()
+
+	var lines []einvoice.Line
+	for rows.Next() {
+		var l einvoice.Line
+		var qty int
+		if err := rows.Scan(&l.Code, &l.Description, &qty, &l.TaxType, &l.Total); err != nil {
+			return nil, totals, err
+		}
+		l.Quantity = float64(qty)
+		l.Base, l.IGV = totals.Add(l.Total, l.TaxType)
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, totals, err
+	}
+
+	var shipping, deposit float64
+	if err := q.QueryRow(ctx, "SELECT shipping_fee, deposit_total FROM orders WHERE id=$1", orderID).Scan(&shipping, &deposit); err != nil {
+		return nil, totals, err
+	}
+	if shipping > 0 {
+		l := einvoice.Line{Description: "Servicio de delivery", Quantity: 1, UnitCode: "ZZ", TaxType: utils.TaxGravado, Total: shipping}
+		l.Base, l.IGV = totals.Add(l.Total, l.TaxType)
+		lines = append(lines, l)
+	}
+	// La garantía de envases retornables se devuelve al cliente, por eso no está afecta al IGV
+	if deposit > 0 {
+		l := einvoice.Line{Description: "Garantía de envases", Quantity: 1, UnitCode: "ZZ", TaxType: utils.TaxInafecto, Total: deposit}
+		l.Base, l.IGV = totals.Add(l.Total, l.TaxType)
+		lines = append(lines, l)
+	}
+	return lines, totals, nil
+}
+
+// invoiceRecord es un comprobante guardado
+type invoiceRecord struct {
+	ID               int64      `json:"id"`
+	OrderID          string     `json:"order_id"`
+	UserID           int64      `json:"-"`
+	DocType          string     `json:"doc_type"`
+	Series           string     `json:"series"`
+	Number           int64      `json:"number"`
+	IssuedAt         time.Time  `json:"issued_at"`
+	CustomerDocType  string     `json:"customer_doc_type"`
+	CustomerDoc      string     `json:"customer_doc_number"`
+	CustomerName     string     `json:"customer_name"`
+	CustomerAddress  string     `json:"customer_address"`
+	Total            float64    `json:"total"`
+	DigestValue      string     `json:"digest_value"`
+	Status           string     `json:"status"`
+	SunatCode        *string    `json:"sunat_code"`
+	SunatDescription *string    `json:"sunat_description"`
+	SubmittedAt      *time.Time `json:"submitted_at"`
+}
+
+const invoiceColumns = `i.id, i.order_id, COALESCE(o.user_id, 0), i.doc_type, i.series, i.number, i.issued_at,
+	i.customer_doc_type, i.customer_doc_number, i.customer_name, i.customer_address,
+	i.total, i.digest_value, i.status, i.sunat_code, i.sunat_description, i.submitted_at`
+
+func scanInvoice(row pgx.Row, inv *invoiceRecord) error {
+	return row.Scan(&inv.ID, &inv.OrderID, &inv.UserID, &inv.DocType, &inv.Series, &inv.Number, &inv.IssuedAt,
+		&inv.CustomerDocType, &inv.CustomerDoc, &inv.CustomerName, &inv.CustomerAddress,
+		&inv.Total, &inv.DigestValue, &inv.Status, &inv.SunatCode, &inv.SunatDescription, &inv.SubmittedAt)
+}
+
+// document reconstruye el comprobante para la representación impresa o el reenvío
+func (inv *invoiceRecord) document(ctx context.Context, q dbQuerier) (*einvoice.Document, error) {
+	lines, totals, err := invoiceLines(ctx, q, inv.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	return &einvoice.Document{
+		Type:     inv.DocType,
+		Series:   inv.Series,
+		Number:   inv.Number,
+		IssuedAt: inv.IssuedAt.In(businessLocation()),
+		Currency: "PEN",
+		Issuer:   invoiceIssuer(),
+		Customer: einvoice.Customer{
+			DocType:   inv.CustomerDocType,
+			DocNumber: inv.CustomerDoc,
+			Name:      inv.CustomerName,
+			Address:   inv.CustomerAddress,
+		},
+		Lines:    lines,
+		Totals:   totals,
+		OrderRef: inv.OrderID,
+	}, nil
+}
+
+// submitInvoice envía el comprobante a la OSE/SUNAT y guarda la respuesta
+func submitInvoice(ctx context.Context, invoiceID int64, doc *einvoice.Document, signedXML []byte) (string, *einvoice.SubmissionResult) {
+	result, err := einvoice.NewSubmitterFromEnv().Submit(ctx, doc, signedXML)
+	status := "error"
+	if err != nil {
+		log.Printf("[EINVOICE] Error enviando %s: %v", doc.ID(), err)
+		result = &einvoice.SubmissionResult{Description: err.Error()}
+	} else if result.Accepted {
+		status = "accepted"
+	} else {
+		status = "rejected"
+	}
+
+	var code interface{}
+	if result.Code != "" {
+		code = result.Code
+	}
+	if _, err := db.DB.Exec(ctx,
+		`UPDATE invoices SET status=$1, sunat_code=$2, sunat_description=$3, cdr=COALESCE($4, cdr), submitted_at=NOW()
+		 WHERE id=$5`,
+		status, code, result.Description, result.CDR, invoiceID); err != nil {
+		log.Printf("[EINVOICE] Error guardando respuesta de %s: %v", doc.ID(), err)
+	}
+	return status, result
+}
+
+// invoiceCustomer valida el tipo de comprobante y los datos del cliente.
+// Sin tipo se emite boleta; una boleta sin documento es para "clientes varios".
+func invoiceCustomer(req InvoiceRequest) (string, einvoice.Customer, string) {
+	if req.Type == "" {
+		req.Type = "boleta"
+	}
+	docType, ok := invoiceTypes[req.Type]
+	if !ok {
+		return "", einvoice.Customer{}, "Tipo de comprobante inválido (boleta o factura)"
+	}
+	customer := einvoice.Customer{
+		DocType:   strings.TrimSpace(req.CustomerDocType),
+		DocNumber: strings.TrimSpace(req.CustomerDoc),
+		Name:      strings.TrimSpace(req.CustomerName),
+		Address:   strings.TrimSpace(req.CustomerAddress),
+	}
+	if docType == einvoice.TypeFactura {
+		customer.DocType = einvoice.DocRUC
+	} else if customer.DocNumber == "" {
+		customer.DocType = einvoice.DocSinDocumento
+	} else if customer.DocType == "" {
+		customer.DocType = einvoice.DocDNI
+	}
+	if !invoiceCustomerDocTypes[customer.DocType] || len(customer.DocNumber) > 15 ||
+		!utils.IsValidString(customer.Name, 0, 255) || !utils.IsValidString(customer.Address, 0, 500) {
+		return "", einvoice.Customer{}, "Datos del cliente inválidos"
+	}
+	return docType, customer, ""
+}
+
+// Emitir la boleta o factura de un pedido pagado (dueño del pedido o admin)
+func IssueOrderInvoice(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	role := claims["role"].(string)
+
+	var req InvoiceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	signer, err := einvoice.LoadSignerFromEnv()
+	if err != nil {
+		log.Printf("[EINVOICE] Certificado no disponible: %v", err)
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "La facturación electrónica no está configurada",
+			"code":  "INVOICING_NOT_CONFIGURED",
+		})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	var ownerID int64
+	var status, paymentMethod string
+	var paid bool
+	var billing InvoiceRequest
+	err = tx.QueryRow(ctx,
+		`SELECT COALESCE(user_id, 0), status, payment_method, paid_at IS NOT NULL, COALESCE(billing_doc_type, ''),
+		        COALESCE(billing_doc_number, ''), COALESCE(billing_name, ''), COALESCE(billing_address, '')
+		 FROM orders WHERE id=$1 FOR UPDATE`,
+		orderID).Scan(&ownerID, &status, &paymentMethod, &paid, &billing.CustomerDocType,
+		&billing.CustomerDoc, &billing.CustomerName, &billing.CustomerAddress)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+	if role != "admin" && ownerID != userID {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
+	}
+	// Contra entrega se cobra al entregar
+	if status == "cancelado" || !(paid || (paymentMethod == paymentMethodContraEntrega && status == "entregado")) {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": "Solo se emiten comprobantes de pedidos pagados",
+			"code":  "ORDER_NOT_PAID",
+		})
+	}
+
+	// Sin datos del cliente se usa el perfil de facturación elegido en el checkout
+	if strings.TrimSpace(req.CustomerDoc) == "" && billing.CustomerDoc != "" {
+		billing.Type = req.Type
+		if billing.Type == "" && billing.CustomerDocType == einvoice.DocRUC {
+			billing.Type = "factura"
+		}
+		req = billing
+	}
+	docType, customer, msg := invoiceCustomer(req)
+	if msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	var existingID int64
+	err = tx.QueryRow(ctx,
+		"SELECT id FROM invoices WHERE order_id=$1 AND status <> 'rejected' LIMIT 1", orderID).Scan(&existingID)
+	if err == nil {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error":      "El pedido ya tiene un comprobante",
+			"code":       "INVOICE_EXISTS",
+			"invoice_id": existingID,
+		})
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+
+	lines, totals, err := invoiceLines(ctx, tx, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+
+	// El correlativo se reserva con el bloqueo de fila de la serie
+	var series string
+	var number int64
+	err = tx.QueryRow(ctx,
+		`UPDATE invoice_series SET next_number = next_number + 1
+		 WHERE id = (SELECT id FROM invoice_series WHERE doc_type=$1 AND is_active ORDER BY series LIMIT 1)
+		 RETURNING series, next_number - 1`, docType).Scan(&series, &number)
+	if err != nil {
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "No hay una serie activa para este comprobante",
+			"code":  "INVOICE_SERIES_UNAVAILABLE",
+		})
+	}
+
+	doc := &einvoice.Document{
+		Type:     docType,
+		Series:   series,
+		Number:   number,
+		IssuedAt: time.Now().In(businessLocation()),
+		Currency: "PEN",
+		Issuer:   invoiceIssuer(),
+		Customer: customer,
+		Lines:    lines,
+		Totals:   totals,
+		OrderRef: orderID,
+	}
+	signed, err := signer.Sign(doc)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "code": "INVALID_INVOICE"})
+	}
+
+	var invoiceID int64
+	err = tx.QueryRow(ctx,
+		`INSERT INTO invoices (order_id, doc_type, series, number, issued_at, customer_doc_type, customer_doc_number,
+		                       customer_name, customer_address, taxable_amount, exempt_amount, unaffected_amount,
+		                       igv_amount, total, xml, digest_value)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id`,
+		orderID, docType, series, number, doc.IssuedAt, customer.DocType, customer.DocNumber,
+		customer.Name, customer.Address, totals.Gravado, totals.Exonerado, totals.Inafecto,
+		totals.IGV, totals.Total, signed.XML, signed.DigestValue).Scan(&invoiceID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo registrar el comprobante"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo registrar el comprobante"})
+	}
+
+	// El comprobante ya está numerado y firmado; si el envío falla se reintenta desde admin
+	sunatStatus, result := submitInvoice(ctx, invoiceID, doc, signed.XML)
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"id":                invoiceID,
+		"number":            doc.ID(),
+		"doc_type":          docType,
+		"status":            sunatStatus,
+		"sunat_code":        result.Code,
+		"sunat_description": result.Description,
+		"digest_value":      signed.DigestValue,
+		"tax":               totals,
+	})
+}
+
+// Errores al obtener un comprobante
+var (
+	errInvoiceNotFound  = errors.New("comprobante no encontrado")
+	errInvoiceForbidden = errors.New("comprobante de otro usuario")
+)
+
+// loadInvoice obtiene un comprobante validando que el usuario pueda verlo
+func loadInvoice(c *fiber.Ctx, where string, arg interface{}) (*invoiceRecord, error) {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	role := claims["role"].(string)
+
+	var inv invoiceRecord
+	err := scanInvoice(db.DB.QueryRow(context.Background(),
+		`SELECT `+invoiceColumns+` FROM invoices i JOIN orders o ON o.id = i.order_id
+		 WHERE `+where+` ORDER BY i.id DESC LIMIT 1`, arg), &inv)
+	if err != nil {
+		return nil, errInvoiceNotFound
+	}
+	if role != "admin" && inv.UserID != userID {
+		return nil, errInvoiceForbidden
+	}
+	return &inv, nil
+}
+
+// respondInvoiceError traduce los errores de loadInvoice a la respuesta HTTP
+func respondInvoiceError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errInvoiceForbidden) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
+	}
+	return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Comprobante no encontrado"})
+}
+
+// Obtener el comprobante de un pedido
+func GetOrderInvoice(c *fiber.Ctx) error {
+	inv, err := loadInvoice(c, "i.order_id = $1", c.Params("id"))
+	if err != nil {
+		return respondInvoiceError(c, err)
+	}
+	return c.JSON(inv)
+}
+
+// Descargar el XML firmado de un comprobante
+func GetInvoiceXML(c *fiber.Ctx) error {
+	inv, err := loadInvoice(c, "i.id = $1", c.Params("id"))
+	if err != nil {
+		return respondInvoiceError(c, err)
+	}
+	var xml []byte
+	if err := db.DB.QueryRow(context.Background(), "SELECT xml FROM invoices WHERE id=$1", inv.ID).Scan(&xml); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener el XML"})
+	}
+	fileName := fmt.Sprintf("%s-%s-%s-%d.xml", os.Getenv("EINVOICE_RUC"), inv.DocType, inv.Series, inv.Number)
+	c.Set("Content-Type", "application/xml")
+	c.Set("Content-Disposition", "attachment;filename="+fileName)
+	return c.Send(xml)
+}
+
+// Descargar la representación impresa (PDF) de un comprobante
+func GetInvoicePDF(c *fiber.Ctx) error {
+	inv, err := loadInvoice(c, "i.id = $1", c.Params("id"))
+	if err != nil {
+		return respondInvoiceError(c, err)
+	}
+	doc, err := inv.document(context.Background(), db.DB)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+	var buf bytes.Buffer
+	if err := einvoice.WritePDF(&buf, doc, inv.DigestValue); err != nil {
+		return c.Status(500).SendString("Error generando PDF")
+	}
+	c.Set("Content-Type", "application/pdf")
+	c.Set("Content-Disposition", "attachment;filename="+doc.FileName()+".pdf")
+	return c.SendStream(&buf)
+}
+
+// Listar comprobantes (solo admin)
+func ListInvoices(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	status := c.Query("status")
+
+	var total int
+	if err := db.DB.QueryRow(context.Background(),
+		"SELECT COUNT(*) FROM invoices WHERE ($1 = '' OR status = $1)", status).Scan(&total); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al contar comprobantes"})
+	}
+	offset := (page - 1) * limit
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT `+invoiceColumns+` FROM invoices i JOIN orders o ON o.id = i.order_id
+		 WHERE ($1 = '' OR i.status = $1)
+		 ORDER BY i.issued_at DESC LIMIT $2 OFFSET $3`, status, limit, offset)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener comprobantes"})
+	}
+	defer rows.Close()
+
+	invoices := []invoiceRecord{}
+	for rows.Next() {
+		var inv invoiceRecord
+		if err := scanInvoice(rows, &inv); err != nil {
+			continue
+		}
+		invoices = append(invoices, inv)
+	}
+	return c.JSON(fiber.Map{
+		"invoices": invoices,
+		"pagination": fiber.Map{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+			"pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// Reenviar a la OSE/SUNAT un comprobante que no llegó a ser evaluado (solo admin)
+func ResendInvoice(c *fiber.Ctx) error {
+	inv, err := loadInvoice(c, "i.id = $1", c.Params("id"))
+	if err != nil {
+		return respondInvoiceError(c, err)
+	}
+	if inv.Status == "accepted" || inv.Status == "rejected" {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": "El comprobante ya fue evaluado por SUNAT",
+			"code":  "INVOICE_ALREADY_PROCESSED",
+		})
+	}
+
+	ctx := context.Background()
+	var xml []byte
+	if err := db.DB.QueryRow(ctx, "SELECT xml FROM invoices WHERE id=$1", inv.ID).Scan(&xml); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener el XML"})
+	}
+	doc, err := inv.document(ctx, db.DB)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+	status, result := submitInvoice(ctx, inv.ID, doc, xml)
+	return c.JSON(fiber.Map{
+		"id":                inv.ID,
+		"status":            status,
+		"sunat_code":        result.Code,
+		"sunat_description": result.Description,
+	})
+}
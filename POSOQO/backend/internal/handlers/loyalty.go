@@ -0,0 +1,1004 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// Movimientos del libro de puntos
+const (
+	loyaltyEarn     = "earn"
+	loyaltyRedeem   = "redeem"
+	loyaltyRefund   = "refund"
+	loyaltyClawback = "clawback"
+	loyaltyExpire   = "expire"
+	loyaltyAdjust   = "adjust"
+)
+
+const (
+	// loyaltyQualifyingWindow es el período cuyos puntos ganados definen el nivel
+	loyaltyQualifyingWindow = 365 * 24 * time.Hour
+	// loyaltyExpiryNotice es la anticipación con que se informan los puntos por vencer
+	loyaltyExpiryNotice = 30 * 24 * time.Hour
+	// loyaltyExpiryBatch es el máximo de movimientos que vence cada ejecución del job
+	loyaltyExpiryBatch = 500
+)
+
+// loyaltyConfig son los parámetros configurables del programa de puntos
+type loyaltyConfig struct {
+	PointsPerSol float64 // puntos por sol pagado en el nivel base
+	PointValue   float64 // soles de descuento por punto canjeado
+	MinRedeem    int     // mínimo de puntos por canje de descuento
+	ExpiryMonths int     // meses de vigencia de los puntos ganados
+}
+
+// loadLoyaltyConfig lee LOYALTY_POINTS_PER_SOL (1), LOYALTY_POINT_VALUE (0.05),
+// LOYALTY_MIN_REDEEM_POINTS (100) y LOYALTY_POINTS_EXPIRY_MONTHS (12)
+func loadLoyaltyConfig() loyaltyConfig {
+	cfg := loyaltyConfig{PointsPerSol: 1, PointValue: 0.05, MinRedeem: 100, ExpiryMonths: 12}
+	if value, err := strconv.ParseFloat(utils.GetEnvWithDefault("LOYALTY_POINTS_PER_SOL", "1"), 64); err == nil && value >= 0 {
+		cfg.PointsPerSol = value
+	}
+	if value, err := strconv.ParseFloat(utils.GetEnvWithDefault("LOYALTY_POINT_VALUE", "0.05"), 64); err == nil && value > 0 {
+		cfg.PointValue = value
+	}
+	if value, err := strconv.Atoi(utils.GetEnvWithDefault("LOYALTY_MIN_REDEEM_POINTS", "100")); err == nil && value > 0 {
+		cfg.MinRedeem = value
+	}
+	if value, err := strconv.Atoi(utils.GetEnvWithDefault("LOYALTY_POINTS_EXPIRY_MONTHS", "12")); err == nil && value > 0 {
+		cfg.ExpiryMonths = value
+	}
+	return cfg
+}
+
+// expiresAt es el vencimiento de los puntos acreditados en from
+func (cfg loyaltyConfig) expiresAt(from time.Time) time.Time {
+	return from.AddDate(0, cfg.ExpiryMonths, 0)
+}
+
+// LoyaltyTier es un nivel del programa
+type LoyaltyTier struct {
+	ID             int     `json:"id"`
+	Name           string  `json:"name"`
+	MinPoints      int     `json:"min_points"`
+	EarnMultiplier float64 `json:"earn_multiplier"`
+}
+
+// LoyaltyTierRequest edita un nivel (admin)
+type LoyaltyTierRequest struct {
+	Name           string  `json:"name"`
+	MinPoints      int     `json:"min_points"`
+	EarnMultiplier float64 `json:"earn_multiplier"`
+}
+
+// LoyaltyReward es un producto que se canjea por puntos
+type LoyaltyReward struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ProductID   string `json:"product_id"`
+	VariantID   string `json:"variant_id,omitempty"`
+	ProductName string `json:"product_name"`
+	PointsCost  int    `json:"points_cost"`
+	IsActive    bool   `json:"is_active"`
+}
+
+// LoyaltyRewardRequest crea o edita una recompensa (admin)
+type LoyaltyRewardRequest struct {
+	Name       string `json:"name"`
+	ProductID  string `json:"product_id"`
+	VariantID  string `json:"variant_id,omitempty"`
+	PointsCost int    `json:"points_cost"`
+	IsActive   *bool  `json:"is_active,omitempty"`
+}
+
+// LoyaltyAdjustRequest suma (positivo) o descuenta (negativo) puntos de un usuario
+type LoyaltyAdjustRequest struct {
+	Points int    `json:"points"`
+	Reason string `json:"reason"`
+}
+
+// LoyaltyError indica por qué no se pueden canjear los puntos
+type LoyaltyError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *LoyaltyError) Error() string {
+	return e.Message
+}
+
+var errLoyaltyInsufficient = &LoyaltyError{Status: http.StatusConflict, Code: "LOYALTY_INSUFFICIENT_POINTS", Message: "No tienes puntos suficientes"}
+
+// tierFor devuelve el nivel que corresponde a los puntos del período y el siguiente (nil si
+// ya está en el más alto). tiers debe estar ordenado por min_points.
+func tierFor(tiers []LoyaltyTier, qualifying int) (LoyaltyTier, *LoyaltyTier) {
+	current := LoyaltyTier{Name: "Bronce", EarnMultiplier: 1}
+	for i, tier := range tiers {
+		if qualifying < tier.MinPoints {
+			return current, &tiers[i]
+		}
+		current = tier
+	}
+	return current, nil
+}
+
+// earnedPoints calcula los puntos de un pedido pagado (se redondea hacia abajo)
+func earnedPoints(base float64, cfg loyaltyConfig, multiplier float64) int {
+	if base <= 0 {
+		return 0
+	}
+	return int(math.Floor(base*cfg.PointsPerSol*multiplier + 1e-9))
+}
+
+// clawbackPoints son los puntos a descontar por un reembolso, proporcionales a lo devuelto
+func clawbackPoints(earned int, refundedCents, amountCents int64) int {
+	if earned <= 0 || refundedCents <= 0 || amountCents <= 0 {
+		return 0
+	}
+	if refundedCents >= amountCents {
+		return earned
+	}
+	return int(math.Round(float64(earned) * float64(refundedCents) / float64(amountCents)))
+}
+
+// clawbackDeduction limita el descuento por reembolso a los puntos vigentes del cliente: el
+// saldo nunca queda negativo. Lo que no se pudo descontar (puntos ya canjeados o vencidos)
+// queda pendiente y se intenta de nuevo en el siguiente reembolso del mismo pedido.
+func clawbackDeduction(due, available int) int {
+	if due <= 0 || available <= 0 {
+		return 0
+	}
+	return min(due, available)
+}
+
+// loyaltyPointsDiscount limita los puntos a canjear a lo que cubre el monto pendiente del
+// pedido y devuelve los puntos usados y su descuento
+func loyaltyPointsDiscount(points int, charged, pointValue float64) (int, float64) {
+	if points <= 0 || charged <= 0 || pointValue <= 0 {
+		return 0, 0
+	}
+	usable := int(math.Floor(charged/pointValue + 1e-9))
+	if points > usable {
+		points = usable
+	}
+	return points, roundMoney(float64(points) * pointValue)
+}
+
+// allocateExtraDiscount reparte un descuento entre las líneas en proporción a lo que aún
+// se cobra por cada una, sumándolo al descuento de cupón ya asignado
+func allocateExtraDiscount(lines []pricedLine, discount float64) {
+	eligible, last := 0.0, -1
+	for i, line := range lines {
+		if line.Charged() > 0 {
+			eligible += line.Charged()
+			last = i
+		}
+	}
+	if last < 0 || discount <= 0 {
+		return
+	}
+	remaining := discount
+	for i := range lines {
+		charged := lines[i].Charged()
+		if charged <= 0 {
+			continue
+		}
+		share := roundMoney(discount * charged / eligible)
+		if i == last {
+			share = roundMoney(remaining)
+		}
+		lines[i].CouponDiscount = roundMoney(lines[i].CouponDiscount + share)
+		remaining -= share
+	}
+}
+
+// validateLoyaltyRewardRequest normaliza una recompensa y devuelve el mensaje de error si no es válida
+func validateLoyaltyRewardRequest(req *LoyaltyRewardRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	switch {
+	case !utils.IsValidString(req.Name, 2, 100):
+		return "Nombre inválido (2-100 caracteres)"
+	case !utils.IsValidUUID(req.ProductID):
+		return "ID de producto inválido"
+	case req.VariantID != "" && !utils.IsValidUUID(req.VariantID):
+		return "ID de formato inválido"
+	case req.PointsCost < 1 || req.PointsCost > 1000000:
+		return "Costo en puntos inválido"
+	}
+	return ""
+}
+
+// loadLoyaltyTiers devuelve los niveles ordenados por min_points
+func loadLoyaltyTiers(ctx context.Context, q dbQuerier) ([]LoyaltyTier, error) {
+	rows, err := q.Query(ctx, "SELECT id, name, min_points, earn_multiplier FROM loyalty_tiers ORDER BY min_points")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tiers := []LoyaltyTier{}
+	for rows.Next() {
+		var tier LoyaltyTier
+		if err := rows.Scan(&tier.ID, &tier.Name, &tier.MinPoints, &tier.EarnMultiplier); err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinPoints < tiers[j].MinPoints })
+	return tiers, rows.Err()
+}
+
+// qualifyingPoints son los puntos ganados en el período que define el nivel (descontando
+// los de pedidos reembolsados)
+func qualifyingPoints(ctx context.Context, q dbQuerier, userID int64) (int, error) {
+	var points int
+	err := q.QueryRow(ctx,
+		`SELECT GREATEST(COALESCE(SUM(points), 0), 0)::int FROM loyalty_transactions
+		 WHERE user_id=$1 AND type IN ('earn', 'clawback') AND created_at >= $2`,
+		userID, time.Now().Add(-loyaltyQualifyingWindow)).Scan(&points)
+	return points, err
+}
+
+// userLoyaltyTier devuelve el nivel actual del usuario, el siguiente y sus puntos del período
+func userLoyaltyTier(ctx context.Context, q dbQuerier, userID int64) (LoyaltyTier, *LoyaltyTier, int, error) {
+	tiers, err := loadLoyaltyTiers(ctx, q)
+	if err != nil {
+		return LoyaltyTier{}, nil, 0, err
+	}
+	qualifying, err := qualifyingPoints(ctx, q, userID)
+	if err != nil {
+		return LoyaltyTier{}, nil, 0, err
+	}
+	current, next := tierFor(tiers, qualifying)
+	return current, next, qualifying, nil
+}
+
+// addLoyaltyPoints acredita puntos con su vencimiento y actualiza el saldo del usuario
+func addLoyaltyPoints(ctx context.Context, tx pgx.Tx, userID int64, txType string, points int, expiresAt time.Time, orderID *string, actorID *int64, note string) (int, error) {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO loyalty_transactions (user_id, type, points, remaining, expires_at, order_id, actor_user_id, note)
+		 VALUES ($1, $2, $3, $3, $4, $5, $6, NULLIF($7, ''))`,
+		userID, txType, points, expiresAt, orderID, actorID, note)
+	if err != nil {
+		return 0, err
+	}
+	var balance int
+	err = tx.QueryRow(ctx,
+		"UPDATE users SET loyalty_points = loyalty_points + $1 WHERE id=$2 RETURNING loyalty_points", points, userID).Scan(&balance)
+	return balance, err
+}
+
+// loyaltyEntry es un movimiento positivo con puntos vigentes por consumir
+type loyaltyEntry struct {
+	id        int64
+	remaining int
+}
+
+// lockLiveLoyaltyEntries bloquea los movimientos con puntos vigentes del usuario, primero
+// los que vencen antes. Su suma es el saldo canjeable: users.loyalty_points puede incluir
+// puntos vencidos que el job horario aún no procesó.
+func lockLiveLoyaltyEntries(ctx context.Context, tx pgx.Tx, userID int64) ([]loyaltyEntry, int, error) {
+	rows, err := tx.Query(ctx,
+		`SELECT id, remaining FROM loyalty_transactions
+		 WHERE user_id=$1 AND remaining > 0 AND (expires_at IS NULL OR expires_at > NOW())
+		 ORDER BY expires_at NULLS LAST, id FOR UPDATE`, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []loyaltyEntry{}
+	total := 0
+	for rows.Next() {
+		var entry loyaltyEntry
+		if err := rows.Scan(&entry.id, &entry.remaining); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+		total += entry.remaining
+	}
+	return entries, total, rows.Err()
+}
+
+// deductLoyaltyPoints descuenta puntos consumiendo primero los que vencen antes y actualiza
+// el saldo del usuario. Falla con errLoyaltyInsufficient si los puntos vigentes no alcanzan.
+func deductLoyaltyPoints(ctx context.Context, tx pgx.Tx, userID int64, txType string, points int, orderID *string, actorID *int64, note string) (int, error) {
+	entries, live, err := lockLiveLoyaltyEntries(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if live < points {
+		return 0, errLoyaltyInsufficient
+	}
+
+	pending := points
+	for _, entry := range entries {
+		if pending == 0 {
+			break
+		}
+		used := min(entry.remaining, pending)
+		if _, err := tx.Exec(ctx, "UPDATE loyalty_transactions SET remaining = remaining - $1 WHERE id=$2", used, entry.id); err != nil {
+			return 0, err
+		}
+		pending -= used
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO loyalty_transactions (user_id, type, points, order_id, actor_user_id, note)
+		 VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`,
+		userID, txType, -points, orderID, actorID, note)
+	if err != nil {
+		return 0, err
+	}
+	var balance int
+	err = tx.QueryRow(ctx,
+		"UPDATE users SET loyalty_points = loyalty_points - $1 WHERE id=$2 RETURNING loyalty_points", points, userID).Scan(&balance)
+	return balance, err
+}
+
+// rewardColumns son las columnas que lee scanLoyaltyReward (r es la recompensa, p el
+// producto y v el formato)
+const rewardColumns = `r.id::text, r.name, r.product_id::text, COALESCE(r.variant_id::text, ''), ` + itemNameSQL + `,
+	r.points_cost, r.is_active AND p.is_active AND (r.variant_id IS NULL OR v.is_active)`
+
+// rewardFrom es el FROM que acompaña a rewardColumns
+const rewardFrom = ` FROM loyalty_rewards r
+	JOIN products p ON p.id = r.product_id
+	LEFT JOIN product_variants v ON v.id = r.variant_id`
+
+func scanLoyaltyReward(row pgx.Row, r *LoyaltyReward) error {
+	return row.Scan(&r.ID, &r.Name, &r.ProductID, &r.VariantID, &r.ProductName, &r.PointsCost, &r.IsActive)
+}
+
+// redeemLoyalty canjea los puntos pedidos en el checkout: la recompensa descuenta una unidad
+// de su producto (que debe estar en el carrito) y los puntos sueltos se descuentan del monto
+// pendiente. Devuelve el descuento total.
+func redeemLoyalty(ctx context.Context, tx pgx.Tx, in checkoutInput, orderID string, lines []pricedLine) (float64, error) {
+	if in.LoyaltyPoints == 0 && in.LoyaltyRewardID == "" {
+		return 0, nil
+	}
+	if in.Guest != nil || in.Subscription != nil {
+		return 0, &LoyaltyError{Status: http.StatusBadRequest, Code: "LOYALTY_NOT_AVAILABLE", Message: "Los puntos solo se canjean con una cuenta"}
+	}
+	cfg := loadLoyaltyConfig()
+
+	// El canje se valida contra los puntos vigentes del libro, no contra el saldo en caché
+	_, balance, err := lockLiveLoyaltyEntries(ctx, tx, in.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	pointsUsed, discount := 0, 0.0
+	var rewardID *string
+	if in.LoyaltyRewardID != "" {
+		var reward LoyaltyReward
+		err := pgx.ErrNoRows
+		if utils.IsValidUUID(in.LoyaltyRewardID) {
+			err = scanLoyaltyReward(tx.QueryRow(ctx, `SELECT `+rewardColumns+rewardFrom+` WHERE r.id=$1`, in.LoyaltyRewardID), &reward)
+		}
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && !reward.IsActive) {
+			return 0, &LoyaltyError{Status: http.StatusBadRequest, Code: "LOYALTY_REWARD_INVALID", Message: "Recompensa no disponible"}
+		}
+		if err != nil {
+			return 0, err
+		}
+		index := -1
+		for i, line := range lines {
+			if line.ProductID == reward.ProductID && (reward.VariantID == "" || line.VariantID == reward.VariantID) && line.Charged() > 0 {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return 0, &LoyaltyError{Status: http.StatusBadRequest, Code: "LOYALTY_REWARD_NOT_IN_CART", Message: "Agrega al carrito el producto de la recompensa"}
+		}
+		rewardDiscount := roundMoney(min(lines[index].UnitPrice, lines[index].Charged()))
+		lines[index].CouponDiscount = roundMoney(lines[index].CouponDiscount + rewardDiscount)
+		pointsUsed += reward.PointsCost
+		discount += rewardDiscount
+		rewardID = &reward.ID
+	}
+
+	if in.LoyaltyPoints > 0 {
+		if in.LoyaltyPoints < cfg.MinRedeem {
+			return 0, &LoyaltyError{
+				Status:  http.StatusBadRequest,
+				Code:    "LOYALTY_MIN_REDEEM",
+				Message: fmt.Sprintf("El canje mínimo es de %d puntos", cfg.MinRedeem),
+			}
+		}
+		charged := 0.0
+		for _, line := range lines {
+			charged += line.Charged()
+		}
+		points, pointsDiscount := loyaltyPointsDiscount(in.LoyaltyPoints, charged, cfg.PointValue)
+		allocateExtraDiscount(lines, pointsDiscount)
+		pointsUsed += points
+		discount += pointsDiscount
+	}
+
+	if pointsUsed > balance {
+		return 0, errLoyaltyInsufficient
+	}
+	if pointsUsed > 0 {
+		if _, err := deductLoyaltyPoints(ctx, tx, in.UserID, loyaltyRedeem, pointsUsed, &orderID, in.Actor.UserID, ""); err != nil {
+			return 0, err
+		}
+	}
+	discount = roundMoney(discount)
+	_, err = tx.Exec(ctx,
+		"UPDATE orders SET loyalty_points_redeemed=$1, loyalty_discount=$2, loyalty_reward_id=$3 WHERE id=$4",
+		pointsUsed, discount, rewardID, orderID)
+	return discount, err
+}
+
+// reverseLoyaltyRedemptions devuelve los puntos canjeados en un pedido cancelado. Es
+// idempotente: solo devuelve lo que no se devolvió antes.
+func reverseLoyaltyRedemptions(ctx context.Context, tx pgx.Tx, orderID string) error {
+	var userID int64
+	var points int
+	err := tx.QueryRow(ctx,
+		`SELECT user_id, -SUM(points)::int FROM loyalty_transactions
+		 WHERE order_id=$1 AND type IN ('redeem', 'refund')
+		 GROUP BY user_id HAVING SUM(points) < 0`, orderID).Scan(&userID, &points)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cfg := loadLoyaltyConfig()
+	_, err = addLoyaltyPoints(ctx, tx, userID, loyaltyRefund, points, cfg.expiresAt(time.Now()), &orderID, nil, "Pedido cancelado")
+	return err
+}
+
+// awardLoyaltyPoints acredita los puntos de un pedido pagado según el nivel del cliente.
+// La base es lo pagado por productos (sin envío, garantía de envases ni gift card). Es
+// idempotente: cada pedido acredita una sola vez.
+func awardLoyaltyPoints(orderID string) {
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("[LOYALTY] Error iniciando transacción para el pedido %s: %v", orderID, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var userID *int64
+	var base float64
+	var status string
+	err = tx.QueryRow(ctx,
+		`SELECT user_id, total - shipping_fee - deposit_total - gift_card_amount, status
+		 FROM orders WHERE id=$1 AND paid_at IS NOT NULL`, orderID).Scan(&userID, &base, &status)
+	if err != nil || userID == nil || status == "cancelado" {
+		return
+	}
+
+	cfg := loadLoyaltyConfig()
+	tier, _, _, err := userLoyaltyTier(ctx, tx, *userID)
+	if err != nil {
+		log.Printf("[LOYALTY] Error obteniendo el nivel del usuario %d: %v", *userID, err)
+		return
+	}
+	points := earnedPoints(base, cfg, tier.EarnMultiplier)
+	if points <= 0 {
+		return
+	}
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO loyalty_transactions (user_id, type, points, remaining, expires_at, order_id, note)
+		 VALUES ($1, 'earn', $2, $2, $3, $4, $5)
+		 ON CONFLICT (order_id) WHERE type = 'earn' DO NOTHING`,
+		*userID, points, cfg.expiresAt(time.Now()), orderID, "Nivel "+tier.Name)
+	if err != nil || tag.RowsAffected() == 0 {
+		if err != nil {
+			log.Printf("[LOYALTY] Error acreditando puntos del pedido %s: %v", orderID, err)
+		}
+		return
+	}
+	if _, err := tx.Exec(ctx, "UPDATE users SET loyalty_points = loyalty_points + $1 WHERE id=$2", points, *userID); err != nil {
+		log.Printf("[LOYALTY] Error actualizando el saldo del usuario %d: %v", *userID, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("[LOYALTY] Error guardando puntos del pedido %s: %v", orderID, err)
+		return
+	}
+
+	userIDStr := fmt.Sprintf("%d", *userID)
+	CreateAutomaticNotification("success", "¡Ganaste puntos!",
+		fmt.Sprintf("Sumaste %d puntos POSOQO por tu pedido", points), &userIDStr, &orderID)
+}
+
+// clawbackLoyaltyPoints descuenta los puntos de un pedido reembolsado en proporción a lo
+// devuelto, sin dejar el saldo en negativo (ver clawbackDeduction). Es idempotente: los
+// reembolsos parciales sucesivos solo descuentan la diferencia.
+func clawbackLoyaltyPoints(paymentIntentID string, refundedCents, amountCents int64) {
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("[LOYALTY] Error iniciando transacción para el reembolso %s: %v", paymentIntentID, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var orderID string
+	var userID int64
+	var earned, clawedBack int
+	err = tx.QueryRow(ctx,
+		`SELECT e.order_id::text, e.user_id, e.points,
+		        COALESCE((SELECT -SUM(c.points) FROM loyalty_transactions c
+		                  WHERE c.order_id = e.order_id AND c.type = 'clawback'), 0)::int
+		 FROM payments pay
+		 JOIN loyalty_transactions e ON e.order_id = pay.order_id AND e.type = 'earn'
+		 WHERE pay.stripe_payment_id = $1
+		 FOR UPDATE OF e`, paymentIntentID).Scan(&orderID, &userID, &earned, &clawedBack)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("[LOYALTY] Error buscando puntos del reembolso %s: %v", paymentIntentID, err)
+		return
+	}
+
+	_, available, err := lockLiveLoyaltyEntries(ctx, tx, userID)
+	if err != nil {
+		log.Printf("[LOYALTY] Error obteniendo puntos vigentes del usuario %d: %v", userID, err)
+		return
+	}
+	due := clawbackPoints(earned, refundedCents, amountCents) - clawedBack
+	points := clawbackDeduction(due, available)
+	if points <= 0 {
+		if due > 0 {
+			log.Printf("[LOYALTY] Pedido %s reembolsado: %d puntos no recuperables (el usuario %d no tiene saldo)", orderID, due, userID)
+		}
+		return
+	}
+	if points < due {
+		log.Printf("[LOYALTY] Pedido %s reembolsado: se descuentan %d de %d puntos (saldo insuficiente)", orderID, points, due)
+	}
+	if _, err := deductLoyaltyPoints(ctx, tx, userID, loyaltyClawback, points, &orderID, nil, "Pedido reembolsado"); err != nil {
+		log.Printf("[LOYALTY] Error descontando puntos del pedido %s: %v", orderID, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("[LOYALTY] Error guardando el descuento de puntos del pedido %s: %v", orderID, err)
+	}
+}
+
+// ExpireLoyaltyPoints vence los puntos cuya vigencia terminó. Se ejecuta cada hora.
+func ExpireLoyaltyPoints() {
+	ctx := context.Background()
+	rows, err := db.DB.Query(ctx,
+		`SELECT id FROM loyalty_transactions
+		 WHERE remaining > 0 AND expires_at <= NOW()
+		 ORDER BY expires_at LIMIT $1`, loyaltyExpiryBatch)
+	if err != nil {
+		log.Printf("[LOYALTY] Error buscando puntos vencidos: %v", err)
+		return
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := expireLoyaltyEntry(ctx, id); err != nil {
+			log.Printf("[LOYALTY] Error venciendo el movimiento %d: %v", id, err)
+		}
+	}
+}
+
+// expireLoyaltyEntry vence el saldo pendiente de un movimiento positivo
+func expireLoyaltyEntry(ctx context.Context, id int64) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int64
+	var remaining int
+	var expiresAt time.Time
+	err = tx.QueryRow(ctx,
+		`SELECT user_id, remaining, expires_at FROM loyalty_transactions
+		 WHERE id=$1 AND remaining > 0 AND expires_at <= NOW() FOR UPDATE`, id).Scan(&userID, &remaining, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE loyalty_transactions SET remaining=0 WHERE id=$1", id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO loyalty_transactions (user_id, type, points, note) VALUES ($1, 'expire', $2, $3)`,
+		userID, -remaining, "Vencimiento "+expiresAt.In(businessLocation()).Format("02/01/2006"))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "UPDATE users SET loyalty_points = loyalty_points - $1 WHERE id=$2", remaining, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// loyaltySummary es el saldo, nivel y puntos por vencer de un usuario
+func loyaltySummary(ctx context.Context, userID int64) (fiber.Map, error) {
+	var balance, expiring int
+	var nextExpiry *time.Time
+	err := db.DB.QueryRow(ctx,
+		`SELECT u.loyalty_points,
+		        COALESCE((SELECT SUM(remaining) FROM loyalty_transactions
+		                  WHERE user_id = u.id AND remaining > 0 AND expires_at > NOW() AND expires_at <= $2), 0)::int,
+		        (SELECT MIN(expires_at) FROM loyalty_transactions
+		          WHERE user_id = u.id AND remaining > 0 AND expires_at > NOW())
+		 FROM users u WHERE u.id = $1`, userID, time.Now().Add(loyaltyExpiryNotice)).Scan(&balance, &expiring, &nextExpiry)
+	if err != nil {
+		return nil, err
+	}
+	tier, next, qualifying, err := userLoyaltyTier(ctx, db.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+	cfg := loadLoyaltyConfig()
+
+	summary := fiber.Map{
+		"balance":           balance,
+		"balance_value":     roundMoney(float64(max(balance, 0)) * cfg.PointValue),
+		"tier":              tier,
+		"qualifying_points": qualifying,
+		"next_tier":         next,
+		"expiring_points":   expiring,
+		"next_expiry":       nextExpiry,
+	}
+	if next != nil {
+		summary["points_to_next_tier"] = next.MinPoints - qualifying
+	}
+	return summary, nil
+}
+
+// loyaltyHistory devuelve una página del libro de puntos de un usuario
+func loyaltyHistory(ctx context.Context, userID int64, page, limit int) ([]fiber.Map, int, error) {
+	var total int
+	if err := db.DB.QueryRow(ctx, "SELECT COUNT(*) FROM loyalty_transactions WHERE user_id=$1", userID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.DB.Query(ctx,
+		`SELECT id, type, points, remaining, expires_at, order_id::text, COALESCE(note, ''), created_at
+		 FROM loyalty_transactions WHERE user_id=$1
+		 ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`, userID, limit, (page-1)*limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	history := []fiber.Map{}
+	for rows.Next() {
+		var id int64
+		var txType, note string
+		var points, remaining int
+		var expiresAt *time.Time
+		var orderID *string
+		var createdAt time.Time
+		if err := rows.Scan(&id, &txType, &points, &remaining, &expiresAt, &orderID, &note, &createdAt); err != nil {
+			continue
+		}
+		history = append(history, fiber.Map{
+			"id":         id,
+			"type":       txType,
+			"points":     points,
+			"remaining":  remaining,
+			"expires_at": expiresAt,
+			"order_id":   orderID,
+			"note":       note,
+			"created_at": createdAt,
+		})
+	}
+	return history, total, nil
+}
+
+// pageParams lee page y limit (20 por defecto, máximo 100)
+func pageParams(c *fiber.Ctx) (int, int) {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	return page, limit
+}
+
+// GET /api/loyalty/program
+// Reglas del programa: niveles, recompensas y valor de los puntos
+func GetLoyaltyProgram(c *fiber.Ctx) error {
+	ctx := context.Background()
+	tiers, err := loadLoyaltyTiers(ctx, db.DB)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener el programa"})
+	}
+	rows, err := db.DB.Query(ctx,
+		`SELECT `+rewardColumns+rewardFrom+`
+		 WHERE r.is_active AND p.is_active AND (r.variant_id IS NULL OR v.is_active)
+		 ORDER BY r.points_cost`)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener el programa"})
+	}
+	defer rows.Close()
+
+	rewards := []LoyaltyReward{}
+	for rows.Next() {
+		var reward LoyaltyReward
+		if err := scanLoyaltyReward(rows, &reward); err != nil {
+			continue
+		}
+		rewards = append(rewards, reward)
+	}
+	cfg := loadLoyaltyConfig()
+	return c.JSON(fiber.Map{
+		"tiers":          tiers,
+		"rewards":        rewards,
+		"points_per_sol": cfg.PointsPerSol,
+		"point_value":    cfg.PointValue,
+		"min_redeem":     cfg.MinRedeem,
+		"expiry_months":  cfg.ExpiryMonths,
+	})
+}
+
+// GET /api/protected/loyalty
+// Saldo de puntos, nivel y puntos por vencer del usuario
+func GetMyLoyalty(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	summary, err := loyaltySummary(context.Background(), userID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener tus puntos"})
+	}
+	return c.JSON(summary)
+}
+
+// GET /api/protected/loyalty/history?page=1&limit=20
+// Movimientos de puntos del usuario
+func GetMyLoyaltyHistory(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	page, limit := pageParams(c)
+
+	history, total, err := loyaltyHistory(context.Background(), userID, page, limit)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener el historial"})
+	}
+	return c.JSON(fiber.Map{
+		"data": history,
+		"pagination": fiber.Map{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+			"pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// GET /api/admin/loyalty/users/:id?page=1&limit=20
+// Saldo, nivel y movimientos de puntos de un usuario
+func GetUserLoyaltyAdmin(c *fiber.Ctx) error {
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	ctx := context.Background()
+	summary, err := loyaltySummary(ctx, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener los puntos"})
+	}
+	page, limit := pageParams(c)
+	history, total, err := loyaltyHistory(ctx, userID, page, limit)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener el historial"})
+	}
+	summary["history"] = history
+	summary["pagination"] = fiber.Map{
+		"page":  page,
+		"limit": limit,
+		"total": total,
+		"pages": (total + limit - 1) / limit,
+	}
+	return c.JSON(summary)
+}
+
+// POST /api/admin/loyalty/users/:id/adjust
+// Suma o descuenta puntos a un usuario; queda en el libro y en audit_logs
+func AdjustLoyaltyPoints(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	adminID := int64(claims["id"].(float64))
+
+	userID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	var req LoyaltyAdjustRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Points == 0 || req.Points > 1000000 || req.Points < -1000000 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Puntos inválidos"})
+	}
+	if !utils.IsValidString(req.Reason, 3, 500) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Motivo inválido (3-500 caracteres)"})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	var previous int
+	err = tx.QueryRow(ctx, "SELECT loyalty_points FROM users WHERE id=$1 FOR UPDATE", userID).Scan(&previous)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Usuario no encontrado"})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+
+	var balance int
+	if req.Points > 0 {
+		balance, err = addLoyaltyPoints(ctx, tx, userID, loyaltyAdjust, req.Points, loadLoyaltyConfig().expiresAt(time.Now()), nil, &adminID, req.Reason)
+	} else {
+		// Solo se pueden quitar puntos vigentes
+		balance, err = deductLoyaltyPoints(ctx, tx, userID, loyaltyAdjust, -req.Points, nil, &adminID, req.Reason)
+		if errors.Is(err, errLoyaltyInsufficient) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "El saldo no puede quedar negativo", "code": "LOYALTY_NEGATIVE_BALANCE"})
+		}
+	}
+	if err == nil {
+		err = recordAdminAudit(ctx, tx, c, adminID, "LOYALTY_POINTS_ADJUSTED", "user", userID, fiber.Map{
+			"points":           req.Points,
+			"previous_balance": previous,
+			"balance":          balance,
+			"reason":           req.Reason,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo ajustar los puntos"})
+	}
+
+	userIDStr := fmt.Sprintf("%d", userID)
+	CreateAutomaticNotification("info", "Puntos actualizados",
+		fmt.Sprintf("Tu saldo de puntos POSOQO ahora es %d", balance), &userIDStr, nil)
+	return c.JSON(fiber.Map{"success": true, "balance": balance})
+}
+
+// PUT /api/admin/loyalty/tiers/:id
+// Edita el nombre, el mínimo de puntos o el multiplicador de un nivel
+func UpdateLoyaltyTier(c *fiber.Ctx) error {
+	var req LoyaltyTierRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	switch {
+	case !utils.IsValidString(req.Name, 2, 50):
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Nombre inválido (2-50 caracteres)"})
+	case req.MinPoints < 0:
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Mínimo de puntos inválido"})
+	case req.EarnMultiplier <= 0 || req.EarnMultiplier > 10:
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Multiplicador inválido (0-10)"})
+	}
+
+	tag, err := db.DB.Exec(context.Background(),
+		"UPDATE loyalty_tiers SET name=$1, min_points=$2, earn_multiplier=$3 WHERE id::text=$4",
+		req.Name, req.MinPoints, req.EarnMultiplier, c.Params("id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			return c.Status(http.StatusConflict).JSON(fiber.Map{"error": "Ya existe un nivel con ese nombre o mínimo de puntos"})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el nivel"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Nivel no encontrado"})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// GET /api/admin/loyalty/rewards
+func ListLoyaltyRewards(c *fiber.Ctx) error {
+	rows, err := db.DB.Query(context.Background(), `SELECT `+rewardColumns+rewardFrom+` ORDER BY r.points_cost, r.name`)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener recompensas"})
+	}
+	defer rows.Close()
+
+	rewards := []LoyaltyReward{}
+	for rows.Next() {
+		var reward LoyaltyReward
+		if err := scanLoyaltyReward(rows, &reward); err != nil {
+			continue
+		}
+		rewards = append(rewards, reward)
+	}
+	return c.JSON(fiber.Map{"data": rewards})
+}
+
+// POST /api/admin/loyalty/rewards
+func CreateLoyaltyReward(c *fiber.Ctx) error {
+	var req LoyaltyRewardRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateLoyaltyRewardRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	isActive := req.IsActive == nil || *req.IsActive
+
+	var id string
+	err := db.DB.QueryRow(context.Background(),
+		`INSERT INTO loyalty_rewards (name, product_id, variant_id, points_cost, is_active)
+		 VALUES ($1, $2, NULLIF($3, '')::uuid, $4, $5) RETURNING id`,
+		req.Name, req.ProductID, req.VariantID, req.PointsCost, isActive).Scan(&id)
+	if err != nil {
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Producto o formato no encontrado"})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear la recompensa"})
+	}
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"success": true, "id": id})
+}
+
+// PUT /api/admin/loyalty/rewards/:id
+func UpdateLoyaltyReward(c *fiber.Ctx) error {
+	var req LoyaltyRewardRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateLoyaltyRewardRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	tag, err := db.DB.Exec(context.Background(),
+		`UPDATE loyalty_rewards SET name=$1, product_id=$2, variant_id=NULLIF($3, '')::uuid, points_cost=$4,
+		        is_active=COALESCE($5, is_active)
+		 WHERE id::text=$6`,
+		req.Name, req.ProductID, req.VariantID, req.PointsCost, req.IsActive, c.Params("id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Producto o formato no encontrado"})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar la recompensa"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Recompensa no encontrada"})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
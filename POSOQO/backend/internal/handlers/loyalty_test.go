@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadLoyaltyConfig valida los valores por defecto y la lectura del entorno
+func TestLoadLoyaltyConfig(t *testing.T) {
+	t.Setenv("LOYALTY_POINTS_PER_SOL", "")
+	t.Setenv("LOYALTY_POINT_VALUE", "")
+	t.Setenv("LOYALTY_MIN_REDEEM_POINTS", "")
+	t.Setenv("LOYALTY_POINTS_EXPIRY_MONTHS", "")
+	assert.Equal(t, loyaltyConfig{PointsPerSol: 1, PointValue: 0.05, MinRedeem: 100, ExpiryMonths: 12}, loadLoyaltyConfig())
+
+	t.Setenv("LOYALTY_POINTS_PER_SOL", "2")
+	t.Setenv("LOYALTY_POINT_VALUE", "0")
+	t.Setenv("LOYALTY_MIN_REDEEM_POINTS", "-5")
+	t.Setenv("LOYALTY_POINTS_EXPIRY_MONTHS", "6")
+	assert.Equal(t, loyaltyConfig{PointsPerSol: 2, PointValue: 0.05, MinRedeem: 100, ExpiryMonths: 6}, loadLoyaltyConfig())
+}
+
+// TestTierFor valida el nivel según los puntos ganados en el período
+func TestTierFor(t *testing.T) {
+	tiers := []LoyaltyTier{
+		{ID: 1, Name: "Bronce", MinPoints: 0, EarnMultiplier: 1},
+		{ID: 2, Name: "Plata", MinPoints: 1000, EarnMultiplier: 1.25},
+		{ID: 3, Name: "Oro", MinPoints: 3000, EarnMultiplier: 1.5},
+	}
+
+	current, next := tierFor(tiers, 0)
+	assert.Equal(t, "Bronce", current.Name)
+	assert.Equal(t, "Plata", next.Name)
+
+	current, next = tierFor(tiers, 1000)
+	assert.Equal(t, "Plata", current.Name)
+	assert.Equal(t, "Oro", next.Name)
+
+	current, next = tierFor(tiers, 5000)
+	assert.Equal(t, "Oro", current.Name)
+	assert.Nil(t, next)
+
+	// Sin niveles configurados se gana a la tasa base
+	current, next = tierFor(nil, 500)
+	assert.Equal(t, 1.0, current.EarnMultiplier)
+	assert.Nil(t, next)
+}
+
+// TestEarnedPoints valida los puntos ganados por un pedido
+func TestEarnedPoints(t *testing.T) {
+	cfg := loyaltyConfig{PointsPerSol: 1, PointValue: 0.05, MinRedeem: 100, ExpiryMonths: 12}
+	assert.Equal(t, 59, earnedPoints(59.9, cfg, 1))
+	assert.Equal(t, 125, earnedPoints(100, cfg, 1.25))
+	assert.Equal(t, 30, earnedPoints(20.1, cfg, 1.5))
+	assert.Equal(t, 0, earnedPoints(0, cfg, 1.5))
+	assert.Equal(t, 0, earnedPoints(-10, cfg, 1))
+}
+
+// TestClawbackPoints valida el descuento de puntos por reembolsos
+func TestClawbackPoints(t *testing.T) {
+	assert.Equal(t, 100, clawbackPoints(100, 5000, 5000))
+	assert.Equal(t, 50, clawbackPoints(100, 2500, 5000))
+	assert.Equal(t, 33, clawbackPoints(100, 1650, 5000))
+	assert.Equal(t, 0, clawbackPoints(100, 0, 5000))
+	assert.Equal(t, 0, clawbackPoints(0, 5000, 5000))
+}
+
+// TestClawbackDeduction valida que el descuento por reembolso no deje el saldo en negativo
+func TestClawbackDeduction(t *testing.T) {
+	tests := []struct {
+		name      string
+		due       int
+		available int
+		deducted  int
+	}{
+		{"Saldo suficiente", 100, 250, 100},
+		{"Saldo parcial", 100, 40, 40},
+		{"Puntos ya canjeados", 100, 0, 0},
+		{"Nada que descontar", 0, 250, 0},
+		{"Reembolso ya descontado", -20, 250, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.deducted, clawbackDeduction(tt.due, tt.available))
+		})
+	}
+
+	// Reembolso parcial y luego total con el saldo ya gastado: solo se descuenta lo vigente
+	// y el resto queda pendiente para el siguiente reembolso
+	earned, clawedBack, available := 100, 0, 80
+	step := clawbackDeduction(clawbackPoints(earned, 2500, 5000)-clawedBack, available)
+	assert.Equal(t, 50, step)
+	clawedBack, available = clawedBack+step, available-step-20 // el cliente canjea 20 puntos más
+	step = clawbackDeduction(clawbackPoints(earned, 5000, 5000)-clawedBack, available)
+	assert.Equal(t, 10, step)
+	assert.Equal(t, 0, available-step)
+}
+
+// TestLoyaltyPointsDiscount valida el descuento por canje de puntos
+func TestLoyaltyPointsDiscount(t *testing.T) {
+	points, discount := loyaltyPointsDiscount(200, 50, 0.05)
+	assert.Equal(t, 200, points)
+	assert.Equal(t, 10.0, discount)
+
+	// No se canjea más de lo que cubre el pedido
+	points, discount = loyaltyPointsDiscount(2000, 30, 0.05)
+	assert.Equal(t, 600, points)
+	assert.Equal(t, 30.0, discount)
+
+	points, discount = loyaltyPointsDiscount(200, 0, 0.05)
+	assert.Equal(t, 0, points)
+	assert.Equal(t, 0.0, discount)
+}
+
+// TestAllocateExtraDiscount valida el reparto del descuento por puntos entre las líneas
+func TestAllocateExtraDiscount(t *testing.T) {
+	lines := []pricedLine{
+		{Quantity: 1, UnitPrice: 30, CouponDiscount: 10},
+		{Quantity: 2, UnitPrice: 20},
+		{Quantity: 1, UnitPrice: 5, Discount: 5},
+	}
+	allocateExtraDiscount(lines, 12)
+
+	assert.Equal(t, 14.0, lines[0].CouponDiscount)
+	assert.Equal(t, 8.0, lines[1].CouponDiscount)
+	assert.Equal(t, 0.0, lines[2].CouponDiscount)
+	assert.Equal(t, 48.0, lines[0].Charged()+lines[1].Charged()+lines[2].Charged())
+}
+
+// TestValidateLoyaltyRewardRequest valida las recompensas del programa
+func TestValidateLoyaltyRewardRequest(t *testing.T) {
+	req := LoyaltyRewardRequest{Name: " Growler gratis ", ProductID: "6f1c2a4e-8b3d-4c5e-9f70-1a2b3c4d5e6f", PointsCost: 500}
+	assert.Empty(t, validateLoyaltyRewardRequest(&req))
+	assert.Equal(t, "Growler gratis", req.Name)
+
+	req.PointsCost = 0
+	assert.Equal(t, "Costo en puntos inválido", validateLoyaltyRewardRequest(&req))
+
+	req = LoyaltyRewardRequest{Name: "Growler", ProductID: "no-uuid", PointsCost: 500}
+	assert.Equal(t, "ID de producto inválido", validateLoyaltyRewardRequest(&req))
+}
+
+// liveEntriesFragment identifica la consulta de movimientos con puntos vigentes
+const liveEntriesFragment = "remaining > 0 AND (expires_at IS NULL OR expires_at > NOW())"
+
+// TestDeductLoyaltyPointsUsesLiveEntries valida que solo se descuenten puntos vigentes
+func TestDeductLoyaltyPointsUsesLiveEntries(t *testing.T) {
+	ctx := context.Background()
+	live := [][]interface{}{{int64(1), 30}, {int64(2), 20}}
+
+	tx := newScriptedTx().on(liveEntriesFragment, live...)
+	_, err := deductLoyaltyPoints(ctx, tx, 3, loyaltyRedeem, 80, nil, nil, "")
+	assert.ErrorIs(t, err, errLoyaltyInsufficient)
+	assert.Empty(t, tx.execs, "un descuento incompleto no toca el libro")
+
+	tx = newScriptedTx().on(liveEntriesFragment, live...).
+		on("UPDATE users SET loyalty_points = loyalty_points - $1", []interface{}{10})
+	balance, err := deductLoyaltyPoints(ctx, tx, 3, loyaltyRedeem, 40, nil, nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, balance)
+	consumed := tx.executed("SET remaining = remaining - $1")
+	if assert.Len(t, consumed, 2) {
+		assert.Equal(t, []interface{}{30, int64(1)}, consumed[0].args)
+		assert.Equal(t, []interface{}{10, int64(2)}, consumed[1].args)
+	}
+}
+
+// TestRedeemLoyaltyIgnoresExpiredPoints valida que el canje no use puntos vencidos que aún
+// figuran en el saldo en caché
+func TestRedeemLoyaltyIgnoresExpiredPoints(t *testing.T) {
+	t.Setenv("LOYALTY_MIN_REDEEM_POINTS", "")
+	tx := newScriptedTx().
+		on("SELECT loyalty_points FROM users", []interface{}{500}).
+		on(liveEntriesFragment, []interface{}{int64(1), 50})
+	lines := []pricedLine{{ProductID: "ipa", Quantity: 2, UnitPrice: 25}}
+
+	_, err := redeemLoyalty(context.Background(), tx, checkoutInput{UserID: 3, LoyaltyPoints: 100}, "o1", lines)
+	assert.ErrorIs(t, err, errLoyaltyInsufficient)
+	assert.Empty(t, tx.execs)
+}
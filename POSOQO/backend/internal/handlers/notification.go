@@ -399,9 +399,9 @@ func CreateOrderNotification(orderID string, userID string, status string) error
 	var orderTotal float64
 
 	err := db.DB.QueryRow(context.Background(),
-		`SELECT u.name, o.total 
+		`SELECT COALESCE(u.name, o.guest_name, 'Invitado'), o.total 
 		 FROM orders o 
-		 JOIN users u ON o.user_id = u.id 
+		 LEFT JOIN users u ON o.user_id = u.id 
 		 WHERE o.id = $1`, orderID).Scan(&userName, &orderTotal)
 
 	if err != nil {
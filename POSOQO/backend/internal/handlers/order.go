@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -11,32 +12,38 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/posoqo/backend/internal/db"
 	"github.com/posoqo/backend/internal/utils"
 )
 
 type OrderItemRequest struct {
 	ProductID string `json:"product_id"`
-	Quantity  int    `json:"quantity"`
+	// VariantID es el formato elegido; obligatorio si el producto tiene variantes
+	VariantID string `json:"variant_id,omitempty"`
+	// Components es la selección del cliente si el producto es un pack mixto
+	Components []BundleSelection `json:"components,omitempty"`
+	Quantity   int               `json:"quantity"`
 }
 
 type CreateOrderRequest struct {
-	Items    []OrderItemRequest `json:"items"`
-	Location string             `json:"location"`
-	Lat      *float64           `json:"lat,omitempty"`
-	Lng      *float64           `json:"lng,omitempty"`
+	Items      []OrderItemRequest `json:"items"`
+	Location   string             `json:"location"`
+	Lat        *float64           `json:"lat,omitempty"`
+	Lng        *float64           `json:"lng,omitempty"`
+	CouponCode string             `json:"coupon_code,omitempty"`
+	// delivery (por defecto) o pickup; scheduled_for es el inicio de la franja elegida
+	FulfillmentType string     `json:"fulfillment_type,omitempty"`
+	ScheduledFor    *time.Time `json:"scheduled_for,omitempty"`
+	// Perfil de facturación (DNI o RUC) para la boleta o factura
+	BillingProfileID *int64 `json:"billing_profile_id,omitempty"`
 }
 
 type UpdateOrderStatusRequest struct {
 	Status string `json:"status"`
-}
-
-var allowedStatuses = map[string]bool{
-	"recibido":   true,
-	"preparando": true,
-	"camino":     true,
-	"entregado":  true,
-	"cancelado":  true,
+	Reason string `json:"reason"`
+	// IDVerified confirma al entregar que se revisó el documento de quien recibe
+	IDVerified bool `json:"id_verified,omitempty"`
 }
 
 // CreateOrder godoc
@@ -58,35 +65,21 @@ func CreateOrder(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil || len(req.Items) == 0 {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos o carrito vacío"})
 	}
-	if !utils.IsValidString(req.Location, 2, 200) {
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Ubicación inválida (2-200 caracteres)"})
+	if req.FulfillmentType == "" {
+		req.FulfillmentType = fulfillmentDelivery
 	}
-	for _, item := range req.Items {
-		if !utils.IsValidString(item.ProductID, 1, 50) {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "ID de producto inválido"})
-		}
-		if !utils.IsValidNumber(item.Quantity, 1, 100) {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Cantidad inválida (1-100)"})
-		}
+	if !isValidFulfillmentType(req.FulfillmentType) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tipo de entrega inválido (delivery o pickup)"})
 	}
-
-	tx, err := db.DB.Begin(context.Background())
-	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	if req.FulfillmentType == fulfillmentPickup && req.Location == "" {
+		req.Location = "Recojo en tienda"
 	}
-	defer tx.Rollback(context.Background())
-
-	total := 0.0
-	for _, item := range req.Items {
-		var price float64
-		err := tx.QueryRow(context.Background(), "SELECT price FROM products WHERE id=$1 AND is_active=TRUE", item.ProductID).Scan(&price)
-		if err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Producto no encontrado o inactivo"})
-		}
-		total += price * float64(item.Quantity)
+	if !utils.IsValidString(req.Location, 2, 200) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Ubicación inválida (2-200 caracteres)"})
+	}
+	if msg := validateOrderItems(req.Items); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
 	}
-
-	var orderID string
 
 	// Construir la ubicación para la orden
 	orderLocation := req.Location
@@ -164,25 +157,28 @@ func CreateOrder(c *fiber.Ctx) error {
 		}
 	}
 
-	err = tx.QueryRow(context.Background(),
-		"INSERT INTO orders (user_id, status, total, location, lat, lng) VALUES ($1, 'recibido', $2, $3, $4, $5) RETURNING id",
-		userID, total, orderLocation, orderLat, orderLng).Scan(&orderID)
+	tx, err := db.DB.Begin(context.Background())
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear el pedido"})
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
 	}
+	defer tx.Rollback(context.Background())
 
-	for _, item := range req.Items {
-		var price float64
-		err := tx.QueryRow(context.Background(), "SELECT price FROM products WHERE id=$1", item.ProductID).Scan(&price)
-		if err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Producto no encontrado"})
-		}
-		_, err = tx.Exec(context.Background(),
-			"INSERT INTO order_items (order_id, product_id, quantity, unit_price) VALUES ($1, $2, $3, $4)",
-			orderID, item.ProductID, item.Quantity, price)
-		if err != nil {
-			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al guardar detalle de pedido"})
-		}
+	orderID, totals, err := placeOrder(context.Background(), tx, checkoutInput{
+		UserID:           userID,
+		Actor:            actorFromClaims(claims),
+		Status:           "recibido",
+		PaymentMethod:    paymentMethodContraEntrega,
+		Items:            req.Items,
+		Location:         orderLocation,
+		Lat:              orderLat,
+		Lng:              orderLng,
+		CouponCode:       req.CouponCode,
+		FulfillmentType:  req.FulfillmentType,
+		ScheduledFor:     req.ScheduledFor,
+		BillingProfileID: req.BillingProfileID,
+	})
+	if err != nil {
+		return respondCheckoutError(c, err)
 	}
 
 	if err := tx.Commit(context.Background()); err != nil {
@@ -192,7 +188,7 @@ func CreateOrder(c *fiber.Ctx) error {
 	// Crear notificación automática
 	CreateOrderNotification(orderID, fmt.Sprintf("%d", userID), "creado")
 
-	return c.Status(http.StatusCreated).JSON(fiber.Map{"message": "Pedido creado", "order_id": orderID})
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"message": "Pedido creado", "order_id": orderID, "totals": totals})
 }
 
 // Listar pedidos del usuario autenticado
@@ -261,10 +257,19 @@ func GetOrderDetail(c *fiber.Ctx) error {
 	var dbUserID int64
 	var status, location string
 	var total float64
+	var totals OrderTotals
+	var tax utils.TaxBreakdown
 	var createdAt, updatedAt time.Time
+	var verifyID bool
+	var idVerifiedAt *time.Time
 	err := db.DB.QueryRow(context.Background(),
-		`SELECT user_id, status, total, location, created_at, updated_at FROM orders WHERE id=$1`, orderID).
-		Scan(&dbUserID, &status, &total, &location, &createdAt, &updatedAt)
+		`SELECT COALESCE(user_id, 0), status, total, location, created_at, updated_at,
+		        subtotal, discount_total, shipping_fee, deposit_total, taxable_amount, exempt_amount, unaffected_amount, igv_amount,
+		        verify_id_on_delivery, id_verified_at, gift_card_amount, loyalty_discount
+		 FROM orders WHERE id=$1`, orderID).
+		Scan(&dbUserID, &status, &total, &location, &createdAt, &updatedAt,
+			&totals.Subtotal, &totals.Discount, &totals.Shipping, &totals.Deposit, &tax.Gravado, &tax.Exonerado, &tax.Inafecto, &tax.IGV,
+			&verifyID, &idVerifiedAt, &totals.GiftCard, &totals.Loyalty)
 	if err != nil {
 		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
 	}
@@ -272,11 +277,20 @@ func GetOrderDetail(c *fiber.Ctx) error {
 		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
 	}
 
+	// Componentes de los packs, para preparar el pedido
+	components, err := loadOrderItemComponents(context.Background(), db.DB, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+
 	// Obtener los items del pedido
 	rows, err := db.DB.Query(context.Background(),
-		`SELECT oi.product_id, p.name, oi.quantity, oi.unit_price
+		`SELECT oi.id::text, oi.product_id, COALESCE(oi.variant_id::text, ''), `+itemNameSQL+`, oi.quantity, oi.unit_price, oi.discount_amount, oi.tax_type,
+		        COALESCE(oi.net_amount, oi.quantity * oi.unit_price - oi.discount_amount),
+		        COALESCE(oi.taxable_base, 0), oi.igv_amount, oi.deposit_amount
 		 FROM order_items oi
 		 JOIN products p ON oi.product_id = p.id
+		 LEFT JOIN product_variants v ON v.id = oi.variant_id
 		 WHERE oi.order_id = $1`, orderID)
 	if err != nil {
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
@@ -285,67 +299,215 @@ func GetOrderDetail(c *fiber.Ctx) error {
 
 	items := []fiber.Map{}
 	for rows.Next() {
-		var productID, name string
+		var itemID, productID, variantID, name string
 		var quantity int
-		var unitPrice float64
-		if err := rows.Scan(&productID, &name, &quantity, &unitPrice); err != nil {
+		var unitPrice, discount, netAmount, taxableBase, igv, deposit float64
+		var taxType string
+		if err := rows.Scan(&itemID, &productID, &variantID, &name, &quantity, &unitPrice, &discount, &taxType, &netAmount, &taxableBase, &igv, &deposit); err != nil {
 			continue
 		}
 		items = append(items, fiber.Map{
-			"product_id": productID,
-			"name":       name,
-			"quantity":   quantity,
-			"unit_price": unitPrice,
-			"subtotal":   unitPrice * float64(quantity),
+			"product_id":   productID,
+			"variant_id":   variantID,
+			"name":         name,
+			"quantity":     quantity,
+			"unit_price":   unitPrice,
+			"subtotal":     unitPrice * float64(quantity),
+			"discount":     discount,
+			"tax_type":     taxType,
+			"taxable_base": taxableBase,
+			"igv":          igv,
+			"total":        netAmount,
+			"deposit":      deposit,
+			"components":   components[itemID],
 		})
 	}
 
+	totals.Total = total
+	tax.Total = total
 	return c.JSON(fiber.Map{
 		"id":         orderID,
 		"status":     status,
 		"total":      total,
+		"totals":     totals,
+		"tax":        tax,
 		"location":   location,
 		"created_at": createdAt,
 		"updated_at": updatedAt,
 		"items":      items,
+		// Pedidos con alcohol: se revisa el documento de quien recibe
+		"verify_id_on_delivery": verifyID,
+		"id_verified_at":        idVerifiedAt,
 	})
 }
 
-// Cambiar el estado de un pedido (solo admin)
+// Cambiar el estado de un pedido (solo admin) respetando la máquina de estados
 func UpdateOrderStatus(c *fiber.Ctx) error {
 	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
 	var req UpdateOrderStatusRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
 	}
-	if !allowedStatuses[req.Status] {
+	if !isKnownOrderStatus(req.Status) {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Estado no permitido"})
 	}
-	// Obtener user_id del pedido
+	if req.Reason != "" && !utils.IsValidString(req.Reason, 1, 500) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Motivo inválido (máximo 500 caracteres)"})
+	}
+	// Obtener user_id del pedido (0 si es de un invitado)
 	var userID int64
-	err := db.DB.QueryRow(context.Background(), "SELECT user_id FROM orders WHERE id=$1", orderID).Scan(&userID)
+	err := db.DB.QueryRow(context.Background(), "SELECT COALESCE(user_id, 0) FROM orders WHERE id=$1", orderID).Scan(&userID)
 	if err != nil {
 		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
 	}
-	res, err := db.DB.Exec(context.Background(),
-		"UPDATE orders SET status=$1, updated_at=NOW() WHERE id=$2",
-		req.Status, orderID)
+
+	tx, err := db.DB.Begin(context.Background())
 	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(context.Background())
+
+	if req.Status == "entregado" && req.IDVerified {
+		if err := markOrderIDVerified(context.Background(), tx, orderID, actorFromClaims(claims)); err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el estado"})
+		}
+	}
+	if _, err := transitionOrderStatus(context.Background(), tx, orderID, req.Status, actorFromClaims(claims), req.Reason); err != nil {
+		return respondTransitionError(c, err)
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el estado"})
 	}
-	if res.RowsAffected() == 0 {
+
+	// Notificar usuario y admins ASYNC - NO ESPERAR RESPUESTA
+	notifyOrderStatus(orderID, userID, req.Status)
+	return c.JSON(fiber.Map{"success": true, "message": "Estado actualizado"})
+}
+
+// Estados en los que el cliente todavía puede cancelar su pedido
+var customerCancellableStatuses = map[string]bool{
+	"recibido":   true,
+	"preparando": true,
+}
+
+// CancelOrderRequest datos opcionales para cancelar un pedido
+type CancelOrderRequest struct {
+	Reason string `json:"reason"`
+}
+
+// errOrderNotOwned indica que el pedido es de otra cuenta o de un invitado
+var errOrderNotOwned = errors.New("el pedido no pertenece al usuario")
+
+// loadOwnOrderStatus obtiene el estado de un pedido del usuario; con forUpdate bloquea el
+// pedido. Los pedidos de invitado (user_id NULL) no pertenecen a ninguna cuenta.
+func loadOwnOrderStatus(ctx context.Context, q dbQuerier, orderID string, userID int64, forUpdate bool) (string, error) {
+	query := "SELECT user_id, status FROM orders WHERE id=$1"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	var ownerID *int64
+	var status string
+	err := q.QueryRow(ctx, query, orderID).Scan(&ownerID, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrOrderNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if ownerID == nil || *ownerID != userID {
+		return "", errOrderNotOwned
+	}
+	return status, nil
+}
+
+// CancelMyOrder permite al cliente cancelar su pedido mientras está en 'recibido' o
+// 'preparando'. Si el pedido fue pagado con Stripe se reembolsa el total.
+func CancelMyOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req CancelOrderRequest
+	_ = c.BodyParser(&req)
+	if req.Reason != "" && !utils.IsValidString(req.Reason, 1, 500) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Motivo inválido (máximo 500 caracteres)"})
+	}
+	reason := "Cancelado por el cliente"
+	if req.Reason != "" {
+		reason = req.Reason
+	}
+
+	tx, err := db.DB.Begin(context.Background())
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(context.Background())
+
+	// Bloquear el pedido para que no cambie de estado mientras se reembolsa
+	status, err := loadOwnOrderStatus(context.Background(), tx, orderID, userID, true)
+	if errors.Is(err, errOrderNotOwned) {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
+	}
+	if err != nil {
 		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
 	}
+	if !customerCancellableStatuses[status] {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": "El pedido ya no puede cancelarse",
+			"code":  "ORDER_NOT_CANCELLABLE",
+		})
+	}
+
+	// Cancelar (libera el stock y registra el historial)
+	if _, err := transitionOrderStatus(context.Background(), tx, orderID, "cancelado", actorFromClaims(claims), reason); err != nil {
+		return respondTransitionError(c, err)
+	}
+
+	// Pago a reembolsar, si existe
+	var paymentID string
+	err = tx.QueryRow(context.Background(),
+		"SELECT id FROM payments WHERE order_id=$1 AND status='paid' ORDER BY created_at DESC LIMIT 1",
+		orderID).Scan(&paymentID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		fmt.Printf("Error guardando cancelación del pedido %s: %v\n", orderID, err)
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo cancelar el pedido"})
+	}
+
+	// El reembolso va después de confirmar la cancelación para no devolver el dinero de
+	// un pedido que sigue activo. Si Stripe falla, el pago queda como 'paid' y se avisa a
+	// los admins para reembolsarlo desde el panel.
+	var refundInfo fiber.Map
+	if paymentID != "" {
+		refundID, refundAmount, err := refundPayment(paymentID, 0, "requested_by_customer")
+		if err != nil {
+			fmt.Printf("Error reembolsando pedido %s: %v\n", orderID, err)
+			go NotifyAdmins("No se pudo reembolsar el pedido cancelado " + orderID + "; reembólsalo manualmente")
+			refundInfo = fiber.Map{"status": "pending", "message": "El reembolso se procesará en breve"}
+		} else {
+			refundInfo = fiber.Map{"status": "refunded", "refund_id": refundID, "amount": refundAmount}
+		}
+	}
 
 	// Crear notificación automática ASYNC - NO ESPERAR RESPUESTA
 	go func() {
-		CreateOrderNotification(orderID, fmt.Sprintf("%d", userID), req.Status)
+		CreateOrderNotification(orderID, fmt.Sprintf("%d", userID), "cancelado")
 	}()
 
 	// Notificar usuario y admins ASYNC
 	go func() {
-		msg := "El estado de tu pedido " + orderID + " cambió a: " + req.Status
+		msg := "El estado de tu pedido " + orderID + " cambió a: cancelado"
 		NotifyUserAndAdmins(userID, msg)
 	}()
-	return c.JSON(fiber.Map{"success": true, "message": "Estado actualizado"})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Pedido cancelado",
+		"refund":  refundInfo,
+	})
 }
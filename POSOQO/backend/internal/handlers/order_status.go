@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+)
+
+// Métodos de pago de un pedido
+const (
+	paymentMethodStripe        = "stripe"
+	paymentMethodContraEntrega = "contra_entrega"
+)
+
+// orderTransitions define los cambios de estado legales de un pedido.
+// entregado y cancelado son estados finales.
+var orderTransitions = map[string][]string{
+	"pendiente":  {"pagado", "recibido", "cancelado"},
+	"pagado":     {"recibido", "preparando", "cancelado"},
+	"recibido":   {"preparando", "cancelado"},
+	"preparando": {"camino", "cancelado"},
+	"camino":     {"entregado"},
+	"entregado":  {},
+	"cancelado":  {},
+}
+
+// ErrOrderNotFound se devuelve cuando el pedido no existe
+var ErrOrderNotFound = errors.New("pedido no encontrado")
+
+// InvalidTransitionError indica un cambio de estado no permitido por la máquina de estados
+type InvalidTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("transición no permitida: %s -> %s", e.From, e.To)
+}
+
+// OrderGuardError indica que la transición es legal pero una regla de negocio la impide
+type OrderGuardError struct {
+	Code    string
+	Message string
+}
+
+func (e *OrderGuardError) Error() string {
+	return e.Message
+}
+
+// orderActor identifica quién provoca un cambio de estado
+type orderActor struct {
+	UserID *int64
+	Role   string
+}
+
+// systemActor representa cambios hechos por webhooks y procesos automáticos
+var systemActor = orderActor{Role: "system"}
+
+// actorFromClaims construye el actor a partir del JWT del usuario autenticado
+func actorFromClaims(claims jwt.MapClaims) orderActor {
+	userID := int64(claims["id"].(float64))
+	role, _ := claims["role"].(string)
+	return orderActor{UserID: &userID, Role: role}
+}
+
+// isKnownOrderStatus indica si el estado existe en la máquina de estados
+func isKnownOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// canTransitionOrder indica si el paso de from a to es legal
+func canTransitionOrder(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// orderTransitionGuard aplica las reglas de negocio de una transición legal: no se envía
+// un pedido sin pagar (salvo contra entrega) ni se entrega alcohol sin revisar el documento
+func orderTransitionGuard(to, paymentMethod string, paid, idPending bool) *OrderGuardError {
+	if to == "camino" && !paid && paymentMethod != paymentMethodContraEntrega {
+		return &OrderGuardError{Code: "ORDER_NOT_PAID", Message: "No se puede enviar un pedido sin pagar"}
+	}
+	if to == "entregado" && idPending {
+		return &OrderGuardError{
+			Code:    "ID_CHECK_REQUIRED",
+			Message: "El pedido contiene alcohol: verifica el documento de quien recibe antes de entregarlo",
+		}
+	}
+	return nil
+}
+
+// transitionOrderStatus cambia el estado de un pedido dentro de la transacción dada:
+// bloquea la fila, valida la transición y sus guardas, aplica los efectos sobre el
+// stock y registra el cambio en order_status_history. Devuelve el estado anterior.
+func transitionOrderStatus(ctx context.Context, tx pgx.Tx, orderID, to string, actor orderActor, reason string) (string, error) {
+	var from, paymentMethod string
+	var paid, idPending bool
+	err := tx.QueryRow(ctx,
+		`SELECT status, payment_method, paid_at IS NOT NULL, verify_id_on_delivery AND id_verified_at IS NULL
+		 FROM orders WHERE id=$1 FOR UPDATE`,
+		orderID).Scan(&from, &paymentMethod, &paid, &idPending)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrOrderNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !canTransitionOrder(from, to) {
+		return from, &InvalidTransitionError{From: from, To: to}
+	}
+
+	if guardErr := orderTransitionGuard(to, paymentMethod, paid, idPending); guardErr != nil {
+		return from, guardErr
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE orders SET status=$1, updated_at=NOW() WHERE id=$2", to, orderID); err != nil {
+		return from, err
+	}
+
+	// Cancelar devuelve el stock (reservado o ya pagado), los usos de cupón, el saldo de gift card y los
+	// puntos canjeados; entregar confirma el stock
+	switch to {
+	case "cancelado":
+		err = cancelOrderStock(ctx, tx, orderID)
+		if err == nil {
+			err = reverseCouponRedemptions(ctx, tx, orderID)
+		}
+		if err == nil {
+			err = reverseGiftCardRedemptions(ctx, tx, orderID)
+		}
+		if err == nil {
+			err = reverseLoyaltyRedemptions(ctx, tx, orderID)
+		}
+	case "entregado":
+		err = commitOrderStock(ctx, tx, orderID)
+	}
+	if err != nil {
+		return from, err
+	}
+
+	return from, recordOrderStatus(ctx, tx, orderID, &from, to, actor, reason)
+}
+
+// recordOrderStatus inserta una entrada en el historial de estados del pedido
+func recordOrderStatus(ctx context.Context, tx pgx.Tx, orderID string, from *string, to string, actor orderActor, reason string) error {
+	var reasonArg interface{}
+	if reason != "" {
+		reasonArg = reason
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO order_status_history (order_id, from_status, to_status, actor_user_id, actor_role, reason)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		orderID, from, to, actor.UserID, actor.Role, reasonArg)
+	return err
+}
+
+// respondTransitionError traduce los errores de la máquina de estados a la respuesta HTTP
+func respondTransitionError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, ErrOrderNotFound) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+	var transitionErr *InvalidTransitionError
+	if errors.As(err, &transitionErr) {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error":   fmt.Sprintf("No se puede pasar de '%s' a '%s'", transitionErr.From, transitionErr.To),
+			"code":    "INVALID_TRANSITION",
+			"from":    transitionErr.From,
+			"allowed": orderTransitions[transitionErr.From],
+		})
+	}
+	var guardErr *OrderGuardError
+	if errors.As(err, &guardErr) {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{"error": guardErr.Message, "code": guardErr.Code})
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el estado"})
+}
+
+// GetOrderTimeline devuelve el historial de estados de un pedido (dueño o admin)
+func GetOrderTimeline(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	role := claims["role"].(string)
+
+	var dbUserID int64
+	var status string
+	err := db.DB.QueryRow(context.Background(),
+		"SELECT COALESCE(user_id, 0), status FROM orders WHERE id=$1", orderID).Scan(&dbUserID, &status)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+	if role != "admin" && dbUserID != userID {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
+	}
+
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT h.from_status, h.to_status, h.actor_user_id, h.actor_role, h.reason, h.created_at, u.name
+		 FROM order_status_history h
+		 LEFT JOIN users u ON u.id = h.actor_user_id
+		 WHERE h.order_id = $1
+		 ORDER BY h.created_at, h.id`, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener historial"})
+	}
+	defer rows.Close()
+
+	timeline := []fiber.Map{}
+	for rows.Next() {
+		var fromStatus, reason, actorName *string
+		var toStatus, actorRole string
+		var actorUserID *int64
+		var createdAt time.Time
+		if err := rows.Scan(&fromStatus, &toStatus, &actorUserID, &actorRole, &reason, &createdAt, &actorName); err != nil {
+			continue
+		}
+		entry := fiber.Map{
+			"from_status": fromStatus,
+			"to_status":   toStatus,
+			"actor_role":  actorRole,
+			"reason":      reason,
+			"created_at":  createdAt,
+		}
+		// El cliente no ve la identidad del personal, solo su rol
+		if role == "admin" {
+			entry["actor_user_id"] = actorUserID
+			entry["actor_name"] = actorName
+		}
+		timeline = append(timeline, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"order_id": orderID,
+		"status":   status,
+		"allowed":  orderTransitions[status],
+		"timeline": timeline,
+	})
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCanTransitionOrder valida las transiciones legales de la máquina de estados de pedidos
+func TestCanTransitionOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		to       string
+		expected bool
+	}{
+		{"Pago confirmado", "pendiente", "recibido", true},
+		{"Checkout pagado", "pendiente", "pagado", true},
+		{"Preparar pedido", "recibido", "preparando", true},
+		{"Enviar pedido", "preparando", "camino", true},
+		{"Entregar pedido", "camino", "entregado", true},
+		{"Cancelar en preparación", "preparando", "cancelado", true},
+		{"Entregado no retrocede", "entregado", "recibido", false},
+		{"Cancelado es final", "cancelado", "recibido", false},
+		{"No se salta la preparación", "recibido", "camino", false},
+		{"No se cancela en camino", "camino", "cancelado", false},
+		{"Mismo estado", "recibido", "recibido", false},
+		{"Estado desconocido", "perdido", "recibido", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, canTransitionOrder(tt.from, tt.to))
+		})
+	}
+}
+
+// TestCancelMyOrderGuestOrder valida que un cliente no pueda cancelar un pedido de invitado
+// (user_id NULL): se rechaza como ajeno sin tocar el pedido
+func TestCancelMyOrderGuestOrder(t *testing.T) {
+	tx := newScriptedTx().on("SELECT user_id, status FROM orders", []interface{}{nil, "recibido"})
+	_, err := loadOwnOrderStatus(context.Background(), tx, "o1", 7, true)
+	assert.ErrorIs(t, err, errOrderNotOwned)
+	assert.Empty(t, tx.execs)
+
+	tx = newScriptedTx().on("SELECT user_id, status FROM orders", []interface{}{int64(7), "recibido"})
+	status, err := loadOwnOrderStatus(context.Background(), tx, "o1", 7, true)
+	assert.NoError(t, err)
+	assert.True(t, customerCancellableStatuses[status])
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/posoqo/backend/internal/db"
 	"github.com/posoqo/backend/internal/services"
 	"github.com/stripe/stripe-go/v78"
@@ -34,10 +36,42 @@ type RefundRequest struct {
 // Crear Checkout Session de Stripe
 func CreateStripeCheckout(c *fiber.Ctx) error {
 	var req CheckoutRequest
-	if err := c.BodyParser(&req); err != nil || req.Amount <= 0 || (req.Type != "order" && req.Type != "reservation") {
+	if err := c.BodyParser(&req); err != nil || req.Amount < 0 || req.ID == "" || (req.Type != "order" && req.Type != "reservation") {
 		return c.Status(400).JSON(fiber.Map{"error": "Datos inválidos"})
 	}
 
+	// El monto se obtiene del pedido o de la reserva, nunca del cliente
+	var amount float64
+	switch req.Type {
+	case "order":
+		var status string
+		var paid bool
+		err := db.DB.QueryRow(context.Background(),
+			"SELECT total, status, amount_paid IS NOT NULL FROM orders WHERE id=$1", req.ID).Scan(&amount, &status, &paid)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Pedido no encontrado"})
+		}
+		if status == "cancelado" || paid {
+			return c.Status(409).JSON(fiber.Map{"error": "El pedido no admite pagos"})
+		}
+	case "reservation":
+		var status string
+		err := db.DB.QueryRow(context.Background(),
+			"SELECT advance, status FROM reservations WHERE id=$1", req.ID).Scan(&amount, &status)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Reserva no encontrada"})
+		}
+		if status != "pendiente" {
+			return c.Status(409).JSON(fiber.Map{"error": "La reserva no admite pagos"})
+		}
+	}
+	if amount <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Monto inválido"})
+	}
+	if req.Amount > 0 && toCents(req.Amount) != toCents(amount) {
+		return respondAmountMismatch(c, amount, nil)
+	}
+
 	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 	if stripe.Key == "" {
 		return c.Status(500).JSON(fiber.Map{"error": "Stripe no configurado"})
@@ -49,7 +83,7 @@ func CreateStripeCheckout(c *fiber.Ctx) error {
 			{
 				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
 					Currency:   stripe.String("pen"),
-					UnitAmount: stripe.Int64(int64(req.Amount * 100)),
+					UnitAmount: stripe.Int64(toCents(amount)),
 					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
 						Name: stripe.String(fmt.Sprintf("Pago %s %s", req.Type, req.ID)),
 					},
@@ -85,14 +119,17 @@ func CreateStripePaymentIntent(c *fiber.Ctx) error {
 	userID := int64(claims["id"].(float64))
 
 	var req struct {
-		Amount   float64 `json:"amount"`
-		Currency string  `json:"currency"`
-		Items    []struct {
-			ID       string  `json:"id"`
-			Quantity int     `json:"quantity"`
-			Price    float64 `json:"price"`
-		} `json:"items"`
-		Shipping struct {
+		Amount           float64            `json:"amount"`
+		Currency         string             `json:"currency"`
+		CouponCode       string             `json:"coupon_code"`
+		GiftCardCode     string             `json:"gift_card_code"`
+		LoyaltyPoints    int                `json:"loyalty_points"`
+		LoyaltyRewardID  string             `json:"loyalty_reward_id"`
+		FulfillmentType  string             `json:"fulfillment_type"`
+		ScheduledFor     *time.Time         `json:"scheduled_for"`
+		BillingProfileID *int64             `json:"billing_profile_id"`
+		Items            []OrderItemRequest `json:"items"`
+		Shipping         struct {
 			Address      string   `json:"address"`
 			AddressRef   string   `json:"addressRef"`
 			StreetNumber string   `json:"streetNumber"`
@@ -109,8 +146,17 @@ func CreateStripePaymentIntent(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Monto inválido"})
 	}
 
-	if len(req.Items) == 0 {
-		return c.Status(400).JSON(fiber.Map{"error": "Carrito vacío"})
+	// Cada línea conserva su formato y la selección del pack mixto
+	items := req.Items
+	if msg := validateOrderItems(items); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+
+	if req.FulfillmentType == "" {
+		req.FulfillmentType = fulfillmentDelivery
+	}
+	if !isValidFulfillmentType(req.FulfillmentType) {
+		return c.Status(400).JSON(fiber.Map{"error": "Tipo de entrega inválido (delivery o pickup)"})
 	}
 
 	// Validar y establecer currency por defecto
@@ -118,23 +164,9 @@ func CreateStripePaymentIntent(c *fiber.Ctx) error {
 		req.Currency = "pen"
 	}
 
-	// Iniciar transacción para crear el pedido
-	tx, err := db.DB.Begin(context.Background())
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Error interno"})
-	}
-	defer tx.Rollback(context.Background())
-
-	// Calcular total y validar productos
-	total := 0.0
-	for _, item := range req.Items {
-		var price float64
-		err := tx.QueryRow(context.Background(),
-			"SELECT price FROM products WHERE id=$1 AND is_active=TRUE", item.ID).Scan(&price)
-		if err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Producto %s no encontrado o inactivo", item.ID)})
-		}
-		total += price * float64(item.Quantity)
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		return c.Status(500).JSON(fiber.Map{"error": "Stripe no configurado"})
 	}
 
 	// Construir la ubicación para la orden
@@ -152,27 +184,45 @@ func CreateStripePaymentIntent(c *fiber.Ctx) error {
 		orderLng = *req.Shipping.Lng
 	}
 
-	// Crear el pedido con status 'pendiente'
-	var orderID string
-	err = tx.QueryRow(context.Background(),
-		"INSERT INTO orders (user_id, status, total, location, lat, lng) VALUES ($1, 'pendiente', $2, $3, $4, $5) RETURNING id",
-		userID, total, orderLocation, orderLat, orderLng).Scan(&orderID)
+	// Iniciar transacción para crear el pedido
+	tx, err := db.DB.Begin(context.Background())
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "No se pudo crear el pedido"})
+		return c.Status(500).JSON(fiber.Map{"error": "Error interno"})
 	}
+	defer tx.Rollback(context.Background())
 
-	// Insertar items del pedido
-	for _, item := range req.Items {
-		var price float64
-		err := tx.QueryRow(context.Background(), "SELECT price FROM products WHERE id=$1", item.ID).Scan(&price)
-		if err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Producto no encontrado"})
-		}
-		_, err = tx.Exec(context.Background(),
-			"INSERT INTO order_items (order_id, product_id, quantity, unit_price) VALUES ($1, $2, $3, $4)",
-			orderID, item.ID, item.Quantity, price)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Error al guardar detalle de pedido"})
+	// Crear el pedido con status 'pendiente'; el total lo calcula el servidor
+	orderID, totals, err := placeOrder(context.Background(), tx, checkoutInput{
+		UserID:           userID,
+		Actor:            actorFromClaims(claims),
+		Status:           "pendiente",
+		PaymentMethod:    paymentMethodStripe,
+		Items:            items,
+		Location:         orderLocation,
+		Lat:              orderLat,
+		Lng:              orderLng,
+		CouponCode:       req.CouponCode,
+		FulfillmentType:  req.FulfillmentType,
+		ScheduledFor:     req.ScheduledFor,
+		BillingProfileID: req.BillingProfileID,
+		GiftCardCode:     req.GiftCardCode,
+		LoyaltyPoints:    req.LoyaltyPoints,
+		LoyaltyRewardID:  req.LoyaltyRewardID,
+	})
+	if err != nil {
+		return respondCheckoutError(c, err)
+	}
+
+	// El monto enviado por el cliente solo se usa para detectar carritos desactualizados
+	if toCents(req.Amount) != toCents(totals.Total) {
+		return respondAmountMismatch(c, totals.Total, &totals)
+	}
+
+	// Pedido cubierto por completo con gift card: no hay nada que cobrar con Stripe
+	paidWithGiftCard := totals.GiftCard > 0 && totals.AmountDue() == 0
+	if paidWithGiftCard {
+		if err := settleGiftCardOrder(context.Background(), tx, orderID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Error al guardar pedido"})
 		}
 	}
 
@@ -181,40 +231,54 @@ func CreateStripePaymentIntent(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Error al guardar pedido"})
 	}
 
-	// Ahora crear el PaymentIntent de Stripe con el order_id
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	if stripe.Key == "" {
-		db.DB.Exec(context.Background(), "UPDATE orders SET status='cancelado' WHERE id=$1", orderID)
-		return c.Status(500).JSON(fiber.Map{"error": "Stripe no configurado"})
-	}
-
-	// Stripe requiere el amount en centavos (o unidades más pequeñas de la moneda)
-	// Para PEN (sol peruano), no hay centavos, pero Stripe espera el monto en centavos
-	// Por lo tanto, multiplicamos por 100 para convertir soles a centavos
-	amountInCents := int64(req.Amount * 100)
-
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(amountInCents),
-		Currency: stripe.String(req.Currency),
-		Metadata: map[string]string{
-			"type":    "order",
-			"id":      orderID,
-			"user_id": fmt.Sprintf("%d", userID),
-		},
+	if paidWithGiftCard {
+		CreateOrderNotification(orderID, fmt.Sprintf("%d", userID), "creado")
+		return c.JSON(fiber.Map{
+			"paid":       true,
+			"orderId":    orderID,
+			"totals":     totals,
+			"amount_due": 0,
+		})
 	}
 
-	pi, err := paymentintent.New(params)
+	pi, err := newOrderPaymentIntent(orderID, totals.AmountDue(), req.Currency, map[string]string{
+		"user_id": fmt.Sprintf("%d", userID),
+	})
 	if err != nil {
-		db.DB.Exec(context.Background(), "UPDATE orders SET status='cancelado' WHERE id=$1", orderID)
 		return c.Status(500).JSON(fiber.Map{"error": "Error creando PaymentIntent"})
 	}
 
 	return c.JSON(fiber.Map{
 		"clientSecret": pi.ClientSecret,
 		"orderId":      orderID,
+		"totals":       totals,
+		"amount_due":   totals.AmountDue(),
 	})
 }
 
+// newOrderPaymentIntent crea el PaymentIntent por el total calculado por el servidor y lo
+// asocia al pedido. Si Stripe falla, el pedido pendiente se cancela y libera su stock.
+func newOrderPaymentIntent(orderID string, total float64, currency string, metadata map[string]string) (*stripe.PaymentIntent, error) {
+	metadata["type"] = "order"
+	metadata["id"] = orderID
+
+	// Stripe espera el monto en céntimos
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(toCents(total)),
+		Currency: stripe.String(currency),
+		Metadata: metadata,
+	}
+	pi, err := paymentintent.New(params)
+	if err != nil {
+		cancelUnpaidOrder(orderID, "No se pudo crear el PaymentIntent")
+		return nil, err
+	}
+
+	_, _ = db.DB.Exec(context.Background(),
+		"UPDATE orders SET stripe_payment_intent_id=$1 WHERE id=$2", pi.ID, orderID)
+	return pi, nil
+}
+
 // Crear PaymentIntent para adelanto de reserva
 func CreateReservationPaymentIntent(c *fiber.Ctx) error {
 	// Verificar autenticación
@@ -365,64 +429,65 @@ func GetPaymentHistory(c *fiber.Ctx) error {
 	})
 }
 
-// Crear reembolso
-func CreateRefund(c *fiber.Ctx) error {
-	var req RefundRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Datos inválidos"})
-	}
+// Errores del flujo de reembolso
+var (
+	ErrPaymentNotFound      = errors.New("pago no encontrado")
+	ErrPaymentNotRefundable = errors.New("el pago no admite reembolso")
+	ErrInvalidRefundAmount  = errors.New("monto de reembolso inválido")
+	ErrStripeNotConfigured  = errors.New("stripe no configurado")
+)
 
+// refundPayment reembolsa un pago en Stripe (amount 0 = reembolso completo), marca el
+// pago como reembolsado y notifica al usuario. Devuelve el ID del reembolso y el monto.
+func refundPayment(paymentID string, amount float64, reason string) (string, float64, error) {
 	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		return "", 0, ErrStripeNotConfigured
+	}
 
 	// Obtener información del pago
-	var stripePaymentID string
-	var amount float64
+	var stripePaymentID, status string
+	var paidAmount float64
 	var userID int64
 	err := db.DB.QueryRow(context.Background(),
-		"SELECT stripe_payment_id, amount, user_id FROM payments WHERE id = $1",
-		req.PaymentID).Scan(&stripePaymentID, &amount, &userID)
+		"SELECT stripe_payment_id, amount, user_id, status FROM payments WHERE id = $1",
+		paymentID).Scan(&stripePaymentID, &paidAmount, &userID, &status)
 	if err != nil {
-		return c.Status(404).JSON(fiber.Map{"error": "Pago no encontrado"})
+		return "", 0, ErrPaymentNotFound
 	}
-
-	// Verificar que el usuario sea el propietario del pago (solo si está autenticado)
-	if user := c.Locals("user"); user != nil {
-		if claims, ok := user.(jwt.MapClaims); ok {
-			currentUserID := int64(claims["id"].(float64))
-			if userID != currentUserID {
-				return c.Status(403).JSON(fiber.Map{"error": "No autorizado"})
-			}
-		}
+	if status != "paid" {
+		return "", 0, ErrPaymentNotRefundable
 	}
 
 	// Calcular monto del reembolso
-	refundAmount := req.Amount
+	refundAmount := amount
 	if refundAmount == 0 {
-		refundAmount = amount
+		refundAmount = paidAmount
 	}
-
-	if refundAmount > amount {
-		return c.Status(400).JSON(fiber.Map{"error": "Monto de reembolso inválido"})
+	if refundAmount < 0 || refundAmount > paidAmount {
+		return "", 0, ErrInvalidRefundAmount
 	}
 
 	// Crear reembolso en Stripe
 	refundParams := &stripe.RefundParams{
 		PaymentIntent: stripe.String(stripePaymentID),
-		Amount:        stripe.Int64(int64(refundAmount * 100)),
-		Reason:        stripe.String(req.Reason),
+		Amount:        stripe.Int64(toCents(refundAmount)),
+	}
+	if reason != "" {
+		refundParams.Reason = stripe.String(reason)
 	}
 
 	ref, err := refund.New(refundParams)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Error creando reembolso"})
+		return "", 0, err
 	}
 
 	// Actualizar estado del pago
 	_, err = db.DB.Exec(context.Background(),
 		"UPDATE payments SET status = 'refunded', updated_at = NOW() WHERE id = $1",
-		req.PaymentID)
+		paymentID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Error actualizando pago"})
+		return ref.ID, refundAmount, err
 	}
 
 	// Crear notificación
@@ -431,13 +496,61 @@ func CreateRefund(c *fiber.Ctx) error {
 		fmt.Sprintf("Tu reembolso de S/%.2f ha sido procesado", refundAmount),
 		&userIDStr, nil)
 
+	return ref.ID, refundAmount, nil
+}
+
+// Crear reembolso
+func CreateRefund(c *fiber.Ctx) error {
+	var req RefundRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+
+	// Obtener el propietario del pago
+	var userID int64
+	err := db.DB.QueryRow(context.Background(),
+		"SELECT user_id FROM payments WHERE id = $1", req.PaymentID).Scan(&userID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Pago no encontrado"})
+	}
+
+	// Verificar que el usuario sea el propietario del pago (solo si está autenticado)
+	if user := c.Locals("user"); user != nil {
+		if claims, ok := user.(jwt.MapClaims); ok {
+			currentUserID := int64(claims["id"].(float64))
+			if userID != currentUserID {
+				return c.Status(403).JSON(fiber.Map{"error": "No autorizado"})
+			}
+		}
+	}
+
+	refundID, refundAmount, err := refundPayment(req.PaymentID, req.Amount, req.Reason)
+	if err != nil {
+		return respondRefundError(c, err)
+	}
+
 	return c.JSON(fiber.Map{
 		"message":   "Reembolso procesado exitosamente",
-		"refund_id": ref.ID,
+		"refund_id": refundID,
 		"amount":    refundAmount,
 	})
 }
 
+// respondRefundError traduce los errores de refundPayment a la respuesta HTTP
+func respondRefundError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrStripeNotConfigured):
+		return c.Status(500).JSON(fiber.Map{"error": "Stripe no configurado"})
+	case errors.Is(err, ErrPaymentNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Pago no encontrado"})
+	case errors.Is(err, ErrPaymentNotRefundable):
+		return c.Status(409).JSON(fiber.Map{"error": "El pago ya fue reembolsado o no está confirmado"})
+	case errors.Is(err, ErrInvalidRefundAmount):
+		return c.Status(400).JSON(fiber.Map{"error": "Monto de reembolso inválido"})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": "Error creando reembolso"})
+}
+
 // Webhook de Stripe
 func StripeWebhook(c *fiber.Ctx) error {
 	endpointSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
@@ -505,7 +618,9 @@ func handleCheckoutCompleted(event stripe.Event) {
 	// Actualizar estado
 	switch typeStr {
 	case "order":
-		_, _ = db.DB.Exec(context.Background(), "UPDATE orders SET status='pagado' WHERE id=$1", id)
+		markOrderPaid(id, "pagado")
+		reconcileOrderPayment(id, session.AmountTotal)
+		awardLoyaltyPoints(id)
 	case "reservation":
 		_, _ = db.DB.Exec(context.Background(), "UPDATE reservations SET status='confirmada' WHERE id=$1", id)
 	}
@@ -562,23 +677,28 @@ func handlePaymentSucceeded(event stripe.Event) {
 
 	if typeStr == "order" && id != "" {
 		orderID := id
-		// Obtener información del pedido
+		// Obtener información del pedido (user_id 0 para pedidos de invitados)
 		var userID int64
 		var total float64
 		err := db.DB.QueryRow(context.Background(),
-			"SELECT user_id, total FROM orders WHERE id=$1", orderID).Scan(&userID, &total)
+			"SELECT COALESCE(user_id, 0), total FROM orders WHERE id=$1", orderID).Scan(&userID, &total)
 
 		if err == nil {
 			// Registrar pago
 			_, _ = db.DB.Exec(context.Background(),
 				`INSERT INTO payments (user_id, order_id, stripe_payment_id, amount, status, method) 
-				 VALUES ($1, $2, $3, $4, 'paid', 'stripe')
+				 VALUES (NULLIF($1::bigint, 0), $2, $3, $4, 'paid', 'stripe')
 				 ON CONFLICT (stripe_payment_id) DO UPDATE SET status = 'paid'`,
 				userID, orderID, paymentIntent.ID, float64(paymentIntent.Amount)/100.0,
 			)
 
-			// Actualizar estado del pedido a 'recibido' (ya fue pagado)
-			_, _ = db.DB.Exec(context.Background(), "UPDATE orders SET status='recibido' WHERE id=$1", orderID)
+			// Actualizar estado del pedido a 'recibido' (ya fue pagado) y confirmar su stock
+			markOrderPaid(orderID, "recibido")
+			reconcileOrderPayment(orderID, capturedAmount(paymentIntent))
+			if paymentIntent.Metadata["subscription_id"] != "" {
+				markSubscriptionCyclePaid(orderID)
+			}
+			awardLoyaltyPoints(orderID)
 
 			// Crear notificación de pago exitoso con IA
 			if userID > 0 {
@@ -671,6 +791,9 @@ func handlePaymentSucceeded(event stripe.Event) {
 				}
 			}
 		}
+	} else if typeStr == "gift_card" && id != "" {
+		// Gift card comprada: se activa su saldo y se envía al destinatario
+		activateGiftCard(id, capturedAmount(paymentIntent))
 	} else {
 		// Si no hay metadata, intentar actualizar por payment_id
 		_, _ = db.DB.Exec(context.Background(),
@@ -690,6 +813,17 @@ func handlePaymentFailed(event stripe.Event) {
 		"UPDATE payments SET status = 'failed' WHERE stripe_payment_id = $1",
 		paymentIntent.ID)
 
+	switch failedPaymentTarget(paymentIntent.Metadata) {
+	case "subscription":
+		// Cobro del Club POSOQO: reintento programado o baja de la suscripción (dunning)
+		handleSubscriptionPaymentFailed(paymentIntent.Metadata["id"], paymentFailureMessage(paymentIntent))
+		return
+	case "order":
+		// El pedido se cancela para devolver su stock, los usos de cupón, el saldo de gift card,
+		// los puntos canjeados y el cupo de su horario de entrega
+		cancelFailedOrderPayment(paymentIntent.ID, paymentIntent.Metadata["id"])
+	}
+
 	// Obtener user_id para notificación
 	var userID int64
 	err := db.DB.QueryRow(context.Background(),
@@ -713,6 +847,9 @@ func handleRefundCompleted(event stripe.Event) {
 		"UPDATE payments SET status = 'refunded' WHERE stripe_payment_id = $1",
 		charge.PaymentIntent.ID)
 
+	// Los puntos ganados con el pedido se descuentan en proporción a lo reembolsado
+	clawbackLoyaltyPoints(charge.PaymentIntent.ID, charge.AmountRefunded, charge.Amount)
+
 	// Obtener user_id para notificación
 	var userID int64
 	err := db.DB.QueryRow(context.Background(),
@@ -725,6 +862,128 @@ func handleRefundCompleted(event stripe.Event) {
 	}
 }
 
+// capturedAmount devuelve el monto efectivamente recibido por un PaymentIntent (en céntimos)
+func capturedAmount(pi stripe.PaymentIntent) int64 {
+	if pi.AmountReceived > 0 {
+		return pi.AmountReceived
+	}
+	return pi.Amount
+}
+
+// markOrderPaid registra el pago de un pedido, confirma su stock y, si seguía
+// pendiente de pago, lo avanza al estado indicado mediante la máquina de estados
+func markOrderPaid(orderID, status string) {
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		fmt.Printf("Error iniciando transacción para pedido %s: %v\n", orderID, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		"UPDATE orders SET paid_at=COALESCE(paid_at, NOW()), payment_method=$1 WHERE id=$2",
+		paymentMethodStripe, orderID); err != nil {
+		fmt.Printf("Error actualizando pedido %s: %v\n", orderID, err)
+		return
+	}
+
+	var current string
+	if err := tx.QueryRow(ctx, "SELECT status FROM orders WHERE id=$1", orderID).Scan(&current); err != nil {
+		fmt.Printf("Error obteniendo pedido %s: %v\n", orderID, err)
+		return
+	}
+	if current == "cancelado" {
+		// El pago llegó después de cancelar el pedido (p. ej. no se pudo cancelar el PaymentIntent)
+		go NotifyAdmins("Se recibió el pago del pedido cancelado " + orderID + "; reembólsalo manualmente")
+		return
+	}
+	if current == "pendiente" {
+		if _, err := transitionOrderStatus(ctx, tx, orderID, status, systemActor, "Pago confirmado por Stripe"); err != nil {
+			fmt.Printf("Error actualizando estado del pedido %s: %v\n", orderID, err)
+			return
+		}
+	}
+
+	if err := commitOrderStock(ctx, tx, orderID); err != nil {
+		fmt.Printf("Error confirmando stock del pedido %s: %v\n", orderID, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		fmt.Printf("Error guardando pedido %s: %v\n", orderID, err)
+	}
+}
+
+// failedPaymentTarget indica qué cobraba un PaymentIntent rechazado según su metadata:
+// "subscription" (un ciclo del club), "order" (un pedido) o "" si no hay nada que revertir
+func failedPaymentTarget(metadata map[string]string) string {
+	switch {
+	case metadata["id"] == "":
+		return ""
+	case metadata["subscription_id"] != "":
+		return "subscription"
+	case metadata["type"] == "order":
+		return "order"
+	}
+	return ""
+}
+
+// cancelFailedOrderPayment cancela el pedido cuyo pago fue rechazado y el PaymentIntent, para
+// que un reintento con otra tarjeta no cobre un pedido ya cancelado
+func cancelFailedOrderPayment(paymentIntentID, orderID string) {
+	if !cancelUnpaidOrder(orderID, "Pago rechazado por Stripe") {
+		return
+	}
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if _, err := paymentintent.Cancel(paymentIntentID, nil); err != nil {
+		fmt.Printf("Error cancelando PaymentIntent %s del pedido %s: %v\n", paymentIntentID, orderID, err)
+	}
+}
+
+// cancelUnpaidOrder cancela un pedido que no llegó a cobrarse. Devuelve false si no se
+// canceló (ya no estaba pendiente o hubo un error).
+func cancelUnpaidOrder(orderID, reason string) bool {
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		fmt.Printf("Error iniciando transacción para pedido %s: %v\n", orderID, err)
+		return false
+	}
+	defer tx.Rollback(ctx)
+
+	canceled, err := cancelUnpaidOrderTx(ctx, tx, orderID, reason)
+	if err != nil {
+		fmt.Printf("Error cancelando pedido %s: %v\n", orderID, err)
+		return false
+	}
+	if !canceled {
+		return false
+	}
+	if err := tx.Commit(ctx); err != nil {
+		fmt.Printf("Error guardando pedido %s: %v\n", orderID, err)
+		return false
+	}
+	return true
+}
+
+// cancelUnpaidOrderTx cancela el pedido si sigue pendiente de pago. La transición a
+// cancelado devuelve su stock, los usos de cupón, el saldo de gift card y los puntos
+// canjeados, y libera su cupo en la franja de entrega.
+func cancelUnpaidOrderTx(ctx context.Context, tx pgx.Tx, orderID, reason string) (bool, error) {
+	var status string
+	err := tx.QueryRow(ctx, "SELECT status FROM orders WHERE id=$1 FOR UPDATE", orderID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && status != "pendiente") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := transitionOrderStatus(ctx, tx, orderID, "cancelado", systemActor, reason); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // Nota: se eliminó la función auxiliar `ifThenElse` porque no se utiliza en el código.
 // Si en el futuro se necesita una utilidad ternaria reutilizable, podemos añadir
 // una versión genérica en `internal/utils`.
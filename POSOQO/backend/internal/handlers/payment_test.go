@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+// scriptedTx es una transacción falsa: responde las consultas según un fragmento de su SQL y
+// registra las sentencias ejecutadas. Un valor nil se comporta como NULL.
+type scriptedTx struct {
+	pgx.Tx
+	rows  map[string][][]interface{}
+	execs []scriptedExec
+}
+
+type scriptedExec struct {
+	sql  string
+	args []interface{}
+}
+
+func newScriptedTx() *scriptedTx {
+	return &scriptedTx{rows: map[string][][]interface{}{}}
+}
+
+// on programa las filas que devuelve cualquier consulta que contenga fragment
+func (tx *scriptedTx) on(fragment string, rows ...[]interface{}) *scriptedTx {
+	tx.rows[fragment] = rows
+	return tx
+}
+
+// match usa el fragmento más largo contenido en sql
+func (tx *scriptedTx) match(sql string) [][]interface{} {
+	best := ""
+	for fragment := range tx.rows {
+		if strings.Contains(sql, fragment) && len(fragment) > len(best) {
+			best = fragment
+		}
+	}
+	return tx.rows[best]
+}
+
+func (tx *scriptedTx) QueryRow(_ context.Context, sql string, _ ...interface{}) pgx.Row {
+	rows := tx.match(sql)
+	if len(rows) == 0 {
+		return scriptedRow{err: pgx.ErrNoRows}
+	}
+	return scriptedRow{values: rows[0]}
+}
+
+func (tx *scriptedTx) Query(_ context.Context, sql string, _ ...interface{}) (pgx.Rows, error) {
+	return &scriptedRows{rows: tx.match(sql), index: -1}, nil
+}
+
+func (tx *scriptedTx) Exec(_ context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	tx.execs = append(tx.execs, scriptedExec{sql: sql, args: args})
+	return pgconn.NewCommandTag("UPDATE 1"), nil
+}
+
+// executed devuelve las sentencias ejecutadas que contienen fragment
+func (tx *scriptedTx) executed(fragment string) []scriptedExec {
+	found := []scriptedExec{}
+	for _, exec := range tx.execs {
+		if strings.Contains(exec.sql, fragment) {
+			found = append(found, exec)
+		}
+	}
+	return found
+}
+
+type scriptedRow struct {
+	values []interface{}
+	err    error
+}
+
+func (r scriptedRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return scanScripted(r.values, dest)
+}
+
+type scriptedRows struct {
+	pgx.Rows
+	rows  [][]interface{}
+	index int
+}
+
+func (r *scriptedRows) Next() bool {
+	r.index++
+	return r.index < len(r.rows)
+}
+
+func (r *scriptedRows) Scan(dest ...interface{}) error { return scanScripted(r.rows[r.index], dest) }
+func (r *scriptedRows) Close()                         {}
+func (r *scriptedRows) Err() error                     { return nil }
+
+// scanScripted copia los valores en los destinos como lo haría pgx: NULL solo en punteros
+func scanScripted(values, dest []interface{}) error {
+	if len(values) != len(dest) {
+		return fmt.Errorf("se esperaban %d columnas, hay %d", len(dest), len(values))
+	}
+	for i, value := range values {
+		target := reflect.ValueOf(dest[i]).Elem()
+		if value == nil {
+			if target.Kind() != reflect.Ptr {
+				return fmt.Errorf("no se puede escanear NULL en %s", target.Type())
+			}
+			target.Set(reflect.Zero(target.Type()))
+			continue
+		}
+		v := reflect.ValueOf(value)
+		if target.Kind() == reflect.Ptr {
+			ptr := reflect.New(target.Type().Elem())
+			ptr.Elem().Set(v.Convert(target.Type().Elem()))
+			target.Set(ptr)
+			continue
+		}
+		target.Set(v.Convert(target.Type()))
+	}
+	return nil
+}
+
+// pendingOrderTx programa un pedido pendiente de pago con stock reservado
+func pendingOrderTx() *scriptedTx {
+	return newScriptedTx().
+		on("SELECT status FROM orders", []interface{}{"pendiente"}).
+		on("SELECT status, payment_method", []interface{}{"pendiente", paymentMethodStripe, false, false}).
+		on("SELECT stock_status FROM orders", []interface{}{stockStatusReserved})
+}
+
+// TestFailedPaymentTarget valida qué se revierte cuando Stripe rechaza un cobro
+func TestFailedPaymentTarget(t *testing.T) {
+	assert.Equal(t, "order", failedPaymentTarget(map[string]string{"type": "order", "id": "o1"}))
+	assert.Equal(t, "subscription", failedPaymentTarget(map[string]string{"type": "order", "id": "o1", "subscription_id": "s1"}))
+	assert.Equal(t, "", failedPaymentTarget(map[string]string{"type": "reservation", "id": "r1"}))
+	assert.Equal(t, "", failedPaymentTarget(map[string]string{"type": "order"}))
+}
+
+// TestFailedPaymentRestoresGiftCard valida que el pago rechazado cancele el pedido y devuelva
+// el saldo de gift card descontado al crearlo
+func TestFailedPaymentRestoresGiftCard(t *testing.T) {
+	tx := pendingOrderTx().
+		on("FROM gift_card_transactions", []interface{}{int64(7), 40.0}).
+		on("UPDATE gift_cards SET balance", []interface{}{90.0})
+
+	canceled, err := cancelUnpaidOrderTx(context.Background(), tx, "o1", "Pago rechazado por Stripe")
+	assert.NoError(t, err)
+	assert.True(t, canceled)
+
+	status := tx.executed("UPDATE orders SET status")
+	if assert.Len(t, status, 1) {
+		assert.Equal(t, "cancelado", status[0].args[0])
+	}
+	refunds := tx.executed("INSERT INTO gift_card_transactions")
+	if assert.Len(t, refunds, 1) {
+		assert.Equal(t, []interface{}{int64(7), giftCardTxRefund, 40.0, 90.0}, refunds[0].args[:4])
+	}
+	// El stock reservado vuelve al inventario
+	assert.Len(t, tx.executed("UPDATE products p SET stock"), 1)
+}
+
+// TestFailedPaymentKeepsPaidOrder valida que un rechazo tardío no cancele un pedido ya pagado
+func TestFailedPaymentKeepsPaidOrder(t *testing.T) {
+	tx := newScriptedTx().on("SELECT status FROM orders", []interface{}{"recibido"})
+
+	canceled, err := cancelUnpaidOrderTx(context.Background(), tx, "o1", "Pago rechazado por Stripe")
+	assert.NoError(t, err)
+	assert.False(t, canceled)
+	assert.Empty(t, tx.execs)
+}
+
+// TestFailedPaymentReturnsLoyaltyPoints valida que el pago rechazado devuelva los puntos
+// canjeados en el pedido
+func TestFailedPaymentReturnsLoyaltyPoints(t *testing.T) {
+	tx := pendingOrderTx().
+		on("WHERE order_id=$1 AND type IN ('redeem', 'refund')", []interface{}{int64(3), 200}).
+		on("UPDATE users SET loyalty_points = loyalty_points + $1", []interface{}{450})
+
+	canceled, err := cancelUnpaidOrderTx(context.Background(), tx, "o1", "Pago rechazado por Stripe")
+	assert.NoError(t, err)
+	assert.True(t, canceled)
+
+	refunds := tx.executed("INSERT INTO loyalty_transactions")
+	if assert.Len(t, refunds, 1) {
+		assert.Equal(t, []interface{}{int64(3), loyaltyRefund, 200}, refunds[0].args[:3])
+	}
+}
+
+// TestFailedPaymentReleasesCoupon valida que el pago rechazado libere los usos del cupón
+func TestFailedPaymentReleasesCoupon(t *testing.T) {
+	tx := pendingOrderTx()
+
+	canceled, err := cancelUnpaidOrderTx(context.Background(), tx, "o1", "Pago rechazado por Stripe")
+	assert.NoError(t, err)
+	assert.True(t, canceled)
+
+	reversals := tx.executed("UPDATE coupon_redemptions SET reversed_at")
+	if assert.Len(t, reversals, 1) {
+		assert.Equal(t, []interface{}{"o1"}, reversals[0].args)
+		assert.Contains(t, reversals[0].sql, "redemptions_count - r.n")
+	}
+}
+
+// postPaymentIntent envía items al handler del PaymentIntent (sin Stripe configurado, una
+// línea válida llega hasta el cobro y responde "Stripe no configurado")
+func postPaymentIntent(t *testing.T, items string) (int, string) {
+	t.Setenv("STRIPE_SECRET_KEY", "")
+	app := fiber.New()
+	app.Post("/create-payment-intent", func(c *fiber.Ctx) error {
+		c.Locals("user", jwt.MapClaims{"id": float64(7), "role": "user"})
+		return c.Next()
+	}, CreateStripePaymentIntent)
+
+	req := httptest.NewRequest(http.MethodPost, "/create-payment-intent",
+		bytes.NewBufferString(`{"amount": 45, "items": `+items+`}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	var body map[string]interface{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	msg, _ := body["error"].(string)
+	return resp.StatusCode, msg
+}
+
+// TestPaymentIntentKeepsVariant valida que el checkout con Stripe reciba el formato elegido
+func TestPaymentIntentKeepsVariant(t *testing.T) {
+	status, msg := postPaymentIntent(t,
+		`[{"product_id": "6f1c2a4e-8b3d-4c5e-9f70-1a2b3c4d5e6f", "variant_id": "8a2d3b5f-9c4e-4d6f-a081-2b3c4d5e6f70", "quantity": 2}]`)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, "Stripe no configurado", msg)
+
+	// El formato se valida: antes se descartaba y nunca llegaba a placeOrder
+	status, msg = postPaymentIntent(t,
+		`[{"product_id": "6f1c2a4e-8b3d-4c5e-9f70-1a2b3c4d5e6f", "variant_id": "330ml", "quantity": 2}]`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "ID de formato inválido", msg)
+}
+
+// TestPaymentIntentKeepsPackSelection valida que el checkout con Stripe reciba la selección
+// de un pack mixto
+func TestPaymentIntentKeepsPackSelection(t *testing.T) {
+	status, msg := postPaymentIntent(t,
+		`[{"product_id": "6f1c2a4e-8b3d-4c5e-9f70-1a2b3c4d5e6f", "quantity": 1,
+		   "components": [{"product_id": "8a2d3b5f-9c4e-4d6f-a081-2b3c4d5e6f70", "quantity": 6}]}]`)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, "Stripe no configurado", msg)
+
+	status, msg = postPaymentIntent(t,
+		`[{"product_id": "6f1c2a4e-8b3d-4c5e-9f70-1a2b3c4d5e6f", "quantity": 1,
+		   "components": [{"product_id": "ipa", "quantity": 6}]}]`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "ID de producto del pack inválido", msg)
+}
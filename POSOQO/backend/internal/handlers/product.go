@@ -9,6 +9,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5"
 	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
 )
 
 // Product representa un producto de cerveza artesanal
@@ -49,6 +50,12 @@ type ProductResponse struct {
 	ABV         string    `json:"abv"`
 	IBU         string    `json:"ibu"`
 	Color       string    `json:"color"`
+	// Variants son los formatos de venta (vacío si el producto se vende con su propio precio)
+	Variants []ProductVariant `json:"variants"`
+	// BundleType es fixed o mixed si el producto es un pack; su stock sale de los componentes
+	BundleType       string            `json:"bundle_type,omitempty"`
+	BundleComponents []BundleSelection `json:"bundle_components,omitempty"`
+	PackRule         *PackRule         `json:"pack_rule,omitempty"`
 }
 
 // GetProducts devuelve todos los productos desde la base de datos
@@ -106,6 +113,20 @@ func GetProducts(c *fiber.Ctx) error {
 			Color:       color.String,
 		})
 	}
+	rows.Close()
+
+	if err := attachProductVariants(context.Background(), products, true); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando formatos de productos",
+		})
+	}
+	if err := attachBundles(context.Background(), products); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando packs de productos",
+		})
+	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
@@ -152,9 +173,22 @@ func GetProduct(c *fiber.Ctx) error {
 		IBU:         nullableToString(p.IBU),
 		Color:       nullableToString(p.Color),
 	}
+	products := []ProductResponse{resp}
+	if err := attachProductVariants(context.Background(), products, true); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando formatos del producto",
+		})
+	}
+	if err := attachBundles(context.Background(), products); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando el pack del producto",
+		})
+	}
 	return c.JSON(fiber.Map{
 		"success": true,
-		"data":    resp,
+		"data":    products[0],
 	})
 }
 
@@ -173,10 +207,14 @@ func CreateProduct(c *fiber.Ctx) error {
 		Color       string  `json:"color"`
 		Stock       int     `json:"stock"`
 		IsFeatured  bool    `json:"is_featured"`
+		TaxType     string  `json:"tax_type"` // vacío = la afectación de la categoría
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Datos inválidos"})
 	}
+	if req.TaxType != "" && !utils.IsValidTaxType(req.TaxType) {
+		return c.Status(400).JSON(fiber.Map{"error": "Afectación al IGV inválida (gravado, exonerado o inafecto)"})
+	}
 
 	var categoryID sql.NullString
 	if req.CategoryID != "" {
@@ -193,9 +231,9 @@ func CreateProduct(c *fiber.Ctx) error {
 	}
 	id := ""
 	err := db.DB.QueryRow(context.Background(),
-		`INSERT INTO products (name, description, price, image_url, category_id, subcategory, estilo, abv, ibu, color, stock, is_active, is_featured, created_at, updated_at)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, true, $12, NOW(), NOW()) RETURNING id`,
-		req.Name, req.Description, req.Price, req.ImageURL, categoryID, subcategoryID, req.Estilo, req.ABV, req.IBU, req.Color, req.Stock, req.IsFeatured).Scan(&id)
+		`INSERT INTO products (name, description, price, image_url, category_id, subcategory, estilo, abv, ibu, color, stock, is_active, is_featured, tax_type, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, true, $12, NULLIF($13, ''), NOW(), NOW()) RETURNING id`,
+		req.Name, req.Description, req.Price, req.ImageURL, categoryID, subcategoryID, req.Estilo, req.ABV, req.IBU, req.Color, req.Stock, req.IsFeatured, req.TaxType).Scan(&id)
 	if err != nil {
 		fmt.Printf("❌ [CREATE] Error creando producto: %v\n", err)
 		return c.Status(500).JSON(fiber.Map{"error": "No se pudo crear el producto: " + err.Error()})
@@ -222,10 +260,14 @@ func UpdateProduct(c *fiber.Ctx) error {
 		Stock       int     `json:"stock"`
 		IsActive    bool    `json:"is_active"`
 		IsFeatured  bool    `json:"is_featured"`
+		TaxType     *string `json:"tax_type"` // omitido = sin cambios, vacío = la de la categoría
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Datos inválidos"})
 	}
+	if req.TaxType != nil && *req.TaxType != "" && !utils.IsValidTaxType(*req.TaxType) {
+		return c.Status(400).JSON(fiber.Map{"error": "Afectación al IGV inválida (gravado, exonerado o inafecto)"})
+	}
 	var categoryID sql.NullString
 	if req.CategoryID != "" {
 		categoryID = sql.NullString{String: req.CategoryID, Valid: true}
@@ -241,8 +283,9 @@ func UpdateProduct(c *fiber.Ctx) error {
 	}
 
 	_, err := db.DB.Exec(context.Background(),
-		`UPDATE products SET name=$1, description=$2, price=$3, image_url=$4, category_id=$5, subcategory=$6, estilo=$7, abv=$8, ibu=$9, color=$10, stock=$11, is_active=$12, is_featured=$13, updated_at=NOW() WHERE id=$14`,
-		req.Name, req.Description, req.Price, req.ImageURL, categoryID, subcategoryID, req.Estilo, req.ABV, req.IBU, req.Color, req.Stock, req.IsActive, req.IsFeatured, id)
+		`UPDATE products SET name=$1, description=$2, price=$3, image_url=$4, category_id=$5, subcategory=$6, estilo=$7, abv=$8, ibu=$9, color=$10, stock=$11, is_active=$12, is_featured=$13,
+		        tax_type=CASE WHEN $15::text IS NULL THEN tax_type ELSE NULLIF($15, '') END, updated_at=NOW() WHERE id=$14`,
+		req.Name, req.Description, req.Price, req.ImageURL, categoryID, subcategoryID, req.Estilo, req.ABV, req.IBU, req.Color, req.Stock, req.IsActive, req.IsFeatured, id, req.TaxType)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Error al actualizar producto"})
 	}
@@ -321,6 +364,20 @@ func GetAllProductsAdmin(c *fiber.Ctx) error {
 			Color:       nullableToString(p.Color),
 		})
 	}
+	rows.Close()
+
+	if err := attachProductVariants(context.Background(), products, false); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando formatos de productos",
+		})
+	}
+	if err := attachBundles(context.Background(), products); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando packs de productos",
+		})
+	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
@@ -400,6 +457,20 @@ func GetFeaturedProducts(c *fiber.Ctx) error {
 			Color:       nullableToString(p.Color),
 		})
 	}
+	rows.Close()
+
+	if err := attachProductVariants(context.Background(), products, true); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando formatos de productos",
+		})
+	}
+	if err := attachBundles(context.Background(), products); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"error":   "Error consultando packs de productos",
+		})
+	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
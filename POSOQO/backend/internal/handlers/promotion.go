@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// Tipos de promoción soportados
+const (
+	promoMultibuy    = "multibuy"
+	promoBundlePrice = "bundle_price"
+	promoPercent     = "percent"
+)
+
+// PromotionRequest datos para crear o actualizar una promoción (solo admin)
+type PromotionRequest struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Type           string   `json:"type"`
+	BuyQuantity    *int     `json:"buy_quantity"`
+	PayQuantity    *int     `json:"pay_quantity"`
+	BundleQuantity *int     `json:"bundle_quantity"`
+	BundlePrice    *float64 `json:"bundle_price"`
+	Percent        *float64 `json:"percent"`
+	ProductIDs     []string `json:"product_ids"`
+	CategoryIDs    []string `json:"category_ids"`
+	DaysOfWeek     []int    `json:"days_of_week"`
+	StartTime      *string  `json:"start_time"` // HH:MM
+	EndTime        *string  `json:"end_time"`   // HH:MM
+	StartsAt       *string  `json:"starts_at"`  // RFC3339
+	EndsAt         *string  `json:"ends_at"`    // RFC3339
+	Priority       int      `json:"priority"`
+	IsActive       *bool    `json:"is_active"`
+}
+
+// promotionRule es una promoción cargada desde la base de datos
+type promotionRule struct {
+	ID             string
+	Name           string
+	Type           string
+	BuyQuantity    int
+	PayQuantity    int
+	BundleQuantity int
+	BundlePrice    float64
+	Percent        float64
+	ProductIDs     []string
+	CategoryIDs    []string
+	DaysOfWeek     []int
+	StartTime      string // HH:MM, vacío = todo el día
+	EndTime        string
+	StartsAt       *time.Time
+	EndsAt         *time.Time
+	Priority       int
+}
+
+// AppliedPromotion es una promoción aplicada al carrito o pedido
+type AppliedPromotion struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Discount float64 `json:"discount"`
+}
+
+// PromotionResult es el resultado de evaluar las promociones sobre un carrito
+type PromotionResult struct {
+	Applied       []AppliedPromotion `json:"applied"`
+	LineDiscounts []float64          `json:"line_discounts"` // mismo orden que las líneas
+	Total         float64            `json:"total"`
+}
+
+// businessLocation devuelve la zona horaria del negocio (hora de Lima por defecto)
+func businessLocation() *time.Location {
+	name := utils.GetEnvWithDefault("BUSINESS_TIMEZONE", "America/Lima")
+	if loc, err := time.LoadLocation(name); err == nil {
+		return loc
+	}
+	return time.FixedZone("PET", -5*60*60)
+}
+
+// appliesTo indica si la línea está dentro del alcance de la promoción
+func (p *promotionRule) appliesTo(line pricedLine) bool {
+	scope := couponRule{ProductIDs: p.ProductIDs, CategoryIDs: p.CategoryIDs}
+	return scope.appliesTo(line)
+}
+
+// activeAt indica si la promoción está vigente en el instante dado (hora del negocio)
+func (p *promotionRule) activeAt(now time.Time) bool {
+	if p.StartsAt != nil && now.Before(*p.StartsAt) {
+		return false
+	}
+	if p.EndsAt != nil && now.After(*p.EndsAt) {
+		return false
+	}
+	local := now.In(businessLocation())
+	if len(p.DaysOfWeek) > 0 {
+		found := false
+		for _, d := range p.DaysOfWeek {
+			if d == int(local.Weekday()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.StartTime != "" && p.EndTime != "" {
+		clock := local.Format("15:04")
+		if p.StartTime <= p.EndTime {
+			return clock >= p.StartTime && clock < p.EndTime
+		}
+		// Horario que cruza la medianoche (ej. 22:00-02:00)
+		return clock >= p.StartTime || clock < p.EndTime
+	}
+	return true
+}
+
+// promoUnit es una unidad individual de una línea, usada para repartir promociones
+type promoUnit struct {
+	line  int
+	price float64
+}
+
+// evaluatePromotions aplica las promociones vigentes a las líneas. Se evalúan por
+// prioridad y cada unidad del carrito recibe como máximo una promoción.
+func evaluatePromotions(promos []promotionRule, lines []pricedLine, now time.Time) PromotionResult {
+	result := PromotionResult{Applied: []AppliedPromotion{}, LineDiscounts: make([]float64, len(lines))}
+
+	ordered := append([]promotionRule(nil), promos...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Priority > ordered[j].Priority })
+
+	remaining := make([]int, len(lines))
+	for i, line := range lines {
+		remaining[i] = line.Quantity
+	}
+
+	for _, promo := range ordered {
+		if !promo.activeAt(now) {
+			continue
+		}
+
+		// Unidades elegibles aún libres, de mayor a menor precio
+		var units []promoUnit
+		for i, line := range lines {
+			if remaining[i] == 0 || !promo.appliesTo(line) {
+				continue
+			}
+			for n := 0; n < remaining[i]; n++ {
+				units = append(units, promoUnit{line: i, price: line.UnitPrice})
+			}
+		}
+		sort.SliceStable(units, func(i, j int) bool { return units[i].price > units[j].price })
+
+		perLine := make(map[int]float64)
+		used := make(map[int]int)
+		switch promo.Type {
+		case promoMultibuy:
+			if promo.BuyQuantity <= 0 || promo.PayQuantity < 0 || promo.PayQuantity >= promo.BuyQuantity {
+				continue
+			}
+			for g := 0; g+promo.BuyQuantity <= len(units); g += promo.BuyQuantity {
+				group := units[g : g+promo.BuyQuantity]
+				// Las unidades más baratas del grupo son gratis
+				for _, u := range group[promo.PayQuantity:] {
+					perLine[u.line] += u.price
+				}
+				for _, u := range group {
+					used[u.line]++
+				}
+			}
+		case promoBundlePrice:
+			if promo.BundleQuantity <= 0 || promo.BundlePrice < 0 {
+				continue
+			}
+			for g := 0; g+promo.BundleQuantity <= len(units); g += promo.BundleQuantity {
+				group := units[g : g+promo.BundleQuantity]
+				groupTotal := 0.0
+				for _, u := range group {
+					groupTotal += u.price
+				}
+				saving := groupTotal - promo.BundlePrice
+				if saving <= 0 {
+					continue
+				}
+				// Repartir el ahorro proporcionalmente al precio de cada unidad
+				for _, u := range group {
+					perLine[u.line] += saving * u.price / groupTotal
+					used[u.line]++
+				}
+			}
+		case promoPercent:
+			if promo.Percent <= 0 {
+				continue
+			}
+			pct := math.Min(promo.Percent, 100) / 100
+			for _, u := range units {
+				perLine[u.line] += u.price * pct
+				used[u.line]++
+			}
+		}
+
+		promoTotal := 0.0
+		for i, amount := range perLine {
+			rounded := roundMoney(amount)
+			result.LineDiscounts[i] = roundMoney(result.LineDiscounts[i] + rounded)
+			promoTotal += rounded
+		}
+		for i, n := range used {
+			remaining[i] -= n
+		}
+		if promoTotal > 0 {
+			result.Applied = append(result.Applied, AppliedPromotion{
+				ID:       promo.ID,
+				Name:     promo.Name,
+				Type:     promo.Type,
+				Discount: roundMoney(promoTotal),
+			})
+			result.Total = roundMoney(result.Total + promoTotal)
+		}
+	}
+
+	return result
+}
+
+const promotionColumns = `id, name, type, COALESCE(buy_quantity, 0), COALESCE(pay_quantity, 0),
+	COALESCE(bundle_quantity, 0), COALESCE(bundle_price, 0), COALESCE(percent, 0),
+	product_ids::text[], category_ids::text[], days_of_week,
+	COALESCE(to_char(start_time, 'HH24:MI'), ''), COALESCE(to_char(end_time, 'HH24:MI'), ''),
+	starts_at, ends_at, priority`
+
+// scanPromotion lee una fila con promotionColumns
+func scanPromotion(row pgx.Row, p *promotionRule) error {
+	return row.Scan(&p.ID, &p.Name, &p.Type, &p.BuyQuantity, &p.PayQuantity, &p.BundleQuantity, &p.BundlePrice,
+		&p.Percent, &p.ProductIDs, &p.CategoryIDs, &p.DaysOfWeek, &p.StartTime, &p.EndTime, &p.StartsAt, &p.EndsAt, &p.Priority)
+}
+
+// loadActivePromotions obtiene las promociones activas (el horario se valida al evaluar)
+func loadActivePromotions(ctx context.Context, q dbQuerier) ([]promotionRule, error) {
+	rows, err := q.Query(ctx, `SELECT `+promotionColumns+` FROM promotions WHERE is_active = TRUE ORDER BY priority DESC, created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promos := []promotionRule{}
+	for rows.Next() {
+		var p promotionRule
+		if err := scanPromotion(rows, &p); err != nil {
+			return nil, err
+		}
+		promos = append(promos, p)
+	}
+	return promos, rows.Err()
+}
+
+// applyLinePromotions copia los descuentos calculados a las líneas
+func applyLinePromotions(lines []pricedLine, result PromotionResult) {
+	for i := range lines {
+		lines[i].Discount = result.LineDiscounts[i]
+	}
+}
+
+// savePromotionsForOrder guarda los descuentos por línea y la atribución de promociones del pedido
+func savePromotionsForOrder(ctx context.Context, tx pgx.Tx, orderID string, lines []pricedLine, result PromotionResult) error {
+	for _, line := range lines {
+		if line.Discount == 0 {
+			continue
+		}
+		if _, err := tx.Exec(ctx, "UPDATE order_items SET discount_amount=$1 WHERE id=$2", line.Discount, line.ItemID); err != nil {
+			return err
+		}
+	}
+	for _, applied := range result.Applied {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO order_promotions (order_id, promotion_id, name, discount_amount) VALUES ($1, $2, $3, $4)",
+			orderID, applied.ID, applied.Name, applied.Discount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePromotionRequest valida los campos requeridos según el tipo de promoción
+func validatePromotionRequest(req *PromotionRequest) string {
+	if !utils.IsValidString(req.Name, 3, 100) {
+		return "Nombre inválido (3-100 caracteres)"
+	}
+	switch req.Type {
+	case promoMultibuy:
+		if req.BuyQuantity == nil || req.PayQuantity == nil || *req.BuyQuantity < 2 || *req.PayQuantity < 0 || *req.PayQuantity >= *req.BuyQuantity {
+			return "Multibuy requiere buy_quantity >= 2 y pay_quantity menor a buy_quantity"
+		}
+	case promoBundlePrice:
+		if req.BundleQuantity == nil || req.BundlePrice == nil || *req.BundleQuantity < 2 || *req.BundlePrice <= 0 {
+			return "Bundle requiere bundle_quantity >= 2 y bundle_price mayor a 0"
+		}
+	case promoPercent:
+		if req.Percent == nil || *req.Percent <= 0 || *req.Percent > 100 {
+			return "Porcentaje inválido (0-100)"
+		}
+	default:
+		return "Tipo de promoción inválido"
+	}
+	for _, d := range req.DaysOfWeek {
+		if d < 0 || d > 6 {
+			return "Día de la semana inválido (0=domingo ... 6=sábado)"
+		}
+	}
+	if (req.StartTime == nil) != (req.EndTime == nil) {
+		return "Debe indicar hora de inicio y de fin"
+	}
+	for _, t := range []*string{req.StartTime, req.EndTime} {
+		if t != nil {
+			if _, err := time.Parse("15:04", *t); err != nil {
+				return "Hora inválida (formato HH:MM)"
+			}
+		}
+	}
+	for _, t := range []*string{req.StartsAt, req.EndsAt} {
+		if t != nil {
+			if _, err := time.Parse(time.RFC3339, *t); err != nil {
+				return "Fecha inválida (formato RFC3339)"
+			}
+		}
+	}
+	if req.ProductIDs == nil {
+		req.ProductIDs = []string{}
+	}
+	if req.CategoryIDs == nil {
+		req.CategoryIDs = []string{}
+	}
+	if req.DaysOfWeek == nil {
+		req.DaysOfWeek = []int{}
+	}
+	return ""
+}
+
+// promotionToMap serializa una promoción para las respuestas de la API
+func promotionToMap(p promotionRule, isActive bool) fiber.Map {
+	return fiber.Map{
+		"id":              p.ID,
+		"name":            p.Name,
+		"type":            p.Type,
+		"buy_quantity":    p.BuyQuantity,
+		"pay_quantity":    p.PayQuantity,
+		"bundle_quantity": p.BundleQuantity,
+		"bundle_price":    p.BundlePrice,
+		"percent":         p.Percent,
+		"product_ids":     p.ProductIDs,
+		"category_ids":    p.CategoryIDs,
+		"days_of_week":    p.DaysOfWeek,
+		"start_time":      p.StartTime,
+		"end_time":        p.EndTime,
+		"starts_at":       p.StartsAt,
+		"ends_at":         p.EndsAt,
+		"priority":        p.Priority,
+		"is_active":       isActive,
+	}
+}
+
+// Listar promociones (solo admin)
+func ListPromotions(c *fiber.Ctx) error {
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT `+promotionColumns+`, is_active FROM promotions ORDER BY is_active DESC, priority DESC, created_at DESC`)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener promociones"})
+	}
+	defer rows.Close()
+
+	promotions := []fiber.Map{}
+	for rows.Next() {
+		var p promotionRule
+		var isActive bool
+		if err := rows.Scan(&p.ID, &p.Name, &p.Type, &p.BuyQuantity, &p.PayQuantity, &p.BundleQuantity, &p.BundlePrice,
+			&p.Percent, &p.ProductIDs, &p.CategoryIDs, &p.DaysOfWeek, &p.StartTime, &p.EndTime, &p.StartsAt, &p.EndsAt,
+			&p.Priority, &isActive); err != nil {
+			continue
+		}
+		promotions = append(promotions, promotionToMap(p, isActive))
+	}
+	return c.JSON(fiber.Map{"promotions": promotions})
+}
+
+// Listar promociones vigentes en este momento (público)
+func ListActivePromotions(c *fiber.Ctx) error {
+	promos, err := loadActivePromotions(context.Background(), db.DB)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener promociones"})
+	}
+	now := time.Now()
+	promotions := []fiber.Map{}
+	for _, p := range promos {
+		if p.activeAt(now) {
+			promotions = append(promotions, promotionToMap(p, true))
+		}
+	}
+	return c.JSON(fiber.Map{"promotions": promotions})
+}
+
+// Crear promoción (solo admin)
+func CreatePromotion(c *fiber.Ctx) error {
+	var req PromotionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validatePromotionRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	var id string
+	err := db.DB.QueryRow(context.Background(),
+		`INSERT INTO promotions (name, description, type, buy_quantity, pay_quantity, bundle_quantity, bundle_price, percent,
+		                         product_ids, category_ids, days_of_week, start_time, end_time, starts_at, ends_at, priority, is_active)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::uuid[], $10::uuid[], $11, $12::time, $13::time, $14::timestamptz, $15::timestamptz, $16, $17)
+		 RETURNING id`,
+		req.Name, req.Description, req.Type, req.BuyQuantity, req.PayQuantity, req.BundleQuantity, req.BundlePrice, req.Percent,
+		req.ProductIDs, req.CategoryIDs, req.DaysOfWeek, req.StartTime, req.EndTime, req.StartsAt, req.EndsAt, req.Priority, isActive).Scan(&id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo crear la promoción"})
+	}
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"message": "Promoción creada", "id": id})
+}
+
+// Actualizar promoción (solo admin); reemplaza todas las reglas
+func UpdatePromotion(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var req PromotionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validatePromotionRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	res, err := db.DB.Exec(context.Background(),
+		`UPDATE promotions SET name=$1, description=$2, type=$3, buy_quantity=$4, pay_quantity=$5, bundle_quantity=$6,
+		        bundle_price=$7, percent=$8, product_ids=$9::uuid[], category_ids=$10::uuid[], days_of_week=$11,
+		        start_time=$12::time, end_time=$13::time, starts_at=$14::timestamptz, ends_at=$15::timestamptz,
+		        priority=$16, is_active=COALESCE($17, is_active)
+		 WHERE id=$18`,
+		req.Name, req.Description, req.Type, req.BuyQuantity, req.PayQuantity, req.BundleQuantity, req.BundlePrice, req.Percent,
+		req.ProductIDs, req.CategoryIDs, req.DaysOfWeek, req.StartTime, req.EndTime, req.StartsAt, req.EndsAt, req.Priority,
+		req.IsActive, id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo actualizar la promoción"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Promoción no encontrada"})
+	}
+	return c.JSON(fiber.Map{"message": "Promoción actualizada"})
+}
+
+// Eliminar promoción (solo admin). Los pedidos conservan su atribución por nombre.
+func DeletePromotion(c *fiber.Ctx) error {
+	id := c.Params("id")
+	res, err := db.DB.Exec(context.Background(), "DELETE FROM promotions WHERE id=$1", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "No se pudo eliminar la promoción"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Promoción no encontrada"})
+	}
+	return c.JSON(fiber.Map{"message": "Promoción eliminada"})
+}
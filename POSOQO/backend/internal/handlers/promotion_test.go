@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEvaluatePromotions valida multibuy, precio de bundle, happy hour y que cada unidad reciba una sola promoción
+func TestEvaluatePromotions(t *testing.T) {
+	lima := time.FixedZone("PET", -5*60*60)
+	friday19 := time.Date(2025, 6, 13, 19, 0, 0, 0, lima)
+	monday12 := time.Date(2025, 6, 16, 12, 0, 0, 0, lima)
+
+	ipas := []pricedLine{
+		{ProductID: "ipa-1", CategoryIDs: []string{"ipa"}, Quantity: 2, UnitPrice: 15},
+		{ProductID: "ipa-2", CategoryIDs: []string{"ipa"}, Quantity: 1, UnitPrice: 12},
+		{ProductID: "lager", CategoryIDs: []string{"lager"}, Quantity: 6, UnitPrice: 10},
+	}
+	threeForTwo := promotionRule{ID: "3x2", Name: "3x2 IPAs", Type: promoMultibuy, BuyQuantity: 3, PayQuantity: 2, CategoryIDs: []string{"ipa"}}
+	sixPack := promotionRule{ID: "six", Name: "Six-pack", Type: promoBundlePrice, BundleQuantity: 6, BundlePrice: 48, CategoryIDs: []string{"lager"}}
+	happyHour := promotionRule{ID: "hh", Name: "Happy hour", Type: promoPercent, Percent: 20, DaysOfWeek: []int{5}, StartTime: "18:00", EndTime: "21:00"}
+
+	t.Run("3x2 regala la unidad más barata", func(t *testing.T) {
+		result := evaluatePromotions([]promotionRule{threeForTwo}, ipas, monday12)
+		assert.Equal(t, 12.0, result.Total)
+		assert.Equal(t, []float64{0, 12, 0}, result.LineDiscounts)
+	})
+
+	t.Run("Precio de bundle", func(t *testing.T) {
+		result := evaluatePromotions([]promotionRule{sixPack}, ipas, monday12)
+		assert.Equal(t, 12.0, result.Total)
+		assert.Equal(t, []float64{0, 0, 12}, result.LineDiscounts)
+	})
+
+	t.Run("Happy hour fuera de horario", func(t *testing.T) {
+		result := evaluatePromotions([]promotionRule{happyHour}, ipas, monday12)
+		assert.Equal(t, 0.0, result.Total)
+		assert.Empty(t, result.Applied)
+	})
+
+	t.Run("Unidades ya promocionadas no acumulan happy hour", func(t *testing.T) {
+		lowPriority := happyHour
+		lowPriority.Priority = -1
+		result := evaluatePromotions([]promotionRule{lowPriority, threeForTwo, sixPack}, ipas, friday19)
+		// 3x2 y six-pack consumen todas las unidades; happy hour no aplica a ninguna
+		assert.Equal(t, 24.0, result.Total)
+		assert.Len(t, result.Applied, 2)
+	})
+
+	t.Run("Happy hour en horario", func(t *testing.T) {
+		result := evaluatePromotions([]promotionRule{happyHour}, ipas, friday19)
+		assert.Equal(t, 20.4, result.Total)
+	})
+}
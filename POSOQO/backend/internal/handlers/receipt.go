@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/jung-kurt/gofpdf/contrib/barcode"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+var paymentMethodLabels = map[string]string{
+	paymentMethodStripe:        "Tarjeta (Stripe)",
+	paymentMethodContraEntrega: "Contra entrega",
+	paymentMethodGiftCard:      "Gift card",
+}
+
+// receiptLine es una fila de los totales del recibo
+type receiptLine struct {
+	Label string
+	Value float64
+	Bold  bool
+}
+
+// receiptTotalLines arma los totales del recibo. Los puntos canjeados se muestran aparte
+// de los demás descuentos y, si parte del total se pagó con gift card, se detalla cuánto
+// se pagó con ella y cuánto con el otro medio de pago.
+func receiptTotalLines(totals OrderTotals, tax utils.TaxBreakdown) []receiptLine {
+	lines := []receiptLine{
+		{Label: "Subtotal", Value: totals.Subtotal},
+		{Label: "Descuentos", Value: -roundMoney(totals.Discount - totals.Loyalty)},
+	}
+	if totals.Loyalty > 0 {
+		lines = append(lines, receiptLine{Label: "Canje de puntos", Value: -totals.Loyalty})
+	}
+	lines = append(lines,
+		receiptLine{Label: "Envío", Value: totals.Shipping},
+		receiptLine{Label: "Garantía envases", Value: totals.Deposit},
+		receiptLine{Label: "Op. Gravadas", Value: tax.Gravado},
+		receiptLine{Label: "Op. Exoneradas", Value: tax.Exonerado},
+		receiptLine{Label: "Op. Inafectas", Value: tax.Inafecto},
+		receiptLine{Label: "IGV (18%)", Value: tax.IGV},
+		receiptLine{Label: "Total", Value: totals.Total, Bold: true},
+	)
+	if totals.GiftCard > 0 {
+		lines = append(lines,
+			receiptLine{Label: "Pagado con gift card", Value: totals.GiftCard},
+			receiptLine{Label: "Saldo cobrado", Value: totals.AmountDue()},
+		)
+	}
+	return lines
+}
+
+// paymentMethodLabel describe el medio de pago, incluida la gift card si cubrió parte del total
+func paymentMethodLabel(method string, giftCard float64) string {
+	label := paymentMethodLabels[method]
+	if label == "" {
+		label = method
+	}
+	if giftCard > 0 && method != paymentMethodGiftCard {
+		label += " + " + paymentMethodLabels[paymentMethodGiftCard]
+	}
+	return label
+}
+
+// orderVerificationCode firma el ID del pedido para que el enlace público no sea adivinable
+func orderVerificationCode(orderID string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_ACCESS_SECRET")))
+	mac.Write([]byte("order-verify:" + orderID))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// frontendBaseURL es la URL pública del frontend para los enlaces que se envían al cliente
+func frontendBaseURL() string {
+	if base := os.Getenv("FRONTEND_URL"); base != "" {
+		return base
+	}
+	return os.Getenv("BASE_URL")
+}
+
+// orderVerificationURL es la página pública del frontend que valida un comprobante;
+// la página consulta GET /api/orders/:id/verify con el mismo código
+func orderVerificationURL(orderID string) string {
+	return fmt.Sprintf("%s/pedidos/verificar/%s?code=%s", frontendBaseURL(), url.PathEscape(orderID), orderVerificationCode(orderID))
+}
+
+// Descargar el recibo en PDF de un pedido (dueño del pedido o admin)
+func GetOrderReceiptPDF(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	role := claims["role"].(string)
+	ctx := context.Background()
+
+	// Verificar que el pedido exista y pertenezca al usuario, o que sea admin
+	var dbUserID int64
+	var status, paymentMethod, fulfillmentType, location, customerName string
+	var totals OrderTotals
+	var tax utils.TaxBreakdown
+	var createdAt time.Time
+	var paidAt, scheduledFor *time.Time
+	err := db.DB.QueryRow(ctx,
+		`SELECT COALESCE(o.user_id, 0), o.status, o.payment_method, o.fulfillment_type, COALESCE(o.location, ''),
+		        COALESCE(NULLIF(o.billing_name, ''), u.name, o.guest_name, ''), o.created_at, o.paid_at, o.scheduled_for,
+		        o.subtotal, o.discount_total, o.shipping_fee, o.deposit_total, o.total,
+		        o.taxable_amount, o.exempt_amount, o.unaffected_amount, o.igv_amount,
+		        o.gift_card_amount, o.loyalty_discount
+		 FROM orders o LEFT JOIN users u ON u.id = o.user_id
+		 WHERE o.id=$1`, orderID).
+		Scan(&dbUserID, &status, &paymentMethod, &fulfillmentType, &location,
+			&customerName, &createdAt, &paidAt, &scheduledFor,
+			&totals.Subtotal, &totals.Discount, &totals.Shipping, &totals.Deposit, &totals.Total,
+			&tax.Gravado, &tax.Exonerado, &tax.Inafecto, &tax.IGV,
+			&totals.GiftCard, &totals.Loyalty)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+	if role != "admin" && dbUserID != userID {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{"error": "No autorizado"})
+	}
+
+	rows, err := db.DB.Query(ctx,
+		`SELECT `+itemNameSQL+`, oi.quantity, oi.unit_price, oi.discount_amount,
+		        COALESCE(oi.net_amount, oi.quantity * oi.unit_price - oi.discount_amount)
+		 FROM order_items oi
+		 JOIN products p ON oi.product_id = p.id
+		 LEFT JOIN product_variants v ON v.id = oi.variant_id
+		 WHERE oi.order_id = $1
+		 ORDER BY p.name, v.size_ml`, orderID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener items"})
+	}
+	defer rows.Close()
+
+	loc := businessLocation()
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+	pdf.SetFont("Arial", "B", 16)
+	pdf.Cell(40, 10, "POSOQO")
+	pdf.Ln(8)
+	pdf.SetFont("Arial", "", 10)
+	pdf.Cell(40, 6, "Recibo de pedido")
+	pdf.Ln(10)
+
+	// Datos del pedido
+	method := paymentMethodLabel(paymentMethod, totals.GiftCard)
+	if paidAt != nil {
+		method += " - pagado el " + paidAt.In(loc).Format("02/01/2006 15:04")
+	} else {
+		method += " - pendiente de pago"
+	}
+	fulfillment := "Delivery"
+	if fulfillmentType == fulfillmentPickup {
+		fulfillment = "Recojo en tienda"
+	}
+	if scheduledFor != nil {
+		fulfillment += " - " + scheduledFor.In(loc).Format("02/01/2006 15:04")
+	}
+	details := [][2]string{
+		{"Pedido", orderID},
+		{"Fecha", createdAt.In(loc).Format("02/01/2006 15:04")},
+		{"Cliente", customerName},
+		{"Estado", status},
+		{"Método de pago", method},
+		{"Entrega", fulfillment},
+	}
+	if fulfillmentType != fulfillmentPickup && location != "" {
+		details = append(details, [2]string{"Dirección", location})
+	}
+	var invoiceSeries string
+	var invoiceNumber int64
+	if err := db.DB.QueryRow(ctx,
+		`SELECT series, number FROM invoices WHERE order_id=$1 AND status <> 'rejected' ORDER BY id DESC LIMIT 1`,
+		orderID).Scan(&invoiceSeries, &invoiceNumber); err == nil {
+		details = append(details, [2]string{"Comprobante", fmt.Sprintf("%s-%d", invoiceSeries, invoiceNumber)})
+	}
+	for _, d := range details {
+		pdf.SetFont("Arial", "B", 9)
+		pdf.CellFormat(35, 6, tr(d[0]+":"), "", 0, "L", false, 0, "")
+		pdf.SetFont("Arial", "", 9)
+		pdf.CellFormat(155, 6, tr(d[1]), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	// Detalle
+	headers := []string{"Producto", "Cant.", "P. Unit.", "Descuento", "Importe"}
+	widths := []float64{90, 20, 25, 25, 30}
+	pdf.SetFont("Arial", "B", 9)
+	for i, h := range headers {
+		pdf.CellFormat(widths[i], 7, h, "1", 0, "C", false, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont("Arial", "", 9)
+	for rows.Next() {
+		var name string
+		var quantity int
+		var unitPrice, discount, net float64
+		if err := rows.Scan(&name, &quantity, &unitPrice, &discount, &net); err != nil {
+			continue
+		}
+		pdf.CellFormat(widths[0], 7, tr(name), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 7, fmt.Sprintf("%d", quantity), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(widths[2], 7, fmt.Sprintf("%.2f", unitPrice), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, fmt.Sprintf("%.2f", discount), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 7, fmt.Sprintf("%.2f", net), "1", 0, "R", false, 0, "")
+		pdf.Ln(-1)
+	}
+
+	// Totales
+	pdf.Ln(2)
+	totalsTop := pdf.GetY()
+	for _, l := range receiptTotalLines(totals, tax) {
+		if l.Bold {
+			pdf.SetFont("Arial", "B", 10)
+		} else {
+			pdf.SetFont("Arial", "", 9)
+		}
+		pdf.CellFormat(130, 6, "", "", 0, "", false, 0, "")
+		pdf.CellFormat(30, 6, tr(l.Label), "", 0, "L", false, 0, "")
+		pdf.CellFormat(30, 6, fmt.Sprintf("S/ %.2f", l.Value), "", 1, "R", false, 0, "")
+	}
+
+	// QR con el enlace público de verificación
+	verifyURL := orderVerificationURL(orderID)
+	key := barcode.RegisterQR(pdf, verifyURL, qr.M, qr.Unicode)
+	barcode.Barcode(pdf, key, 12, totalsTop+2, 35, 35, false)
+	pdf.SetXY(50, totalsTop+10)
+	pdf.SetFont("Arial", "", 8)
+	pdf.MultiCell(75, 4, tr("Escanea el código para verificar este pedido"), "", "L", false)
+	if err := pdf.Error(); err != nil {
+		return c.Status(500).SendString("Error generando PDF")
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return c.Status(500).SendString("Error generando PDF")
+	}
+	c.Set("Content-Type", "application/pdf")
+	c.Set("Content-Disposition", fmt.Sprintf("attachment;filename=recibo-%s.pdf", orderID))
+	return c.SendStream(&buf)
+}
+
+// Verificar públicamente un pedido con el código del recibo. No expone datos personales.
+func VerifyOrder(c *fiber.Ctx) error {
+	orderID := c.Params("id")
+	code := c.Query("code")
+	if !hmac.Equal([]byte(code), []byte(orderVerificationCode(orderID))) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+
+	var status, paymentMethod string
+	var total float64
+	var paid bool
+	var items int
+	var createdAt time.Time
+	err := db.DB.QueryRow(context.Background(),
+		`SELECT o.status, o.payment_method, o.total, o.paid_at IS NOT NULL, o.created_at,
+		        (SELECT COALESCE(SUM(quantity), 0) FROM order_items WHERE order_id = o.id)
+		 FROM orders o WHERE o.id=$1`, orderID).
+		Scan(&status, &paymentMethod, &total, &paid, &createdAt, &items)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Pedido no encontrado"})
+	}
+	return c.JSON(fiber.Map{
+		"valid":          true,
+		"id":             orderID,
+		"status":         status,
+		"payment_method": paymentMethod,
+		"paid":           paid,
+		"total":          total,
+		"items":          items,
+		"created_at":     createdAt,
+	})
+}
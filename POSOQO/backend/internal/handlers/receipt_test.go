@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/posoqo/backend/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOrderVerificationCode valida la firma del enlace público del recibo
+func TestOrderVerificationCode(t *testing.T) {
+	t.Setenv("JWT_ACCESS_SECRET", "secreto-a")
+	code := orderVerificationCode("pedido-1")
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{16}$`), code)
+	assert.Equal(t, code, orderVerificationCode("pedido-1"))
+	assert.NotEqual(t, code, orderVerificationCode("pedido-2"))
+
+	// Cambiar el secreto invalida los códigos emitidos
+	t.Setenv("JWT_ACCESS_SECRET", "secreto-b")
+	assert.NotEqual(t, code, orderVerificationCode("pedido-1"))
+}
+
+// TestVerifyOrderRejectsInvalidCode valida que un código incorrecto no revele si el pedido existe
+func TestVerifyOrderRejectsInvalidCode(t *testing.T) {
+	t.Setenv("JWT_ACCESS_SECRET", "secreto-a")
+	app := fiber.New()
+	app.Get("/orders/:id/verify", VerifyOrder)
+
+	for _, code := range []string{"", "0000000000000000", orderVerificationCode("otro-pedido")} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/orders/pedido-1/verify?code="+code, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// TestReceiptTotalLines valida el desglose de totales con gift card y canje de puntos
+func TestReceiptTotalLines(t *testing.T) {
+	values := func(lines []receiptLine) map[string]float64 {
+		m := map[string]float64{}
+		for _, l := range lines {
+			m[l.Label] = l.Value
+		}
+		return m
+	}
+
+	totals := OrderTotals{Subtotal: 100, Discount: 15, Shipping: 5, Total: 90, GiftCard: 40, Loyalty: 5}
+	lines := receiptTotalLines(totals, utils.TaxBreakdown{})
+	got := values(lines)
+	assert.Equal(t, -10.0, got["Descuentos"])
+	assert.Equal(t, -5.0, got["Canje de puntos"])
+	assert.Equal(t, 90.0, got["Total"])
+	assert.Equal(t, 40.0, got["Pagado con gift card"])
+	assert.Equal(t, 50.0, got["Saldo cobrado"])
+
+	// Sin gift card ni puntos no aparecen esas filas
+	got = values(receiptTotalLines(OrderTotals{Subtotal: 50, Total: 50}, utils.TaxBreakdown{}))
+	assert.NotContains(t, got, "Canje de puntos")
+	assert.NotContains(t, got, "Pagado con gift card")
+}
+
+// TestPaymentMethodLabel valida el medio de pago impreso en el recibo
+func TestPaymentMethodLabel(t *testing.T) {
+	assert.Equal(t, "Tarjeta (Stripe)", paymentMethodLabel(paymentMethodStripe, 0))
+	assert.Equal(t, "Tarjeta (Stripe) + Gift card", paymentMethodLabel(paymentMethodStripe, 40))
+	assert.Equal(t, "Gift card", paymentMethodLabel(paymentMethodGiftCard, 90))
+	assert.Equal(t, "yape", paymentMethodLabel("yape", 0))
+}
@@ -17,7 +17,9 @@ import (
 // Exportar ventas a CSV
 func ExportSalesCSV(c *fiber.Ctx) error {
 	rows, err := db.DB.Query(context.Background(),
-		`SELECT o.id, u.name, u.email, o.total, o.status, o.created_at FROM orders o JOIN users u ON o.user_id = u.id ORDER BY o.created_at DESC`)
+		`SELECT o.id, COALESCE(u.name, o.guest_name, ''), COALESCE(u.email, o.guest_email, ''),
+		        o.taxable_amount, o.exempt_amount + o.unaffected_amount, o.igv_amount, o.total, o.status, o.created_at
+		 FROM orders o LEFT JOIN users u ON o.user_id = u.id ORDER BY o.created_at DESC`)
 	if err != nil {
 		return c.Status(500).SendString("Error al obtener ventas")
 	}
@@ -28,15 +30,17 @@ func ExportSalesCSV(c *fiber.Ctx) error {
 	writer := csv.NewWriter(c)
 	defer writer.Flush()
 
-	writer.Write([]string{"ID Pedido", "Cliente", "Email", "Total", "Estado", "Fecha"})
+	writer.Write([]string{"ID Pedido", "Cliente", "Email", "Op. Gravadas", "Op. Exoneradas/Inafectas", "IGV", "Total", "Estado", "Fecha"})
 	for rows.Next() {
 		var id, name, email, status string
-		var total float64
+		var taxable, exempt, igv, total float64
 		var createdAt time.Time
-		if err := rows.Scan(&id, &name, &email, &total, &status, &createdAt); err != nil {
+		if err := rows.Scan(&id, &name, &email, &taxable, &exempt, &igv, &total, &status, &createdAt); err != nil {
 			continue
 		}
-		writer.Write([]string{id, name, email, fmt.Sprintf("%.2f", total), status, createdAt.Format("2006-01-02 15:04:05")})
+		writer.Write([]string{id, name, email,
+			fmt.Sprintf("%.2f", taxable), fmt.Sprintf("%.2f", exempt), fmt.Sprintf("%.2f", igv), fmt.Sprintf("%.2f", total),
+			status, createdAt.Format("2006-01-02 15:04:05")})
 	}
 	return nil
 }
@@ -71,39 +75,62 @@ func ExportUsersCSV(c *fiber.Ctx) error {
 // Exportar ventas a PDF
 func ExportSalesPDF(c *fiber.Ctx) error {
 	rows, err := db.DB.Query(context.Background(),
-		`SELECT o.id, u.name, u.email, o.total, o.status, o.created_at FROM orders o JOIN users u ON o.user_id = u.id ORDER BY o.created_at DESC`)
+		`SELECT o.id, COALESCE(u.name, o.guest_name, ''), COALESCE(u.email, o.guest_email, ''),
+		        o.taxable_amount, o.exempt_amount + o.unaffected_amount, o.igv_amount, o.total, o.status, o.created_at
+		 FROM orders o LEFT JOIN users u ON o.user_id = u.id ORDER BY o.created_at DESC`)
 	if err != nil {
 		return c.Status(500).SendString("Error al obtener ventas")
 	}
 	defer rows.Close()
 
-	pdf := gofpdf.New("P", "mm", "A4", "")
+	// Horizontal para que entren las columnas del desglose de IGV
+	pdf := gofpdf.New("L", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
 	pdf.AddPage()
 	pdf.SetFont("Arial", "B", 16)
 	pdf.Cell(40, 10, "Reporte de Ventas")
 	pdf.Ln(12)
-	pdf.SetFont("Arial", "B", 10)
-	headers := []string{"ID Pedido", "Cliente", "Email", "Total", "Estado", "Fecha"}
-	for _, h := range headers {
-		pdf.CellFormat(32, 7, h, "1", 0, "C", false, 0, "")
+	pdf.SetFont("Arial", "B", 9)
+	headers := []string{"ID Pedido", "Cliente", "Email", "Op. Gravadas", "Exon./Inaf.", "IGV", "Total", "Estado", "Fecha"}
+	widths := []float64{50, 32, 50, 26, 24, 22, 24, 24, 24}
+	for i, h := range headers {
+		pdf.CellFormat(widths[i], 7, h, "1", 0, "C", false, 0, "")
 	}
 	pdf.Ln(-1)
-	pdf.SetFont("Arial", "", 10)
+	pdf.SetFont("Arial", "", 8)
+	var sumTaxable, sumExempt, sumIGV, sumTotal float64
 	for rows.Next() {
 		var id, name, email, status string
-		var total float64
+		var taxable, exempt, igv, total float64
 		var createdAt time.Time
-		if err := rows.Scan(&id, &name, &email, &total, &status, &createdAt); err != nil {
+		if err := rows.Scan(&id, &name, &email, &taxable, &exempt, &igv, &total, &status, &createdAt); err != nil {
 			continue
 		}
-		pdf.CellFormat(32, 7, id, "1", 0, "C", false, 0, "")
-		pdf.CellFormat(32, 7, name, "1", 0, "C", false, 0, "")
-		pdf.CellFormat(32, 7, email, "1", 0, "C", false, 0, "")
-		pdf.CellFormat(32, 7, fmt.Sprintf("%.2f", total), "1", 0, "C", false, 0, "")
-		pdf.CellFormat(32, 7, status, "1", 0, "C", false, 0, "")
-		pdf.CellFormat(32, 7, createdAt.Format("2006-01-02"), "1", 0, "C", false, 0, "")
+		// Los pedidos cancelados no suman a las ventas
+		if status != "cancelado" {
+			sumTaxable += taxable
+			sumExempt += exempt
+			sumIGV += igv
+			sumTotal += total
+		}
+		pdf.CellFormat(widths[0], 7, id, "1", 0, "C", false, 0, "")
+		pdf.CellFormat(widths[1], 7, tr(name), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(widths[2], 7, email, "1", 0, "C", false, 0, "")
+		pdf.CellFormat(widths[3], 7, fmt.Sprintf("%.2f", taxable), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 7, fmt.Sprintf("%.2f", exempt), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[5], 7, fmt.Sprintf("%.2f", igv), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[6], 7, fmt.Sprintf("%.2f", total), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[7], 7, status, "1", 0, "C", false, 0, "")
+		pdf.CellFormat(widths[8], 7, createdAt.Format("2006-01-02"), "1", 0, "C", false, 0, "")
 		pdf.Ln(-1)
 	}
+	pdf.SetFont("Arial", "B", 8)
+	pdf.CellFormat(widths[0]+widths[1]+widths[2], 7, "Totales (sin cancelados)", "1", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[3], 7, fmt.Sprintf("%.2f", sumTaxable), "1", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[4], 7, fmt.Sprintf("%.2f", sumExempt), "1", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[5], 7, fmt.Sprintf("%.2f", sumIGV), "1", 0, "R", false, 0, "")
+	pdf.CellFormat(widths[6], 7, fmt.Sprintf("%.2f", sumTotal), "1", 0, "R", false, 0, "")
+	pdf.Ln(-1)
 	var buf bytes.Buffer
 	if err := pdf.Output(&buf); err != nil {
 		return c.Status(500).SendString("Error generando PDF")
@@ -66,11 +66,15 @@ func UpsertReview(c *fiber.Ctx) error {
 		safeComment = ""
 	}
 
+	// La reseña se asocia al formato del último pedido entregado con el producto
 	_, err = db.DB.Exec(context.Background(),
-		`INSERT INTO reviews (user_id, product_id, rating, comment)
-		 VALUES ($1, $2, $3, $4)
+		`INSERT INTO reviews (user_id, product_id, rating, comment, variant_id)
+		 VALUES ($1, $2, $3, $4,
+		         (SELECT oi.variant_id FROM order_items oi JOIN orders o ON oi.order_id = o.id
+		          WHERE o.user_id = $1 AND oi.product_id = $2 AND o.status = 'entregado'
+		          ORDER BY o.created_at DESC LIMIT 1))
 		 ON CONFLICT (user_id, product_id)
-		 DO UPDATE SET rating = EXCLUDED.rating, comment = EXCLUDED.comment, created_at = CURRENT_TIMESTAMP`,
+		 DO UPDATE SET rating = EXCLUDED.rating, comment = EXCLUDED.comment, variant_id = EXCLUDED.variant_id, created_at = CURRENT_TIMESTAMP`,
 		userID, productID, req.Rating, safeComment)
 	
 	if err != nil {
@@ -104,12 +108,12 @@ func ListProductReviews(c *fiber.Ctx) error {
 	}
 	
 	offset := (page - 1) * limit
-	listQuery := `SELECT r.rating, COALESCE(r.comment, '') as comment, r.created_at::text, u.name FROM reviews r JOIN users u ON r.user_id = u.id WHERE r.product_id = $1::uuid ORDER BY r.created_at DESC LIMIT $2 OFFSET $3`
+	listQuery := `SELECT r.rating, COALESCE(r.comment, '') as comment, r.created_at::text, u.name, COALESCE(r.variant_id::text, ''), COALESCE(` + variantLabelSQL + `, '') FROM reviews r JOIN users u ON r.user_id = u.id LEFT JOIN product_variants v ON v.id = r.variant_id WHERE r.product_id = $1::uuid ORDER BY r.created_at DESC LIMIT $2 OFFSET $3`
 	rows, err := db.DB.Query(context.Background(), listQuery, productID, limit, offset)
 	if err != nil {
 		// Intentar con texto si falla con UUID
 		productIDTrimmed := strings.TrimSpace(productID)
-		listQuerySimple := `SELECT r.rating, COALESCE(r.comment, '') as comment, r.created_at::text, u.name FROM reviews r JOIN users u ON r.user_id = u.id WHERE r.product_id::text = $1 ORDER BY r.created_at DESC LIMIT $2 OFFSET $3`
+		listQuerySimple := `SELECT r.rating, COALESCE(r.comment, '') as comment, r.created_at::text, u.name, COALESCE(r.variant_id::text, ''), COALESCE(` + variantLabelSQL + `, '') FROM reviews r JOIN users u ON r.user_id = u.id LEFT JOIN product_variants v ON v.id = r.variant_id WHERE r.product_id::text = $1 ORDER BY r.created_at DESC LIMIT $2 OFFSET $3`
 		rows, err = db.DB.Query(context.Background(), listQuerySimple, productIDTrimmed, limit, offset)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Error al obtener reseñas"})
@@ -120,8 +124,8 @@ func ListProductReviews(c *fiber.Ctx) error {
 	reviews := []fiber.Map{}
 	for rows.Next() {
 		var rating int
-		var comment, createdAt, userName string
-		if err := rows.Scan(&rating, &comment, &createdAt, &userName); err != nil {
+		var comment, createdAt, userName, variantID, variant string
+		if err := rows.Scan(&rating, &comment, &createdAt, &userName, &variantID, &variant); err != nil {
 			continue
 		}
 		reviews = append(reviews, fiber.Map{
@@ -129,6 +133,8 @@ func ListProductReviews(c *fiber.Ctx) error {
 			"comment":    comment,
 			"created_at": createdAt,
 			"user_name":  userName,
+			"variant_id": variantID,
+			"variant":    variant,
 		})
 	}
 	
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// RUCData es la respuesta normalizada de una consulta de RUC
+type RUCData struct {
+	RUC          string `json:"ruc"`
+	RazonSocial  string `json:"razon_social"`
+	Direccion    string `json:"direccion"`
+	Estado       string `json:"estado"`    // ACTIVO, BAJA DE OFICIO, ...
+	Condicion    string `json:"condicion"` // HABIDO, NO HABIDO, ...
+	Departamento string `json:"departamento"`
+	Provincia    string `json:"provincia"`
+	Distrito     string `json:"distrito"`
+	Ubigeo       string `json:"ubigeo"`
+}
+
+// RUCProvider consulta contribuyentes del padrón de SUNAT
+type RUCProvider interface {
+	LookupRUC(ctx context.Context, ruc string) (*RUCData, error)
+}
+
+// Errores de consulta de RUC
+var (
+	ErrRUCNotFound        = errors.New("RUC no encontrado")
+	ErrLookupRateLimited  = errors.New("límite de consultas excedido")
+	ErrLookupUnauthorized = errors.New("token de API inválido")
+)
+
+// rucProvider es el proveedor en uso; las pruebas lo reemplazan por uno falso
+var rucProvider RUCProvider = &apiPeruRUCProvider{
+	baseURL: "https://apiperu.dev/api",
+	client:  &http.Client{Timeout: 10 * time.Second},
+}
+
+// apiPeruRUCProvider consulta RUCs en APIperu.dev, el mismo proveedor del DNI
+type apiPeruRUCProvider struct {
+	baseURL string
+	client  *http.Client
+}
+
+// apiPeruRUCResponse es la respuesta de APIperu.dev para /ruc/{ruc}
+type apiPeruRUCResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Data    struct {
+		RUC               string `json:"ruc"`
+		RazonSocial       string `json:"nombre_o_razon_social"`
+		Direccion         string `json:"direccion"`
+		DireccionCompleta string `json:"direccion_completa"`
+		Estado            string `json:"estado"`
+		Condicion         string `json:"condicion"`
+		Departamento      string `json:"departamento"`
+		Provincia         string `json:"provincia"`
+		Distrito          string `json:"distrito"`
+		UbigeoSunat       string `json:"ubigeo_sunat"`
+	} `json:"data"`
+}
+
+// LookupRUC consulta un RUC en APIperu.dev
+func (p *apiPeruRUCProvider) LookupRUC(ctx context.Context, ruc string) (*RUCData, error) {
+	apiToken := os.Getenv("APIPERU_TOKEN")
+	if apiToken == "" {
+		// Si no hay token, usar token de prueba (limitado)
+		apiToken = "demo"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/ruc/%s", p.baseURL, ruc), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrRUCNotFound
+	case http.StatusTooManyRequests:
+		return nil, ErrLookupRateLimited
+	case http.StatusUnauthorized:
+		return nil, ErrLookupUnauthorized
+	default:
+		return nil, fmt.Errorf("APIperu respondió HTTP %d", resp.StatusCode)
+	}
+
+	var body apiPeruRUCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("respuesta inválida de APIperu: %w", err)
+	}
+	if !body.Success || body.Data.RazonSocial == "" {
+		return nil, ErrRUCNotFound
+	}
+
+	direccion := body.Data.DireccionCompleta
+	if direccion == "" {
+		direccion = body.Data.Direccion
+	}
+	data := &RUCData{
+		RUC:          body.Data.RUC,
+		RazonSocial:  body.Data.RazonSocial,
+		Direccion:    strings.TrimSpace(direccion),
+		Estado:       body.Data.Estado,
+		Condicion:    body.Data.Condicion,
+		Departamento: body.Data.Departamento,
+		Provincia:    body.Data.Provincia,
+		Distrito:     body.Data.Distrito,
+		Ubigeo:       body.Data.UbigeoSunat,
+	}
+	if data.RUC == "" {
+		data.RUC = ruc
+	}
+	return data, nil
+}
+
+// respondLookupError traduce los errores del proveedor a la respuesta HTTP
+func respondLookupError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrRUCNotFound):
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "RUC no encontrado en los registros"})
+	case errors.Is(err, ErrLookupRateLimited):
+		return c.Status(http.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Límite de consultas excedido. Por favor intenta más tarde.",
+		})
+	case errors.Is(err, ErrLookupUnauthorized):
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Token de API inválido. Por favor contacta al administrador.",
+		})
+	}
+	log.Printf("[RUC] Error consultando RUC: %v", err)
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Error al consultar la API de RUC. Por favor intenta más tarde.",
+	})
+}
+
+// ConsultarRUC consulta la razón social y dirección fiscal de un RUC
+// @Summary Consultar datos de RUC
+// @Description Consulta los datos de un contribuyente en SUNAT desde APIperu.dev
+// @Tags dni
+// @Produce json
+// @Param ruc path string true "Número de RUC (11 dígitos)"
+// @Success 200 {object} RUCData
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /api/ruc/{ruc} [get]
+func ConsultarRUC(c *fiber.Ctx) error {
+	ruc := c.Params("ruc")
+	if !utils.IsValidRUC(ruc) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "El RUC debe tener 11 dígitos y un dígito verificador válido",
+		})
+	}
+
+	data, err := rucProvider.LookupRUC(context.Background(), ruc)
+	if err != nil {
+		return respondLookupError(c, err)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"data":    data,
+	})
+}
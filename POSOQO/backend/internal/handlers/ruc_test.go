@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRUCProvider responde con un padrón fijo en lugar de consultar APIperu
+type fakeRUCProvider map[string]RUCData
+
+func (f fakeRUCProvider) LookupRUC(ctx context.Context, ruc string) (*RUCData, error) {
+	if ruc == "20100070970" {
+		return nil, ErrLookupRateLimited
+	}
+	data, ok := f[ruc]
+	if !ok {
+		return nil, ErrRUCNotFound
+	}
+	return &data, nil
+}
+
+func withFakeRUCProvider(t *testing.T, fake fakeRUCProvider) {
+	original := rucProvider
+	rucProvider = fake
+	t.Cleanup(func() { rucProvider = original })
+}
+
+// TestConsultarRUC valida la consulta de RUC con un proveedor falso
+func TestConsultarRUC(t *testing.T) {
+	withFakeRUCProvider(t, fakeRUCProvider{
+		"20131312955": {RUC: "20131312955", RazonSocial: "SUPERINTENDENCIA NACIONAL DE ADUANAS Y DE ADMINISTRACION TRIBUTARIA", Estado: "ACTIVO"},
+	})
+	app := fiber.New()
+	app.Get("/ruc/:ruc", ConsultarRUC)
+
+	tests := []struct {
+		name           string
+		ruc            string
+		expectedStatus int
+	}{
+		{"RUC encontrado", "20131312955", http.StatusOK},
+		{"Dígito verificador inválido", "20131312956", http.StatusBadRequest},
+		{"Longitud inválida", "2013131295", http.StatusBadRequest},
+		{"RUC no registrado", "10467793549", http.StatusNotFound},
+		{"Límite del proveedor", "20100070970", http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ruc/"+tt.ruc, nil))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/ruc/20131312955", nil))
+	require.NoError(t, err)
+	var body struct {
+		Data RUCData `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "ACTIVO", body.Data.Estado)
+}
+
+// TestNormalizeBillingProfile valida que un perfil con RUC se complete desde SUNAT
+func TestNormalizeBillingProfile(t *testing.T) {
+	withFakeRUCProvider(t, fakeRUCProvider{
+		"20131312955": {RUC: "20131312955", RazonSocial: "SUNAT", Direccion: "AV. GARCILASO DE LA VEGA 1472, LIMA", Estado: "ACTIVO"},
+		"10467793549": {RUC: "10467793549", RazonSocial: "PEREZ JUAN", Estado: "BAJA DE OFICIO"},
+	})
+
+	req := BillingProfileRequest{DocType: "RUC", DocNumber: "20131312955"}
+	msg, err := normalizeBillingProfile(&req)
+	require.NoError(t, err)
+	assert.Empty(t, msg)
+	assert.Equal(t, "ruc", req.DocType)
+	assert.Equal(t, "SUNAT", req.Name)
+	assert.Equal(t, "AV. GARCILASO DE LA VEGA 1472, LIMA", req.Address)
+
+	req = BillingProfileRequest{DocType: "ruc", DocNumber: "10467793549"}
+	msg, err = normalizeBillingProfile(&req)
+	require.NoError(t, err)
+	assert.Contains(t, msg, "no está activo")
+
+	req = BillingProfileRequest{DocType: "dni", DocNumber: "1234567"}
+	msg, _ = normalizeBillingProfile(&req)
+	assert.NotEmpty(t, msg)
+
+	req = BillingProfileRequest{DocType: "dni", DocNumber: "12345678", Name: "Juan Pérez"}
+	msg, err = normalizeBillingProfile(&req)
+	require.NoError(t, err)
+	assert.Empty(t, msg)
+}
@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/posoqo/backend/internal/db"
+)
+
+// Tipos de entrega de un pedido
+const (
+	fulfillmentDelivery = "delivery"
+	fulfillmentPickup   = "pickup"
+)
+
+const (
+	// slotLeadTime es el tiempo mínimo de preparación antes de una franja
+	slotLeadTime = 30 * time.Minute
+	// slotBookingDays es cuántos días por adelantado se puede reservar
+	slotBookingDays = 7
+)
+
+// OpeningHoursRequest datos para crear o actualizar un rango de atención (solo admin)
+type OpeningHoursRequest struct {
+	DayOfWeek       int    `json:"day_of_week"`
+	FulfillmentType string `json:"fulfillment_type"`
+	OpensAt         string `json:"opens_at"`  // HH:MM
+	ClosesAt        string `json:"closes_at"` // HH:MM
+	SlotMinutes     int    `json:"slot_minutes"`
+	Capacity        int    `json:"capacity"`
+	IsActive        *bool  `json:"is_active"`
+}
+
+// openingHours es un rango de atención de un día para un tipo de entrega
+type openingHours struct {
+	ID              int    `json:"id"`
+	DayOfWeek       int    `json:"day_of_week"`
+	FulfillmentType string `json:"fulfillment_type"`
+	OpensAt         string `json:"opens_at"`
+	ClosesAt        string `json:"closes_at"`
+	SlotMinutes     int    `json:"slot_minutes"`
+	Capacity        int    `json:"capacity"`
+	IsActive        bool   `json:"is_active"`
+}
+
+// timeSlot es una franja reservable con su cupo
+type timeSlot struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Capacity  int       `json:"capacity"`
+	Booked    int       `json:"booked"`
+	Available bool      `json:"available"`
+}
+
+// SlotError indica que la franja elegida no se puede reservar
+type SlotError struct {
+	Code    string
+	Message string
+}
+
+func (e *SlotError) Error() string {
+	return e.Message
+}
+
+// isValidFulfillmentType indica si el tipo de entrega es conocido
+func isValidFulfillmentType(t string) bool {
+	return t == fulfillmentDelivery || t == fulfillmentPickup
+}
+
+// clockMinutes convierte una hora HH:MM en minutos desde la medianoche
+func clockMinutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// slotsForDay genera las franjas de un día (en la zona horaria de day) a partir de
+// los rangos de atención activos del tipo de entrega indicado
+func slotsForDay(hours []openingHours, fulfillmentType string, day time.Time) []timeSlot {
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	seen := map[int64]bool{}
+	slots := []timeSlot{}
+	for _, h := range hours {
+		if !h.IsActive || h.FulfillmentType != fulfillmentType || h.DayOfWeek != int(midnight.Weekday()) || h.SlotMinutes <= 0 {
+			continue
+		}
+		opens, errOpen := clockMinutes(h.OpensAt)
+		closes, errClose := clockMinutes(h.ClosesAt)
+		if errOpen != nil || errClose != nil {
+			continue
+		}
+		for m := opens; m+h.SlotMinutes <= closes; m += h.SlotMinutes {
+			start := midnight.Add(time.Duration(m) * time.Minute)
+			if seen[start.Unix()] {
+				continue
+			}
+			seen[start.Unix()] = true
+			slots = append(slots, timeSlot{
+				Start:    start,
+				End:      start.Add(time.Duration(h.SlotMinutes) * time.Minute),
+				Capacity: h.Capacity,
+			})
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Start.Before(slots[j].Start) })
+	return slots
+}
+
+// findSlot busca la franja que empieza exactamente en at
+func findSlot(hours []openingHours, fulfillmentType string, at time.Time) *timeSlot {
+	local := at.In(businessLocation())
+	for _, slot := range slotsForDay(hours, fulfillmentType, local) {
+		if slot.Start.Equal(at) {
+			return &slot
+		}
+	}
+	return nil
+}
+
+// loadOpeningHours obtiene los rangos de atención (solo activos si onlyActive)
+func loadOpeningHours(ctx context.Context, q dbQuerier, onlyActive bool) ([]openingHours, error) {
+	query := `SELECT id, day_of_week, fulfillment_type, to_char(opens_at, 'HH24:MI'), to_char(closes_at, 'HH24:MI'),
+	                 slot_minutes, capacity, is_active
+	          FROM opening_hours`
+	if onlyActive {
+		query += " WHERE is_active = TRUE"
+	}
+	query += " ORDER BY fulfillment_type, day_of_week, opens_at"
+
+	rows, err := q.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := []openingHours{}
+	for rows.Next() {
+		var h openingHours
+		if err := rows.Scan(&h.ID, &h.DayOfWeek, &h.FulfillmentType, &h.OpensAt, &h.ClosesAt, &h.SlotMinutes, &h.Capacity, &h.IsActive); err != nil {
+			return nil, err
+		}
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+// reserveSlot valida que la franja exista y tenga cupo. El advisory lock serializa
+// los checkouts que compiten por la misma franja hasta que la transacción termina.
+func reserveSlot(ctx context.Context, q dbQuerier, fulfillmentType string, at time.Time) error {
+	lockKey := fmt.Sprintf("slot:%s:%d", fulfillmentType, at.Unix())
+	if _, err := q.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", lockKey); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if at.Before(now.Add(slotLeadTime)) || at.After(now.AddDate(0, 0, slotBookingDays)) {
+		return &SlotError{Code: "SLOT_UNAVAILABLE", Message: "La franja elegida ya no está disponible"}
+	}
+
+	hours, err := loadOpeningHours(ctx, q, true)
+	if err != nil {
+		return err
+	}
+	slot := findSlot(hours, fulfillmentType, at)
+	if slot == nil {
+		return &SlotError{Code: "SLOT_UNAVAILABLE", Message: "La franja elegida no está en nuestro horario de atención"}
+	}
+
+	var booked int
+	err = q.QueryRow(ctx,
+		`SELECT COUNT(*) FROM orders
+		 WHERE fulfillment_type=$1 AND scheduled_for=$2 AND status <> 'cancelado'`,
+		fulfillmentType, at).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked >= slot.Capacity {
+		return &SlotError{Code: "SLOT_FULL", Message: "La franja elegida está llena, elige otro horario"}
+	}
+	return nil
+}
+
+// respondSlotError traduce un error de franja a la respuesta HTTP
+func respondSlotError(c *fiber.Ctx, err *SlotError) error {
+	status := http.StatusBadRequest
+	if err.Code == "SLOT_FULL" {
+		status = http.StatusConflict
+	}
+	return c.Status(status).JSON(fiber.Map{"error": err.Message, "code": err.Code})
+}
+
+// GET /api/slots?type=delivery&date=2006-01-02
+// Lista las franjas del día con su cupo disponible
+func ListSlots(c *fiber.Ctx) error {
+	fulfillmentType := c.Query("type", fulfillmentDelivery)
+	if !isValidFulfillmentType(fulfillmentType) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tipo de entrega inválido (delivery o pickup)"})
+	}
+
+	loc := businessLocation()
+	now := time.Now().In(loc)
+	day := now
+	if date := c.Query("date"); date != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", date, loc)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Fecha inválida (formato YYYY-MM-DD)"})
+		}
+		day = parsed
+	}
+
+	hours, err := loadOpeningHours(context.Background(), db.DB, true)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener horarios"})
+	}
+	slots := slotsForDay(hours, fulfillmentType, day)
+
+	if len(slots) > 0 {
+		rows, err := db.DB.Query(context.Background(),
+			`SELECT scheduled_for, COUNT(*) FROM orders
+			 WHERE fulfillment_type=$1 AND scheduled_for >= $2 AND scheduled_for < $3 AND status <> 'cancelado'
+			 GROUP BY scheduled_for`,
+			fulfillmentType, slots[0].Start, slots[len(slots)-1].End)
+		if err != nil {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener franjas"})
+		}
+		booked := map[int64]int{}
+		for rows.Next() {
+			var at time.Time
+			var count int
+			if err := rows.Scan(&at, &count); err == nil {
+				booked[at.Unix()] = count
+			}
+		}
+		rows.Close()
+
+		earliest := now.Add(slotLeadTime)
+		latest := now.AddDate(0, 0, slotBookingDays)
+		for i := range slots {
+			slots[i].Booked = booked[slots[i].Start.Unix()]
+			slots[i].Available = slots[i].Booked < slots[i].Capacity &&
+				!slots[i].Start.Before(earliest) && !slots[i].Start.After(latest)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"date":             day.Format("2006-01-02"),
+		"fulfillment_type": fulfillmentType,
+		"slots":            slots,
+	})
+}
+
+// validateOpeningHoursRequest valida un rango de atención
+func validateOpeningHoursRequest(req *OpeningHoursRequest) string {
+	if req.DayOfWeek < 0 || req.DayOfWeek > 6 {
+		return "Día inválido (0=domingo ... 6=sábado)"
+	}
+	if !isValidFulfillmentType(req.FulfillmentType) {
+		return "Tipo de entrega inválido (delivery o pickup)"
+	}
+	opens, errOpen := clockMinutes(req.OpensAt)
+	closes, errClose := clockMinutes(req.ClosesAt)
+	if errOpen != nil || errClose != nil {
+		return "Hora inválida (formato HH:MM)"
+	}
+	if closes <= opens {
+		return "La hora de cierre debe ser posterior a la de apertura"
+	}
+	if req.SlotMinutes == 0 {
+		req.SlotMinutes = 30
+	}
+	if req.SlotMinutes < 10 || req.SlotMinutes > 240 {
+		return "Duración de franja inválida (10-240 minutos)"
+	}
+	if req.Capacity <= 0 {
+		return "El cupo por franja debe ser mayor a 0"
+	}
+	return ""
+}
+
+// Listar horario de atención (solo admin)
+func ListOpeningHours(c *fiber.Ctx) error {
+	hours, err := loadOpeningHours(context.Background(), db.DB, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Error al obtener horarios"})
+	}
+	return c.JSON(fiber.Map{"opening_hours": hours})
+}
+
+// Crear rango de atención (solo admin)
+func CreateOpeningHours(c *fiber.Ctx) error {
+	var req OpeningHoursRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateOpeningHoursRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+	var id int
+	err := db.DB.QueryRow(context.Background(),
+		`INSERT INTO opening_hours (day_of_week, fulfillment_type, opens_at, closes_at, slot_minutes, capacity, is_active)
+		 VALUES ($1, $2, $3::time, $4::time, $5, $6, $7) RETURNING id`,
+		req.DayOfWeek, req.FulfillmentType, req.OpensAt, req.ClosesAt, req.SlotMinutes, req.Capacity, isActive).Scan(&id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo crear el horario"})
+	}
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"message": "Horario creado", "id": id})
+}
+
+// Actualizar rango de atención (solo admin)
+func UpdateOpeningHours(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var req OpeningHoursRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateOpeningHoursRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	res, err := db.DB.Exec(context.Background(),
+		`UPDATE opening_hours SET day_of_week=$1, fulfillment_type=$2, opens_at=$3::time, closes_at=$4::time,
+		        slot_minutes=$5, capacity=$6, is_active=COALESCE($7, is_active)
+		 WHERE id=$8`,
+		req.DayOfWeek, req.FulfillmentType, req.OpensAt, req.ClosesAt, req.SlotMinutes, req.Capacity, req.IsActive, id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo actualizar el horario"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Horario no encontrado"})
+	}
+	return c.JSON(fiber.Map{"message": "Horario actualizado"})
+}
+
+// Eliminar rango de atención (solo admin)
+func DeleteOpeningHours(c *fiber.Ctx) error {
+	id := c.Params("id")
+	res, err := db.DB.Exec(context.Background(), "DELETE FROM opening_hours WHERE id=$1", id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "No se pudo eliminar el horario"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Horario no encontrado"})
+	}
+	return c.JSON(fiber.Map{"message": "Horario eliminado"})
+}
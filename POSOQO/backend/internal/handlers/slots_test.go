@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSlotsForDay valida la generación de franjas a partir del horario de atención
+func TestSlotsForDay(t *testing.T) {
+	lima := time.FixedZone("PET", -5*60*60)
+	friday := time.Date(2025, 6, 13, 9, 30, 0, 0, lima)
+
+	hours := []openingHours{
+		{DayOfWeek: 5, FulfillmentType: fulfillmentDelivery, OpensAt: "18:00", ClosesAt: "19:45", SlotMinutes: 30, Capacity: 4, IsActive: true},
+		{DayOfWeek: 5, FulfillmentType: fulfillmentDelivery, OpensAt: "12:00", ClosesAt: "13:00", SlotMinutes: 60, Capacity: 2, IsActive: true},
+		{DayOfWeek: 5, FulfillmentType: fulfillmentPickup, OpensAt: "12:00", ClosesAt: "22:00", SlotMinutes: 30, Capacity: 9, IsActive: true},
+		{DayOfWeek: 6, FulfillmentType: fulfillmentDelivery, OpensAt: "12:00", ClosesAt: "22:00", SlotMinutes: 30, Capacity: 9, IsActive: true},
+		{DayOfWeek: 5, FulfillmentType: fulfillmentDelivery, OpensAt: "08:00", ClosesAt: "10:00", SlotMinutes: 30, Capacity: 9, IsActive: false},
+	}
+
+	slots := slotsForDay(hours, fulfillmentDelivery, friday)
+	starts := []string{}
+	for _, slot := range slots {
+		starts = append(starts, slot.Start.Format("15:04"))
+	}
+	// La última franja de la tarde no cabe completa antes del cierre (19:30-20:00 > 19:45)
+	assert.Equal(t, []string{"12:00", "18:00", "18:30", "19:00"}, starts)
+	assert.Equal(t, 2, slots[0].Capacity)
+	assert.Equal(t, time.Date(2025, 6, 13, 13, 0, 0, 0, lima), slots[0].End)
+	assert.Equal(t, 4, slots[1].Capacity)
+
+	assert.Len(t, slotsForDay(hours, fulfillmentPickup, friday), 20)
+	assert.Empty(t, slotsForDay(hours, fulfillmentPickup, friday.AddDate(0, 0, 1)))
+}
+
+// slotOrdersTx guarda el estado de un pedido con franja reservada para que el conteo de
+// cupo refleje las cancelaciones hechas en la misma transacción
+type slotOrdersTx struct {
+	*scriptedTx
+	status string
+}
+
+func (tx *slotOrdersTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	if strings.Contains(sql, "SELECT COUNT(*) FROM orders") {
+		booked := 1
+		if tx.status == "cancelado" && strings.Contains(sql, "status <> 'cancelado'") {
+			booked = 0
+		}
+		return scriptedRow{values: []interface{}{booked}}
+	}
+	if strings.Contains(sql, "SELECT status") {
+		tx.scriptedTx.on("SELECT status FROM orders", []interface{}{tx.status}).
+			on("SELECT status, payment_method", []interface{}{tx.status, paymentMethodStripe, false, false})
+	}
+	return tx.scriptedTx.QueryRow(ctx, sql, args...)
+}
+
+func (tx *slotOrdersTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	if strings.Contains(sql, "UPDATE orders SET status") {
+		tx.status = args[0].(string)
+	}
+	return tx.scriptedTx.Exec(ctx, sql, args...)
+}
+
+// TestFailedPaymentFreesSlot valida que el pedido cuyo pago falló deje de ocupar su franja
+func TestFailedPaymentFreesSlot(t *testing.T) {
+	tomorrow := time.Now().In(businessLocation()).AddDate(0, 0, 1)
+	at := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 12, 0, 0, 0, tomorrow.Location())
+	tx := &slotOrdersTx{
+		scriptedTx: newScriptedTx().
+			on("FROM opening_hours", []interface{}{1, int(at.Weekday()), fulfillmentDelivery, "11:00", "14:00", 60, 1, true}).
+			on("SELECT stock_status FROM orders", []interface{}{stockStatusReserved}),
+		status: "pendiente",
+	}
+	ctx := context.Background()
+
+	// El pedido pendiente ocupa el único cupo de la franja
+	slotErr, ok := reserveSlot(ctx, tx, fulfillmentDelivery, at).(*SlotError)
+	if assert.True(t, ok) {
+		assert.Equal(t, "SLOT_FULL", slotErr.Code)
+	}
+
+	canceled, err := cancelUnpaidOrderTx(ctx, tx, "o1", "Pago rechazado por Stripe")
+	assert.NoError(t, err)
+	assert.True(t, canceled)
+	assert.NoError(t, reserveSlot(ctx, tx, fulfillmentDelivery, at))
+}
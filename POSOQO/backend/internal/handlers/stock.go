@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// Estados de la reserva de stock de un pedido (columna orders.stock_status)
+const (
+	stockStatusNone      = "none"
+	stockStatusReserved  = "reserved"
+	stockStatusCommitted = "committed"
+	stockStatusReleased  = "released"
+)
+
+// InsufficientStockError indica los productos (y formatos) que no tienen stock suficiente
+type InsufficientStockError struct {
+	ProductIDs []string
+	VariantIDs []string
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("stock insuficiente para los productos: %s", strings.Join(e.ProductIDs, ", "))
+}
+
+// check registra el producto (y su formato) si su stock no alcanza para la cantidad pedida
+func (e *InsufficientStockError) check(productID, variantID string, stock, quantity int) {
+	if stock >= quantity {
+		return
+	}
+	e.ProductIDs = append(e.ProductIDs, productID)
+	if variantID != "" {
+		e.VariantIDs = append(e.VariantIDs, variantID)
+	}
+}
+
+// orderStockDemandSQL son las unidades que consume un pedido por producto y formato.
+// Las líneas que son packs consumen sus componentes (order_item_components) y no su propio stock.
+const orderStockDemandSQL = `SELECT COALESCE(c.product_id, oi.product_id) AS product_id,
+		        CASE WHEN c.id IS NULL THEN oi.variant_id ELSE c.variant_id END AS variant_id,
+		        oi.quantity * COALESCE(c.quantity, 1) AS quantity
+		 FROM order_items oi
+		 LEFT JOIN order_item_components c ON c.order_item_id = oi.id
+		 WHERE oi.order_id = $1`
+
+// Consultas que bloquean el stock pedido por un pedido: (producto, variante, stock, cantidad).
+// Los items con formato usan el stock de su variante.
+const (
+	lockProductStockQuery = `SELECT p.id::text, '', COALESCE(p.stock, 0), oi.quantity
+		 FROM products p
+		 JOIN (SELECT product_id, SUM(quantity) AS quantity
+		       FROM (` + orderStockDemandSQL + `) d WHERE variant_id IS NULL GROUP BY product_id) oi
+		   ON oi.product_id = p.id
+		 ORDER BY p.id
+		 FOR UPDATE OF p`
+	lockVariantStockQuery = `SELECT v.product_id::text, v.id::text, v.stock, oi.quantity
+		 FROM product_variants v
+		 JOIN (SELECT variant_id, SUM(quantity) AS quantity
+		       FROM (` + orderStockDemandSQL + `) d WHERE variant_id IS NOT NULL GROUP BY variant_id) oi
+		   ON oi.variant_id = v.id
+		 ORDER BY v.id
+		 FOR UPDATE OF v`
+)
+
+// reserveStock descuenta el stock de los items de un pedido dentro de la transacción
+// que lo crea. Las filas de productos y variantes se bloquean con FOR UPDATE (ordenadas
+// por id para evitar deadlocks) de modo que dos checkouts concurrentes no vendan la misma unidad.
+func reserveStock(ctx context.Context, tx pgx.Tx, orderID string) error {
+	stockErr := &InsufficientStockError{}
+	for _, query := range []string{lockProductStockQuery, lockVariantStockQuery} {
+		rows, err := tx.Query(ctx, query, orderID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var productID, variantID string
+			var stock, quantity int
+			if err := rows.Scan(&productID, &variantID, &stock, &quantity); err != nil {
+				rows.Close()
+				return err
+			}
+			stockErr.check(productID, variantID, stock, quantity)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	if len(stockErr.ProductIDs) > 0 {
+		return stockErr
+	}
+
+	if err := adjustOrderStock(ctx, tx, orderID, -1); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "UPDATE orders SET stock_status=$1 WHERE id=$2", stockStatusReserved, orderID)
+	return err
+}
+
+// Acciones sobre el stock de un pedido
+const (
+	stockActionCancel = "cancel" // pedido cancelado antes de entregarse (también si su pago falló)
+	stockActionCommit = "commit" // pedido pagado o entregado
+)
+
+// stockTransition devuelve el estado de stock al que pasa un pedido con la acción dada y
+// el ajuste de inventario que implica (1 devuelve unidades, -1 las descuenta, 0 nada).
+// ok es false si la acción no cambia nada.
+//
+// Cancelar devuelve las unidades tanto de una reserva como de un pedido ya pagado
+// (committed): los pedidos solo se cancelan antes de entregarse. Confirmar un pedido cuya
+// reserva ya se liberó vuelve a descontar el stock, aunque quede en negativo, porque el
+// cobro ya se realizó.
+func stockTransition(status, action string) (next string, sign int, ok bool) {
+	switch action {
+	case stockActionCancel:
+		if status == stockStatusReserved || status == stockStatusCommitted {
+			return stockStatusReleased, 1, true
+		}
+	case stockActionCommit:
+		switch status {
+		case stockStatusReserved:
+			return stockStatusCommitted, 0, true
+		case stockStatusReleased:
+			return stockStatusCommitted, -1, true
+		}
+	}
+	return status, 0, false
+}
+
+// applyStockAction bloquea el pedido y aplica la acción sobre su stock. Es idempotente:
+// repetir una acción no vuelve a mover el inventario.
+func applyStockAction(ctx context.Context, tx pgx.Tx, orderID, action string) error {
+	status, err := lockOrderStockStatus(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+	next, sign, ok := stockTransition(status, action)
+	if !ok {
+		return nil
+	}
+	if sign != 0 {
+		if err := adjustOrderStock(ctx, tx, orderID, sign); err != nil {
+			return err
+		}
+	}
+	if status == stockStatusReleased && action == stockActionCommit {
+		log.Printf("[STOCK] Pedido %s pagado tras liberar su reserva; stock descontado nuevamente", orderID)
+	}
+	_, err = tx.Exec(ctx, "UPDATE orders SET stock_status=$1 WHERE id=$2", next, orderID)
+	return err
+}
+
+// cancelOrderStock devuelve al inventario el stock de un pedido cancelado, esté reservado
+// o ya confirmado por el pago
+func cancelOrderStock(ctx context.Context, tx pgx.Tx, orderID string) error {
+	return applyStockAction(ctx, tx, orderID, stockActionCancel)
+}
+
+// commitOrderStock confirma definitivamente el stock de un pedido pagado o entregado
+func commitOrderStock(ctx context.Context, tx pgx.Tx, orderID string) error {
+	return applyStockAction(ctx, tx, orderID, stockActionCommit)
+}
+
+// lockOrderStockStatus bloquea la fila del pedido y devuelve su estado de stock
+func lockOrderStockStatus(ctx context.Context, tx pgx.Tx, orderID string) (string, error) {
+	var status string
+	err := tx.QueryRow(ctx, "SELECT stock_status FROM orders WHERE id=$1 FOR UPDATE", orderID).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return stockStatusNone, nil
+	}
+	return status, err
+}
+
+// adjustOrderStock suma (sign=1) o resta (sign=-1) las cantidades del pedido al stock
+// del producto o, si el item tiene formato, al de su variante. Los packs ajustan el
+// stock de sus componentes.
+func adjustOrderStock(ctx context.Context, tx pgx.Tx, orderID string, sign int) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE products p SET stock = COALESCE(p.stock, 0) + $2 * oi.quantity
+		 FROM (SELECT product_id, SUM(quantity) AS quantity
+		       FROM (`+orderStockDemandSQL+`) d WHERE variant_id IS NULL GROUP BY product_id) oi
+		 WHERE p.id = oi.product_id`, orderID, sign)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE product_variants v SET stock = v.stock + $2 * oi.quantity
+		 FROM (SELECT variant_id, SUM(quantity) AS quantity
+		       FROM (`+orderStockDemandSQL+`) d WHERE variant_id IS NOT NULL GROUP BY variant_id) oi
+		 WHERE v.id = oi.variant_id`, orderID, sign)
+	return err
+}
+
+// respondStockError traduce un error de reserva de stock a la respuesta HTTP
+func respondStockError(c *fiber.Ctx, err error) error {
+	var stockErr *InsufficientStockError
+	if errors.As(err, &stockErr) {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error":       "Stock insuficiente",
+			"code":        "INSUFFICIENT_STOCK",
+			"product_ids": stockErr.ProductIDs,
+			"variant_ids": stockErr.VariantIDs,
+		})
+	}
+	return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al reservar stock"})
+}
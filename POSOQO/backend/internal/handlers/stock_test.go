@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestInsufficientStockCheck valida qué líneas se reportan sin stock al reservar
+func TestInsufficientStockCheck(t *testing.T) {
+	stockErr := &InsufficientStockError{}
+	stockErr.check("p1", "", 5, 5)
+	stockErr.check("p2", "", 1, 2)
+	stockErr.check("p3", "v3", 0, 1)
+	stockErr.check("p4", "v4", 10, 1)
+
+	assert.Equal(t, []string{"p2", "p3"}, stockErr.ProductIDs)
+	assert.Equal(t, []string{"v3"}, stockErr.VariantIDs)
+}
+
+// TestStockTransition valida los cambios de estado del stock de un pedido
+func TestStockTransition(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		action string
+		next   string
+		sign   int
+		ok     bool
+	}{
+		// Cancelación (también por pago fallido): devuelve el stock reservado o ya pagado
+		{"Cancelar pedido reservado", stockStatusReserved, stockActionCancel, stockStatusReleased, 1, true},
+		{"Cancelar pedido pagado", stockStatusCommitted, stockActionCancel, stockStatusReleased, 1, true},
+		{"Cancelar dos veces", stockStatusReleased, stockActionCancel, stockStatusReleased, 0, false},
+		{"Cancelar pedido sin stock", stockStatusNone, stockActionCancel, stockStatusNone, 0, false},
+		// Pago o entrega: confirma la reserva
+		{"Confirmar reserva", stockStatusReserved, stockActionCommit, stockStatusCommitted, 0, true},
+		{"Confirmar tras liberar descuenta otra vez", stockStatusReleased, stockActionCommit, stockStatusCommitted, -1, true},
+		{"Confirmar dos veces", stockStatusCommitted, stockActionCommit, stockStatusCommitted, 0, false},
+		{"Confirmar pedido sin stock", stockStatusNone, stockActionCommit, stockStatusNone, 0, false},
+		{"Acción desconocida", stockStatusReserved, "perder", stockStatusReserved, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, sign, ok := stockTransition(tt.status, tt.action)
+			assert.Equal(t, tt.next, next)
+			assert.Equal(t, tt.sign, sign)
+			assert.Equal(t, tt.ok, ok)
+		})
+	}
+}
+
+// TestRespondStockError valida la respuesta HTTP de los errores de stock
+func TestRespondStockError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		productIDs []interface{}
+	}{
+		{
+			name:       "Stock insuficiente",
+			err:        &InsufficientStockError{ProductIDs: []string{"p1", "p2"}, VariantIDs: []string{"v2"}},
+			status:     http.StatusConflict,
+			code:       "INSUFFICIENT_STOCK",
+			productIDs: []interface{}{"p1", "p2"},
+		},
+		{
+			name:       "Stock insuficiente envuelto",
+			err:        fmt.Errorf("checkout: %w", &InsufficientStockError{ProductIDs: []string{"p1"}}),
+			status:     http.StatusConflict,
+			code:       "INSUFFICIENT_STOCK",
+			productIDs: []interface{}{"p1"},
+		},
+		{
+			name:   "Otro error",
+			err:    errors.New("conexión perdida"),
+			status: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error { return respondStockError(c, tt.err) })
+
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, resp.StatusCode)
+
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			if tt.code != "" {
+				assert.Equal(t, tt.code, body["code"])
+				assert.Equal(t, tt.productIDs, body["product_ids"])
+			} else {
+				assert.Nil(t, body["code"])
+			}
+		})
+	}
+}
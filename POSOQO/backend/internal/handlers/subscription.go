@@ -0,0 +1,1471 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+	"github.com/stripe/stripe-go/v78"
+	"github.com/stripe/stripe-go/v78/customer"
+	"github.com/stripe/stripe-go/v78/paymentintent"
+	"github.com/stripe/stripe-go/v78/paymentmethod"
+	"github.com/stripe/stripe-go/v78/setupintent"
+)
+
+// Estados de una suscripción del Club POSOQO
+const (
+	subscriptionActive   = "active"
+	subscriptionPaused   = "paused"
+	subscriptionPastDue  = "past_due" // cobro rechazado, esperando reintento
+	subscriptionCanceled = "canceled"
+)
+
+const (
+	// subscriptionBatch es el máximo de suscripciones que procesa cada ejecución del job
+	subscriptionBatch = 50
+	// maxSubscriptionPause es lo máximo que se puede pausar una suscripción
+	maxSubscriptionPause = 90 * 24 * time.Hour
+)
+
+// subscriptionRetrySchedule son las esperas entre reintentos de un cobro rechazado; si el
+// último reintento también falla, la suscripción se cancela
+var subscriptionRetrySchedule = []time.Duration{24 * time.Hour, 72 * time.Hour, 120 * time.Hour}
+
+// Errores de suscripciones
+var (
+	ErrSubscriptionNotFound     = errors.New("suscripción no encontrada")
+	ErrSubscriptionPlanNotFound = errors.New("plan no encontrado")
+	ErrPaymentMethodNotOwned    = errors.New("la tarjeta no pertenece al cliente")
+	ErrSubscriptionExists       = errors.New("ya existe una suscripción abierta a este plan")
+)
+
+// SubscriptionPlan es un plan del club: qué se envía cada mes y su precio estimado
+type SubscriptionPlan struct {
+	ID              string  `json:"id"`
+	Name            string  `json:"name"`
+	Description     string  `json:"description"`
+	ProductID       string  `json:"product_id"`
+	VariantID       string  `json:"variant_id,omitempty"`
+	ProductName     string  `json:"product_name"`
+	Quantity        int     `json:"quantity"`
+	UnitsPerCycle   int     `json:"units_per_cycle"`
+	DiscountPercent float64 `json:"discount_percent"`
+	IsActive        bool    `json:"is_active"`
+	// RegularPrice es el precio vigente sin descuento y Price el que paga el socio (sin envío)
+	RegularPrice float64 `json:"regular_price"`
+	Price        float64 `json:"price"`
+	// BundleType indica si el plan es un pack mixto en el que el socio elige las cervezas
+	BundleType string `json:"bundle_type,omitempty"`
+}
+
+// SubscriptionPlanRequest crea o edita un plan del club (admin)
+type SubscriptionPlanRequest struct {
+	Name            string  `json:"name"`
+	Description     string  `json:"description"`
+	ProductID       string  `json:"product_id"`
+	VariantID       string  `json:"variant_id,omitempty"`
+	Quantity        int     `json:"quantity"`
+	UnitsPerCycle   int     `json:"units_per_cycle"`
+	DiscountPercent float64 `json:"discount_percent"`
+	IsActive        *bool   `json:"is_active,omitempty"`
+}
+
+// SubscriptionRequest es la suscripción de un cliente a un plan
+type SubscriptionRequest struct {
+	PlanID string `json:"plan_id"`
+	// DeliveryDay es el día del mes (1-28) en que se crea, cobra y envía el pedido
+	DeliveryDay int `json:"delivery_day"`
+	// PaymentMethodID es la tarjeta guardada con el SetupIntent (pm_...)
+	PaymentMethodID string   `json:"payment_method_id"`
+	Location        string   `json:"location"`
+	Lat             *float64 `json:"lat,omitempty"`
+	Lng             *float64 `json:"lng,omitempty"`
+	// Components es la selección del socio si el plan es un pack mixto
+	Components []BundleSelection `json:"components,omitempty"`
+}
+
+// PaymentMethodRequest cambia la tarjeta de una suscripción
+type PaymentMethodRequest struct {
+	PaymentMethodID string `json:"payment_method_id"`
+}
+
+// PauseSubscriptionRequest pausa una suscripción hasta una fecha (AAAA-MM-DD)
+type PauseSubscriptionRequest struct {
+	Until string `json:"until"`
+}
+
+// CancelSubscriptionRequest motivo opcional de la baja
+type CancelSubscriptionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// subscriptionOrder identifica la suscripción que genera un pedido y su descuento
+type subscriptionOrder struct {
+	ID              string
+	DiscountPercent float64
+}
+
+// subscriptionRecord es una suscripción cargada desde la base de datos
+type subscriptionRecord struct {
+	ID               string
+	UserID           int64
+	PlanID           string
+	PlanName         string
+	Status           string
+	DeliveryDay      int
+	Components       []BundleSelection
+	Location         string
+	Lat              *float64
+	Lng              *float64
+	PaymentMethodID  string
+	CardBrand        string
+	CardLast4        string
+	NextOrderDate    time.Time
+	PausedUntil      *time.Time
+	NextRetryAt      *time.Time
+	CanceledAt       *time.Time
+	CreatedAt        time.Time
+	StripeCustomerID string
+}
+
+// subscriptionColumns son las columnas que lee scanSubscription (s es subscriptions,
+// sp el plan y u el usuario)
+const subscriptionColumns = `s.id::text, s.user_id, s.plan_id::text, sp.name, s.status, s.delivery_day, s.components,
+	s.location, s.lat, s.lng, s.stripe_payment_method_id, COALESCE(s.card_brand, ''), COALESCE(s.card_last4, ''),
+	s.next_order_date, s.paused_until, s.next_retry_at, s.canceled_at, s.created_at, COALESCE(u.stripe_customer_id, '')`
+
+// subscriptionFrom es el FROM que acompaña a subscriptionColumns
+const subscriptionFrom = ` FROM subscriptions s
+	JOIN subscription_plans sp ON sp.id = s.plan_id
+	JOIN users u ON u.id = s.user_id`
+
+func scanSubscription(row pgx.Row, s *subscriptionRecord) error {
+	return row.Scan(&s.ID, &s.UserID, &s.PlanID, &s.PlanName, &s.Status, &s.DeliveryDay, &s.Components,
+		&s.Location, &s.Lat, &s.Lng, &s.PaymentMethodID, &s.CardBrand, &s.CardLast4,
+		&s.NextOrderDate, &s.PausedUntil, &s.NextRetryAt, &s.CanceledAt, &s.CreatedAt, &s.StripeCustomerID)
+}
+
+// toMap es la representación JSON de la suscripción para el cliente y el admin
+func (s *subscriptionRecord) toMap() fiber.Map {
+	var pausedUntil *string
+	if s.PausedUntil != nil {
+		value := s.PausedUntil.Format(birthDateLayout)
+		pausedUntil = &value
+	}
+	nextOrderDate := s.NextOrderDate.Format(birthDateLayout)
+	if s.Status == subscriptionCanceled {
+		nextOrderDate = ""
+	}
+	return fiber.Map{
+		"id":              s.ID,
+		"plan_id":         s.PlanID,
+		"plan_name":       s.PlanName,
+		"status":          s.Status,
+		"delivery_day":    s.DeliveryDay,
+		"components":      s.Components,
+		"location":        s.Location,
+		"lat":             s.Lat,
+		"lng":             s.Lng,
+		"card_brand":      s.CardBrand,
+		"card_last4":      s.CardLast4,
+		"next_order_date": nextOrderDate,
+		"paused_until":    pausedUntil,
+		"next_retry_at":   s.NextRetryAt,
+		"canceled_at":     s.CanceledAt,
+		"created_at":      s.CreatedAt,
+	}
+}
+
+// businessToday es la fecha de hoy en la zona horaria del negocio (a medianoche UTC, como
+// se leen las columnas DATE)
+func businessToday() time.Time {
+	now := time.Now().In(businessLocation())
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// firstCycleDate es la primera fecha de entrega después de today para el día del mes elegido
+func firstCycleDate(today time.Time, deliveryDay int) time.Time {
+	date := time.Date(today.Year(), today.Month(), deliveryDay, 0, 0, 0, 0, time.UTC)
+	if !date.After(today) {
+		date = date.AddDate(0, 1, 0)
+	}
+	return date
+}
+
+// nextCycleDate es la fecha de entrega del mes siguiente a from
+func nextCycleDate(from time.Time, deliveryDay int) time.Time {
+	return time.Date(from.Year(), from.Month()+1, deliveryDay, 0, 0, 0, 0, time.UTC)
+}
+
+// subscriptionRetryDelay devuelve la espera hasta el próximo reintento después de attempts
+// cobros fallidos, o false si ya no quedan reintentos
+func subscriptionRetryDelay(attempts int) (time.Duration, bool) {
+	if attempts < 1 || attempts > len(subscriptionRetrySchedule) {
+		return 0, false
+	}
+	return subscriptionRetrySchedule[attempts-1], true
+}
+
+// clubDiscount calcula el descuento del club sobre el importe ya promocionado de las líneas
+func clubDiscount(lines []pricedLine, percent float64) float64 {
+	net := 0.0
+	for _, line := range lines {
+		net += line.Net()
+	}
+	if net <= 0 || percent <= 0 {
+		return 0
+	}
+	return roundMoney(net * math.Min(percent, 100) / 100)
+}
+
+// applyClubDiscount reparte el descuento del club entre las líneas del pedido igual que un
+// cupón (los pedidos del club no aceptan cupones) y devuelve el descuento total
+func applyClubDiscount(lines []pricedLine, percent float64) float64 {
+	discount := clubDiscount(lines, percent)
+	if discount > 0 {
+		(&couponRule{}).allocate(lines, discount)
+	}
+	return discount
+}
+
+// orderItems son los items del pedido de cada ciclo del plan
+func (p *SubscriptionPlan) orderItems(components []BundleSelection) []OrderItemRequest {
+	return []OrderItemRequest{{
+		ProductID:  p.ProductID,
+		VariantID:  p.VariantID,
+		Quantity:   p.Quantity,
+		Components: components,
+	}}
+}
+
+// validateSubscriptionPlanRequest normaliza un plan y devuelve el mensaje de error si no es válido
+func validateSubscriptionPlanRequest(req *SubscriptionPlanRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	switch {
+	case !utils.IsValidString(req.Name, 2, 100):
+		return "Nombre inválido (2-100 caracteres)"
+	case len(req.Description) > 1000:
+		return "Descripción inválida (máximo 1000 caracteres)"
+	case !utils.IsValidUUID(req.ProductID):
+		return "ID de producto inválido"
+	case req.VariantID != "" && !utils.IsValidUUID(req.VariantID):
+		return "ID de formato inválido"
+	case !utils.IsValidNumber(req.Quantity, 1, 100):
+		return "Cantidad inválida (1-100)"
+	case !utils.IsValidNumber(req.UnitsPerCycle, 1, 500):
+		return "Unidades por envío inválidas (1-500)"
+	case req.DiscountPercent < 0 || req.DiscountPercent >= 100:
+		return "Descuento inválido (0-99%)"
+	}
+	return ""
+}
+
+// validateSubscriptionRequest normaliza la suscripción y devuelve el mensaje de error si no es válida
+func validateSubscriptionRequest(req *SubscriptionRequest) string {
+	req.Location = strings.TrimSpace(req.Location)
+	req.PaymentMethodID = strings.TrimSpace(req.PaymentMethodID)
+	switch {
+	case !utils.IsValidUUID(req.PlanID):
+		return "ID de plan inválido"
+	case !utils.IsValidNumber(req.DeliveryDay, 1, 28):
+		return "Día de entrega inválido (1-28)"
+	case !isValidPaymentMethodID(req.PaymentMethodID):
+		return "Tarjeta inválida"
+	case !utils.IsValidString(req.Location, 2, 200):
+		return "Ubicación inválida (2-200 caracteres)"
+	case (req.Lat == nil) != (req.Lng == nil):
+		return "Coordenadas incompletas"
+	case req.Lat != nil && !utils.IsValidCoordinate(*req.Lat, *req.Lng):
+		return "Coordenadas inválidas"
+	}
+	return ""
+}
+
+// isValidPaymentMethodID acepta solo IDs de PaymentMethod de Stripe
+func isValidPaymentMethodID(id string) bool {
+	return strings.HasPrefix(id, "pm_") && utils.IsValidString(id, 4, 255)
+}
+
+// subscriptionPlanColumns son las columnas que lee scanSubscriptionPlan (sp es el plan,
+// p el producto y v el formato)
+const subscriptionPlanColumns = `sp.id::text, sp.name, COALESCE(sp.description, ''), sp.product_id::text,
+	COALESCE(sp.variant_id::text, ''), ` + itemNameSQL + `, sp.quantity, sp.units_per_cycle, sp.discount_percent,
+	sp.is_active AND p.is_active AND (sp.variant_id IS NULL OR v.is_active),
+	COALESCE(v.price, p.price) * sp.quantity, COALESCE(p.bundle_type, '')`
+
+// subscriptionPlanFrom es el FROM que acompaña a subscriptionPlanColumns
+const subscriptionPlanFrom = ` FROM subscription_plans sp
+	JOIN products p ON p.id = sp.product_id
+	LEFT JOIN product_variants v ON v.id = sp.variant_id`
+
+func scanSubscriptionPlan(row pgx.Row, p *SubscriptionPlan) error {
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.ProductID, &p.VariantID, &p.ProductName, &p.Quantity,
+		&p.UnitsPerCycle, &p.DiscountPercent, &p.IsActive, &p.RegularPrice, &p.BundleType)
+	if err != nil {
+		return err
+	}
+	p.RegularPrice = roundMoney(p.RegularPrice)
+	p.Price = roundMoney(p.RegularPrice * (1 - p.DiscountPercent/100))
+	return nil
+}
+
+// loadSubscriptionPlan obtiene un plan por ID
+func loadSubscriptionPlan(ctx context.Context, q dbQuerier, id string) (*SubscriptionPlan, error) {
+	var plan SubscriptionPlan
+	err := scanSubscriptionPlan(q.QueryRow(ctx, `SELECT `+subscriptionPlanColumns+subscriptionPlanFrom+` WHERE sp.id = $1`, id), &plan)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSubscriptionPlanNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// loadOwnedSubscription obtiene una suscripción del usuario; con forUpdate bloquea la fila
+func loadOwnedSubscription(ctx context.Context, q dbQuerier, id string, userID int64, forUpdate bool) (*subscriptionRecord, error) {
+	if !utils.IsValidUUID(id) {
+		return nil, ErrSubscriptionNotFound
+	}
+	query := `SELECT ` + subscriptionColumns + subscriptionFrom + ` WHERE s.id = $1 AND s.user_id = $2`
+	if forUpdate {
+		query += " FOR UPDATE OF s"
+	}
+	var sub subscriptionRecord
+	err := scanSubscription(q.QueryRow(ctx, query, id, userID), &sub)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// ensureStripeCustomer devuelve el cliente de Stripe del usuario y lo crea si no existe
+func ensureStripeCustomer(ctx context.Context, userID int64) (string, error) {
+	var customerID, email, name string
+	err := db.DB.QueryRow(ctx,
+		"SELECT COALESCE(stripe_customer_id, ''), email, TRIM(name || ' ' || COALESCE(last_name, '')) FROM users WHERE id=$1",
+		userID).Scan(&customerID, &email, &name)
+	if err != nil || customerID != "" {
+		return customerID, err
+	}
+
+	cus, err := customer.New(&stripe.CustomerParams{
+		Email:    stripe.String(email),
+		Name:     stripe.String(name),
+		Metadata: map[string]string{"user_id": fmt.Sprintf("%d", userID)},
+	})
+	if err != nil {
+		return "", err
+	}
+	// Si otra petición lo creó al mismo tiempo se conserva el primero
+	err = db.DB.QueryRow(ctx,
+		`UPDATE users SET stripe_customer_id = COALESCE(stripe_customer_id, $1) WHERE id=$2
+		 RETURNING stripe_customer_id`, cus.ID, userID).Scan(&customerID)
+	return customerID, err
+}
+
+// customerCard obtiene una tarjeta guardada y verifica que pertenezca al cliente
+func customerCard(customerID, paymentMethodID string) (*stripe.PaymentMethod, error) {
+	pm, err := paymentmethod.Get(paymentMethodID, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pm.Customer == nil || pm.Customer.ID != customerID {
+		return nil, ErrPaymentMethodNotOwned
+	}
+	return pm, nil
+}
+
+// cardDetails devuelve la marca y los últimos dígitos de una tarjeta para mostrarla
+func cardDetails(pm *stripe.PaymentMethod) (string, string) {
+	if pm.Card == nil {
+		return "", ""
+	}
+	return string(pm.Card.Brand), pm.Card.Last4
+}
+
+// respondSubscriptionError traduce los errores de suscripciones a la respuesta HTTP
+func respondSubscriptionError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrSubscriptionNotFound):
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Suscripción no encontrada"})
+	case errors.Is(err, ErrSubscriptionPlanNotFound):
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Plan no encontrado", "code": "PLAN_NOT_FOUND"})
+	case errors.Is(err, ErrSubscriptionExists):
+		return c.Status(http.StatusConflict).JSON(fiber.Map{"error": "Ya tienes una suscripción a este plan", "code": "SUBSCRIPTION_EXISTS"})
+	case errors.Is(err, ErrPaymentMethodNotOwned):
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tarjeta inválida", "code": "INVALID_PAYMENT_METHOD"})
+	}
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		log.Printf("[SUBSCRIPTION] Error de Stripe: %s", stripeErr.Msg)
+		return c.Status(http.StatusBadGateway).JSON(fiber.Map{"error": "No se pudo validar la tarjeta", "code": "STRIPE_ERROR"})
+	}
+	return respondCheckoutError(c, err)
+}
+
+// respondSubscriptionState rechaza una acción no permitida en el estado actual
+func respondSubscriptionState(c *fiber.Ctx, sub *subscriptionRecord, message string) error {
+	return c.Status(http.StatusConflict).JSON(fiber.Map{
+		"error":  message,
+		"code":   "INVALID_SUBSCRIPTION_STATE",
+		"status": sub.Status,
+	})
+}
+
+// GET /api/subscription-plans
+// Planes activos del Club POSOQO con su precio estimado por envío
+func ListSubscriptionPlans(c *fiber.Ctx) error {
+	rows, err := db.DB.Query(context.Background(),
+		`SELECT `+subscriptionPlanColumns+subscriptionPlanFrom+`
+		 WHERE sp.is_active AND p.is_active AND (sp.variant_id IS NULL OR v.is_active)
+		 ORDER BY sp.units_per_cycle, sp.name`)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener planes"})
+	}
+	defer rows.Close()
+
+	plans := []SubscriptionPlan{}
+	for rows.Next() {
+		var plan SubscriptionPlan
+		if err := scanSubscriptionPlan(rows, &plan); err != nil {
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	return c.JSON(fiber.Map{"data": plans})
+}
+
+// POST /api/protected/subscriptions/setup-intent
+// Crea un SetupIntent para guardar una tarjeta que se cobrará sin la presencia del cliente
+func CreateSubscriptionSetupIntent(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Stripe no configurado"})
+	}
+	customerID, err := ensureStripeCustomer(context.Background(), userID)
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error creando cliente de Stripe para %d: %v", userID, err)
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error creando cliente de pago"})
+	}
+	si, err := setupintent.New(&stripe.SetupIntentParams{
+		Customer:           stripe.String(customerID),
+		Usage:              stripe.String(string(stripe.SetupIntentUsageOffSession)),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+	})
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error creando SetupIntent"})
+	}
+	return c.JSON(fiber.Map{"clientSecret": si.ClientSecret})
+}
+
+// POST /api/protected/subscriptions
+// Suscribe al usuario a un plan con una tarjeta guardada. Valida de antemano el pedido
+// mensual (producto, pack, edad y zona de reparto) para no fallar en el primer ciclo.
+func CreateSubscription(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req SubscriptionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateSubscriptionRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Stripe no configurado"})
+	}
+
+	ctx := context.Background()
+	plan, err := loadSubscriptionPlan(ctx, db.DB, req.PlanID)
+	if err == nil && !plan.IsActive {
+		err = ErrSubscriptionPlanNotFound
+	}
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	var exists bool
+	err = db.DB.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM subscriptions WHERE user_id=$1 AND plan_id=$2 AND status <> 'canceled')",
+		userID, plan.ID).Scan(&exists)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	if exists {
+		return respondSubscriptionError(c, ErrSubscriptionExists)
+	}
+	if plan.BundleType != bundleMixed {
+		req.Components = nil
+	}
+	items := plan.orderItems(req.Components)
+	if msg := validateOrderItems(items); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	quote, lines, err := quoteCart(ctx, db.DB, items)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	if _, err := checkAgeVerification(ctx, db.DB, checkoutInput{UserID: userID}, lines); err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	var lat, lng float64
+	if req.Lat != nil {
+		lat, lng = *req.Lat, *req.Lng
+	}
+	goods := quote.Totals.Subtotal - quote.Totals.Discount - clubDiscount(lines, plan.DiscountPercent)
+	if _, err := resolveDelivery(ctx, db.DB, lat, lng, req.Lat != nil, goods); err != nil {
+		return respondSubscriptionError(c, err)
+	}
+
+	customerID, err := ensureStripeCustomer(ctx, userID)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	pm, err := customerCard(customerID, req.PaymentMethodID)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	brand, last4 := cardDetails(pm)
+
+	nextOrderDate := firstCycleDate(businessToday(), req.DeliveryDay)
+	var id string
+	err = db.DB.QueryRow(ctx,
+		`INSERT INTO subscriptions (user_id, plan_id, delivery_day, components, location, lat, lng,
+		                            stripe_payment_method_id, card_brand, card_last4, next_order_date)
+		 VALUES ($1, $2, $3, $4::jsonb, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		userID, plan.ID, req.DeliveryDay, selectionsJSON(req.Components), req.Location, req.Lat, req.Lng,
+		req.PaymentMethodID, brand, last4, nextOrderDate).Scan(&id)
+	if err != nil && strings.Contains(err.Error(), "duplicate key") {
+		return respondSubscriptionError(c, ErrSubscriptionExists)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear la suscripción"})
+	}
+
+	sub, err := loadOwnedSubscription(ctx, db.DB, id, userID, false)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear la suscripción"})
+	}
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"message":      "Suscripción creada",
+		"subscription": sub.toMap(),
+		"plan":         plan,
+	})
+}
+
+// GET /api/protected/subscriptions
+// Suscripciones del usuario con sus últimos ciclos
+func ListMySubscriptions(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+	ctx := context.Background()
+
+	rows, err := db.DB.Query(ctx,
+		`SELECT `+subscriptionColumns+subscriptionFrom+` WHERE s.user_id = $1 ORDER BY s.created_at DESC`, userID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener suscripciones"})
+	}
+	subs := []subscriptionRecord{}
+	for rows.Next() {
+		var sub subscriptionRecord
+		if err := scanSubscription(rows, &sub); err != nil {
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	data := make([]fiber.Map, 0, len(subs))
+	for i := range subs {
+		item := subs[i].toMap()
+		item["cycles"] = loadSubscriptionCycles(ctx, subs[i].ID, 6)
+		data = append(data, item)
+	}
+	return c.JSON(fiber.Map{"data": data})
+}
+
+// loadSubscriptionCycles devuelve los últimos ciclos de una suscripción
+func loadSubscriptionCycles(ctx context.Context, subscriptionID string, limit int) []fiber.Map {
+	rows, err := db.DB.Query(ctx,
+		`SELECT cycle_date, order_id::text, status, attempts, amount, last_error, paid_at
+		 FROM subscription_cycles WHERE subscription_id = $1
+		 ORDER BY cycle_date DESC LIMIT $2`, subscriptionID, limit)
+	if err != nil {
+		return []fiber.Map{}
+	}
+	defer rows.Close()
+
+	cycles := []fiber.Map{}
+	for rows.Next() {
+		var cycleDate time.Time
+		var orderID, lastError *string
+		var status string
+		var attempts int
+		var amount *float64
+		var paidAt *time.Time
+		if err := rows.Scan(&cycleDate, &orderID, &status, &attempts, &amount, &lastError, &paidAt); err != nil {
+			continue
+		}
+		cycles = append(cycles, fiber.Map{
+			"cycle_date": cycleDate.Format(birthDateLayout),
+			"order_id":   orderID,
+			"status":     status,
+			"attempts":   attempts,
+			"amount":     amount,
+			"last_error": lastError,
+			"paid_at":    paidAt,
+		})
+	}
+	return cycles
+}
+
+// PUT /api/protected/subscriptions/:id/payment-method
+// Cambia la tarjeta de la suscripción; si tenía un cobro rechazado se reintenta en la
+// próxima ejecución del job
+func UpdateSubscriptionPaymentMethod(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req PaymentMethodRequest
+	if err := c.BodyParser(&req); err != nil || !isValidPaymentMethodID(req.PaymentMethodID) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Tarjeta inválida"})
+	}
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Stripe no configurado"})
+	}
+
+	ctx := context.Background()
+	sub, err := loadOwnedSubscription(ctx, db.DB, c.Params("id"), userID, false)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	if sub.Status == subscriptionCanceled {
+		return respondSubscriptionState(c, sub, "La suscripción está cancelada")
+	}
+	pm, err := customerCard(sub.StripeCustomerID, req.PaymentMethodID)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	brand, last4 := cardDetails(pm)
+
+	_, err = db.DB.Exec(ctx,
+		`UPDATE subscriptions SET stripe_payment_method_id=$1, card_brand=$2, card_last4=$3,
+		        next_retry_at = CASE WHEN status = 'past_due' THEN NOW() ELSE next_retry_at END
+		 WHERE id=$4`, req.PaymentMethodID, brand, last4, sub.ID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar la tarjeta"})
+	}
+	return c.JSON(fiber.Map{"success": true, "card_brand": brand, "card_last4": last4})
+}
+
+// POST /api/protected/subscriptions/:id/pause
+// Pausa la suscripción hasta la fecha indicada (máximo 90 días); se reanuda sola
+func PauseSubscription(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req PauseSubscriptionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	today := businessToday()
+	until, err := time.Parse(birthDateLayout, strings.TrimSpace(req.Until))
+	if err != nil || !until.After(today) || until.Sub(today) > maxSubscriptionPause {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Fecha de reanudación inválida (hasta 90 días)"})
+	}
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	sub, err := loadOwnedSubscription(ctx, tx, c.Params("id"), userID, true)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	if sub.Status != subscriptionActive {
+		return respondSubscriptionState(c, sub, "Solo se puede pausar una suscripción activa")
+	}
+	if _, err := tx.Exec(ctx, "UPDATE subscriptions SET status='paused', paused_until=$1 WHERE id=$2", until, sub.ID); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo pausar la suscripción"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo pausar la suscripción"})
+	}
+	return c.JSON(fiber.Map{"success": true, "status": subscriptionPaused, "paused_until": until.Format(birthDateLayout)})
+}
+
+// resumeSubscription reactiva una suscripción pausada desde la próxima fecha de entrega
+func resumeSubscription(ctx context.Context, q dbQuerier, sub *subscriptionRecord) (time.Time, error) {
+	next := sub.NextOrderDate
+	if today := businessToday(); !next.After(today) {
+		next = firstCycleDate(today, sub.DeliveryDay)
+	}
+	_, err := q.Exec(ctx,
+		"UPDATE subscriptions SET status='active', paused_until=NULL, next_order_date=$1 WHERE id=$2 AND status='paused'",
+		next, sub.ID)
+	return next, err
+}
+
+// POST /api/protected/subscriptions/:id/resume
+// Reanuda una suscripción pausada antes de la fecha prevista
+func ResumeSubscription(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	sub, err := loadOwnedSubscription(ctx, tx, c.Params("id"), userID, true)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	if sub.Status != subscriptionPaused {
+		return respondSubscriptionState(c, sub, "La suscripción no está pausada")
+	}
+	next, err := resumeSubscription(ctx, tx, sub)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo reanudar la suscripción"})
+	}
+	return c.JSON(fiber.Map{"success": true, "status": subscriptionActive, "next_order_date": next.Format(birthDateLayout)})
+}
+
+// POST /api/protected/subscriptions/:id/skip
+// Salta el próximo envío: no se crea ni se cobra ese pedido
+func SkipSubscriptionCycle(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	defer tx.Rollback(ctx)
+
+	sub, err := loadOwnedSubscription(ctx, tx, c.Params("id"), userID, true)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	if sub.Status != subscriptionActive {
+		return respondSubscriptionState(c, sub, "Solo se puede saltar un envío de una suscripción activa")
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO subscription_cycles (subscription_id, cycle_date, status) VALUES ($1, $2, 'skipped')
+		 ON CONFLICT (subscription_id, cycle_date) DO NOTHING`, sub.ID, sub.NextOrderDate)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo saltar el envío"})
+	}
+	next := nextCycleDate(sub.NextOrderDate, sub.DeliveryDay)
+	if _, err := tx.Exec(ctx, "UPDATE subscriptions SET next_order_date=$1 WHERE id=$2", next, sub.ID); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo saltar el envío"})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo saltar el envío"})
+	}
+	return c.JSON(fiber.Map{
+		"success":         true,
+		"skipped_date":    sub.NextOrderDate.Format(birthDateLayout),
+		"next_order_date": next.Format(birthDateLayout),
+	})
+}
+
+// POST /api/protected/subscriptions/:id/cancel
+// Da de baja la suscripción; los pedidos ya creados siguen su curso
+func CancelSubscription(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userID := int64(claims["id"].(float64))
+
+	var req CancelSubscriptionRequest
+	_ = c.BodyParser(&req)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if len(req.Reason) > 500 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Motivo inválido (máximo 500 caracteres)"})
+	}
+
+	ctx := context.Background()
+	sub, err := loadOwnedSubscription(ctx, db.DB, c.Params("id"), userID, false)
+	if err != nil {
+		return respondSubscriptionError(c, err)
+	}
+	if sub.Status == subscriptionCanceled {
+		return respondSubscriptionState(c, sub, "La suscripción ya está cancelada")
+	}
+	_, err = db.DB.Exec(ctx,
+		`UPDATE subscriptions SET status='canceled', canceled_at=NOW(), cancel_reason=NULLIF($1, ''),
+		        paused_until=NULL, next_retry_at=NULL
+		 WHERE id=$2 AND status <> 'canceled'`, req.Reason, sub.ID)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo cancelar la suscripción"})
+	}
+	return c.JSON(fiber.Map{"success": true, "status": subscriptionCanceled})
+}
+
+// POST /api/admin/subscription-plans
+func CreateSubscriptionPlan(c *fiber.Ctx) error {
+	var req SubscriptionPlanRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateSubscriptionPlanRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	isActive := req.IsActive == nil || *req.IsActive
+
+	var id string
+	err := db.DB.QueryRow(context.Background(),
+		`INSERT INTO subscription_plans (name, description, product_id, variant_id, quantity, units_per_cycle, discount_percent, is_active)
+		 VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, '')::uuid, $5, $6, $7, $8) RETURNING id`,
+		req.Name, req.Description, req.ProductID, req.VariantID, req.Quantity, req.UnitsPerCycle, req.DiscountPercent, isActive).Scan(&id)
+	if err != nil {
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Producto o formato no encontrado"})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo crear el plan"})
+	}
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"success": true, "id": id})
+}
+
+// PUT /api/admin/subscription-plans/:id
+// Los cambios de producto, cantidad o descuento aplican desde el próximo ciclo
+func UpdateSubscriptionPlan(c *fiber.Ctx) error {
+	var req SubscriptionPlanRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateSubscriptionPlanRequest(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+
+	tag, err := db.DB.Exec(context.Background(),
+		`UPDATE subscription_plans SET name=$1, description=NULLIF($2, ''), product_id=$3, variant_id=NULLIF($4, '')::uuid,
+		        quantity=$5, units_per_cycle=$6, discount_percent=$7, is_active=COALESCE($8, is_active)
+		 WHERE id::text=$9`,
+		req.Name, req.Description, req.ProductID, req.VariantID, req.Quantity, req.UnitsPerCycle, req.DiscountPercent,
+		req.IsActive, c.Params("id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "foreign key") {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Producto o formato no encontrado"})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo actualizar el plan"})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Plan no encontrado"})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// GET /api/admin/subscriptions?status=active&page=1&limit=20
+// Base de socios del club con su plan, estado y próximo envío
+func ListSubscriptionsAdmin(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	status := c.Query("status")
+	if status != "" && status != subscriptionActive && status != subscriptionPaused &&
+		status != subscriptionPastDue && status != subscriptionCanceled {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Estado inválido"})
+	}
+
+	ctx := context.Background()
+	var total int
+	err := db.DB.QueryRow(ctx,
+		"SELECT COUNT(*) FROM subscriptions WHERE status = $1 OR $1 = ''", status).Scan(&total)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al contar suscripciones"})
+	}
+	rows, err := db.DB.Query(ctx,
+		`SELECT `+subscriptionColumns+`, u.name, COALESCE(u.last_name, ''), u.email,
+		        (SELECT COUNT(*) FROM subscription_cycles sc WHERE sc.subscription_id = s.id AND sc.status = 'paid'),
+		        (SELECT COALESCE(SUM(sc.amount), 0) FROM subscription_cycles sc WHERE sc.subscription_id = s.id AND sc.status = 'paid')
+		`+subscriptionFrom+`
+		 WHERE s.status = $1 OR $1 = ''
+		 ORDER BY s.created_at DESC LIMIT $2 OFFSET $3`, status, limit, (page-1)*limit)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener suscripciones"})
+	}
+	defer rows.Close()
+
+	data := []fiber.Map{}
+	for rows.Next() {
+		var sub subscriptionRecord
+		var name, lastName, email string
+		var paidCycles int
+		var revenue float64
+		err := rows.Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.PlanName, &sub.Status, &sub.DeliveryDay, &sub.Components,
+			&sub.Location, &sub.Lat, &sub.Lng, &sub.PaymentMethodID, &sub.CardBrand, &sub.CardLast4,
+			&sub.NextOrderDate, &sub.PausedUntil, &sub.NextRetryAt, &sub.CanceledAt, &sub.CreatedAt, &sub.StripeCustomerID,
+			&name, &lastName, &email, &paidCycles, &revenue)
+		if err != nil {
+			continue
+		}
+		item := sub.toMap()
+		item["user_id"] = sub.UserID
+		item["customer_name"] = strings.TrimSpace(name + " " + lastName)
+		item["customer_email"] = email
+		item["paid_cycles"] = paidCycles
+		item["revenue"] = roundMoney(revenue)
+		data = append(data, item)
+	}
+	return c.JSON(fiber.Map{
+		"data": data,
+		"pagination": fiber.Map{
+			"page":  page,
+			"limit": limit,
+			"total": total,
+			"pages": (total + limit - 1) / limit,
+		},
+	})
+}
+
+// GET /api/admin/subscriptions/metrics?days=30
+// Socios por estado, MRR (ingreso mensual recurrente de las suscripciones activas y en
+// reintento, al precio vigente de cada plan), altas, bajas y cobros del período
+func GetSubscriptionMetrics(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 30)
+	if days < 1 || days > 365 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Rango de días inválido (1-365)"})
+	}
+	since := time.Now().AddDate(0, 0, -days)
+	ctx := context.Background()
+
+	rows, err := db.DB.Query(ctx,
+		`SELECT `+subscriptionPlanColumns+`,
+		        COUNT(s.id) FILTER (WHERE s.status = 'active'),
+		        COUNT(s.id) FILTER (WHERE s.status = 'paused'),
+		        COUNT(s.id) FILTER (WHERE s.status = 'past_due'),
+		        COUNT(s.id) FILTER (WHERE s.status = 'canceled')
+		`+subscriptionPlanFrom+`
+		 LEFT JOIN subscriptions s ON s.plan_id = sp.id
+		 GROUP BY sp.id, p.id, v.id
+		 ORDER BY sp.name`)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener métricas"})
+	}
+	defer rows.Close()
+
+	byStatus := map[string]int{subscriptionActive: 0, subscriptionPaused: 0, subscriptionPastDue: 0, subscriptionCanceled: 0}
+	plans := []fiber.Map{}
+	mrr := 0.0
+	for rows.Next() {
+		var plan SubscriptionPlan
+		var active, paused, pastDue, canceled int
+		err := rows.Scan(&plan.ID, &plan.Name, &plan.Description, &plan.ProductID, &plan.VariantID, &plan.ProductName,
+			&plan.Quantity, &plan.UnitsPerCycle, &plan.DiscountPercent, &plan.IsActive, &plan.RegularPrice, &plan.BundleType,
+			&active, &paused, &pastDue, &canceled)
+		if err != nil {
+			continue
+		}
+		plan.Price = roundMoney(plan.RegularPrice * (1 - plan.DiscountPercent/100))
+		planMRR := roundMoney(plan.Price * float64(active+pastDue))
+		mrr += planMRR
+		byStatus[subscriptionActive] += active
+		byStatus[subscriptionPaused] += paused
+		byStatus[subscriptionPastDue] += pastDue
+		byStatus[subscriptionCanceled] += canceled
+		plans = append(plans, fiber.Map{
+			"plan_id":  plan.ID,
+			"name":     plan.Name,
+			"price":    plan.Price,
+			"active":   active,
+			"paused":   paused,
+			"past_due": pastDue,
+			"canceled": canceled,
+			"mrr":      planMRR,
+		})
+	}
+
+	var created, canceledInPeriod, paidCycles, failedCycles int
+	var revenue float64
+	err = db.DB.QueryRow(ctx, `
+		SELECT (SELECT COUNT(*) FROM subscriptions WHERE created_at >= $1),
+		       (SELECT COUNT(*) FROM subscriptions WHERE canceled_at >= $1),
+		       (SELECT COUNT(*) FROM subscription_cycles WHERE status = 'paid' AND paid_at >= $1),
+		       (SELECT COUNT(*) FROM subscription_cycles WHERE status = 'failed' AND updated_at >= $1),
+		       (SELECT COALESCE(SUM(amount), 0) FROM subscription_cycles WHERE status = 'paid' AND paid_at >= $1)
+	`, since).Scan(&created, &canceledInPeriod, &paidCycles, &failedCycles, &revenue)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener métricas"})
+	}
+
+	// Tasa de bajas: cancelaciones del período sobre los socios al inicio del período
+	churnRate := 0.0
+	if base := byStatus[subscriptionActive] + byStatus[subscriptionPaused] + byStatus[subscriptionPastDue] + canceledInPeriod - created; base > 0 {
+		churnRate = roundMoney(float64(canceledInPeriod) / float64(base) * 100)
+	}
+	return c.JSON(fiber.Map{
+		"days":          days,
+		"subscribers":   byStatus,
+		"mrr":           roundMoney(mrr),
+		"arr":           roundMoney(mrr * 12),
+		"new":           created,
+		"canceled":      canceledInPeriod,
+		"churn_rate":    churnRate,
+		"paid_cycles":   paidCycles,
+		"failed_cycles": failedCycles,
+		"revenue":       roundMoney(revenue),
+		"plans":         plans,
+	})
+}
+
+// ProcessSubscriptions reanuda las pausas vencidas, crea y cobra los pedidos de los ciclos
+// que tocan hoy y reintenta los cobros rechazados cuya espera terminó. Se ejecuta cada hora.
+func ProcessSubscriptions() {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	if stripe.Key == "" {
+		return
+	}
+	ctx := context.Background()
+	today := businessToday()
+
+	// Pausas vencidas
+	paused, err := querySubscriptionIDs(ctx,
+		"SELECT id::text FROM subscriptions WHERE status='paused' AND paused_until <= $1 LIMIT $2", today, subscriptionBatch)
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error buscando pausas vencidas: %v", err)
+	}
+	for _, id := range paused {
+		var sub subscriptionRecord
+		err := scanSubscription(db.DB.QueryRow(ctx, `SELECT `+subscriptionColumns+subscriptionFrom+` WHERE s.id=$1`, id), &sub)
+		if err == nil {
+			_, err = resumeSubscription(ctx, db.DB, &sub)
+		}
+		if err != nil {
+			log.Printf("[SUBSCRIPTION] Error reanudando la suscripción %s: %v", id, err)
+		}
+	}
+
+	// Ciclos del día
+	due, err := querySubscriptionIDs(ctx,
+		"SELECT id::text FROM subscriptions WHERE status='active' AND next_order_date <= $1 ORDER BY next_order_date LIMIT $2",
+		today, subscriptionBatch)
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error buscando ciclos pendientes: %v", err)
+	}
+	for _, id := range due {
+		if err := billSubscription(ctx, id, false); err != nil {
+			log.Printf("[SUBSCRIPTION] Error procesando la suscripción %s: %v", id, err)
+		}
+	}
+
+	// Reintentos de cobros rechazados
+	retries, err := querySubscriptionIDs(ctx,
+		"SELECT id::text FROM subscriptions WHERE status='past_due' AND next_retry_at <= NOW() ORDER BY next_retry_at LIMIT $1",
+		subscriptionBatch)
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error buscando reintentos: %v", err)
+	}
+	for _, id := range retries {
+		if err := billSubscription(ctx, id, true); err != nil {
+			log.Printf("[SUBSCRIPTION] Error reintentando la suscripción %s: %v", id, err)
+		}
+	}
+}
+
+// querySubscriptionIDs devuelve los IDs de suscripciones de una consulta
+func querySubscriptionIDs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// billSubscription crea el pedido de un ciclo (o de su reintento) con el descuento del club
+// y lo cobra con la tarjeta guardada. Si el pedido no se puede crear (sin stock, producto
+// inactivo, edad sin verificar) el ciclo queda como unfulfilled y se avisa al socio.
+func billSubscription(ctx context.Context, subscriptionID string, retry bool) error {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var sub subscriptionRecord
+	err = scanSubscription(tx.QueryRow(ctx,
+		`SELECT `+subscriptionColumns+subscriptionFrom+` WHERE s.id=$1 FOR UPDATE OF s`, subscriptionID), &sub)
+	if err != nil {
+		return err
+	}
+	// Otra ejecución pudo haberla procesado entre la búsqueda y el bloqueo
+	if retry && (sub.Status != subscriptionPastDue || sub.NextRetryAt == nil || sub.NextRetryAt.After(time.Now())) {
+		return nil
+	}
+	if !retry && (sub.Status != subscriptionActive || sub.NextOrderDate.After(businessToday())) {
+		return nil
+	}
+
+	var cycleID string
+	var cycleDate time.Time
+	if retry {
+		err = tx.QueryRow(ctx,
+			`SELECT id::text, cycle_date FROM subscription_cycles
+			 WHERE subscription_id=$1 AND status='failed' ORDER BY cycle_date DESC LIMIT 1`, sub.ID).Scan(&cycleID, &cycleDate)
+		if errors.Is(err, pgx.ErrNoRows) {
+			_, err = tx.Exec(ctx, "UPDATE subscriptions SET status='active', next_retry_at=NULL WHERE id=$1", sub.ID)
+			if err != nil {
+				return err
+			}
+			return tx.Commit(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "UPDATE subscriptions SET next_retry_at=NULL WHERE id=$1", sub.ID); err != nil {
+			return err
+		}
+	} else {
+		cycleDate = sub.NextOrderDate
+		err = tx.QueryRow(ctx,
+			`INSERT INTO subscription_cycles (subscription_id, cycle_date) VALUES ($1, $2)
+			 ON CONFLICT (subscription_id, cycle_date) DO NOTHING RETURNING id::text`, sub.ID, cycleDate).Scan(&cycleID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		_, err = tx.Exec(ctx, "UPDATE subscriptions SET next_order_date=$1 WHERE id=$2",
+			nextCycleDate(cycleDate, sub.DeliveryDay), sub.ID)
+		if err != nil {
+			return err
+		}
+		// El ciclo ya existía (p. ej. saltado por el socio): solo se avanza la fecha
+		if cycleID == "" {
+			return tx.Commit(ctx)
+		}
+	}
+
+	plan, err := loadSubscriptionPlan(ctx, tx, sub.PlanID)
+	if err != nil {
+		return err
+	}
+	var lat, lng interface{}
+	if sub.Lat != nil && sub.Lng != nil {
+		lat, lng = *sub.Lat, *sub.Lng
+	}
+
+	// El pedido va en un savepoint para poder registrar el ciclo aunque falle
+	orderTx, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	orderID, totals, orderErr := placeOrder(ctx, orderTx, checkoutInput{
+		UserID:          sub.UserID,
+		Actor:           systemActor,
+		Status:          "pendiente",
+		PaymentMethod:   paymentMethodStripe,
+		Items:           plan.orderItems(sub.Components),
+		Location:        sub.Location,
+		Lat:             lat,
+		Lng:             lng,
+		FulfillmentType: fulfillmentDelivery,
+		Subscription:    &subscriptionOrder{ID: sub.ID, DiscountPercent: plan.DiscountPercent},
+	})
+	if orderErr == nil {
+		orderErr = orderTx.Commit(ctx)
+	}
+	if orderErr != nil {
+		_ = orderTx.Rollback(ctx)
+		_, err = tx.Exec(ctx,
+			"UPDATE subscription_cycles SET status='unfulfilled', last_error=$1 WHERE id=$2", orderErr.Error(), cycleID)
+		if err != nil {
+			return err
+		}
+		if retry {
+			_, err = tx.Exec(ctx, "UPDATE subscriptions SET status='active' WHERE id=$1", sub.ID)
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		log.Printf("[SUBSCRIPTION] No se pudo crear el pedido de la suscripción %s: %v", sub.ID, orderErr)
+		notifySubscriptionUser(sub.UserID, "warning", "Club POSOQO",
+			fmt.Sprintf("No pudimos preparar tu envío del %s. Revisa tu suscripción.", cycleDate.Format("02/01/2006")), nil)
+		return nil
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE subscription_cycles SET order_id=$1, status='pending', attempts=attempts+1, amount=$2, last_error=NULL
+		 WHERE id=$3`, orderID, totals.Total, cycleID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if err := chargeSubscriptionOrder(&sub, orderID, totals.Total); err != nil {
+		handleSubscriptionPaymentFailed(orderID, chargeFailureMessage(err))
+	}
+	return nil
+}
+
+// chargeSubscriptionOrder cobra el pedido del ciclo con la tarjeta guardada, sin la
+// presencia del socio. El resultado definitivo llega por el webhook de Stripe.
+func chargeSubscriptionOrder(sub *subscriptionRecord, orderID string, total float64) error {
+	if sub.StripeCustomerID == "" {
+		return errors.New("el socio no tiene cliente de Stripe")
+	}
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(toCents(total)),
+		Currency:      stripe.String("pen"),
+		Customer:      stripe.String(sub.StripeCustomerID),
+		PaymentMethod: stripe.String(sub.PaymentMethodID),
+		OffSession:    stripe.Bool(true),
+		Confirm:       stripe.Bool(true),
+		Metadata: map[string]string{
+			"type":            "order",
+			"id":              orderID,
+			"user_id":         fmt.Sprintf("%d", sub.UserID),
+			"subscription_id": sub.ID,
+		},
+	}
+	params.SetIdempotencyKey("subscription-order-" + orderID)
+
+	pi, err := paymentintent.New(params)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.PaymentIntent != nil {
+		pi = stripeErr.PaymentIntent
+	}
+	if pi != nil {
+		_, _ = db.DB.Exec(context.Background(),
+			"UPDATE orders SET stripe_payment_intent_id=$1 WHERE id=$2", pi.ID, orderID)
+	}
+	if err != nil {
+		return err
+	}
+	if pi.Status == stripe.PaymentIntentStatusRequiresAction || pi.Status == stripe.PaymentIntentStatusRequiresPaymentMethod {
+		return errors.New("el banco requiere autenticar el pago")
+	}
+	return nil
+}
+
+// chargeFailureMessage es el motivo de un cobro rechazado para mostrar al socio
+func chargeFailureMessage(err error) string {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Msg != "" {
+		return stripeErr.Msg
+	}
+	return err.Error()
+}
+
+// paymentFailureMessage es el motivo del rechazo informado por el webhook de Stripe
+func paymentFailureMessage(pi stripe.PaymentIntent) string {
+	if pi.LastPaymentError != nil && pi.LastPaymentError.Msg != "" {
+		return pi.LastPaymentError.Msg
+	}
+	return "Pago rechazado"
+}
+
+// handleSubscriptionPaymentFailed aplica el dunning a un cobro rechazado del club: cancela
+// el pedido (liberando su stock) y programa un reintento, o cancela la suscripción si ya no
+// quedan reintentos. Es idempotente: el rechazo llega por la respuesta de Stripe y por el
+// webhook payment_intent.payment_failed.
+func handleSubscriptionPaymentFailed(orderID, reason string) {
+	ctx := context.Background()
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error iniciando transacción para el pedido %s: %v", orderID, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var subscriptionID, planName, email, name string
+	var attempts int
+	var userID int64
+	err = tx.QueryRow(ctx,
+		`UPDATE subscription_cycles sc SET status='failed', last_error=$2
+		 FROM subscriptions s
+		 JOIN subscription_plans sp ON sp.id = s.plan_id
+		 JOIN users u ON u.id = s.user_id
+		 WHERE sc.order_id::text = $1 AND sc.status = 'pending' AND s.id = sc.subscription_id
+		 RETURNING s.id::text, sc.attempts, s.user_id, sp.name, u.email, u.name`, orderID, reason).
+		Scan(&subscriptionID, &attempts, &userID, &planName, &email, &name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error registrando el cobro rechazado del pedido %s: %v", orderID, err)
+		return
+	}
+
+	// El pedido no se cobró: se cancela y el reintento crea uno nuevo con precios vigentes
+	var transitionErr *InvalidTransitionError
+	if _, err := transitionOrderStatus(ctx, tx, orderID, "cancelado", systemActor, "Cobro de la suscripción rechazado"); err != nil && !errors.As(err, &transitionErr) {
+		log.Printf("[SUBSCRIPTION] Error cancelando el pedido %s: %v", orderID, err)
+		return
+	}
+
+	var nextRetry *time.Time
+	if delay, ok := subscriptionRetryDelay(attempts); ok {
+		retryAt := time.Now().Add(delay)
+		nextRetry = &retryAt
+		_, err = tx.Exec(ctx,
+			"UPDATE subscriptions SET status='past_due', next_retry_at=$1 WHERE id=$2 AND status IN ('active', 'past_due')",
+			retryAt, subscriptionID)
+	} else {
+		_, err = tx.Exec(ctx,
+			`UPDATE subscriptions SET status='canceled', canceled_at=NOW(), next_retry_at=NULL,
+			        cancel_reason='Cobro rechazado tras varios intentos'
+			 WHERE id=$1 AND status <> 'canceled'`, subscriptionID)
+	}
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error actualizando la suscripción %s: %v", subscriptionID, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("[SUBSCRIPTION] Error guardando el cobro rechazado del pedido %s: %v", orderID, err)
+		return
+	}
+
+	message := "No pudimos cobrar tu envío del Club POSOQO. Actualiza tu tarjeta para no perder tu suscripción."
+	if nextRetry == nil {
+		message = "Tu suscripción al Club POSOQO se canceló porque no pudimos cobrar tu envío."
+	}
+	notifySubscriptionUser(userID, "error", "Pago del Club rechazado", message, &orderID)
+	go func() {
+		if err := sendSubscriptionDunningEmail(email, name, planName, reason, nextRetry); err != nil {
+			log.Printf("[SUBSCRIPTION] No se pudo enviar el aviso de cobro rechazado a %s: %v", utils.SanitizeForLog(email), err)
+		}
+	}()
+}
+
+// markSubscriptionCyclePaid marca como pagado el ciclo del pedido y reactiva la suscripción
+// si estaba en reintento
+func markSubscriptionCyclePaid(orderID string) {
+	ctx := context.Background()
+	var subscriptionID string
+	err := db.DB.QueryRow(ctx,
+		`UPDATE subscription_cycles SET status='paid', paid_at=NOW(), last_error=NULL
+		 WHERE order_id::text = $1 AND status = 'pending' RETURNING subscription_id::text`, orderID).Scan(&subscriptionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return
+	}
+	if err == nil {
+		_, err = db.DB.Exec(ctx,
+			"UPDATE subscriptions SET status='active', next_retry_at=NULL WHERE id=$1 AND status='past_due'", subscriptionID)
+	}
+	if err != nil {
+		log.Printf("[SUBSCRIPTION] Error registrando el pago del pedido %s: %v", orderID, err)
+	}
+}
+
+// notifySubscriptionUser crea una notificación en la app para el socio
+func notifySubscriptionUser(userID int64, notificationType, title, message string, orderID *string) {
+	userIDStr := fmt.Sprintf("%d", userID)
+	if err := CreateAutomaticNotification(notificationType, title, message, &userIDStr, orderID); err != nil {
+		log.Printf("[SUBSCRIPTION] Error creando notificación para %d: %v", userID, err)
+	}
+}
+
+const subscriptionDunningEmailTemplate = `
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Club POSOQO - Pago rechazado</title>
+</head>
+<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333; max-width: 600px; margin: 0 auto; padding: 20px; background-color: #f4f4f4;">
+    <div style="background-color: white; padding: 30px; border-radius: 10px; box-shadow: 0 2px 10px rgba(0,0,0,0.1);">
+        <div style="text-align: center; margin-bottom: 30px;">
+            <div style="font-size: 24px; font-weight: bold; color: #FFD700; margin-bottom: 10px;">POSOQO</div>
+            <div style="color: #333; font-size: 20px; margin-bottom: 20px;">Club POSOQO</div>
+        </div>
+
+        <p>Hola {{.Name}},</p>
+        <p>No pudimos cobrar el envío de tu plan <strong>{{.PlanName}}</strong>. Motivo: {{.Reason}}.</p>
+
+        {{if .NextRetry}}
+        <p>Volveremos a intentarlo el {{.NextRetry}}. Si tu tarjeta cambió, actualízala para no perder tu suscripción.</p>
+        {{else}}
+        <p>Tu suscripción se canceló después de varios intentos. Puedes volver a suscribirte cuando quieras.</p>
+        {{end}}
+
+        <div style="text-align: center; margin: 30px 0;">
+            <a href="{{.ClubURL}}" style="display: inline-block; background: linear-gradient(135deg, #FFD700, #D4AF37); color: #000; padding: 12px 30px; text-decoration: none; border-radius: 25px; font-weight: bold;">{{if .NextRetry}}Actualizar mi tarjeta{{else}}Ver planes del club{{end}}</a>
+        </div>
+    </div>
+</body>
+</html>
+`
+
+// sendSubscriptionDunningEmail avisa al socio de un cobro rechazado (nextRetry nil si la
+// suscripción se canceló)
+func sendSubscriptionDunningEmail(email, name, planName, reason string, nextRetry *time.Time) error {
+	tmpl, err := template.New("subscriptionDunning").Parse(subscriptionDunningEmailTemplate)
+	if err != nil {
+		return err
+	}
+	var retryDate string
+	if nextRetry != nil {
+		retryDate = nextRetry.In(businessLocation()).Format("02/01/2006")
+	}
+	var body strings.Builder
+	err = tmpl.Execute(&body, struct {
+		Name      string
+		PlanName  string
+		Reason    string
+		NextRetry string
+		ClubURL   string
+	}{
+		Name:      name,
+		PlanName:  planName,
+		Reason:    reason,
+		NextRetry: retryDate,
+		ClubURL:   frontendBaseURL() + "/club",
+	})
+	if err != nil {
+		return err
+	}
+	return sendHTMLEmail(email, "No pudimos cobrar tu envío del Club POSOQO", body.String())
+}
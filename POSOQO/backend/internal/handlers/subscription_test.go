@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSubscriptionCycleDates valida el calendario de envíos del club
+func TestSubscriptionCycleDates(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	today := day(2026, 10, 17)
+
+	assert.Equal(t, day(2026, 10, 20), firstCycleDate(today, 20))
+	assert.Equal(t, day(2026, 11, 17), firstCycleDate(today, 17))
+	assert.Equal(t, day(2026, 11, 5), firstCycleDate(today, 5))
+	assert.Equal(t, day(2027, 1, 5), firstCycleDate(day(2026, 12, 31), 5))
+
+	assert.Equal(t, day(2026, 11, 20), nextCycleDate(day(2026, 10, 20), 20))
+	assert.Equal(t, day(2027, 1, 28), nextCycleDate(day(2026, 12, 28), 28))
+}
+
+// TestSubscriptionRetryDelay valida el calendario de reintentos de un cobro rechazado
+func TestSubscriptionRetryDelay(t *testing.T) {
+	delay, ok := subscriptionRetryDelay(1)
+	assert.True(t, ok)
+	assert.Equal(t, 24*time.Hour, delay)
+
+	delay, ok = subscriptionRetryDelay(3)
+	assert.True(t, ok)
+	assert.Equal(t, 120*time.Hour, delay)
+
+	_, ok = subscriptionRetryDelay(4)
+	assert.False(t, ok)
+	_, ok = subscriptionRetryDelay(0)
+	assert.False(t, ok)
+}
+
+// TestClubDiscount valida el descuento del club sobre el importe ya promocionado
+func TestClubDiscount(t *testing.T) {
+	lines := []pricedLine{
+		{ProductID: "a", Quantity: 6, UnitPrice: 10, Discount: 6},
+		{ProductID: "b", Quantity: 2, UnitPrice: 23},
+	}
+	// (60 - 6) + 46 = 100
+	assert.Equal(t, 15.0, clubDiscount(lines, 15))
+	assert.Equal(t, 0.0, clubDiscount(lines, 0))
+
+	assert.Equal(t, 15.0, applyClubDiscount(lines, 15))
+	assert.InDelta(t, 8.1, lines[0].CouponDiscount, 0.001)
+	assert.InDelta(t, 6.9, lines[1].CouponDiscount, 0.001)
+}
+
+// TestValidateSubscriptionRequest valida los datos de una suscripción
+func TestValidateSubscriptionRequest(t *testing.T) {
+	lat, lng := -13.16, -74.22
+	valid := func() SubscriptionRequest {
+		return SubscriptionRequest{
+			PlanID:          "3f2b9c4e-8a1d-4e6f-9b2a-1c3d5e7f9a0b",
+			DeliveryDay:     15,
+			PaymentMethodID: " pm_123abc ",
+			Location:        "Jr. Lima 123, Ayacucho",
+			Lat:             &lat,
+			Lng:             &lng,
+		}
+	}
+
+	req := valid()
+	assert.Empty(t, validateSubscriptionRequest(&req))
+	assert.Equal(t, "pm_123abc", req.PaymentMethodID)
+
+	req = valid()
+	req.DeliveryDay = 31
+	assert.Equal(t, "Día de entrega inválido (1-28)", validateSubscriptionRequest(&req))
+
+	req = valid()
+	req.PaymentMethodID = "card_123"
+	assert.Equal(t, "Tarjeta inválida", validateSubscriptionRequest(&req))
+
+	req = valid()
+	req.Lng = nil
+	assert.Equal(t, "Coordenadas incompletas", validateSubscriptionRequest(&req))
+
+	plan := SubscriptionPlanRequest{Name: "Club 12", ProductID: "3f2b9c4e-8a1d-4e6f-9b2a-1c3d5e7f9a0b", UnitsPerCycle: 12, DiscountPercent: 10}
+	assert.Empty(t, validateSubscriptionPlanRequest(&plan))
+	assert.Equal(t, 1, plan.Quantity)
+	plan.DiscountPercent = 100
+	assert.Equal(t, "Descuento inválido (0-99%)", validateSubscriptionPlanRequest(&plan))
+}
@@ -224,6 +224,8 @@ func RegisterUser(c *fiber.Ctx) error {
 	db.DB.QueryRow(context.Background(), "SELECT id FROM users WHERE email=$1", req.Email).Scan(&userID)
 	if userID != 0 {
 		go sendVerificationEmail(userID, req.Email, req.Name)
+		// El carrito armado antes de registrarse pasa a la cuenta nueva
+		mergeAnonymousCart(c, userID)
 	}
 
 	// Crear notificación automática para nuevo usuario
@@ -459,6 +461,9 @@ func LoginUser(c *fiber.Ctx) error {
 		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al generar tokens"})
 	}
 
+	// Combinar el carrito armado sin sesión con el del usuario
+	mergeAnonymousCart(c, id)
+
 	// Log de auditoría exitoso
 	logAuthAttempt(req.Email, clientIP, userAgent, "SUCCESS")
 	createAuditLog(ctx, &id, "LOGIN_SUCCESS", "user", &id, clientIP, userAgent, "POST", "/api/auth/login", "", 200, "", "")
@@ -581,12 +586,16 @@ func Profile(c *fiber.Ctx) error {
 	var name, lastName, dni, phone, email, role string
 	var address, addressRef, streetNumber sql.NullString
 	var lat, lng sql.NullFloat64
+	var marketingOptIn, ageVerified bool
+	var birthDate *time.Time
 
 	err := db.DB.QueryRow(context.Background(),
 		`SELECT name, last_name, dni, phone, email, role, 
-		        address, address_ref, street_number, lat, lng 
+		        address, address_ref, street_number, lat, lng, marketing_opt_in,
+		        birth_date, age_verified_at IS NOT NULL
 		 FROM users WHERE id = $1`, int64(userID)).
-		Scan(&name, &lastName, &dni, &phone, &email, &role, &address, &addressRef, &streetNumber, &lat, &lng)
+		Scan(&name, &lastName, &dni, &phone, &email, &role, &address, &addressRef, &streetNumber, &lat, &lng, &marketingOptIn,
+			&birthDate, &ageVerified)
 
 	if err != nil {
 		log.Printf("[ERROR] Profile - Error fetching user data: %v", err)
@@ -608,22 +617,30 @@ func Profile(c *fiber.Ctx) error {
 		})
 	}
 
+	var birthDateValue string
+	if birthDate != nil {
+		birthDateValue = birthDate.Format(birthDateLayout)
+	}
+
 	log.Printf("[DEBUG] Profile - Found user in database: ID=%v, Name=%s, LastName=%s, DNI=%s, Phone=%s, Address=%s",
 		userID, name, lastName, dni, phone, address.String)
 
 	return c.JSON(fiber.Map{
-		"id":           userID,
-		"name":         name,
-		"last_name":    lastName,
-		"dni":          dni,
-		"phone":        phone,
-		"email":        email,
-		"role":         role,
-		"address":      address.String,
-		"addressRef":   addressRef.String,
-		"streetNumber": streetNumber.String,
-		"lat":          lat.Float64,
-		"lng":          lng.Float64,
+		"id":               userID,
+		"name":             name,
+		"last_name":        lastName,
+		"dni":              dni,
+		"phone":            phone,
+		"email":            email,
+		"role":             role,
+		"address":          address.String,
+		"addressRef":       addressRef.String,
+		"streetNumber":     streetNumber.String,
+		"lat":              lat.Float64,
+		"lng":              lng.Float64,
+		"marketing_opt_in": marketingOptIn,
+		"birth_date":       birthDateValue,
+		"age_verified":     ageVerified,
 	})
 }
 
@@ -762,6 +779,9 @@ func UpdateUser(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil || req.Name == "" || req.Email == "" || req.Role == "" {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
 	}
+	if req.Role != "user" && req.Role != "admin" && req.Role != roleDriver {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Rol inválido (user, admin o repartidor)"})
+	}
 	_, err := db.DB.Exec(context.Background(),
 		`UPDATE users SET name=$1, email=$2, role=$3 WHERE id=$4`,
 		req.Name, req.Email, req.Role, id)
@@ -803,6 +823,7 @@ func SocialLogin(c *fiber.Ctx) error {
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Error al generar tokens"})
 		}
+		mergeAnonymousCart(c, id)
 		return c.JSON(fiber.Map{
 			"id": id, "name": name, "email": email, "role": role, "tokens": tokenPair,
 		})
@@ -823,6 +844,7 @@ func SocialLogin(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Error al generar tokens"})
 	}
+	mergeAnonymousCart(c, id)
 	return c.JSON(fiber.Map{
 		"id": id, "name": req.Name, "email": req.Email, "role": "user", "tokens": tokenPair,
 	})
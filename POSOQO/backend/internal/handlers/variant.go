@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/posoqo/backend/internal/db"
+	"github.com/posoqo/backend/internal/utils"
+)
+
+// Envases de una variante (columna product_variants.container_type)
+const (
+	containerBottle  = "bottle"
+	containerCan     = "can"
+	containerGrowler = "growler"
+	containerKeg     = "keg"
+)
+
+// containerLabels es el nombre del envase que ve el cliente
+var containerLabels = map[string]string{
+	containerBottle:  "Botella",
+	containerCan:     "Lata",
+	containerGrowler: "Growler",
+	containerKeg:     "Barril",
+}
+
+// ProductVariant es un formato de venta de un producto con su propio precio y stock
+type ProductVariant struct {
+	ID            string    `json:"id"`
+	ProductID     string    `json:"product_id"`
+	SKU           string    `json:"sku"`
+	ContainerType string    `json:"container_type"`
+	SizeML        int       `json:"size_ml"`
+	Label         string    `json:"label"`
+	Price         float64   `json:"price"`
+	Stock         int       `json:"stock"`
+	DepositAmount float64   `json:"deposit_amount"`
+	IsActive      bool      `json:"is_active"`
+	SortOrder     int       `json:"sort_order"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// variantLabel arma el nombre del formato, p. ej. "Botella 330 ml" o "Barril 20 L"
+func variantLabel(containerType string, sizeML int) string {
+	size := fmt.Sprintf("%d ml", sizeML)
+	if sizeML >= 1000 && sizeML%100 == 0 {
+		size = strconv.FormatFloat(float64(sizeML)/1000, 'f', -1, 64) + " L"
+	}
+	if label, ok := containerLabels[containerType]; ok {
+		return label + " " + size
+	}
+	return size
+}
+
+// variantLabelSQL arma en SQL el mismo nombre que variantLabel (v es el alias de product_variants)
+const variantLabelSQL = `CASE v.container_type WHEN 'bottle' THEN 'Botella ' WHEN 'can' THEN 'Lata '
+	WHEN 'growler' THEN 'Growler ' WHEN 'keg' THEN 'Barril ' ELSE '' END ||
+	CASE WHEN v.size_ml >= 1000 AND v.size_ml % 100 = 0 THEN TRIM(TRAILING '.' FROM TRIM(TRAILING '0' FROM (v.size_ml / 1000.0)::text)) || ' L'
+	     ELSE v.size_ml::text || ' ml' END`
+
+// itemNameSQL es el nombre del producto con su formato, p. ej. "IPA - Botella 330 ml"
+// (p es products y v el LEFT JOIN a product_variants; sin variante queda solo el nombre)
+const itemNameSQL = `p.name || COALESCE(' - ' || (` + variantLabelSQL + `), '')`
+
+// VariantRequiredError indica un producto con formatos vendido sin elegir uno
+type VariantRequiredError struct {
+	ProductID string
+}
+
+func (e *VariantRequiredError) Error() string {
+	return fmt.Sprintf("el producto %s requiere elegir un formato", e.ProductID)
+}
+
+const productVariantColumns = `id, product_id, sku, container_type, size_ml, price, stock, deposit_amount, is_active, sort_order, created_at`
+
+// loadProductVariants obtiene las variantes de los productos indicados, agrupadas por producto
+func loadProductVariants(ctx context.Context, q dbQuerier, productIDs []string, activeOnly bool) (map[string][]ProductVariant, error) {
+	variants := map[string][]ProductVariant{}
+	if len(productIDs) == 0 {
+		return variants, nil
+	}
+	rows, err := q.Query(ctx,
+		`SELECT `+productVariantColumns+` FROM product_variants
+		 WHERE product_id = ANY($1::uuid[]) AND (is_active OR NOT $2)
+		 ORDER BY sort_order, size_ml`, productIDs, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v ProductVariant
+		if err := rows.Scan(&v.ID, &v.ProductID, &v.SKU, &v.ContainerType, &v.SizeML, &v.Price, &v.Stock,
+			&v.DepositAmount, &v.IsActive, &v.SortOrder, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		v.Label = variantLabel(v.ContainerType, v.SizeML)
+		variants[v.ProductID] = append(variants[v.ProductID], v)
+	}
+	return variants, rows.Err()
+}
+
+// attachProductVariants completa la lista de variantes de cada producto de la respuesta
+func attachProductVariants(ctx context.Context, products []ProductResponse, activeOnly bool) error {
+	ids := make([]string, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	variants, err := loadProductVariants(ctx, db.DB, ids, activeOnly)
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		products[i].Variants = variants[products[i].ID]
+		if products[i].Variants == nil {
+			products[i].Variants = []ProductVariant{}
+		}
+	}
+	return nil
+}
+
+// ProductVariantRequest crea o actualiza una variante
+type ProductVariantRequest struct {
+	SKU           string  `json:"sku"`
+	ContainerType string  `json:"container_type"`
+	SizeML        int     `json:"size_ml"`
+	Price         float64 `json:"price"`
+	Stock         int     `json:"stock"`
+	DepositAmount float64 `json:"deposit_amount"`
+	IsActive      *bool   `json:"is_active"`
+	SortOrder     int     `json:"sort_order"`
+}
+
+// validateProductVariant normaliza la variante y devuelve el mensaje de error si no es válida
+func validateProductVariant(req *ProductVariantRequest) string {
+	req.SKU = strings.ToUpper(strings.TrimSpace(req.SKU))
+	req.ContainerType = strings.ToLower(strings.TrimSpace(req.ContainerType))
+	switch {
+	case !utils.IsValidString(req.SKU, 2, 50):
+		return "SKU inválido (2-50 caracteres)"
+	case containerLabels[req.ContainerType] == "":
+		return "Envase inválido (bottle, can, growler o keg)"
+	case !utils.IsValidNumber(req.SizeML, 1, 100000):
+		return "Tamaño inválido (ml)"
+	case req.Price <= 0:
+		return "Precio debe ser mayor a 0"
+	case req.Stock < 0:
+		return "Stock no puede ser negativo"
+	case req.DepositAmount < 0:
+		return "La garantía no puede ser negativa"
+	}
+	return ""
+}
+
+// GET /api/products/:id/variants
+func ListProductVariants(c *fiber.Ctx) error {
+	productID := c.Params("id")
+	if !utils.IsValidUUID(productID) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "ID de producto inválido"})
+	}
+	variants, err := loadProductVariants(context.Background(), db.DB, []string{productID}, true)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error al obtener formatos"})
+	}
+	list := variants[productID]
+	if list == nil {
+		list = []ProductVariant{}
+	}
+	return c.JSON(fiber.Map{"data": list})
+}
+
+// POST /api/admin/products/:id/variants
+func CreateProductVariant(c *fiber.Ctx) error {
+	productID := c.Params("id")
+	var req ProductVariantRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateProductVariant(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	isActive := req.IsActive == nil || *req.IsActive
+
+	var id string
+	err := db.DB.QueryRow(context.Background(),
+		`INSERT INTO product_variants (product_id, sku, container_type, size_ml, price, stock, deposit_amount, is_active, sort_order)
+		 SELECT id, $2, $3, $4, $5, $6, $7, $8, $9 FROM products WHERE id = $1
+		 RETURNING id`,
+		productID, req.SKU, req.ContainerType, req.SizeML, req.Price, req.Stock, req.DepositAmount, isActive, req.SortOrder).Scan(&id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo crear el formato (¿producto inexistente o SKU repetido?)"})
+	}
+	return c.Status(http.StatusCreated).JSON(fiber.Map{"message": "Formato creado", "id": id})
+}
+
+// PUT /api/admin/variants/:id
+func UpdateProductVariant(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var req ProductVariantRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Datos inválidos"})
+	}
+	if msg := validateProductVariant(&req); msg != "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": msg})
+	}
+	res, err := db.DB.Exec(context.Background(),
+		`UPDATE product_variants SET sku=$1, container_type=$2, size_ml=$3, price=$4, stock=$5, deposit_amount=$6,
+		        is_active=COALESCE($7, is_active), sort_order=$8
+		 WHERE id=$9`,
+		req.SKU, req.ContainerType, req.SizeML, req.Price, req.Stock, req.DepositAmount, req.IsActive, req.SortOrder, id)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "No se pudo actualizar el formato (¿SKU repetido?)"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Formato no encontrado"})
+	}
+	return c.JSON(fiber.Map{"message": "Formato actualizado"})
+}
+
+// DELETE /api/admin/variants/:id
+// Se desactiva en lugar de borrarse para conservar los pedidos que la vendieron; en los
+// carritos que la tenían aparece como no disponible
+func DeleteProductVariant(c *fiber.Ctx) error {
+	id := c.Params("id")
+	res, err := db.DB.Exec(context.Background(), "UPDATE product_variants SET is_active=false WHERE id=$1", id)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "No se pudo eliminar el formato"})
+	}
+	if res.RowsAffected() == 0 {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Formato no encontrado"})
+	}
+	return c.JSON(fiber.Map{"message": "Formato eliminado"})
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestVariantLabel valida el nombre del formato que ve el cliente
+func TestVariantLabel(t *testing.T) {
+	assert.Equal(t, "Botella 330 ml", variantLabel(containerBottle, 330))
+	assert.Equal(t, "Lata 473 ml", variantLabel(containerCan, 473))
+	assert.Equal(t, "Growler 1 L", variantLabel(containerGrowler, 1000))
+	assert.Equal(t, "Growler 1.9 L", variantLabel(containerGrowler, 1900))
+	assert.Equal(t, "Barril 20 L", variantLabel(containerKeg, 20000))
+	assert.Equal(t, "Botella 1250 ml", variantLabel(containerBottle, 1250))
+	assert.Equal(t, "500 ml", variantLabel("otro", 500))
+}
+
+// TestValidateProductVariant valida la normalización y los errores de una variante
+func TestValidateProductVariant(t *testing.T) {
+	req := ProductVariantRequest{SKU: " ipa-can-473 ", ContainerType: " CAN ", SizeML: 473, Price: 9.5, Stock: 10}
+	assert.Empty(t, validateProductVariant(&req))
+	assert.Equal(t, "IPA-CAN-473", req.SKU)
+	assert.Equal(t, containerCan, req.ContainerType)
+
+	cases := map[string]ProductVariantRequest{
+		"SKU inválido (2-50 caracteres)":               {SKU: "X", ContainerType: "can", SizeML: 473, Price: 9.5},
+		"Envase inválido (bottle, can, growler o keg)": {SKU: "IPA", ContainerType: "caja", SizeML: 473, Price: 9.5},
+		"Tamaño inválido (ml)":                         {SKU: "IPA", ContainerType: "can", SizeML: 0, Price: 9.5},
+		"Precio debe ser mayor a 0":                    {SKU: "IPA", ContainerType: "can", SizeML: 473},
+		"Stock no puede ser negativo":                  {SKU: "IPA", ContainerType: "can", SizeML: 473, Price: 9.5, Stock: -1},
+		"La garantía no puede ser negativa":            {SKU: "IPA", ContainerType: "keg", SizeML: 20000, Price: 300, DepositAmount: -5},
+	}
+	for want, req := range cases {
+		assert.Equal(t, want, validateProductVariant(&req))
+	}
+}
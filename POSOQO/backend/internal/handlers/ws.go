@@ -9,12 +9,30 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// wsWriter es la parte de *websocket.Conn que usan las notificaciones
+type wsWriter interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+// wsClient serializa las escrituras: la conexión no admite escritores concurrentes y las
+// notificaciones llegan desde varias goroutines a la vez
+type wsClient struct {
+	mu   sync.Mutex
+	conn wsWriter
+}
+
+func (c *wsClient) send(message string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
 // Mapa de conexiones por user_id y admin
 var wsConns = struct {
 	mu     sync.RWMutex
-	users  map[int64]*websocket.Conn
-	admins map[int64]*websocket.Conn
-}{users: make(map[int64]*websocket.Conn), admins: make(map[int64]*websocket.Conn)}
+	users  map[int64]*wsClient
+	admins map[int64]*wsClient
+}{users: make(map[int64]*wsClient), admins: make(map[int64]*wsClient)}
 
 // Handler para /ws
 func WebSocketHandler(c *fiber.Ctx) error {
@@ -34,18 +52,20 @@ func WebSocketConn(c *websocket.Conn) {
 		isAdmin = claims["role"] == "admin"
 	}
 	// Guardar conexión
+	client := &wsClient{conn: c}
 	wsConns.mu.Lock()
 	if isAdmin {
-		wsConns.admins[userID] = c
+		wsConns.admins[userID] = client
 	} else {
-		wsConns.users[userID] = c
+		wsConns.users[userID] = client
 	}
 	wsConns.mu.Unlock()
 	defer func() {
 		wsConns.mu.Lock()
-		if isAdmin {
+		// Una conexión más reciente del mismo usuario no se borra
+		if isAdmin && wsConns.admins[userID] == client {
 			delete(wsConns.admins, userID)
-		} else {
+		} else if !isAdmin && wsConns.users[userID] == client {
 			delete(wsConns.users, userID)
 		}
 		wsConns.mu.Unlock()
@@ -62,20 +82,24 @@ func WebSocketConn(c *websocket.Conn) {
 // Enviar notificación a usuario específico
 func NotifyUser(userID int64, message string) {
 	wsConns.mu.RLock()
-	conn, ok := wsConns.users[userID]
+	client, ok := wsConns.users[userID]
 	wsConns.mu.RUnlock()
 	if ok {
-		conn.WriteMessage(websocket.TextMessage, []byte(message))
+		client.send(message)
 	}
 }
 
 // Enviar notificación a todos los admins conectados
 func NotifyAdmins(message string) {
 	wsConns.mu.RLock()
-	for _, conn := range wsConns.admins {
-		conn.WriteMessage(websocket.TextMessage, []byte(message))
+	clients := make([]*wsClient, 0, len(wsConns.admins))
+	for _, client := range wsConns.admins {
+		clients = append(clients, client)
 	}
 	wsConns.mu.RUnlock()
+	for _, client := range clients {
+		client.send(message)
+	}
 }
 
 // Utilidad: notificar usuario y admins
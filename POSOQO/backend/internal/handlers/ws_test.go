@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// overlapWriter registra si dos escrituras se solapan en la misma conexión
+type overlapWriter struct {
+	active  int32
+	overlap int32
+	writes  int32
+}
+
+func (w *overlapWriter) WriteMessage(_ int, _ []byte) error {
+	if atomic.AddInt32(&w.active, 1) > 1 {
+		atomic.StoreInt32(&w.overlap, 1)
+	}
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&w.writes, 1)
+	atomic.AddInt32(&w.active, -1)
+	return nil
+}
+
+// TestNotifyUserSerializesWrites valida que las notificaciones concurrentes no escriban a la
+// vez en la misma conexión
+func TestNotifyUserSerializesWrites(t *testing.T) {
+	user, admin := &overlapWriter{}, &overlapWriter{}
+	wsConns.mu.Lock()
+	wsConns.users[99] = &wsClient{conn: user}
+	wsConns.admins[99] = &wsClient{conn: admin}
+	wsConns.mu.Unlock()
+	defer func() {
+		wsConns.mu.Lock()
+		delete(wsConns.users, 99)
+		delete(wsConns.admins, 99)
+		wsConns.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); NotifyUser(99, "pedido actualizado") }()
+		go func() { defer wg.Done(); NotifyAdmins("nuevo pedido") }()
+	}
+	wg.Wait()
+
+	for _, writer := range []*overlapWriter{user, admin} {
+		assert.Equal(t, int32(10), atomic.LoadInt32(&writer.writes))
+		assert.Zero(t, atomic.LoadInt32(&writer.overlap))
+	}
+}
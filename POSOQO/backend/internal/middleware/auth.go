@@ -53,9 +53,9 @@ func GetCorsConfig() cors.Config {
 			return isOriginAllowed(origin)
 		},
 		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS,PATCH,HEAD",
-		AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Requested-With,Access-Control-Allow-Origin,X-CSRF-Token",
+		AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Requested-With,Access-Control-Allow-Origin,X-CSRF-Token,Idempotency-Key,X-Cart-Token",
 		AllowCredentials: true,
-		ExposeHeaders:    "Content-Length,Authorization",
+		ExposeHeaders:    "Content-Length,Authorization,Idempotent-Replayed",
 		MaxAge:           86400, // 24 horas
 	}
 }
@@ -66,9 +66,9 @@ var CorsConfig = cors.Config{
 		return isOriginAllowed(origin)
 	},
 	AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS,PATCH,HEAD",
-	AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Requested-With,Access-Control-Allow-Origin,X-CSRF-Token",
+	AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Requested-With,Access-Control-Allow-Origin,X-CSRF-Token,Idempotency-Key,X-Cart-Token",
 	AllowCredentials: true,
-	ExposeHeaders:    "Content-Length,Authorization",
+	ExposeHeaders:    "Content-Length,Authorization,Idempotent-Replayed",
 	MaxAge:           86400, // 24 horas
 }
 
@@ -257,6 +257,18 @@ func AuthMiddleware() fiber.Handler {
 	}
 }
 
+// WebSocketAuth autentica el handshake de /ws. Los navegadores no pueden enviar
+// cabeceras al abrir un WebSocket, así que también se acepta ?token=<access token>.
+func WebSocketAuth() fiber.Handler {
+	auth := AuthMiddleware()
+	return func(c *fiber.Ctx) error {
+		if c.Get("Authorization") == "" && c.Query("token") != "" {
+			c.Request().Header.Set("Authorization", "Bearer "+c.Query("token"))
+		}
+		return auth(c)
+	}
+}
+
 // Middleware para roles específicos
 func RequireRole(roles ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
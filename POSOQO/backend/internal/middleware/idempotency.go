@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/posoqo/backend/internal/db"
+)
+
+// idempotencyTTL es cuánto tiempo se guarda la respuesta original de una clave
+const idempotencyTTL = 24 * time.Hour
+
+// IdempotencyHeader es la cabecera con la clave que envía el cliente
+const IdempotencyHeader = "Idempotency-Key"
+
+// requestFingerprint resume método, ruta y cuerpo para detectar claves reutilizadas
+func requestFingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyScope aísla las claves por usuario autenticado. Sin sesión se usa el carrito
+// anónimo del cliente (cookie o X-Cart-Token) o, si no tiene, su IP, para que las claves
+// de clientes distintos no choquen.
+func idempotencyScope(c *fiber.Ctx) string {
+	if claims, ok := c.Locals("user").(jwt.MapClaims); ok {
+		if id, ok := claims["id"].(float64); ok {
+			return fmt.Sprintf("user:%d", int64(id))
+		}
+	}
+	token := c.Cookies("posoqo_cart")
+	if token == "" {
+		token = c.Get("X-Cart-Token")
+	}
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "cart:" + hex.EncodeToString(sum[:16])
+	}
+	return "ip:" + c.IP()
+}
+
+// idempotencyRecord es una clave guardada; StatusCode es nil mientras la petición
+// original sigue en proceso
+type idempotencyRecord struct {
+	RequestHash string
+	StatusCode  *int
+	Body        []byte
+	ContentType string
+}
+
+// idempotencyStorage guarda las claves y sus respuestas
+type idempotencyStorage interface {
+	// claim reclama la clave (una vencida se puede volver a usar); false si ya existe
+	claim(ctx context.Context, scope, key, method, path, hash string, ttl time.Duration) (bool, error)
+	// lookup devuelve la clave guardada o nil si no existe
+	lookup(ctx context.Context, scope, key string) (*idempotencyRecord, error)
+	save(ctx context.Context, scope, key string, status int, body []byte, contentType string) error
+	release(ctx context.Context, scope, key string) error
+}
+
+// idempotencyStore es el almacenamiento de las claves (PostgreSQL)
+var idempotencyStore idempotencyStorage = pgIdempotencyStore{}
+
+// pgIdempotencyStore guarda las claves en la tabla idempotency_keys. El vencimiento se
+// calcula con el reloj de la base, el mismo con que se compara.
+type pgIdempotencyStore struct{}
+
+func (pgIdempotencyStore) claim(ctx context.Context, scope, key, method, path, hash string, ttl time.Duration) (bool, error) {
+	if _, err := db.DB.Exec(ctx,
+		"DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2 AND expires_at < NOW()", scope, key); err != nil {
+		log.Printf("[IDEMPOTENCY] Error limpiando clave vencida: %v", err)
+	}
+	tag, err := db.DB.Exec(ctx,
+		`INSERT INTO idempotency_keys (key, scope, method, path, request_hash, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, NOW() + $6 * INTERVAL '1 second')
+		 ON CONFLICT (scope, key) DO NOTHING`,
+		key, scope, method, path, hash, int64(ttl/time.Second))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (pgIdempotencyStore) lookup(ctx context.Context, scope, key string) (*idempotencyRecord, error) {
+	var record idempotencyRecord
+	var contentType *string
+	err := db.DB.QueryRow(ctx,
+		`SELECT request_hash, status_code, response_body, content_type
+		 FROM idempotency_keys WHERE scope=$1 AND key=$2`,
+		scope, key).Scan(&record.RequestHash, &record.StatusCode, &record.Body, &contentType)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if contentType != nil {
+		record.ContentType = *contentType
+	}
+	return &record, nil
+}
+
+func (pgIdempotencyStore) save(ctx context.Context, scope, key string, status int, body []byte, contentType string) error {
+	_, err := db.DB.Exec(ctx,
+		`UPDATE idempotency_keys SET status_code=$1, response_body=$2, content_type=$3
+		 WHERE scope=$4 AND key=$5`,
+		status, body, contentType, scope, key)
+	return err
+}
+
+func (pgIdempotencyStore) release(ctx context.Context, scope, key string) error {
+	_, err := db.DB.Exec(ctx, "DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2", scope, key)
+	return err
+}
+
+// Idempotency evita crear pedidos o cobros duplicados por doble clic o reintentos.
+// Si la petición trae Idempotency-Key, la primera respuesta se guarda 24h y los
+// reintentos con el mismo cuerpo la reciben otra vez sin ejecutar el handler.
+// Reutilizar la clave con otro cuerpo se rechaza. Sin cabecera no hace nada.
+// Debe montarse después de AuthMiddleware para que las claves sean por usuario.
+func Idempotency() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyHeader)
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Idempotency-Key inválida (máximo 255 caracteres)",
+				"code":  "INVALID_IDEMPOTENCY_KEY",
+			})
+		}
+
+		ctx := context.Background()
+		scope := idempotencyScope(c)
+		hash := requestFingerprint(c.Method(), c.Path(), c.Body())
+
+		// Reclamar la clave; si ya existe es un reintento
+		claimed, err := idempotencyStore.claim(ctx, scope, key, c.Method(), c.Path(), hash, idempotencyTTL)
+		if err != nil {
+			log.Printf("[IDEMPOTENCY] Error registrando clave: %v", err)
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+		}
+		if !claimed {
+			return replayIdempotentResponse(c, scope, key, hash)
+		}
+
+		err = c.Next()
+		status := c.Response().StatusCode()
+
+		// Errores del servidor no se guardan: el cliente puede reintentar con la misma clave
+		if err != nil || status >= http.StatusInternalServerError {
+			if relErr := idempotencyStore.release(ctx, scope, key); relErr != nil {
+				log.Printf("[IDEMPOTENCY] Error liberando clave: %v", relErr)
+			}
+			return err
+		}
+
+		if saveErr := idempotencyStore.save(ctx, scope, key, status, c.Response().Body(),
+			string(c.Response().Header.ContentType())); saveErr != nil {
+			log.Printf("[IDEMPOTENCY] Error guardando respuesta: %v", saveErr)
+		}
+		return nil
+	}
+}
+
+// replayIdempotentResponse responde a un reintento con la respuesta original
+func replayIdempotentResponse(c *fiber.Ctx, scope, key, hash string) error {
+	record, err := idempotencyStore.lookup(context.Background(), scope, key)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Error interno"})
+	}
+	if record == nil {
+		// La petición original falló y liberó la clave justo ahora
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": "La petición original falló, vuelve a intentarlo",
+			"code":  "IDEMPOTENCY_RETRY",
+		})
+	}
+
+	if record.RequestHash != hash {
+		return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": "La Idempotency-Key ya se usó con otra petición",
+			"code":  "IDEMPOTENCY_KEY_REUSED",
+		})
+	}
+	if record.StatusCode == nil {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": "La petición original todavía está en proceso",
+			"code":  "IDEMPOTENCY_IN_PROGRESS",
+		})
+	}
+
+	if record.ContentType != "" {
+		c.Set(fiber.HeaderContentType, record.ContentType)
+	}
+	c.Set("Idempotent-Replayed", "true")
+	return c.Status(*record.StatusCode).Send(record.Body)
+}
+
+// PurgeExpiredIdempotencyKeys elimina las claves vencidas
+func PurgeExpiredIdempotencyKeys() {
+	tag, err := db.DB.Exec(context.Background(), "DELETE FROM idempotency_keys WHERE expires_at < NOW()")
+	if err != nil {
+		log.Printf("[IDEMPOTENCY] Error eliminando claves vencidas: %v", err)
+		return
+	}
+	if tag.RowsAffected() > 0 {
+		log.Printf("[IDEMPOTENCY] %d claves vencidas eliminadas", tag.RowsAffected())
+	}
+}
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryIdempotencyStore guarda las claves en memoria con un reloj controlable
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	now     time.Time
+	records map[string]*idempotencyRecord
+	expires map[string]time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		now:     time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC),
+		records: map[string]*idempotencyRecord{},
+		expires: map[string]time.Time{},
+	}
+}
+
+func (s *memoryIdempotencyStore) claim(_ context.Context, scope, key, _, _, hash string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := scope + "|" + key
+	if _, ok := s.records[id]; ok && !s.expires[id].Before(s.now) {
+		return false, nil
+	}
+	s.records[id] = &idempotencyRecord{RequestHash: hash}
+	s.expires[id] = s.now.Add(ttl)
+	return true, nil
+}
+
+func (s *memoryIdempotencyStore) lookup(_ context.Context, scope, key string) (*idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[scope+"|"+key]
+	if !ok {
+		return nil, nil
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (s *memoryIdempotencyStore) save(_ context.Context, scope, key string, status int, body []byte, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[scope+"|"+key]; ok {
+		record.StatusCode = &status
+		record.Body = append([]byte(nil), body...)
+		record.ContentType = contentType
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(_ context.Context, scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, scope+"|"+key)
+	return nil
+}
+
+// idempotencyTestApp monta una ruta que cuenta sus ejecuciones detrás del middleware
+func idempotencyTestApp(t *testing.T, handler fiber.Handler) (*fiber.App, *memoryIdempotencyStore) {
+	store := newMemoryIdempotencyStore()
+	previous := idempotencyStore
+	idempotencyStore = store
+	t.Cleanup(func() { idempotencyStore = previous })
+
+	app := fiber.New()
+	app.Post("/orders", func(c *fiber.Ctx) error {
+		c.Locals("user", jwt.MapClaims{"id": float64(7)})
+		return c.Next()
+	}, Idempotency(), handler)
+	return app, store
+}
+
+func idempotentRequest(key, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdempotencyHeader, key)
+	return req
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+// TestIdempotencyReplay valida que un reintento reciba la respuesta original sin ejecutar el handler
+func TestIdempotencyReplay(t *testing.T) {
+	var calls int32
+	app, _ := idempotencyTestApp(t, func(c *fiber.Ctx) error {
+		n := atomic.AddInt32(&calls, 1)
+		return c.Status(http.StatusCreated).JSON(fiber.Map{"order": n})
+	})
+
+	resp, err := app.Test(idempotentRequest("abc", `{"items":[1]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	first := readBody(t, resp)
+
+	resp, err = app.Test(idempotentRequest("abc", `{"items":[1]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, first, readBody(t, resp))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+// TestIdempotencyKeyReused valida que reutilizar la clave con otro cuerpo se rechace con 422
+func TestIdempotencyKeyReused(t *testing.T) {
+	app, _ := idempotencyTestApp(t, func(c *fiber.Ctx) error {
+		return c.Status(http.StatusCreated).JSON(fiber.Map{"ok": true})
+	})
+
+	resp, err := app.Test(idempotentRequest("abc", `{"items":[1]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = app.Test(idempotentRequest("abc", `{"items":[2]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Contains(t, readBody(t, resp), "IDEMPOTENCY_KEY_REUSED")
+}
+
+// TestIdempotencyInProgress valida que una petición concurrente con la misma clave no ejecute el handler
+func TestIdempotencyInProgress(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	var calls int32
+	app, _ := idempotencyTestApp(t, func(c *fiber.Ctx) error {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-finish
+		return c.Status(http.StatusCreated).JSON(fiber.Map{"ok": true})
+	})
+
+	done := make(chan int)
+	go func() {
+		resp, err := app.Test(idempotentRequest("abc", `{}`), -1)
+		assert.NoError(t, err)
+		done <- resp.StatusCode
+	}()
+	<-started
+
+	resp, err := app.Test(idempotentRequest("abc", `{}`), -1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Contains(t, readBody(t, resp), "IDEMPOTENCY_IN_PROGRESS")
+
+	close(finish)
+	assert.Equal(t, http.StatusCreated, <-done)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+// TestIdempotencyExpiry valida que una clave vencida se pueda volver a usar
+func TestIdempotencyExpiry(t *testing.T) {
+	var calls int32
+	app, store := idempotencyTestApp(t, func(c *fiber.Ctx) error {
+		atomic.AddInt32(&calls, 1)
+		return c.Status(http.StatusCreated).JSON(fiber.Map{"ok": true})
+	})
+
+	_, err := app.Test(idempotentRequest("abc", `{}`))
+	assert.NoError(t, err)
+
+	store.now = store.now.Add(idempotencyTTL - time.Minute)
+	resp, err := app.Test(idempotentRequest("abc", `{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+	store.now = store.now.Add(2 * time.Minute)
+	resp, err = app.Test(idempotentRequest("abc", `{}`))
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+// TestIdempotencyServerErrorReleasesKey valida que un error 5xx libere la clave para reintentar
+func TestIdempotencyServerErrorReleasesKey(t *testing.T) {
+	var calls int32
+	app, _ := idempotencyTestApp(t, func(c *fiber.Ctx) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "fallo"})
+		}
+		return c.Status(http.StatusCreated).JSON(fiber.Map{"ok": true})
+	})
+
+	resp, err := app.Test(idempotentRequest("abc", `{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp, err = app.Test(idempotentRequest("abc", `{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+// TestIdempotencyScope valida que las claves anónimas se separen por carrito o IP
+func TestIdempotencyScope(t *testing.T) {
+	app := fiber.New()
+	app.Get("/scope", func(c *fiber.Ctx) error {
+		if c.Get("X-User") != "" {
+			c.Locals("user", jwt.MapClaims{"id": float64(7)})
+		}
+		return c.SendString(idempotencyScope(c))
+	})
+	scope := func(headers map[string]string) string {
+		req := httptest.NewRequest(http.MethodGet, "/scope", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return readBody(t, resp)
+	}
+
+	assert.Equal(t, "user:7", scope(map[string]string{"X-User": "1"}))
+	cartA := scope(map[string]string{"X-Cart-Token": "token-a"})
+	cartB := scope(map[string]string{"Cookie": "posoqo_cart=token-b"})
+	assert.True(t, strings.HasPrefix(cartA, "cart:"))
+	assert.NotEqual(t, cartA, cartB)
+	assert.LessOrEqual(t, len(cartA), 100)
+	assert.True(t, strings.HasPrefix(scope(nil), "ip:"))
+}
@@ -8,10 +8,11 @@ import (
 )
 
 type Favorite struct {
-	ID        string `db:"id"`
-	UserID    int64  `db:"user_id"`
-	ProductID string `db:"product_id"`
-	CreatedAt string `db:"created_at"`
+	ID        string  `db:"id"`
+	UserID    int64   `db:"user_id"`
+	ProductID string  `db:"product_id"`
+	VariantID *string `db:"variant_id"`
+	CreatedAt string  `db:"created_at"`
 }
 
 func MigrateFavoritesTable(db *pgxpool.Pool) error {
@@ -0,0 +1,47 @@
+package utils
+
+import "math"
+
+// earthRadiusKm radio medio de la Tierra en kilómetros
+const earthRadiusKm = 6371.0
+
+// GeoPoint es una coordenada geográfica en grados
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// IsValidCoordinate valida que la coordenada esté dentro de rangos y no sea 0,0
+func IsValidCoordinate(lat, lng float64) bool {
+	return !(lat == 0 && lng == 0) && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// HaversineKm calcula la distancia en kilómetros entre dos coordenadas
+func HaversineKm(a, b GeoPoint) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Lat - a.Lat)
+	dLng := toRad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// PointInPolygon indica si el punto está dentro del polígono (ray casting).
+// Los vértices pueden estar en sentido horario o antihorario y el polígono no
+// necesita repetir el primer vértice al final.
+func PointInPolygon(p GeoPoint, polygon []GeoPoint) bool {
+	if len(polygon) < 3 {
+		return false
+	}
+	inside := false
+	j := len(polygon) - 1
+	for i := 0; i < len(polygon); i++ {
+		vi, vj := polygon[i], polygon[j]
+		if (vi.Lat > p.Lat) != (vj.Lat > p.Lat) &&
+			p.Lng < (vj.Lng-vi.Lng)*(p.Lat-vi.Lat)/(vj.Lat-vi.Lat)+vi.Lng {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHaversineKm(t *testing.T) {
+	// Plaza de Armas de Ayacucho -> punto al este (~2.2 km)
+	plaza := GeoPoint{Lat: -13.1588, Lng: -74.2239}
+	airport := GeoPoint{Lat: -13.1548, Lng: -74.2044}
+
+	assert.InDelta(t, 2.16, HaversineKm(plaza, airport), 0.05)
+	assert.Equal(t, 0.0, HaversineKm(plaza, plaza))
+	assert.InDelta(t, HaversineKm(plaza, airport), HaversineKm(airport, plaza), 1e-9)
+}
+
+func TestPointInPolygon(t *testing.T) {
+	square := []GeoPoint{
+		{Lat: -13.10, Lng: -74.25},
+		{Lat: -13.10, Lng: -74.20},
+		{Lat: -13.20, Lng: -74.20},
+		{Lat: -13.20, Lng: -74.25},
+	}
+
+	tests := []struct {
+		name     string
+		point    GeoPoint
+		expected bool
+	}{
+		{"Centro del polígono", GeoPoint{Lat: -13.15, Lng: -74.22}, true},
+		{"Fuera al norte", GeoPoint{Lat: -13.05, Lng: -74.22}, false},
+		{"Fuera al este", GeoPoint{Lat: -13.15, Lng: -74.10}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, PointInPolygon(tt.point, square))
+		})
+	}
+
+	assert.False(t, PointInPolygon(GeoPoint{Lat: -13.15, Lng: -74.22}, square[:2]), "polígono degenerado")
+}
+
+func TestIsValidCoordinate(t *testing.T) {
+	assert.True(t, IsValidCoordinate(-13.16, -74.22))
+	assert.False(t, IsValidCoordinate(0, 0))
+	assert.False(t, IsValidCoordinate(-91, 10))
+	assert.False(t, IsValidCoordinate(10, 181))
+}
@@ -0,0 +1,59 @@
+package utils
+
+import "math"
+
+// IGVRate es la tasa del Impuesto General a las Ventas (18%, incluye IPM)
+const IGVRate = 0.18
+
+// Afectación al IGV de un producto o categoría
+const (
+	TaxGravado   = "gravado"   // precio incluye 18% de IGV
+	TaxExonerado = "exonerado" // exonerado del IGV
+	TaxInafecto  = "inafecto"  // fuera del ámbito del IGV
+)
+
+// IsValidTaxType valida la afectación al IGV
+func IsValidTaxType(taxType string) bool {
+	return taxType == TaxGravado || taxType == TaxExonerado || taxType == TaxInafecto
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// SplitIGV separa un monto con IGV incluido en base imponible e IGV.
+// Los montos exonerados o inafectos no llevan IGV.
+func SplitIGV(gross float64, taxType string) (base, igv float64) {
+	gross = roundCents(gross)
+	if taxType != TaxGravado {
+		return gross, 0
+	}
+	base = roundCents(gross / (1 + IGVRate))
+	return base, roundCents(gross - base)
+}
+
+// TaxBreakdown acumula las operaciones de una venta como las pide SUNAT
+type TaxBreakdown struct {
+	Gravado   float64 `json:"taxable_amount"`    // base imponible de operaciones gravadas
+	Exonerado float64 `json:"exempt_amount"`     // operaciones exoneradas
+	Inafecto  float64 `json:"unaffected_amount"` // operaciones inafectas
+	IGV       float64 `json:"igv_amount"`
+	Total     float64 `json:"total"`
+}
+
+// Add suma una línea con IGV incluido y devuelve su base imponible e IGV.
+// El IGV se calcula por línea, así el total siempre cuadra con la suma de líneas.
+func (b *TaxBreakdown) Add(gross float64, taxType string) (base, igv float64) {
+	base, igv = SplitIGV(gross, taxType)
+	switch taxType {
+	case TaxGravado:
+		b.Gravado = roundCents(b.Gravado + base)
+	case TaxExonerado:
+		b.Exonerado = roundCents(b.Exonerado + base)
+	default:
+		b.Inafecto = roundCents(b.Inafecto + base)
+	}
+	b.IGV = roundCents(b.IGV + igv)
+	b.Total = roundCents(b.Total + base + igv)
+	return base, igv
+}
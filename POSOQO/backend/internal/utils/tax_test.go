@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitIGV(t *testing.T) {
+	tests := []struct {
+		name    string
+		gross   float64
+		taxType string
+		base    float64
+		igv     float64
+	}{
+		{"Gravado exacto", 118, TaxGravado, 100, 18},
+		{"Gravado con redondeo", 25, TaxGravado, 21.19, 3.81},
+		{"Exonerado", 25, TaxExonerado, 25, 0},
+		{"Inafecto", 10.5, TaxInafecto, 10.5, 0},
+		{"Cero", 0, TaxGravado, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, igv := SplitIGV(tt.gross, tt.taxType)
+			assert.Equal(t, tt.base, base)
+			assert.Equal(t, tt.igv, igv)
+		})
+	}
+}
+
+func TestTaxBreakdown(t *testing.T) {
+	var b TaxBreakdown
+	b.Add(25, TaxGravado)
+	b.Add(25, TaxGravado)
+	b.Add(12, TaxExonerado)
+	b.Add(5, TaxInafecto)
+
+	assert.Equal(t, 42.38, b.Gravado)
+	assert.Equal(t, 7.62, b.IGV)
+	assert.Equal(t, 12.0, b.Exonerado)
+	assert.Equal(t, 5.0, b.Inafecto)
+	// El total siempre cuadra con la suma de los montos con IGV
+	assert.Equal(t, 67.0, b.Total)
+}
@@ -233,6 +233,25 @@ func IsValidPeruvianPhone(phone string) bool {
 	return false
 }
 
+// Valida DNI peruano (8 dígitos)
+func IsValidDNI(dni string) bool {
+	return regexp.MustCompile(`^\d{8}$`).MatchString(dni)
+}
+
+// Valida RUC peruano: 11 dígitos, prefijo de contribuyente y dígito verificador (módulo 11)
+func IsValidRUC(ruc string) bool {
+	if !regexp.MustCompile(`^(10|15|17|20)\d{9}$`).MatchString(ruc) {
+		return false
+	}
+	weights := []int{5, 4, 3, 2, 7, 6, 5, 4, 3, 2}
+	sum := 0
+	for i, w := range weights {
+		sum += int(ruc[i]-'0') * w
+	}
+	check := (11 - sum%11) % 10
+	return int(ruc[10]-'0') == check
+}
+
 // Genera una contraseña aleatoria segura de longitud n
 func GenerateRandomPassword(n int) string {
 	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*()-_"
@@ -120,3 +120,24 @@ func TestSanitizeForLog(t *testing.T) {
 		})
 	}
 }
+
+func TestIsValidRUC(t *testing.T) {
+	tests := []struct {
+		name     string
+		ruc      string
+		expected bool
+	}{
+		{"RUC empresa válido", "20100070970", true},
+		{"RUC persona natural válido", "10467793549", true},
+		{"Dígito verificador incorrecto", "20100070971", false},
+		{"Prefijo inválido", "30100070970", false},
+		{"Longitud incorrecta", "2010007097", false},
+		{"Con letras", "2010007097A", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsValidRUC(tt.ruc))
+		})
+	}
+}
@@ -0,0 +1,19 @@
+-- ========================================
+-- Migración: Stock reservation on orders
+-- ========================================
+
+-- Estado de la reserva de stock de cada pedido:
+--   none      -> pedido antiguo, nunca descontó stock
+--   reserved  -> stock descontado al crear el pedido (en espera de pago/entrega)
+--   committed -> stock confirmado (pago exitoso o pedido entregado)
+--   released  -> stock devuelto (pago fallido o pedido cancelado)
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stock_status VARCHAR(20) NOT NULL DEFAULT 'none';
+
+-- Normalizar stock nulo para que las validaciones de disponibilidad funcionen
+UPDATE products SET stock = 0 WHERE stock IS NULL;
+
+-- Índice para encontrar reservas pendientes
+CREATE INDEX IF NOT EXISTS idx_orders_stock_status ON orders(stock_status);
+
+-- Comentario
+COMMENT ON COLUMN orders.stock_status IS 'Estado de la reserva de stock: none, reserved, committed, released';
@@ -0,0 +1,28 @@
+-- ========================================
+-- Migración: Order totals breakdown
+-- ========================================
+
+-- Desglose del total calculado por el servidor al crear el pedido
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS subtotal NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS discount_total NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_fee NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- Conciliación con el monto capturado por Stripe
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stripe_payment_intent_id VARCHAR(255);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS amount_paid NUMERIC(10,2);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_mismatch BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Los pedidos existentes no tenían desglose: el subtotal es el total
+UPDATE orders SET subtotal = total WHERE subtotal = 0 AND total > 0;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_orders_stripe_payment_intent_id ON orders(stripe_payment_intent_id);
+CREATE INDEX IF NOT EXISTS idx_orders_payment_mismatch ON orders(payment_mismatch) WHERE payment_mismatch = TRUE;
+
+-- Comentarios
+COMMENT ON COLUMN orders.subtotal IS 'Suma de order_items (cantidad x precio unitario)';
+COMMENT ON COLUMN orders.discount_total IS 'Descuentos aplicados al pedido';
+COMMENT ON COLUMN orders.shipping_fee IS 'Costo de envío cobrado';
+COMMENT ON COLUMN orders.stripe_payment_intent_id IS 'PaymentIntent de Stripe creado para el pedido';
+COMMENT ON COLUMN orders.amount_paid IS 'Monto efectivamente capturado por Stripe';
+COMMENT ON COLUMN orders.payment_mismatch IS 'TRUE si el monto capturado no coincide con el total esperado';
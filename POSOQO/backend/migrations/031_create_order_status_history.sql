@@ -0,0 +1,45 @@
+-- ========================================
+-- Migración: Order status history
+-- ========================================
+
+-- Método y fecha de pago del pedido (usados por las guardas de la máquina de estados)
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_method VARCHAR(20) NOT NULL DEFAULT 'contra_entrega';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS paid_at TIMESTAMP;
+
+-- Backfill: los pedidos con pago registrado en Stripe se consideran pagados
+UPDATE orders o SET payment_method = 'stripe',
+       paid_at = COALESCE(o.paid_at, p.created_at)
+FROM payments p
+WHERE p.order_id = o.id AND p.status IN ('paid', 'refunded');
+
+UPDATE orders SET payment_method = 'stripe' WHERE status = 'pendiente' OR stripe_payment_intent_id IS NOT NULL;
+
+-- Historial de cambios de estado de los pedidos
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    actor_user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    actor_role VARCHAR(20) NOT NULL DEFAULT 'system',
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Estado inicial de los pedidos existentes
+INSERT INTO order_status_history (order_id, from_status, to_status, actor_user_id, actor_role, reason, created_at)
+SELECT o.id, NULL, o.status, NULL, 'system', 'Estado previo a la migración', COALESCE(o.updated_at, o.created_at)
+FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_id = o.id);
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_orders_paid_at ON orders(paid_at);
+
+-- Comentarios
+COMMENT ON TABLE order_status_history IS 'Historial de cambios de estado de cada pedido';
+COMMENT ON COLUMN order_status_history.actor_user_id IS 'Usuario que realizó el cambio (NULL si fue el sistema)';
+COMMENT ON COLUMN order_status_history.actor_role IS 'Rol del actor: user, admin, system';
+COMMENT ON COLUMN order_status_history.reason IS 'Motivo del cambio de estado';
+COMMENT ON COLUMN orders.payment_method IS 'Método de pago: stripe, contra_entrega';
+COMMENT ON COLUMN orders.paid_at IS 'Fecha en que se confirmó el pago';
@@ -0,0 +1,38 @@
+-- ========================================
+-- Migración: Coupon limits and redemptions
+-- ========================================
+
+-- Reglas de uso de los cupones
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS max_redemptions INTEGER;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS max_per_user INTEGER;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS min_order_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS product_ids UUID[] NOT NULL DEFAULT '{}';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS category_ids UUID[] NOT NULL DEFAULT '{}';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS redemptions_count INTEGER NOT NULL DEFAULT 0;
+
+-- Canjes de cupones por pedido
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    coupon_id UUID NOT NULL REFERENCES coupons(id) ON DELETE CASCADE,
+    user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    discount_amount NUMERIC(10,2) NOT NULL,
+    reversed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(order_id, coupon_id)
+);
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_coupon_id ON coupon_redemptions(coupon_id);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_user_id ON coupon_redemptions(coupon_id, user_id);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_order_id ON coupon_redemptions(order_id);
+
+-- Comentarios
+COMMENT ON COLUMN coupons.max_redemptions IS 'Máximo de canjes totales (NULL = ilimitado)';
+COMMENT ON COLUMN coupons.max_per_user IS 'Máximo de canjes por usuario (NULL = ilimitado)';
+COMMENT ON COLUMN coupons.min_order_amount IS 'Subtotal mínimo del pedido para aplicar el cupón';
+COMMENT ON COLUMN coupons.product_ids IS 'Productos a los que aplica (vacío = todos)';
+COMMENT ON COLUMN coupons.category_ids IS 'Categorías a las que aplica (vacío = todas)';
+COMMENT ON COLUMN coupons.redemptions_count IS 'Canjes vigentes (no revertidos)';
+COMMENT ON TABLE coupon_redemptions IS 'Canjes de cupones por pedido para atribución de descuentos';
+COMMENT ON COLUMN coupon_redemptions.reversed_at IS 'Fecha en que se revirtió el canje (pedido cancelado)';
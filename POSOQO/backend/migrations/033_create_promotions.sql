@@ -0,0 +1,68 @@
+-- ========================================
+-- Migración: Promotions engine
+-- ========================================
+
+-- Promociones basadas en reglas (distintas de los cupones con código)
+--   multibuy     -> lleva buy_quantity, paga pay_quantity (ej. 3x2 en IPAs)
+--   bundle_price -> bundle_quantity unidades por bundle_price (ej. six-pack a S/60)
+--   percent      -> percent% de descuento (ej. happy hour viernes 18-21h en barril)
+CREATE TABLE IF NOT EXISTS promotions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    description TEXT,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('multibuy', 'bundle_price', 'percent')),
+    buy_quantity INTEGER,
+    pay_quantity INTEGER,
+    bundle_quantity INTEGER,
+    bundle_price NUMERIC(10,2),
+    percent NUMERIC(5,2),
+    product_ids UUID[] NOT NULL DEFAULT '{}',
+    category_ids UUID[] NOT NULL DEFAULT '{}',
+    days_of_week INTEGER[] NOT NULL DEFAULT '{}',
+    start_time TIME,
+    end_time TIME,
+    starts_at TIMESTAMP,
+    ends_at TIMESTAMP,
+    priority INTEGER NOT NULL DEFAULT 0,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Descuento por línea de pedido
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS discount_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- Promociones aplicadas a cada pedido
+CREATE TABLE IF NOT EXISTS order_promotions (
+    id BIGSERIAL PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    promotion_id UUID REFERENCES promotions(id) ON DELETE SET NULL,
+    name TEXT NOT NULL,
+    discount_amount NUMERIC(10,2) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Trigger para actualizar `updated_at` en `promotions`
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_promotions_updated_at') THEN
+        CREATE TRIGGER update_promotions_updated_at
+            BEFORE UPDATE ON promotions
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_promotions_is_active ON promotions(is_active);
+CREATE INDEX IF NOT EXISTS idx_order_promotions_order_id ON order_promotions(order_id);
+CREATE INDEX IF NOT EXISTS idx_order_promotions_promotion_id ON order_promotions(promotion_id);
+
+-- Comentarios
+COMMENT ON TABLE promotions IS 'Promociones automáticas: multibuy, precio de bundle y porcentaje con horario';
+COMMENT ON COLUMN promotions.days_of_week IS 'Días en que aplica (0=domingo ... 6=sábado, vacío = todos)';
+COMMENT ON COLUMN promotions.start_time IS 'Hora de inicio diaria (hora de Lima)';
+COMMENT ON COLUMN promotions.end_time IS 'Hora de fin diaria (hora de Lima)';
+COMMENT ON COLUMN promotions.priority IS 'Mayor prioridad se evalúa primero; cada unidad recibe una sola promoción';
+COMMENT ON COLUMN order_items.discount_amount IS 'Descuento por promociones aplicado a la línea';
+COMMENT ON TABLE order_promotions IS 'Promociones aplicadas a cada pedido y su descuento';
@@ -0,0 +1,46 @@
+-- ========================================
+-- Migración: Delivery zones
+-- ========================================
+
+-- Zonas de reparto definidas por el admin: radio desde la cervecería o polígono
+CREATE TABLE IF NOT EXISTS delivery_zones (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    type VARCHAR(10) NOT NULL CHECK (type IN ('radius', 'polygon')),
+    radius_km NUMERIC(6,2),
+    polygon JSONB,
+    fee NUMERIC(10,2) NOT NULL DEFAULT 0,
+    min_order NUMERIC(10,2) NOT NULL DEFAULT 0,
+    eta_minutes INTEGER NOT NULL DEFAULT 45,
+    priority INTEGER NOT NULL DEFAULT 0,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Zona y tiempo estimado asignados al pedido
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_zone_id UUID REFERENCES delivery_zones(id) ON DELETE SET NULL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_eta_minutes INTEGER;
+
+-- Trigger para actualizar `updated_at` en `delivery_zones`
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_delivery_zones_updated_at') THEN
+        CREATE TRIGGER update_delivery_zones_updated_at
+            BEFORE UPDATE ON delivery_zones
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_delivery_zones_is_active ON delivery_zones(is_active);
+CREATE INDEX IF NOT EXISTS idx_orders_delivery_zone_id ON orders(delivery_zone_id);
+
+-- Comentarios
+COMMENT ON TABLE delivery_zones IS 'Zonas de reparto con costo de envío, pedido mínimo y tiempo estimado';
+COMMENT ON COLUMN delivery_zones.radius_km IS 'Radio en km desde la cervecería (tipo radius)';
+COMMENT ON COLUMN delivery_zones.polygon IS 'Vértices [{"lat":..,"lng":..}] del área (tipo polygon)';
+COMMENT ON COLUMN delivery_zones.priority IS 'Si un punto cae en varias zonas gana la de mayor prioridad';
+COMMENT ON COLUMN orders.delivery_zone_id IS 'Zona de reparto usada para calcular el envío';
+COMMENT ON COLUMN orders.delivery_eta_minutes IS 'Tiempo estimado de entrega en minutos';
@@ -0,0 +1,55 @@
+-- ========================================
+-- Migración: Opening hours and fulfillment slots
+-- ========================================
+
+-- Horario de atención por día y tipo de entrega. De cada rango se generan franjas
+-- de slot_minutes con un cupo máximo de pedidos (capacity) por franja.
+CREATE TABLE IF NOT EXISTS opening_hours (
+    id SERIAL PRIMARY KEY,
+    day_of_week INTEGER NOT NULL CHECK (day_of_week BETWEEN 0 AND 6),
+    fulfillment_type VARCHAR(10) NOT NULL CHECK (fulfillment_type IN ('delivery', 'pickup')),
+    opens_at TIME NOT NULL,
+    closes_at TIME NOT NULL,
+    slot_minutes INTEGER NOT NULL DEFAULT 30 CHECK (slot_minutes BETWEEN 10 AND 240),
+    capacity INTEGER NOT NULL DEFAULT 5 CHECK (capacity > 0),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (closes_at > opens_at)
+);
+
+-- Tipo de entrega y franja elegida por el cliente
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS fulfillment_type VARCHAR(10) NOT NULL DEFAULT 'delivery';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS scheduled_for TIMESTAMPTZ;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'orders_fulfillment_type_check') THEN
+        ALTER TABLE orders ADD CONSTRAINT orders_fulfillment_type_check
+            CHECK (fulfillment_type IN ('delivery', 'pickup'));
+    END IF;
+END $$;
+
+-- Trigger para actualizar `updated_at` en `opening_hours`
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_opening_hours_updated_at') THEN
+        CREATE TRIGGER update_opening_hours_updated_at
+            BEFORE UPDATE ON opening_hours
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_opening_hours_day ON opening_hours(day_of_week, fulfillment_type);
+CREATE INDEX IF NOT EXISTS idx_orders_scheduled_for ON orders(scheduled_for, fulfillment_type);
+
+-- Comentarios
+COMMENT ON TABLE opening_hours IS 'Horario de atención y cupo por franja para reparto y recojo en tienda';
+COMMENT ON COLUMN opening_hours.day_of_week IS '0=domingo ... 6=sábado';
+COMMENT ON COLUMN opening_hours.opens_at IS 'Hora de apertura (hora de Lima)';
+COMMENT ON COLUMN opening_hours.closes_at IS 'Hora de cierre (hora de Lima, no cruza medianoche)';
+COMMENT ON COLUMN opening_hours.capacity IS 'Máximo de pedidos por franja';
+COMMENT ON COLUMN orders.fulfillment_type IS 'delivery (reparto) o pickup (recojo en tienda)';
+COMMENT ON COLUMN orders.scheduled_for IS 'Inicio de la franja elegida (NULL = lo antes posible)';
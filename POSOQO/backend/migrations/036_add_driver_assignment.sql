@@ -0,0 +1,34 @@
+-- ========================================
+-- Migración: Delivery drivers
+-- ========================================
+
+-- Repartidor asignado y prueba de entrega
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS driver_id BIGINT REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS driver_assigned_at TIMESTAMP;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMP;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_proof_photo_url TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_proof_signature_url TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_recipient_name VARCHAR(100);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_notes TEXT;
+
+-- Posiciones GPS enviadas por los repartidores
+CREATE TABLE IF NOT EXISTS driver_locations (
+    id BIGSERIAL PRIMARY KEY,
+    driver_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    lat DOUBLE PRECISION NOT NULL,
+    lng DOUBLE PRECISION NOT NULL,
+    accuracy_m NUMERIC(8,2),
+    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_orders_driver_id ON orders(driver_id);
+CREATE INDEX IF NOT EXISTS idx_driver_locations_driver_recorded ON driver_locations(driver_id, recorded_at DESC);
+
+-- Comentarios
+COMMENT ON COLUMN users.role IS 'Rol del usuario: user, admin, repartidor';
+COMMENT ON COLUMN order_status_history.actor_role IS 'Rol del actor: user, admin, repartidor, system';
+COMMENT ON COLUMN orders.driver_id IS 'Repartidor asignado al pedido';
+COMMENT ON COLUMN orders.delivery_proof_photo_url IS 'Foto de la entrega (URL de Cloudinary)';
+COMMENT ON COLUMN orders.delivery_proof_signature_url IS 'Firma del cliente (URL de Cloudinary)';
+COMMENT ON TABLE driver_locations IS 'Historial de posiciones GPS de los repartidores';
@@ -0,0 +1,28 @@
+-- ========================================
+-- Migración: Idempotency keys
+-- ========================================
+
+-- Respuestas guardadas por cabecera Idempotency-Key en las rutas que mueven dinero.
+-- Un reintento con la misma clave recibe la respuesta original durante 24 horas.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key VARCHAR(255) NOT NULL,
+    scope VARCHAR(100) NOT NULL,
+    method VARCHAR(10) NOT NULL,
+    path TEXT NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INTEGER,
+    response_body BYTEA,
+    content_type VARCHAR(100),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+-- Comentarios
+COMMENT ON TABLE idempotency_keys IS 'Claves de idempotencia con la respuesta original para reintentos';
+COMMENT ON COLUMN idempotency_keys.scope IS 'Usuario dueño de la clave (user:<id>) o anon para rutas públicas';
+COMMENT ON COLUMN idempotency_keys.request_hash IS 'SHA-256 de método, ruta y cuerpo de la petición original';
+COMMENT ON COLUMN idempotency_keys.status_code IS 'NULL mientras la petición original sigue en proceso';
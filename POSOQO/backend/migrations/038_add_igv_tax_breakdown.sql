@@ -0,0 +1,54 @@
+-- ========================================
+-- Migración: IGV tax breakdown
+-- ========================================
+
+-- Afectación al IGV: la categoría define el valor por defecto y el producto puede sobrescribirlo
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS tax_type VARCHAR(10) NOT NULL DEFAULT 'gravado';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS tax_type VARCHAR(10);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'categories_tax_type_check') THEN
+        ALTER TABLE categories ADD CONSTRAINT categories_tax_type_check
+            CHECK (tax_type IN ('gravado', 'exonerado', 'inafecto'));
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'products_tax_type_check') THEN
+        ALTER TABLE products ADD CONSTRAINT products_tax_type_check
+            CHECK (tax_type IS NULL OR tax_type IN ('gravado', 'exonerado', 'inafecto'));
+    END IF;
+END $$;
+
+-- Desglose por línea (los precios incluyen IGV)
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS tax_type VARCHAR(10) NOT NULL DEFAULT 'gravado';
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS net_amount NUMERIC(10,2);
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS taxable_base NUMERIC(10,2);
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS igv_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- Desglose del pedido
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS taxable_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS exempt_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS unaffected_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS igv_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- Pedidos anteriores: todo se vendía como gravado
+UPDATE order_items
+SET net_amount = ROUND(quantity * unit_price - discount_amount, 2),
+    taxable_base = ROUND((quantity * unit_price - discount_amount) / 1.18, 2),
+    igv_amount = ROUND(quantity * unit_price - discount_amount, 2) - ROUND((quantity * unit_price - discount_amount) / 1.18, 2)
+WHERE net_amount IS NULL;
+
+UPDATE orders
+SET taxable_amount = ROUND(total / 1.18, 2),
+    igv_amount = ROUND(total, 2) - ROUND(total / 1.18, 2)
+WHERE taxable_amount = 0 AND igv_amount = 0 AND total > 0;
+
+-- Comentarios
+COMMENT ON COLUMN categories.tax_type IS 'Afectación al IGV por defecto: gravado, exonerado o inafecto';
+COMMENT ON COLUMN products.tax_type IS 'Afectación al IGV del producto (NULL = la de su categoría)';
+COMMENT ON COLUMN order_items.net_amount IS 'Importe de la línea con IGV, después de descuentos';
+COMMENT ON COLUMN order_items.taxable_base IS 'Valor de venta de la línea sin IGV';
+COMMENT ON COLUMN order_items.igv_amount IS 'IGV de la línea';
+COMMENT ON COLUMN orders.taxable_amount IS 'Operaciones gravadas (base imponible sin IGV)';
+COMMENT ON COLUMN orders.exempt_amount IS 'Operaciones exoneradas';
+COMMENT ON COLUMN orders.unaffected_amount IS 'Operaciones inafectas';
+COMMENT ON COLUMN orders.igv_amount IS 'IGV total del pedido (18%)';
@@ -0,0 +1,93 @@
+-- ========================================
+-- Migración: Comprobantes electrónicos SUNAT
+-- ========================================
+
+-- Series de comprobantes con su correlativo
+CREATE TABLE IF NOT EXISTS invoice_series (
+    id SERIAL PRIMARY KEY,
+    doc_type VARCHAR(2) NOT NULL,
+    series VARCHAR(4) NOT NULL,
+    next_number BIGINT NOT NULL DEFAULT 1,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(doc_type, series)
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'invoice_series_doc_type_check') THEN
+        ALTER TABLE invoice_series ADD CONSTRAINT invoice_series_doc_type_check
+            CHECK ((doc_type = '01' AND series LIKE 'F%') OR (doc_type = '03' AND series LIKE 'B%'));
+    END IF;
+END $$;
+
+INSERT INTO invoice_series (doc_type, series) VALUES ('03', 'B001'), ('01', 'F001')
+ON CONFLICT (doc_type, series) DO NOTHING;
+
+-- Comprobantes emitidos
+CREATE TABLE IF NOT EXISTS invoices (
+    id SERIAL PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE RESTRICT,
+    doc_type VARCHAR(2) NOT NULL,
+    series VARCHAR(4) NOT NULL,
+    number BIGINT NOT NULL,
+    issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    customer_doc_type VARCHAR(1) NOT NULL,
+    customer_doc_number VARCHAR(15) NOT NULL DEFAULT '',
+    customer_name VARCHAR(255) NOT NULL DEFAULT '',
+    customer_address TEXT NOT NULL DEFAULT '',
+    taxable_amount NUMERIC(10,2) NOT NULL DEFAULT 0,
+    exempt_amount NUMERIC(10,2) NOT NULL DEFAULT 0,
+    unaffected_amount NUMERIC(10,2) NOT NULL DEFAULT 0,
+    igv_amount NUMERIC(10,2) NOT NULL DEFAULT 0,
+    total NUMERIC(10,2) NOT NULL,
+    xml BYTEA NOT NULL,
+    digest_value VARCHAR(64) NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'signed',
+    sunat_code VARCHAR(10),
+    sunat_description TEXT,
+    cdr BYTEA,
+    submitted_at TIMESTAMPTZ,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(doc_type, series, number)
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'invoices_status_check') THEN
+        ALTER TABLE invoices ADD CONSTRAINT invoices_status_check
+            CHECK (status IN ('signed', 'accepted', 'rejected', 'error'));
+    END IF;
+END $$;
+
+-- Triggers para updated_at
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_invoice_series_updated_at') THEN
+        CREATE TRIGGER update_invoice_series_updated_at
+            BEFORE UPDATE ON invoice_series
+            FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_invoices_updated_at') THEN
+        CREATE TRIGGER update_invoices_updated_at
+            BEFORE UPDATE ON invoices
+            FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_invoices_order_id ON invoices(order_id);
+CREATE INDEX IF NOT EXISTS idx_invoices_status ON invoices(status);
+CREATE INDEX IF NOT EXISTS idx_invoices_issued_at ON invoices(issued_at);
+
+-- Comentarios
+COMMENT ON TABLE invoice_series IS 'Series de boletas (B) y facturas (F) con su siguiente correlativo';
+COMMENT ON TABLE invoices IS 'Comprobantes electrónicos emitidos a partir de pedidos pagados';
+COMMENT ON COLUMN invoices.doc_type IS 'Catálogo 01 SUNAT: 01 factura, 03 boleta';
+COMMENT ON COLUMN invoices.customer_doc_type IS 'Catálogo 06 SUNAT: 0 sin documento, 1 DNI, 4 C.E., 6 RUC, 7 pasaporte';
+COMMENT ON COLUMN invoices.xml IS 'XML UBL 2.1 firmado';
+COMMENT ON COLUMN invoices.digest_value IS 'Código hash de la firma, se imprime en la representación impresa';
+COMMENT ON COLUMN invoices.status IS 'Estado ante SUNAT: signed, accepted, rejected, error';
+COMMENT ON COLUMN invoices.cdr IS 'Constancia de recepción (zip) devuelta por la OSE/SUNAT';
@@ -0,0 +1,52 @@
+-- ========================================
+-- Migración: Perfiles de facturación
+-- ========================================
+
+-- Datos con los que el cliente pide su boleta (DNI) o factura (RUC)
+CREATE TABLE IF NOT EXISTS billing_profiles (
+    id SERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    doc_type VARCHAR(1) NOT NULL,
+    doc_number VARCHAR(11) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, doc_type, doc_number)
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'billing_profiles_doc_type_check') THEN
+        ALTER TABLE billing_profiles ADD CONSTRAINT billing_profiles_doc_type_check
+            CHECK ((doc_type = '1' AND doc_number ~ '^[0-9]{8}$') OR (doc_type = '6' AND doc_number ~ '^[0-9]{11}$'));
+    END IF;
+END $$;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_billing_profiles_updated_at') THEN
+        CREATE TRIGGER update_billing_profiles_updated_at
+            BEFORE UPDATE ON billing_profiles
+            FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Copia de los datos de facturación elegidos en el checkout
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS billing_doc_type VARCHAR(1);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS billing_doc_number VARCHAR(11);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS billing_name VARCHAR(255);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS billing_address TEXT;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_billing_profiles_user_id ON billing_profiles(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_billing_profiles_default ON billing_profiles(user_id) WHERE is_default;
+
+-- Comentarios
+COMMENT ON TABLE billing_profiles IS 'Perfiles de facturación del usuario (DNI para boleta, RUC para factura)';
+COMMENT ON COLUMN billing_profiles.doc_type IS 'Catálogo 06 SUNAT: 1 DNI, 6 RUC';
+COMMENT ON COLUMN billing_profiles.name IS 'Nombre completo o razón social';
+COMMENT ON COLUMN billing_profiles.address IS 'Dirección fiscal';
+COMMENT ON COLUMN orders.billing_doc_type IS 'Documento del comprobante elegido en el checkout (1 DNI, 6 RUC)';
+COMMENT ON COLUMN orders.billing_name IS 'Nombre o razón social para el comprobante';
@@ -0,0 +1,40 @@
+-- ========================================
+-- Migración: Guest checkout
+-- ========================================
+
+-- Contacto de los pedidos hechos sin cuenta (user_id NULL)
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS guest_email VARCHAR(255);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS guest_phone VARCHAR(20);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS guest_name VARCHAR(100);
+
+-- Todo pedido nuevo debe tener un usuario o un email de invitado
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'orders_customer_check') THEN
+        ALTER TABLE orders ADD CONSTRAINT orders_customer_check
+            CHECK (user_id IS NOT NULL OR guest_email IS NOT NULL) NOT VALID;
+    END IF;
+END $$;
+
+-- Enlaces mágicos para seguir un pedido de invitado sin iniciar sesión
+CREATE TABLE IF NOT EXISTS guest_order_links (
+    id BIGSERIAL PRIMARY KEY,
+    order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_orders_guest_email ON orders(LOWER(guest_email)) WHERE guest_email IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_guest_order_links_order_id ON guest_order_links(order_id);
+CREATE INDEX IF NOT EXISTS idx_guest_order_links_expires_at ON guest_order_links(expires_at);
+
+-- Comentarios
+COMMENT ON COLUMN orders.guest_email IS 'Email del comprador invitado; al verificar una cuenta con este email el pedido pasa a esa cuenta';
+COMMENT ON COLUMN orders.guest_phone IS 'Teléfono de contacto del comprador invitado';
+COMMENT ON COLUMN orders.guest_name IS 'Nombre del comprador invitado';
+COMMENT ON TABLE guest_order_links IS 'Enlaces mágicos de seguimiento de pedidos de invitados';
+COMMENT ON COLUMN guest_order_links.token_hash IS 'SHA-256 del token enviado por email; el token en claro no se guarda';
@@ -0,0 +1,10 @@
+-- ========================================
+-- Migración: Cart item price snapshot
+-- ========================================
+
+-- Precio del producto la última vez que el cliente vio su carrito; permite avisarle
+-- cuando el precio cambió desde entonces
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS unit_price NUMERIC(10,2);
+
+-- Comentarios
+COMMENT ON COLUMN cart_items.unit_price IS 'Último precio mostrado al cliente (NULL en carritos anteriores a esta migración)';
@@ -0,0 +1,13 @@
+-- ========================================
+-- Migración: Anonymous carts
+-- ========================================
+
+-- Los carritos sin usuario pertenecen a visitantes anónimos y se identifican con un
+-- token firmado en cookie; al iniciar sesión se combinan con el carrito del usuario
+ALTER TABLE carts ALTER COLUMN user_id DROP NOT NULL;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_carts_anonymous_updated_at ON carts(updated_at) WHERE user_id IS NULL;
+
+-- Comentarios
+COMMENT ON COLUMN carts.user_id IS 'Dueño del carrito; NULL para carritos anónimos';
@@ -0,0 +1,34 @@
+-- ========================================
+-- Migración: Abandoned cart emails
+-- ========================================
+
+-- Consentimiento del usuario para recibir emails de marketing (recordatorios, ofertas)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS marketing_opt_in BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS marketing_opt_in_at TIMESTAMP;
+
+-- Recordatorios de carrito abandonado enviados y su conversión
+CREATE TABLE IF NOT EXISTS abandoned_cart_emails (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    cart_id UUID REFERENCES carts(id) ON DELETE SET NULL,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    cart_updated_at TIMESTAMP NOT NULL,
+    cart_total NUMERIC(10,2) NOT NULL DEFAULT 0,
+    coupon_id UUID REFERENCES coupons(id) ON DELETE SET NULL,
+    sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    recovered_order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+    recovered_at TIMESTAMP,
+    UNIQUE(cart_id, cart_updated_at)
+);
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_abandoned_cart_emails_user_id ON abandoned_cart_emails(user_id, sent_at DESC);
+CREATE INDEX IF NOT EXISTS idx_abandoned_cart_emails_sent_at ON abandoned_cart_emails(sent_at);
+
+-- Comentarios
+COMMENT ON COLUMN users.marketing_opt_in IS 'El usuario aceptó recibir emails de marketing';
+COMMENT ON COLUMN users.marketing_opt_in_at IS 'Fecha en que el usuario dio su consentimiento';
+COMMENT ON TABLE abandoned_cart_emails IS 'Recordatorios de carrito abandonado enviados y pedidos recuperados';
+COMMENT ON COLUMN abandoned_cart_emails.cart_updated_at IS 'Versión del carrito recordada; evita repetir el email por el mismo carrito';
+COMMENT ON COLUMN abandoned_cart_emails.coupon_id IS 'Cupón de un solo uso incluido en el recordatorio (NULL si no se ofreció)';
+COMMENT ON COLUMN abandoned_cart_emails.recovered_order_id IS 'Pedido hecho por el usuario después del recordatorio';
@@ -0,0 +1,175 @@
+-- ========================================
+-- Migración: Product variants
+-- ========================================
+
+-- Formatos de venta de un producto (botella 330ml, lata 473ml, growler, barril).
+-- Un producto sin variantes se sigue vendiendo con el precio y stock de products.
+CREATE TABLE IF NOT EXISTS product_variants (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku VARCHAR(50) NOT NULL UNIQUE,
+    container_type VARCHAR(20) NOT NULL,
+    size_ml INTEGER NOT NULL,
+    price NUMERIC(10,2) NOT NULL,
+    stock INTEGER NOT NULL DEFAULT 0,
+    deposit_amount NUMERIC(10,2) NOT NULL DEFAULT 0,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'product_variants_values_check') THEN
+        ALTER TABLE product_variants ADD CONSTRAINT product_variants_values_check
+            CHECK (container_type IN ('bottle', 'can', 'growler', 'keg')
+                   AND size_ml > 0 AND price >= 0 AND deposit_amount >= 0);
+    END IF;
+END $$;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_product_variants_updated_at') THEN
+        CREATE TRIGGER update_product_variants_updated_at
+            BEFORE UPDATE ON product_variants
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Variante elegida en carrito, pedidos, favoritos y reseñas
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS deposit_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS deposit_total NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE favorites ADD COLUMN IF NOT EXISTS variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL;
+ALTER TABLE reviews ADD COLUMN IF NOT EXISTS variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL;
+
+-- Un mismo producto puede estar en el carrito en varios formatos: la unicidad pasa a
+-- (carrito, producto, variante)
+DO $$
+DECLARE
+    con RECORD;
+BEGIN
+    FOR con IN
+        SELECT c.conname FROM pg_constraint c
+        WHERE c.conrelid = 'cart_items'::regclass AND c.contype IN ('u', 'p')
+          AND (SELECT array_agg(a.attname::text ORDER BY a.attname) FROM pg_attribute a
+               WHERE a.attrelid = c.conrelid AND a.attnum = ANY(c.conkey)) = ARRAY['cart_id', 'product_id']
+    LOOP
+        EXECUTE format('ALTER TABLE cart_items DROP CONSTRAINT %I', con.conname);
+    END LOOP;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cart_items_cart_product_variant
+    ON cart_items (cart_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'::uuid));
+
+-- ----------------------------------------
+-- Agrupar productos duplicados por formato ("IPA 330ml", "IPA Growler 1L", "IPA Barril 20L")
+-- en un solo producto con variantes. El producto más antiguo del grupo queda como padre
+-- con el nombre base; los demás se desactivan (sus pedidos históricos se conservan).
+-- ----------------------------------------
+CREATE TEMP TABLE variant_fold AS
+WITH parsed AS (
+    SELECT p.id, p.name, p.category_id, p.created_at, p.price, COALESCE(p.stock, 0) AS stock,
+           TRIM(regexp_replace(p.name,
+                '\s*[-(]?\s*(\m(botella|bottle|lata|can|growler|barril|keg)\M|\d+([.,]\d+)?\s*(ml|lt|l|litros?)\M).*$',
+                '', 'i')) AS base_name,
+           CASE
+               WHEN p.name ~* '\m(lata|can)\M' THEN 'can'
+               WHEN p.name ~* '\mgrowler\M' THEN 'growler'
+               WHEN p.name ~* '\m(barril|keg)\M' THEN 'keg'
+               ELSE 'bottle'
+           END AS container_type,
+           regexp_match(p.name, '(\d+(?:[.,]\d+)?)\s*(ml|lt|l|litros?)\M', 'i') AS size
+    FROM products p
+    WHERE p.is_active = TRUE
+      AND NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id OR v.id = p.id)
+),
+grouped AS (
+    SELECT parsed.*,
+           FIRST_VALUE(id) OVER (PARTITION BY LOWER(base_name), category_id ORDER BY created_at, id) AS parent_id,
+           COUNT(*) OVER (PARTITION BY LOWER(base_name), category_id) AS group_size
+    FROM parsed
+    WHERE base_name <> '' AND base_name <> name
+)
+SELECT id AS product_id, parent_id, base_name, container_type, price, stock,
+       CASE
+           WHEN size IS NULL THEN
+               CASE container_type WHEN 'can' THEN 473 WHEN 'growler' THEN 1000 WHEN 'keg' THEN 20000 ELSE 330 END
+           WHEN LOWER(size[2]) = 'ml' THEN ROUND(REPLACE(size[1], ',', '.')::numeric)::integer
+           ELSE ROUND(REPLACE(size[1], ',', '.')::numeric * 1000)::integer
+       END AS size_ml
+FROM grouped
+WHERE group_size >= 2;
+
+-- Cada producto duplicado pasa a ser una variante con el mismo id, precio y stock
+INSERT INTO product_variants (id, product_id, sku, container_type, size_ml, price, stock, sort_order)
+SELECT product_id, parent_id, 'MIG-' || UPPER(REPLACE(product_id::text, '-', '')), container_type, size_ml, price, stock,
+       ROW_NUMBER() OVER (PARTITION BY parent_id ORDER BY size_ml, product_id)
+FROM variant_fold
+ON CONFLICT (id) DO NOTHING;
+
+UPDATE cart_items ci SET product_id = f.parent_id, variant_id = f.product_id
+FROM variant_fold f WHERE ci.product_id = f.product_id AND ci.variant_id IS NULL;
+
+UPDATE order_items oi SET product_id = f.parent_id, variant_id = f.product_id
+FROM variant_fold f WHERE oi.product_id = f.product_id AND oi.variant_id IS NULL;
+
+-- Favoritos y reseñas son únicos por producto: se conserva el del padre si ya existía
+INSERT INTO favorites (user_id, product_id, variant_id, created_at)
+SELECT fav.user_id, f.parent_id, f.product_id, fav.created_at
+FROM favorites fav JOIN variant_fold f ON f.product_id = fav.product_id
+WHERE f.product_id <> f.parent_id
+ON CONFLICT (user_id, product_id) DO NOTHING;
+DELETE FROM favorites fav USING variant_fold f
+WHERE fav.product_id = f.product_id AND f.product_id <> f.parent_id;
+UPDATE favorites fav SET variant_id = f.product_id
+FROM variant_fold f WHERE fav.product_id = f.product_id AND f.product_id = f.parent_id AND fav.variant_id IS NULL;
+
+INSERT INTO reviews (user_id, product_id, variant_id, rating, comment, created_at)
+SELECT r.user_id, f.parent_id, f.product_id, r.rating, r.comment, r.created_at
+FROM reviews r JOIN variant_fold f ON f.product_id = r.product_id
+WHERE f.product_id <> f.parent_id
+ON CONFLICT (user_id, product_id) DO NOTHING;
+DELETE FROM reviews r USING variant_fold f
+WHERE r.product_id = f.product_id AND f.product_id <> f.parent_id;
+UPDATE reviews r SET variant_id = f.product_id
+FROM variant_fold f WHERE r.product_id = f.product_id AND f.product_id = f.parent_id AND r.variant_id IS NULL;
+
+-- Cupones y promociones limitados a un duplicado pasan a aplicar al producto padre
+UPDATE coupons c SET product_ids = ARRAY(
+    SELECT DISTINCT COALESCE(f.parent_id, pid) FROM unnest(c.product_ids) pid
+    LEFT JOIN variant_fold f ON f.product_id = pid)
+WHERE c.product_ids && ARRAY(SELECT product_id FROM variant_fold);
+
+UPDATE promotions pr SET product_ids = ARRAY(
+    SELECT DISTINCT COALESCE(f.parent_id, pid) FROM unnest(pr.product_ids) pid
+    LEFT JOIN variant_fold f ON f.product_id = pid)
+WHERE pr.product_ids && ARRAY(SELECT product_id FROM variant_fold);
+
+-- El padre toma el nombre base y el precio desde el formato más barato
+UPDATE products p SET name = f.base_name,
+       price = (SELECT MIN(v.price) FROM product_variants v WHERE v.product_id = p.id)
+FROM variant_fold f WHERE p.id = f.parent_id AND f.product_id = f.parent_id;
+
+UPDATE products p SET is_active = FALSE
+FROM variant_fold f WHERE p.id = f.product_id AND f.product_id <> f.parent_id;
+
+DROP TABLE variant_fold;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_product_variants_product_id ON product_variants(product_id, sort_order);
+CREATE INDEX IF NOT EXISTS idx_order_items_variant_id ON order_items(variant_id);
+
+-- Comentarios
+COMMENT ON TABLE product_variants IS 'Formatos de venta de un producto con su propio precio, stock y SKU';
+COMMENT ON COLUMN product_variants.container_type IS 'Envase: bottle, can, growler o keg';
+COMMENT ON COLUMN product_variants.size_ml IS 'Contenido en mililitros';
+COMMENT ON COLUMN product_variants.deposit_amount IS 'Garantía por envase retornable (growler, barril), se cobra aparte y no está afecta al IGV';
+COMMENT ON COLUMN cart_items.variant_id IS 'Formato elegido (NULL si el producto no tiene variantes)';
+COMMENT ON COLUMN order_items.variant_id IS 'Formato vendido (NULL si el producto no tiene variantes)';
+COMMENT ON COLUMN order_items.deposit_amount IS 'Garantía por unidad del envase retornable';
+COMMENT ON COLUMN orders.deposit_total IS 'Total de garantías por envases retornables incluido en el total';
+COMMENT ON COLUMN favorites.variant_id IS 'Formato preferido del producto favorito';
+COMMENT ON COLUMN reviews.variant_id IS 'Formato que compró quien reseña';
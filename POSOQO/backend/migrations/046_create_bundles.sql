@@ -0,0 +1,127 @@
+-- ========================================
+-- Migración: Bundles y packs mixtos
+-- ========================================
+
+-- Tipo de pack del producto: NULL (producto simple), 'fixed' (componentes definidos por
+-- el admin) o 'mixed' ("arma tu six-pack": el cliente elige los componentes según una regla)
+ALTER TABLE products ADD COLUMN IF NOT EXISTS bundle_type VARCHAR(10);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'products_bundle_type_check') THEN
+        ALTER TABLE products ADD CONSTRAINT products_bundle_type_check
+            CHECK (bundle_type IS NULL OR bundle_type IN ('fixed', 'mixed'));
+    END IF;
+END $$;
+
+-- Componentes de un pack fijo
+CREATE TABLE IF NOT EXISTS bundle_components (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    bundle_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    variant_id UUID REFERENCES product_variants(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Regla de un pack mixto, p. ej. "6 cualquiera de la categoría Lager"
+CREATE TABLE IF NOT EXISTS bundle_pack_rules (
+    bundle_id UUID PRIMARY KEY REFERENCES products(id) ON DELETE CASCADE,
+    pack_size INTEGER NOT NULL CHECK (pack_size BETWEEN 2 AND 48),
+    category_id UUID REFERENCES categories(id) ON DELETE SET NULL,
+    container_type VARCHAR(20),
+    size_ml INTEGER,
+    max_per_product INTEGER CHECK (max_per_product IS NULL OR max_per_product > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_bundle_pack_rules_updated_at') THEN
+        CREATE TRIGGER update_bundle_pack_rules_updated_at
+            BEFORE UPDATE ON bundle_pack_rules
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Componentes que consume cada unidad de una línea de pedido que es un pack.
+-- El stock se descuenta de estos productos y no del pack.
+CREATE TABLE IF NOT EXISTS order_item_components (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    order_item_id UUID NOT NULL REFERENCES order_items(id) ON DELETE CASCADE,
+    product_id UUID NOT NULL REFERENCES products(id),
+    variant_id UUID REFERENCES product_variants(id) ON DELETE SET NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0)
+);
+
+-- Selección del cliente para un pack mixto en el carrito. El mismo pack puede estar
+-- varias veces con selecciones distintas.
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS components JSONB NOT NULL DEFAULT '[]'::jsonb;
+DROP INDEX IF EXISTS idx_cart_items_cart_product_variant;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_cart_items_cart_product_selection
+    ON cart_items (cart_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'::uuid), md5(components::text));
+
+-- Stock de un pack calculado desde sus componentes. Para un pack mixto con selección
+-- (jsonb [{product_id, variant_id, quantity}]) se usa esa selección; sin selección se
+-- estima con el stock de todos los productos que cumplen la regla.
+CREATE OR REPLACE FUNCTION bundle_stock(p_bundle_id UUID, p_selection JSONB DEFAULT '[]'::jsonb)
+RETURNS INTEGER AS $$
+DECLARE
+    b_type VARCHAR;
+    result INTEGER;
+BEGIN
+    SELECT bundle_type INTO b_type FROM products WHERE id = p_bundle_id;
+
+    IF b_type = 'fixed' THEN
+        SELECT MIN(CASE WHEN p.is_active AND (bc.variant_id IS NULL OR v.is_active)
+                        THEN GREATEST(COALESCE(v.stock, p.stock, 0), 0) / bc.quantity
+                        ELSE 0 END)
+          INTO result
+          FROM bundle_components bc
+          JOIN products p ON p.id = bc.product_id
+          LEFT JOIN product_variants v ON v.id = bc.variant_id
+         WHERE bc.bundle_id = p_bundle_id;
+    ELSIF b_type = 'mixed' AND jsonb_array_length(COALESCE(p_selection, '[]'::jsonb)) > 0 THEN
+        SELECT MIN(CASE WHEN p.is_active AND (NULLIF(s.variant_id, '') IS NULL OR v.is_active)
+                        THEN GREATEST(COALESCE(v.stock, p.stock, 0), 0) / GREATEST(s.quantity, 1)
+                        ELSE 0 END)
+          INTO result
+          FROM jsonb_to_recordset(p_selection) AS s(product_id UUID, variant_id TEXT, quantity INTEGER)
+          LEFT JOIN products p ON p.id = s.product_id
+          LEFT JOIN product_variants v ON v.id = NULLIF(s.variant_id, '')::uuid;
+    ELSIF b_type = 'mixed' THEN
+        SELECT COALESCE(SUM(GREATEST(COALESCE(v.stock, p.stock, 0), 0)), 0) / MAX(r.pack_size)
+          INTO result
+          FROM bundle_pack_rules r
+          JOIN products p ON p.is_active AND p.bundle_type IS NULL
+          LEFT JOIN categories cat ON cat.id = p.category_id
+          LEFT JOIN product_variants v ON v.product_id = p.id AND v.is_active
+         WHERE r.bundle_id = p_bundle_id
+           AND (r.category_id IS NULL OR r.category_id IN (p.category_id, cat.parent_id))
+           AND (r.container_type IS NULL OR v.container_type = r.container_type)
+           AND (r.size_ml IS NULL OR v.size_ml = r.size_ml)
+           AND (v.id IS NOT NULL OR NOT EXISTS (
+                SELECT 1 FROM product_variants pv WHERE pv.product_id = p.id AND pv.is_active));
+    END IF;
+
+    RETURN COALESCE(result, 0);
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+-- Índices
+CREATE UNIQUE INDEX IF NOT EXISTS idx_bundle_components_unique
+    ON bundle_components (bundle_id, product_id, COALESCE(variant_id, '00000000-0000-0000-0000-000000000000'::uuid));
+CREATE INDEX IF NOT EXISTS idx_bundle_components_product_id ON bundle_components(product_id);
+CREATE INDEX IF NOT EXISTS idx_order_item_components_order_item_id ON order_item_components(order_item_id);
+
+-- Comentarios
+COMMENT ON COLUMN products.bundle_type IS 'NULL = producto simple, fixed = pack con componentes fijos, mixed = pack que arma el cliente';
+COMMENT ON TABLE bundle_components IS 'Productos (o formatos) y cantidades que forman un pack fijo';
+COMMENT ON TABLE bundle_pack_rules IS 'Regla para armar un pack mixto: cantidad de unidades y productos permitidos';
+COMMENT ON COLUMN bundle_pack_rules.category_id IS 'Categoría (o subcategoría) de la que se eligen las unidades; NULL = cualquiera';
+COMMENT ON COLUMN bundle_pack_rules.max_per_product IS 'Máximo de unidades de un mismo producto dentro del pack';
+COMMENT ON TABLE order_item_components IS 'Componentes por unidad de un pack vendido; el stock se descuenta de ellos';
+COMMENT ON COLUMN cart_items.components IS 'Selección del cliente para un pack mixto ([] para productos simples)';
+COMMENT ON FUNCTION bundle_stock(UUID, JSONB) IS 'Unidades disponibles de un pack según el stock de sus componentes';
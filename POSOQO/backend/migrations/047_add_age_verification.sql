@@ -0,0 +1,44 @@
+-- ========================================
+-- Migración: Verificación de edad para bebidas alcohólicas
+-- ========================================
+
+-- Verificación de edad a nivel de cuenta: fecha de nacimiento declarada y, opcionalmente,
+-- el cruce del DNI con el padrón (APIperu.dev)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS birth_date DATE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS age_verified_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS age_verification_method VARCHAR(20);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'users_age_verification_method_check') THEN
+        ALTER TABLE users ADD CONSTRAINT users_age_verification_method_check
+            CHECK (age_verification_method IS NULL OR age_verification_method IN ('birth_date', 'dni'));
+    END IF;
+END $$;
+
+-- Categorías cuyos productos solo se venden a mayores de edad (se hereda a las subcategorías)
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS requires_age_verification BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE categories SET requires_age_verification = TRUE
+ WHERE NOT requires_age_verification
+   AND name ~* '(cerveza|licor|vino|pisco|chela|alcohol)';
+
+-- Pedidos con alcohol: fecha de nacimiento declarada por el invitado y verificación del
+-- documento de quien recibe al momento de la entrega
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS guest_birth_date DATE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS verify_id_on_delivery BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS id_verified_at TIMESTAMP;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS id_verified_by BIGINT REFERENCES users(id) ON DELETE SET NULL;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_categories_requires_age_verification ON categories(requires_age_verification) WHERE requires_age_verification;
+
+-- Comentarios
+COMMENT ON COLUMN users.birth_date IS 'Fecha de nacimiento declarada por el usuario';
+COMMENT ON COLUMN users.age_verified_at IS 'Fecha en que se verificó la mayoría de edad; NULL = sin verificar';
+COMMENT ON COLUMN users.age_verification_method IS 'birth_date = fecha declarada, dni = fecha declarada y DNI cruzado con el padrón';
+COMMENT ON COLUMN categories.requires_age_verification IS 'TRUE si los productos de la categoría (o sus subcategorías) contienen alcohol';
+COMMENT ON COLUMN orders.guest_birth_date IS 'Fecha de nacimiento declarada en un pedido de invitado con alcohol';
+COMMENT ON COLUMN orders.verify_id_on_delivery IS 'TRUE si quien entrega debe verificar el documento de quien recibe';
+COMMENT ON COLUMN orders.id_verified_at IS 'Fecha en que se verificó el documento en la entrega';
+COMMENT ON COLUMN orders.id_verified_by IS 'Repartidor o admin que verificó el documento en la entrega';
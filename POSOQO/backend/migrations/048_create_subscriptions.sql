@@ -0,0 +1,126 @@
+-- ========================================
+-- Migración: Club POSOQO (suscripciones mensuales)
+-- ========================================
+
+-- Cliente de Stripe del usuario, para guardar tarjetas y cobrar sin su presencia
+ALTER TABLE users ADD COLUMN IF NOT EXISTS stripe_customer_id VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_stripe_customer_id ON users(stripe_customer_id) WHERE stripe_customer_id IS NOT NULL;
+
+-- Planes del club: qué se envía cada mes (un producto, formato o pack) y el descuento del club
+CREATE TABLE IF NOT EXISTS subscription_plans (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(100) NOT NULL,
+    description TEXT,
+    product_id UUID NOT NULL REFERENCES products(id),
+    variant_id UUID REFERENCES product_variants(id),
+    quantity INTEGER NOT NULL DEFAULT 1 CHECK (quantity BETWEEN 1 AND 100),
+    units_per_cycle INTEGER NOT NULL CHECK (units_per_cycle > 0),
+    discount_percent NUMERIC(5,2) NOT NULL DEFAULT 0 CHECK (discount_percent >= 0 AND discount_percent < 100),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Suscripciones de los clientes
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    plan_id UUID NOT NULL REFERENCES subscription_plans(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'active',
+    delivery_day INTEGER NOT NULL CHECK (delivery_day BETWEEN 1 AND 28),
+    -- Selección del cliente si el plan es un pack mixto
+    components JSONB NOT NULL DEFAULT '[]'::jsonb,
+    location TEXT NOT NULL,
+    lat DOUBLE PRECISION,
+    lng DOUBLE PRECISION,
+    stripe_payment_method_id VARCHAR(255) NOT NULL,
+    card_brand VARCHAR(30),
+    card_last4 VARCHAR(4),
+    next_order_date DATE NOT NULL,
+    paused_until DATE,
+    next_retry_at TIMESTAMP,
+    canceled_at TIMESTAMP,
+    cancel_reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'subscriptions_status_check') THEN
+        ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_status_check
+            CHECK (status IN ('active', 'paused', 'past_due', 'canceled'));
+    END IF;
+END $$;
+
+-- Ciclos de facturación: un pedido por suscripción y fecha de entrega
+CREATE TABLE IF NOT EXISTS subscription_cycles (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    subscription_id UUID NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    cycle_date DATE NOT NULL,
+    order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    amount NUMERIC(10,2),
+    last_error TEXT,
+    paid_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (subscription_id, cycle_date)
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'subscription_cycles_status_check') THEN
+        ALTER TABLE subscription_cycles ADD CONSTRAINT subscription_cycles_status_check
+            CHECK (status IN ('pending', 'paid', 'failed', 'skipped', 'unfulfilled'));
+    END IF;
+END $$;
+
+-- Pedidos generados por una suscripción
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS subscription_id UUID REFERENCES subscriptions(id) ON DELETE SET NULL;
+
+-- Triggers para updated_at
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_subscription_plans_updated_at') THEN
+        CREATE TRIGGER update_subscription_plans_updated_at
+            BEFORE UPDATE ON subscription_plans
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_subscriptions_updated_at') THEN
+        CREATE TRIGGER update_subscriptions_updated_at
+            BEFORE UPDATE ON subscriptions
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_subscription_cycles_updated_at') THEN
+        CREATE TRIGGER update_subscription_cycles_updated_at
+            BEFORE UPDATE ON subscription_cycles
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id ON subscriptions(user_id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_plan_id ON subscriptions(plan_id);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_due ON subscriptions(status, next_order_date);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_retry ON subscriptions(next_retry_at) WHERE status = 'past_due';
+CREATE INDEX IF NOT EXISTS idx_subscription_cycles_order_id ON subscription_cycles(order_id);
+CREATE INDEX IF NOT EXISTS idx_orders_subscription_id ON orders(subscription_id) WHERE subscription_id IS NOT NULL;
+
+-- Comentarios
+COMMENT ON COLUMN users.stripe_customer_id IS 'Cliente de Stripe con las tarjetas guardadas del usuario';
+COMMENT ON TABLE subscription_plans IS 'Planes del Club POSOQO: producto (o pack) que se envía cada mes y su descuento';
+COMMENT ON COLUMN subscription_plans.units_per_cycle IS 'Cervezas por envío, para mostrar el plan (p. ej. 12)';
+COMMENT ON COLUMN subscription_plans.discount_percent IS 'Descuento del club sobre el precio vigente del producto';
+COMMENT ON TABLE subscriptions IS 'Suscripciones al Club POSOQO con su día de entrega y tarjeta guardada';
+COMMENT ON COLUMN subscriptions.status IS 'active, paused, past_due (cobro fallido en reintento) o canceled';
+COMMENT ON COLUMN subscriptions.next_order_date IS 'Fecha en que se crea y cobra el próximo pedido';
+COMMENT ON COLUMN subscriptions.paused_until IS 'Fecha en que se reanuda automáticamente una suscripción pausada';
+COMMENT ON COLUMN subscriptions.next_retry_at IS 'Próximo reintento del cobro fallido (dunning)';
+COMMENT ON TABLE subscription_cycles IS 'Pedido y cobro de cada ciclo de una suscripción';
+COMMENT ON COLUMN subscription_cycles.status IS 'pending, paid, failed (cobro rechazado), skipped (saltado por el cliente) o unfulfilled (no se pudo crear el pedido)';
+COMMENT ON COLUMN orders.subscription_id IS 'Suscripción que generó el pedido';
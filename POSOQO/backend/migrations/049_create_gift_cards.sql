@@ -0,0 +1,91 @@
+-- ========================================
+-- Migración: Gift cards con libro de saldo
+-- ========================================
+
+-- Gift cards digitales: compradas por clientes (Stripe) o emitidas por un admin
+CREATE TABLE IF NOT EXISTS gift_cards (
+    id BIGSERIAL PRIMARY KEY,
+    -- Código sin guiones ni espacios (se muestra en grupos de 4)
+    code VARCHAR(20) NOT NULL UNIQUE,
+    initial_amount NUMERIC(10,2) NOT NULL CHECK (initial_amount > 0),
+    balance NUMERIC(10,2) NOT NULL DEFAULT 0 CHECK (balance >= 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    source VARCHAR(20) NOT NULL,
+    purchaser_user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    issued_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    sender_name VARCHAR(100),
+    recipient_name VARCHAR(100),
+    recipient_email VARCHAR(255),
+    message TEXT,
+    stripe_payment_intent_id VARCHAR(255),
+    activated_at TIMESTAMP,
+    delivered_at TIMESTAMP,
+    voided_at TIMESTAMP,
+    void_reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'gift_cards_status_check') THEN
+        ALTER TABLE gift_cards ADD CONSTRAINT gift_cards_status_check
+            CHECK (status IN ('pending', 'active', 'voided'));
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'gift_cards_source_check') THEN
+        ALTER TABLE gift_cards ADD CONSTRAINT gift_cards_source_check
+            CHECK (source IN ('purchase', 'admin'));
+    END IF;
+END $$;
+
+-- Libro de saldo: cada movimiento con el saldo resultante
+CREATE TABLE IF NOT EXISTS gift_card_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    gift_card_id BIGINT NOT NULL REFERENCES gift_cards(id) ON DELETE CASCADE,
+    type VARCHAR(20) NOT NULL,
+    amount NUMERIC(10,2) NOT NULL,
+    balance_after NUMERIC(10,2) NOT NULL CHECK (balance_after >= 0),
+    order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+    actor_user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    note TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'gift_card_transactions_type_check') THEN
+        ALTER TABLE gift_card_transactions ADD CONSTRAINT gift_card_transactions_type_check
+            CHECK (type IN ('issue', 'redeem', 'refund', 'adjust', 'void'));
+    END IF;
+END $$;
+
+-- Parte del total de un pedido pagada con gift card (el resto se cobra con tarjeta)
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS gift_card_amount NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- Triggers para updated_at
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_gift_cards_updated_at') THEN
+        CREATE TRIGGER update_gift_cards_updated_at
+            BEFORE UPDATE ON gift_cards
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_gift_cards_status ON gift_cards(status);
+CREATE INDEX IF NOT EXISTS idx_gift_cards_purchaser ON gift_cards(purchaser_user_id);
+CREATE INDEX IF NOT EXISTS idx_gift_cards_recipient_email ON gift_cards(LOWER(recipient_email));
+CREATE INDEX IF NOT EXISTS idx_gift_card_transactions_card ON gift_card_transactions(gift_card_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_gift_card_transactions_order ON gift_card_transactions(order_id) WHERE order_id IS NOT NULL;
+
+-- Comentarios
+COMMENT ON TABLE gift_cards IS 'Gift cards digitales de POSOQO';
+COMMENT ON COLUMN gift_cards.status IS 'pending (compra sin pagar), active o voided (anulada por un admin)';
+COMMENT ON COLUMN gift_cards.source IS 'purchase = comprada por un cliente, admin = emitida por un admin';
+COMMENT ON COLUMN gift_cards.delivered_at IS 'Fecha en que se envió el email al destinatario';
+COMMENT ON TABLE gift_card_transactions IS 'Libro de saldo de las gift cards';
+COMMENT ON COLUMN gift_card_transactions.type IS 'issue (carga inicial), redeem (uso en un pedido), refund (pedido cancelado), adjust (ajuste de un admin) o void (anulación)';
+COMMENT ON COLUMN gift_card_transactions.amount IS 'Importe del movimiento: positivo suma saldo, negativo lo descuenta';
+COMMENT ON COLUMN orders.gift_card_amount IS 'Parte del total pagada con gift card';
@@ -0,0 +1,101 @@
+-- ========================================
+-- Migración: Programa de puntos POSOQO
+-- ========================================
+
+-- Niveles del programa: los puntos ganados en los últimos 12 meses definen el nivel y el
+-- nivel multiplica los puntos que se ganan por cada sol pagado
+CREATE TABLE IF NOT EXISTS loyalty_tiers (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    min_points INTEGER NOT NULL UNIQUE CHECK (min_points >= 0),
+    earn_multiplier NUMERIC(4,2) NOT NULL DEFAULT 1 CHECK (earn_multiplier > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO loyalty_tiers (name, min_points, earn_multiplier) VALUES
+    ('Bronce', 0, 1.00),
+    ('Plata', 1000, 1.25),
+    ('Oro', 3000, 1.50)
+ON CONFLICT (name) DO NOTHING;
+
+-- Saldo de puntos del usuario (suma del libro); puede quedar negativo si se descuentan
+-- puntos de un pedido reembolsado que ya se habían canjeado
+ALTER TABLE users ADD COLUMN IF NOT EXISTS loyalty_points INTEGER NOT NULL DEFAULT 0;
+
+-- Libro de puntos. Los movimientos positivos guardan en remaining lo que aún no se canjeó
+-- ni venció; los negativos lo consumen por orden de vencimiento
+CREATE TABLE IF NOT EXISTS loyalty_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(20) NOT NULL,
+    points INTEGER NOT NULL CHECK (points <> 0),
+    remaining INTEGER NOT NULL DEFAULT 0 CHECK (remaining >= 0),
+    expires_at TIMESTAMP,
+    order_id UUID REFERENCES orders(id) ON DELETE SET NULL,
+    actor_user_id BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    note TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'loyalty_transactions_type_check') THEN
+        ALTER TABLE loyalty_transactions ADD CONSTRAINT loyalty_transactions_type_check
+            CHECK (type IN ('earn', 'redeem', 'refund', 'clawback', 'expire', 'adjust'));
+    END IF;
+END $$;
+
+-- Recompensas: un producto (o formato) que se canjea por puntos
+CREATE TABLE IF NOT EXISTS loyalty_rewards (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(100) NOT NULL,
+    product_id UUID NOT NULL REFERENCES products(id),
+    variant_id UUID REFERENCES product_variants(id),
+    points_cost INTEGER NOT NULL CHECK (points_cost > 0),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Puntos canjeados en el pedido y su descuento
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS loyalty_points_redeemed INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS loyalty_discount NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS loyalty_reward_id UUID REFERENCES loyalty_rewards(id) ON DELETE SET NULL;
+
+-- Triggers para updated_at
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_loyalty_tiers_updated_at') THEN
+        CREATE TRIGGER update_loyalty_tiers_updated_at
+            BEFORE UPDATE ON loyalty_tiers
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'update_loyalty_rewards_updated_at') THEN
+        CREATE TRIGGER update_loyalty_rewards_updated_at
+            BEFORE UPDATE ON loyalty_rewards
+            FOR EACH ROW
+            EXECUTE FUNCTION update_updated_at_column();
+    END IF;
+END $$;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_loyalty_transactions_user ON loyalty_transactions(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_loyalty_transactions_order ON loyalty_transactions(order_id) WHERE order_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_loyalty_transactions_open ON loyalty_transactions(user_id, expires_at) WHERE remaining > 0;
+-- Un pedido acredita puntos una sola vez (el webhook de Stripe puede repetirse)
+CREATE UNIQUE INDEX IF NOT EXISTS idx_loyalty_transactions_earn_order ON loyalty_transactions(order_id) WHERE type = 'earn';
+
+-- Comentarios
+COMMENT ON TABLE loyalty_tiers IS 'Niveles del programa de puntos (Bronce, Plata, Oro)';
+COMMENT ON COLUMN loyalty_tiers.min_points IS 'Puntos ganados en los últimos 12 meses para alcanzar el nivel';
+COMMENT ON COLUMN loyalty_tiers.earn_multiplier IS 'Multiplicador de los puntos ganados por sol pagado';
+COMMENT ON COLUMN users.loyalty_points IS 'Saldo de puntos del programa de fidelización';
+COMMENT ON TABLE loyalty_transactions IS 'Libro de puntos de cada usuario';
+COMMENT ON COLUMN loyalty_transactions.type IS 'earn (pedido pagado), redeem (canje), refund (canje de pedido cancelado), clawback (pedido reembolsado), expire (vencimiento) o adjust (ajuste de un admin)';
+COMMENT ON COLUMN loyalty_transactions.remaining IS 'Puntos de un movimiento positivo que aún no se canjearon ni vencieron';
+COMMENT ON COLUMN loyalty_transactions.expires_at IS 'Vencimiento de los puntos de un movimiento positivo';
+COMMENT ON TABLE loyalty_rewards IS 'Productos que se canjean por puntos';
+COMMENT ON COLUMN orders.loyalty_points_redeemed IS 'Puntos canjeados en el pedido (descuento y recompensa)';
+COMMENT ON COLUMN orders.loyalty_discount IS 'Descuento del pedido pagado con puntos';
@@ -0,0 +1,17 @@
+-- ========================================
+-- Migración: Una suscripción abierta por usuario y plan
+-- ========================================
+
+-- Un doble envío del formulario creaba dos suscripciones activas del mismo plan, cada una
+-- cobrada todos los meses. Las duplicadas existentes se cancelan conservando la más antigua.
+UPDATE subscriptions s
+   SET status = 'canceled', canceled_at = NOW(), next_retry_at = NULL,
+       cancel_reason = 'Suscripción duplicada'
+ WHERE s.status <> 'canceled'
+   AND EXISTS (SELECT 1 FROM subscriptions older
+                WHERE older.user_id = s.user_id AND older.plan_id = s.plan_id
+                  AND older.status <> 'canceled'
+                  AND (older.created_at, older.id) < (s.created_at, s.id));
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_subscriptions_open_user_plan
+    ON subscriptions(user_id, plan_id) WHERE status <> 'canceled';
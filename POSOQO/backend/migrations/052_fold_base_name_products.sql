@@ -0,0 +1,107 @@
+-- ========================================
+-- Migración: Integrar productos con el nombre base en su grupo de variantes
+-- ========================================
+
+-- La agrupación de 045 excluía los productos cuyo nombre ya era el nombre base ("IPA"),
+-- así que "IPA 330ml" e "IPA Growler 1L" quedaron como un padre renombrado a "IPA" junto
+-- al "IPA" original: dos productos activos con el mismo nombre. El producto original pasa
+-- a ser el padre (conserva su id, enlaces y reseñas) y el padre creado por la migración
+-- se desactiva tras mover sus variantes.
+CREATE TEMP TABLE base_name_fold AS
+SELECT DISTINCT ON (m.id) p.id AS keep_id, m.id AS merged_id
+FROM products m
+JOIN products p ON p.id <> m.id
+               AND LOWER(p.name) = LOWER(m.name)
+               AND p.category_id IS NOT DISTINCT FROM m.category_id
+WHERE m.is_active = TRUE
+  AND p.is_active = TRUE
+  AND EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = m.id AND v.sku LIKE 'MIG-%')
+  AND NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id OR v.id = p.id)
+ORDER BY m.id, p.created_at, p.id;
+
+-- Un producto original solo puede absorber un grupo
+DELETE FROM base_name_fold f
+WHERE EXISTS (SELECT 1 FROM base_name_fold o WHERE o.keep_id = f.keep_id AND o.merged_id < f.merged_id);
+
+-- El producto original se vende como su propio formato con el mismo id, precio y stock
+INSERT INTO product_variants (id, product_id, sku, container_type, size_ml, price, stock, sort_order)
+SELECT p.id, p.id, 'MIG-' || UPPER(REPLACE(p.id::text, '-', '')), 'bottle', 330, p.price, COALESCE(p.stock, 0), 0
+FROM base_name_fold f JOIN products p ON p.id = f.keep_id
+ON CONFLICT (id) DO NOTHING;
+
+UPDATE product_variants v SET product_id = f.keep_id
+FROM base_name_fold f WHERE v.product_id = f.merged_id;
+
+UPDATE product_variants v SET sort_order = o.rn
+FROM (SELECT v.id, ROW_NUMBER() OVER (PARTITION BY v.product_id ORDER BY v.size_ml, v.id) AS rn
+      FROM product_variants v JOIN base_name_fold f ON f.keep_id = v.product_id) o
+WHERE v.id = o.id;
+
+-- Carritos, pedidos, packs, planes y recompensas apuntan al nuevo padre
+UPDATE cart_items ci SET product_id = f.keep_id
+FROM base_name_fold f WHERE ci.product_id = f.merged_id;
+UPDATE cart_items ci SET variant_id = f.keep_id
+FROM base_name_fold f WHERE ci.product_id = f.keep_id AND ci.variant_id IS NULL;
+UPDATE cart_items ci SET components = REPLACE(ci.components::text, f.merged_id::text, f.keep_id::text)::jsonb
+FROM base_name_fold f WHERE ci.components::text LIKE '%' || f.merged_id::text || '%';
+
+UPDATE order_items oi SET product_id = f.keep_id
+FROM base_name_fold f WHERE oi.product_id = f.merged_id;
+UPDATE order_items oi SET variant_id = f.keep_id
+FROM base_name_fold f WHERE oi.product_id = f.keep_id AND oi.variant_id IS NULL;
+
+UPDATE order_item_components oc SET product_id = f.keep_id
+FROM base_name_fold f WHERE oc.product_id = f.merged_id;
+UPDATE order_item_components oc SET variant_id = f.keep_id
+FROM base_name_fold f WHERE oc.product_id = f.keep_id AND oc.variant_id IS NULL;
+
+UPDATE bundle_components bc SET product_id = f.keep_id
+FROM base_name_fold f WHERE bc.product_id = f.merged_id;
+UPDATE bundle_components bc SET variant_id = f.keep_id
+FROM base_name_fold f WHERE bc.product_id = f.keep_id AND bc.variant_id IS NULL;
+
+UPDATE subscription_plans sp SET product_id = f.keep_id
+FROM base_name_fold f WHERE sp.product_id = f.merged_id;
+UPDATE subscription_plans sp SET variant_id = f.keep_id
+FROM base_name_fold f WHERE sp.product_id = f.keep_id AND sp.variant_id IS NULL;
+
+UPDATE loyalty_rewards lr SET product_id = f.keep_id
+FROM base_name_fold f WHERE lr.product_id = f.merged_id;
+UPDATE loyalty_rewards lr SET variant_id = f.keep_id
+FROM base_name_fold f WHERE lr.product_id = f.keep_id AND lr.variant_id IS NULL;
+
+-- Favoritos y reseñas son únicos por producto: se conserva el del producto original si ya existía
+INSERT INTO favorites (user_id, product_id, variant_id, created_at)
+SELECT fav.user_id, f.keep_id, fav.variant_id, fav.created_at
+FROM favorites fav JOIN base_name_fold f ON f.merged_id = fav.product_id
+ON CONFLICT (user_id, product_id) DO NOTHING;
+DELETE FROM favorites fav USING base_name_fold f WHERE fav.product_id = f.merged_id;
+UPDATE favorites fav SET variant_id = f.keep_id
+FROM base_name_fold f WHERE fav.product_id = f.keep_id AND fav.variant_id IS NULL;
+
+INSERT INTO reviews (user_id, product_id, variant_id, rating, comment, created_at)
+SELECT r.user_id, f.keep_id, r.variant_id, r.rating, r.comment, r.created_at
+FROM reviews r JOIN base_name_fold f ON f.merged_id = r.product_id
+ON CONFLICT (user_id, product_id) DO NOTHING;
+DELETE FROM reviews r USING base_name_fold f WHERE r.product_id = f.merged_id;
+UPDATE reviews r SET variant_id = f.keep_id
+FROM base_name_fold f WHERE r.product_id = f.keep_id AND r.variant_id IS NULL;
+
+UPDATE coupons c SET product_ids = ARRAY(
+    SELECT DISTINCT COALESCE(f.keep_id, pid) FROM unnest(c.product_ids) pid
+    LEFT JOIN base_name_fold f ON f.merged_id = pid)
+WHERE c.product_ids && ARRAY(SELECT merged_id FROM base_name_fold);
+
+UPDATE promotions pr SET product_ids = ARRAY(
+    SELECT DISTINCT COALESCE(f.keep_id, pid) FROM unnest(pr.product_ids) pid
+    LEFT JOIN base_name_fold f ON f.merged_id = pid)
+WHERE pr.product_ids && ARRAY(SELECT merged_id FROM base_name_fold);
+
+-- El producto original toma el precio del formato más barato; el padre anterior se desactiva
+UPDATE products p SET price = (SELECT MIN(v.price) FROM product_variants v WHERE v.product_id = p.id)
+FROM base_name_fold f WHERE p.id = f.keep_id;
+
+UPDATE products p SET is_active = FALSE
+FROM base_name_fold f WHERE p.id = f.merged_id;
+
+DROP TABLE base_name_fold;
@@ -0,0 +1,18 @@
+-- ========================================
+-- Migración: Cupones personales
+-- ========================================
+
+-- Los cupones de recuperación de carrito pertenecen al usuario que recibió el recordatorio;
+-- NULL es un cupón general que puede canjear cualquier cliente
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS user_id BIGINT REFERENCES users(id) ON DELETE CASCADE;
+
+-- Los cupones ya enviados se asignan a su destinatario
+UPDATE coupons c SET user_id = e.user_id
+FROM abandoned_cart_emails e
+WHERE e.coupon_id = c.id AND c.user_id IS NULL;
+
+-- Índices
+CREATE INDEX IF NOT EXISTS idx_coupons_user_id ON coupons(user_id) WHERE user_id IS NOT NULL;
+
+-- Comentarios
+COMMENT ON COLUMN coupons.user_id IS 'Único usuario que puede canjear el cupón (NULL si es general)';
@@ -113,9 +113,8 @@ export default function CheckoutPage() {
           amount: total * 100, // Stripe expects amount in cents
           currency: "pen",
           items: cart.map((item) => ({
-            id: item.id,
+            product_id: item.id,
             quantity: item.quantity,
-            price: item.price,
           })),
           shipping: {
             address: addressHook.address,